@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+)
+
+// AuditEntry is a struct holding the representation of an entry of the audit
+// log on the API.
+type AuditEntry struct {
+	ID    string `json:"id"`
+	Attrs struct {
+		Action string `json:"action"`
+		Actor  struct {
+			Type string `json:"type"`
+			ID   string `json:"id,omitempty"`
+		} `json:"actor"`
+		IP      string            `json:"ip,omitempty"`
+		Time    time.Time         `json:"time"`
+		Details map[string]string `json:"details,omitempty"`
+	} `json:"attributes"`
+}
+
+// ListAuditEntries returns all the entries of the audit log of the instance,
+// from the most recent to the oldest.
+func (c *Client) ListAuditEntries() ([]*AuditEntry, error) {
+	var list []*AuditEntry
+	reqPath := "/settings/audit"
+	reqQuery := url.Values{"page[limit]": {"100"}}
+	for {
+		res, err := c.Req(&request.Options{
+			Method:  "GET",
+			Path:    reqPath,
+			Queries: reqQuery,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var doc jsonAPIDocument
+		err = json.NewDecoder(res.Body).Decode(&doc)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var page []*AuditEntry
+		if err = json.Unmarshal(*doc.Data, &page); err != nil {
+			return nil, err
+		}
+		list = append(list, page...)
+
+		var links struct {
+			Next string
+		}
+		if doc.Links != nil {
+			if err = json.Unmarshal(*doc.Links, &links); err != nil {
+				return nil, err
+			}
+		}
+		if links.Next == "" {
+			break
+		}
+		u, err := url.Parse(links.Next)
+		if err != nil {
+			return nil, err
+		}
+		reqPath = u.Path
+		reqQuery = u.Query()
+	}
+	return list, nil
+}
@@ -0,0 +1,33 @@
+package client
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/client/request"
+)
+
+// Export returns the archive with all the data of the instance, to move it
+// to another host. The caller must close it.
+func (c *Client) Export() (io.ReadCloser, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/export",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Import sends an archive made by the export of an instance, to rebuild the
+// instance from it. The instance must be fresh.
+func (c *Client) Import(archive io.Reader) error {
+	_, err := c.Req(&request.Options{
+		Method:     "POST",
+		Path:       "/import",
+		Body:       archive,
+		Headers:    request.Headers{"Content-Type": "application/gzip"},
+		NoResponse: true,
+	})
+	return err
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -17,29 +18,33 @@ type Instance struct {
 	ID    string `json:"id"`
 	Rev   string `json:"rev"`
 	Attrs struct {
-		Domain            string `json:"domain"`
-		Locale            string `json:"locale"`
-		Dev               bool   `json:"dev"`
-		BytesDiskQuota    int64  `json:"disk_quota,string,omitempty"`
-		IndexViewsVersion int    `json:"indexes_version"`
-		PassphraseHash    []byte `json:"passphrase_hash,omitempty"`
-		RegisterToken     []byte `json:"register_token,omitempty"`
+		Domain             string `json:"domain"`
+		Locale             string `json:"locale"`
+		Dev                bool   `json:"dev"`
+		BytesDiskQuota     int64  `json:"disk_quota,string,omitempty"`
+		TrashRetentionDays int    `json:"trash_retention_days,omitempty"`
+		TrashPurgeOnQuota  bool   `json:"trash_purge_on_quota,omitempty"`
+		IndexViewsVersion  int    `json:"indexes_version"`
+		PassphraseHash     []byte `json:"passphrase_hash,omitempty"`
+		RegisterToken      []byte `json:"register_token,omitempty"`
 	} `json:"attributes"`
 }
 
 // InstanceOptions contains the options passed on instance creation.
 type InstanceOptions struct {
-	Domain     string
-	Locale     string
-	Timezone   string
-	Email      string
-	PublicName string
-	Settings   string
-	DiskQuota  int64
-	Apps       []string
-	Dev        bool
-	Passphrase string
-	Debug      *bool
+	Domain             string
+	Locale             string
+	Timezone           string
+	Email              string
+	PublicName         string
+	Settings           string
+	DiskQuota          int64
+	Apps               []string
+	Dev                bool
+	Passphrase         string
+	Debug              *bool
+	TrashRetentionDays *int
+	TrashPurgeOnQuota  *bool
 }
 
 // TokenOptions is a struct holding all the options to generate a token.
@@ -78,20 +83,23 @@ func (c *Client) CreateInstance(opts *InstanceOptions) (*Instance, error) {
 	if !validDomain(opts.Domain) {
 		return nil, fmt.Errorf("Invalid domain: %s", opts.Domain)
 	}
+	trashRetention, trashPurge := trashQueries(opts)
 	res, err := c.Req(&request.Options{
 		Method: "POST",
 		Path:   "/instances",
 		Queries: url.Values{
-			"Domain":     {opts.Domain},
-			"Locale":     {opts.Locale},
-			"Timezone":   {opts.Timezone},
-			"Email":      {opts.Email},
-			"PublicName": {opts.PublicName},
-			"Settings":   {opts.Settings},
-			"DiskQuota":  {strconv.FormatInt(opts.DiskQuota, 10)},
-			"Apps":       {strings.Join(opts.Apps, ",")},
-			"Dev":        {strconv.FormatBool(opts.Dev)},
-			"Passphrase": {opts.Passphrase},
+			"Domain":             {opts.Domain},
+			"Locale":             {opts.Locale},
+			"Timezone":           {opts.Timezone},
+			"Email":              {opts.Email},
+			"PublicName":         {opts.PublicName},
+			"Settings":           {opts.Settings},
+			"DiskQuota":          {strconv.FormatInt(opts.DiskQuota, 10)},
+			"Apps":               {strings.Join(opts.Apps, ",")},
+			"Dev":                {strconv.FormatBool(opts.Dev)},
+			"Passphrase":         {opts.Passphrase},
+			"TrashRetentionDays": {trashRetention},
+			"TrashPurgeOnQuota":  {trashPurge},
 		},
 	})
 	if err != nil {
@@ -125,13 +133,16 @@ func (c *Client) ModifyInstance(domain string, opts *InstanceOptions) (*Instance
 	if opts.Debug != nil {
 		debug = strconv.FormatBool(*opts.Debug)
 	}
+	trashRetention, trashPurge := trashQueries(opts)
 	res, err := c.Req(&request.Options{
 		Method: "PATCH",
 		Path:   "/instances/" + domain,
 		Queries: url.Values{
-			"Locale":    {opts.Locale},
-			"DiskQuota": {strconv.FormatInt(opts.DiskQuota, 10)},
-			"Debug":     {debug},
+			"Locale":             {opts.Locale},
+			"DiskQuota":          {strconv.FormatInt(opts.DiskQuota, 10)},
+			"Debug":              {debug},
+			"TrashRetentionDays": {trashRetention},
+			"TrashPurgeOnQuota":  {trashPurge},
 		},
 	})
 	if err != nil {
@@ -140,6 +151,18 @@ func (c *Client) ModifyInstance(domain string, opts *InstanceOptions) (*Instance
 	return readInstance(res)
 }
 
+// trashQueries returns the query parameters for the trash policy, or empty
+// strings for the options that are not set.
+func trashQueries(opts *InstanceOptions) (retention, purge string) {
+	if opts.TrashRetentionDays != nil {
+		retention = strconv.Itoa(*opts.TrashRetentionDays)
+	}
+	if opts.TrashPurgeOnQuota != nil {
+		purge = strconv.FormatBool(*opts.TrashPurgeOnQuota)
+	}
+	return
+}
+
 // DestroyInstance is used to delete an instance and all its data.
 func (c *Client) DestroyInstance(domain string) error {
 	if !validDomain(domain) {
@@ -203,6 +226,77 @@ func (c *Client) RegisterOAuthClient(opts *OAuthClientOptions) (string, error) {
 	return string(b), nil
 }
 
+// RotateMasterKey wraps the data keys of the instances with the current
+// master key of the configuration. It returns the number of instances whose
+// data key has been rewrapped, and the number of failures.
+func (c *Client) RotateMasterKey() (rotated, failed int, err error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/rotate_master_key",
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	var counts struct {
+		Rotated int `json:"rotated"`
+		Failed  int `json:"failed"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&counts); err != nil {
+		return 0, 0, err
+	}
+	return counts.Rotated, counts.Failed, nil
+}
+
+// AddMissingTriggers adds the missing triggers to an instance, like the ones
+// added to the stack after its creation. It returns the number of triggers
+// added.
+func (c *Client) AddMissingTriggers(domain string) (int, error) {
+	if !validDomain(domain) {
+		return 0, fmt.Errorf("Invalid domain: %s", domain)
+	}
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + domain + "/triggers",
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Added int `json:"triggers_added"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Added, nil
+}
+
+// Reindex adds the missing triggers to an instance and pushes a job to
+// rebuild its full-text search index. It returns the number of triggers added
+// and the identifier of the job.
+func (c *Client) Reindex(domain string) (added int, jobID string, err error) {
+	if !validDomain(domain) {
+		return 0, "", fmt.Errorf("Invalid domain: %s", domain)
+	}
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + domain + "/reindex",
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Added int    `json:"triggers_added"`
+		JobID string `json:"job_id"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, "", err
+	}
+	return result.Added, result.JobID, nil
+}
+
 func readInstance(res *http.Response) (*Instance, error) {
 	in := &Instance{}
 	if err := readJSONAPI(res.Body, &in); err != nil {
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+)
+
+// Job is a struct holding the representation of a job on the API.
+type Job struct {
+	ID    string `json:"id"`
+	Rev   string `json:"rev"`
+	Attrs struct {
+		Domain     string `json:"domain"`
+		WorkerType string `json:"worker"`
+		Message    *struct {
+			Data []byte
+			Type string
+		} `json:"message"`
+		State     string    `json:"state"`
+		QueuedAt  time.Time `json:"queued_at"`
+		StartedAt time.Time `json:"started_at"`
+		Error     string    `json:"error"`
+		Errors    []struct {
+			Attempt int       `json:"attempt"`
+			Error   string    `json:"error"`
+			At      time.Time `json:"at"`
+		} `json:"errors"`
+	} `json:"attributes"`
+}
+
+// ListDeadLetters returns the jobs that have failed after all their attempts.
+// The domain and the worker type are optional filters.
+func (c *Client) ListDeadLetters(domain, workerType string) ([]*Job, error) {
+	var list []*Job
+	reqPath := "/jobs/dead_letters"
+	reqQuery := url.Values{
+		"Domain":      {domain},
+		"Worker":      {workerType},
+		"page[limit]": {"100"},
+	}
+	for {
+		res, err := c.Req(&request.Options{
+			Method:  "GET",
+			Path:    reqPath,
+			Queries: reqQuery,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var doc jsonAPIDocument
+		err = json.NewDecoder(res.Body).Decode(&doc)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var page []*Job
+		if err = json.Unmarshal(*doc.Data, &page); err != nil {
+			return nil, err
+		}
+		list = append(list, page...)
+
+		var links struct {
+			Next string
+		}
+		if doc.Links != nil {
+			if err = json.Unmarshal(*doc.Links, &links); err != nil {
+				return nil, err
+			}
+		}
+		if links.Next == "" {
+			break
+		}
+		u, err := url.Parse(links.Next)
+		if err != nil {
+			return nil, err
+		}
+		reqPath = u.Path
+		reqQuery = u.Query()
+	}
+	return list, nil
+}
+
+// GetDeadLetter returns the dead-lettered job with the given identifier.
+func (c *Client) GetDeadLetter(jobID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/jobs/dead_letters/" + jobID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readJob(res)
+}
+
+// ReplayDeadLetter pushes again a dead-lettered job in its queue.
+func (c *Client) ReplayDeadLetter(jobID string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/jobs/dead_letters/" + jobID + "/replay",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return readJob(res)
+}
+
+// DiscardDeadLetter removes a dead-lettered job.
+func (c *Client) DiscardDeadLetter(jobID string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       "/jobs/dead_letters/" + jobID,
+		NoResponse: true,
+	})
+	return err
+}
+
+func readJob(res *http.Response) (*Job, error) {
+	job := &Job{}
+	if err := readJSONAPI(res.Body, &job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
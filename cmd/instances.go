@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/client"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	humanize "github.com/dustin/go-humanize"
@@ -24,6 +26,8 @@ var flagEmail string
 var flagPublicName string
 var flagSettings string
 var flagDiskQuota string
+var flagTrashRetention int
+var flagTrashPurgeOnQuota bool
 var flagApps []string
 var flagDev bool
 var flagPassphrase string
@@ -115,16 +119,18 @@ given domain.
 		domain := args[0]
 		c := newAdminClient()
 		in, err := c.CreateInstance(&client.InstanceOptions{
-			Domain:     domain,
-			Apps:       flagApps,
-			Locale:     flagLocale,
-			Timezone:   flagTimezone,
-			Email:      flagEmail,
-			PublicName: flagPublicName,
-			Settings:   flagSettings,
-			DiskQuota:  int64(diskQuota),
-			Dev:        flagDev,
-			Passphrase: flagPassphrase,
+			Domain:             domain,
+			Apps:               flagApps,
+			Locale:             flagLocale,
+			Timezone:           flagTimezone,
+			Email:              flagEmail,
+			PublicName:         flagPublicName,
+			Settings:           flagSettings,
+			DiskQuota:          int64(diskQuota),
+			Dev:                flagDev,
+			Passphrase:         flagPassphrase,
+			TrashRetentionDays: &flagTrashRetention,
+			TrashPurgeOnQuota:  &flagTrashPurgeOnQuota,
 		})
 		if err != nil {
 			errPrintfln(
@@ -165,6 +171,45 @@ instance of the given domain. Set the quota to 0 to remove the quota.
 	},
 }
 
+var trashInstanceCmd = &cobra.Command{
+	Use:   "set-trash-retention [domain] [days]",
+	Short: "Change the retention of the trash of the instance",
+	Long: `
+cozy-stack instances set-trash-retention allows to change the number of days
+after which the files and directories put in the trash of the instance are
+destroyed. Set it to 0 to keep them until the user clears the trash.
+
+With the --purge-on-quota flag, the oldest items of the trash are also
+destroyed when the disk quota is exceeded.
+
+The trigger of the trash worker is added to the instances created before the
+retention of the trash, if they don't have it.
+`,
+	Example: "$ cozy-stack instances set-trash-retention --purge-on-quota cozy.tools:8080 30",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		days, err := strconv.Atoi(args[1])
+		if err != nil || days < 0 {
+			return fmt.Errorf("Invalid number of days: %s", args[1])
+		}
+		domain := args[0]
+		c := newAdminClient()
+		// The disk quota is sent with the other options, so it is kept
+		in, err := c.GetInstance(domain)
+		if err != nil {
+			return err
+		}
+		_, err = c.ModifyInstance(domain, &client.InstanceOptions{
+			DiskQuota:          in.Attrs.BytesDiskQuota,
+			TrashRetentionDays: &days,
+			TrashPurgeOnQuota:  &flagTrashPurgeOnQuota,
+		})
+		return err
+	},
+}
+
 var debugInstanceCmd = &cobra.Command{
 	Use:   "debug [domain] [true/false]",
 	Short: "Activate or deactivate debugging of the instance",
@@ -320,6 +365,100 @@ var cliTokenInstanceCmd = &cobra.Command{
 	},
 }
 
+var exportInstanceCmd = &cobra.Command{
+	Use:   "export [domain] [archive]",
+	Short: "Export all the data of an instance in an archive",
+	Long: `
+cozy-stack instances export writes a tar.gz archive with all the data of an
+instance: its files, documents, triggers and the hash of its passphrase. The
+archive can be imported with cozy-stack instances import, for example to move
+the instance to another host.
+
+The archive contains sensitive data, and should be kept secret.
+`,
+	Example: "$ cozy-stack instances export cozy.tools:8080 cozy.tar.gz",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+		c := newClient(args[0], consts.Files)
+		archive, err := c.Export()
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, archive)
+		if errc := f.Close(); err == nil {
+			err = errc
+		}
+		if err != nil {
+			os.Remove(args[1]) // #nosec
+		}
+		return err
+	},
+}
+
+var importInstanceCmd = &cobra.Command{
+	Use:   "import [domain] [archive]",
+	Short: "Rebuild an instance from an export archive",
+	Long: `
+cozy-stack instances import rebuilds a fresh instance from the tar.gz archive
+made by the export of an instance, for example on another host. The files,
+documents, triggers and permissions are restored, and the applications are
+reinstalled from their sources.
+
+The instance must have been created before, and must not have any file.
+`,
+	Example: "$ cozy-stack instances import cozy.tools:8080 cozy.tar.gz",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+		archive, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		c := newClient(args[0], consts.Files)
+		return c.Import(archive)
+	},
+}
+
+var auditInstanceCmd = &cobra.Command{
+	Use:   "audit [domain]",
+	Short: "Export the audit log of an instance",
+	Long: `
+cozy-stack instances audit exports the audit log of an instance, where the
+security-relevant actions are recorded: logins, registration of OAuth clients,
+permissions given, apps installed, sharings, and changes of the passphrase.
+
+The entries are printed as JSON, one per line, from the most recent to the
+oldest.
+`,
+	Example: "$ cozy-stack instances audit cozy.tools:8080 > audit.json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newClient(args[0], consts.Audit)
+		list, err := c.ListAuditEntries()
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range list {
+			if err = encoder.Encode(entry.Attrs); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
 var oauthTokenInstanceCmd = &cobra.Command{
 	Use:   "token-oauth [domain] [clientid] [scopes]",
 	Short: "Generate a new OAuth access token",
@@ -366,27 +505,118 @@ var oauthClientInstanceCmd = &cobra.Command{
 	},
 }
 
+var rotateMasterKeyInstanceCmd = &cobra.Command{
+	Use:   "rotate-master-key",
+	Short: "Wrap the data keys of the instances with the new master key",
+	Long: `
+cozy-stack instances rotate-master-key wraps the data keys of all the
+instances, used to encrypt the content of their files, with the current master
+key of the configuration (fs.encryption.master_key).
+
+To rotate the master key, put the new key in master_key, move the old one to
+previous_master_keys, restart the stack and run this command. The content of
+the files is not re-encrypted. When it has succeeded, the old key can be
+removed from previous_master_keys.
+`,
+	Example: "$ cozy-stack instances rotate-master-key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		rotated, failed, err := c.RotateMasterKey()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d data key(s) wrapped with the new master key\n", rotated)
+		if failed > 0 {
+			return fmt.Errorf("%d data key(s) could not be rotated, see the logs", failed)
+		}
+		return nil
+	},
+}
+
+var addTriggersInstanceCmd = &cobra.Command{
+	Use:   "add-triggers [domain]",
+	Short: "Add the missing triggers to an instance",
+	Long: `
+cozy-stack instances add-triggers adds to an instance the triggers that are
+given to the new instances but that it does not have, like the ones that
+generate the thumbnails of the videos and PDF for an instance created before
+they were added. The triggers that the instance already has are kept.
+
+It should be run for all the instances after an upgrade of the stack that adds
+new triggers.
+`,
+	Example: "$ cozy-stack instances add-triggers cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		added, err := c.AddMissingTriggers(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d trigger(s) added\n", added)
+		return nil
+	},
+}
+
+var reindexInstanceCmd = &cobra.Command{
+	Use:   "reindex [domain]",
+	Short: "Rebuild the full-text search index of an instance",
+	Long: `
+cozy-stack instances reindex adds the missing triggers to an instance, like the
+ones that keep the full-text search index up-to-date for an instance created
+before the search was added, and rebuilds its index from all its files and the
+documents of the indexed doctypes.
+
+The index is rebuilt by a job of the reindex worker, in the background.
+`,
+	Example: "$ cozy-stack instances reindex cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		added, jobID, err := c.Reindex(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d trigger(s) added, the index is rebuilt by the job %s\n", added, jobID)
+		return nil
+	},
+}
+
 func init() {
 	instanceCmdGroup.AddCommand(showInstanceCmd)
 	instanceCmdGroup.AddCommand(addInstanceCmd)
 	instanceCmdGroup.AddCommand(cleanInstanceCmd)
 	instanceCmdGroup.AddCommand(lsInstanceCmd)
 	instanceCmdGroup.AddCommand(quotaInstanceCmd)
+	instanceCmdGroup.AddCommand(trashInstanceCmd)
 	instanceCmdGroup.AddCommand(debugInstanceCmd)
 	instanceCmdGroup.AddCommand(destroyInstanceCmd)
 	instanceCmdGroup.AddCommand(appTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(cliTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthTokenInstanceCmd)
+	instanceCmdGroup.AddCommand(exportInstanceCmd)
+	instanceCmdGroup.AddCommand(importInstanceCmd)
+	instanceCmdGroup.AddCommand(auditInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthClientInstanceCmd)
+	instanceCmdGroup.AddCommand(rotateMasterKeyInstanceCmd)
+	instanceCmdGroup.AddCommand(addTriggersInstanceCmd)
+	instanceCmdGroup.AddCommand(reindexInstanceCmd)
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", instance.DefaultLocale, "Locale of the new cozy instance")
 	addInstanceCmd.Flags().StringVar(&flagTimezone, "tz", "", "The timezone for the user")
 	addInstanceCmd.Flags().StringVar(&flagEmail, "email", "", "The email of the owner")
 	addInstanceCmd.Flags().StringVar(&flagPublicName, "public-name", "", "The public name of the owner")
 	addInstanceCmd.Flags().StringVar(&flagSettings, "settings", "", "A list of settings (eg context:foo,offer:premium)")
 	addInstanceCmd.Flags().StringVar(&flagDiskQuota, "disk-quota", "", "The quota allowed to the instance's VFS")
+	addInstanceCmd.Flags().IntVar(&flagTrashRetention, "trash-retention", 0, "The number of days after which the trashed files are destroyed")
+	addInstanceCmd.Flags().BoolVar(&flagTrashPurgeOnQuota, "trash-purge-on-quota", false, "Destroy the oldest trashed files when the disk quota is exceeded")
 	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
 	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance")
 	addInstanceCmd.Flags().StringVar(&flagPassphrase, "passphrase", "", "Register the instance with this passphrase (useful for tests)")
+	trashInstanceCmd.Flags().BoolVar(&flagTrashPurgeOnQuota, "purge-on-quota", false, "Destroy the oldest trashed files when the disk quota is exceeded")
 	destroyInstanceCmd.Flags().BoolVar(&flagForce, "force", false, "Force the deletion without asking for confirmation")
 	appTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	oauthTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
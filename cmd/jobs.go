@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var flagJobsDomain string
+var flagJobsWorker string
+
+// jobsCmdGroup represents the jobs command
+var jobsCmdGroup = &cobra.Command{
+	Use:   "jobs [command]",
+	Short: "Manage the jobs of the stack",
+	Long: `
+cozy-stack jobs allows to manage the jobs of all the instances of this stack.
+
+A job that has failed after all its attempts is put in the dead letters, with
+the errors of all its attempts. It can then be inspected, and replayed or
+discarded.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+var deadLettersJobsCmd = &cobra.Command{
+	Use:   "dead-letters",
+	Short: "List the dead-lettered jobs",
+	Long: `
+cozy-stack jobs dead-letters lists the jobs that have failed after all their
+attempts, from the oldest to the most recent.
+`,
+	Example: "$ cozy-stack jobs dead-letters --domain cozy.tools:8080 --worker konnector",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.ListDeadLetters(flagJobsDomain, flagJobsWorker)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, j := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				j.ID,
+				j.Attrs.Domain,
+				j.Attrs.WorkerType,
+				j.Attrs.QueuedAt.Format(time.RFC3339),
+				j.Attrs.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var inspectJobsCmd = &cobra.Command{
+	Use:   "inspect [job-id]",
+	Short: "Show a dead-lettered job",
+	Long: `
+cozy-stack jobs inspect shows a dead-lettered job, with its message and the
+errors of all its attempts.
+`,
+	Example: "$ cozy-stack jobs inspect 4b1d3f8a6e4c2b9d",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		job, err := c.GetDeadLetter(args[0])
+		if err != nil {
+			return err
+		}
+		json, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(json))
+		return nil
+	},
+}
+
+var replayJobsCmd = &cobra.Command{
+	Use:   "replay [job-id]",
+	Short: "Push again a dead-lettered job in its queue",
+	Long: `
+cozy-stack jobs replay pushes again a dead-lettered job in its queue. The
+errors of its previous attempts are kept.
+`,
+	Example: "$ cozy-stack jobs replay 4b1d3f8a6e4c2b9d",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		job, err := c.ReplayDeadLetter(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Job %s has been queued again\n", job.ID)
+		return nil
+	},
+}
+
+var discardJobsCmd = &cobra.Command{
+	Use:   "discard [job-id]",
+	Short: "Remove a dead-lettered job",
+	Long: `
+cozy-stack jobs discard removes a dead-lettered job, with its logs.
+`,
+	Example: "$ cozy-stack jobs discard 4b1d3f8a6e4c2b9d",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return cmd.Help()
+		}
+		c := newAdminClient()
+		return c.DiscardDeadLetter(args[0])
+	},
+}
+
+func init() {
+	jobsCmdGroup.AddCommand(deadLettersJobsCmd)
+	jobsCmdGroup.AddCommand(inspectJobsCmd)
+	jobsCmdGroup.AddCommand(replayJobsCmd)
+	jobsCmdGroup.AddCommand(discardJobsCmd)
+	deadLettersJobsCmd.Flags().StringVar(&flagJobsDomain, "domain", "", "Only list the jobs of this domain")
+	deadLettersJobsCmd.Flags().StringVar(&flagJobsWorker, "worker", "", "Only list the jobs of this worker type")
+	RootCmd.AddCommand(jobsCmdGroup)
+}
@@ -99,6 +99,12 @@ func init() {
 	flags.String("downloads-url", "", "URL for the download secret storage, redis or in-memory")
 	checkNoErr(viper.BindPFlag("downloads.url", flags.Lookup("downloads-url")))
 
+	flags.String("realtime-url", "", "URL for the realtime events dispatching, redis or in-memory")
+	checkNoErr(viper.BindPFlag("realtime.url", flags.Lookup("realtime-url")))
+
+	flags.String("rate-limiting-url", "", "URL for the counters of the rate limiting, redis or in-memory")
+	checkNoErr(viper.BindPFlag("rate_limiting.url", flags.Lookup("rate-limiting-url")))
+
 	flags.Int("jobs-workers", runtime.NumCPU(), "Number of parallel workers (0 to disable the processing of jobs)")
 	checkNoErr(viper.BindPFlag("jobs.workers", flags.Lookup("jobs-workers")))
 
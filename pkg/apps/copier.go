@@ -2,12 +2,14 @@ package apps
 
 import (
 	"archive/tar"
+	"bytes"
 	"io"
 	"os"
 	"path"
 	"time"
 
 	"github.com/cozy/swift"
+	minio "github.com/minio/minio-go"
 	"github.com/spf13/afero"
 )
 
@@ -26,6 +28,14 @@ type swiftCopier struct {
 	started   bool
 }
 
+type s3Copier struct {
+	c       *minio.Client
+	bucket  string
+	prefix  string
+	rootObj string
+	started bool
+}
+
 type aferoCopier struct {
 	fs      afero.Fs
 	appDir  string
@@ -90,6 +100,55 @@ func (f *swiftCopier) Close() error {
 	return nil
 }
 
+// NewS3Copier defines a Copier storing data into a S3 bucket. The objects of
+// the applications are prefixed by the name of a pseudo container, that can't
+// be mistaken for the domain of an instance.
+func NewS3Copier(c *minio.Client, bucket string, appsType AppType) Copier {
+	return &s3Copier{
+		c:      c,
+		bucket: bucket,
+		prefix: s3Prefix(appsType),
+	}
+}
+
+func (f *s3Copier) Start(slug, version string) (bool, error) {
+	f.rootObj = path.Join(f.prefix, slug, version)
+	_, err := f.c.StatObject(f.bucket, f.rootObj, minio.StatObjectOptions{})
+	if err == nil {
+		return true, nil
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return false, err
+	}
+	_, err = f.c.PutObject(f.bucket, f.rootObj, bytes.NewReader(nil), 0,
+		minio.PutObjectOptions{})
+	f.started = err == nil
+	return false, err
+}
+
+func (f *s3Copier) Copy(stat os.FileInfo, src io.Reader) (err error) {
+	if !f.started {
+		panic("copier should call Start() before Copy()")
+	}
+	defer func() {
+		if err != nil {
+			f.c.RemoveObject(f.bucket, f.rootObj) // #nosec
+		}
+	}()
+	objName := path.Join(f.rootObj, stat.Name())
+	// The size is not always known: the tar copier gives a size of 0
+	size := stat.Size()
+	if size == 0 {
+		size = -1
+	}
+	_, err = f.c.PutObject(f.bucket, objName, src, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (f *s3Copier) Close() error {
+	return nil
+}
+
 // NewAferoCopier defines a copier using an afero.Fs filesystem to store the
 // application data.
 func NewAferoCopier(fs afero.Fs) Copier {
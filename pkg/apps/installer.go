@@ -173,6 +173,12 @@ func (i *Installer) Run() {
 	return
 }
 
+// Err returns the error of the operation, if any. It must be called only
+// after Run has returned.
+func (i *Installer) Err() error {
+	return i.err
+}
+
 // RunSync does the same work as Run but can be used synchronously.
 func (i *Installer) RunSync() (Manifest, error) {
 	go i.Run()
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/cozy/swift"
+	minio "github.com/minio/minio-go"
 	"github.com/spf13/afero"
 )
 
@@ -24,6 +25,12 @@ type swiftServer struct {
 	container string
 }
 
+type s3Server struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
 type aferoServer struct {
 	mkPath func(slug, version, file string) string
 	fs     afero.Fs
@@ -64,6 +71,53 @@ func (s *swiftServer) makeObjectName(slug, version, file string) string {
 	return path.Join(slug, version, file)
 }
 
+// NewS3FileServer returns provides the apps.FileServer implementation using a
+// S3 bucket as file server.
+func NewS3FileServer(c *minio.Client, bucket string, appsType AppType) FileServer {
+	return &s3Server{
+		c:      c,
+		bucket: bucket,
+		prefix: s3Prefix(appsType),
+	}
+}
+
+func (s *s3Server) Open(slug, version, file string) (io.ReadCloser, error) {
+	obj, _, err := s.open(s.makeObjectName(slug, version, file))
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3Server) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
+	objName := s.makeObjectName(slug, version, file)
+	obj, info, err := s.open(objName)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	w.Header().Set("Etag", `"`+info.ETag+`"`)
+	http.ServeContent(w, req, objName, info.LastModified, obj)
+	return nil
+}
+
+func (s *s3Server) open(objName string) (*minio.Object, minio.ObjectInfo, error) {
+	obj, err := s.c.GetObject(s.bucket, objName, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close() // #nosec
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	return obj, info, nil
+}
+
+func (s *s3Server) makeObjectName(slug, version, file string) string {
+	return path.Join(s.prefix, slug, version, file)
+}
+
 // NewAferoFileServer returns a simple wrapper of the afero.Fs interface that
 // provides the apps.FileServer interface.
 //
@@ -134,6 +188,21 @@ func containerName(appsType AppType) string {
 	panic("Unknown AppType")
 }
 
+// s3Prefix returns the prefix of the objects of the applications in the S3
+// bucket. It starts with a dot to not collide with the domains of the
+// instances, that are used as prefixes for their files.
+func s3Prefix(appsType AppType) string {
+	return "." + containerName(appsType)
+}
+
+func wrapS3Err(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return os.ErrNotExist
+	}
+	return err
+}
+
 func wrapSwiftErr(err error) error {
 	if err == swift.ObjectNotFound || err == swift.ContainerNotFound {
 		return os.ErrNotExist
@@ -0,0 +1,146 @@
+// Package audit keeps a log of the security-relevant actions made on an
+// instance: logins, registration of OAuth clients, permissions given, apps
+// installed, sharings, etc. The log is append-only: its entries are never
+// updated nor deleted by the stack.
+package audit
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+// Actions that are recorded in the audit log
+const (
+	// Login is a successful login
+	Login = "login"
+	// LoginFailure is a failed login
+	LoginFailure = "login.failure"
+	// PassphraseChange is a change or a renewal of the passphrase
+	PassphraseChange = "passphrase.change"
+	// OAuthClientRegistration is the registration of a new OAuth client
+	OAuthClientRegistration = "oauth_client.register"
+	// PermissionCreation is the creation of a new set of permissions, for
+	// example for a share by link
+	PermissionCreation = "permission.create"
+	// PermissionUpdate is an update of a set of permissions
+	PermissionUpdate = "permission.update"
+	// AppInstallation is the installation of an app or a konnector
+	AppInstallation = "app.install"
+	// SharingCreation is the creation of a sharing with other cozys
+	SharingCreation = "sharing.create"
+	// SharingRevocation is the revocation of a sharing, or of one of its
+	// recipients
+	SharingRevocation = "sharing.revoke"
+)
+
+// Types of actors
+const (
+	// ActorSession is for the user logged in the stack with a session
+	ActorSession = "session"
+	// ActorApp is for a client-side app, identified by its slug
+	ActorApp = "app"
+	// ActorKonnector is for a konnector, identified by its slug
+	ActorKonnector = "konnector"
+	// ActorOAuth is for an OAuth client, identified by its client ID
+	ActorOAuth = "oauth"
+	// ActorCLI is for the command line, or the admin API
+	ActorCLI = "cli"
+	// ActorShare is for a share by link, identified by its permissions doc
+	ActorShare = "share"
+	// ActorAnonymous is for the requests without any credential, like a
+	// failed login
+	ActorAnonymous = "anonymous"
+)
+
+// Actor is who has done an action
+type Actor struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+// Entry is an entry of the audit log
+type Entry struct {
+	DocID   string            `json:"_id,omitempty"`
+	DocRev  string            `json:"_rev,omitempty"`
+	Action  string            `json:"action"`
+	Actor   Actor             `json:"actor"`
+	IP      string            `json:"ip,omitempty"`
+	Time    time.Time         `json:"time"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// ID is used to implement the couchdb.Doc interface
+func (e *Entry) ID() string { return e.DocID }
+
+// Rev is used to implement the couchdb.Doc interface
+func (e *Entry) Rev() string { return e.DocRev }
+
+// DocType is used to implement the couchdb.Doc interface
+func (e *Entry) DocType() string { return consts.Audit }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	cloned := *e
+	if e.Details != nil {
+		cloned.Details = make(map[string]string, len(e.Details))
+		for k, v := range e.Details {
+			cloned.Details[k] = v
+		}
+	}
+	return &cloned
+}
+
+// SetID is used to implement the couchdb.Doc interface
+func (e *Entry) SetID(id string) { e.DocID = id }
+
+// SetRev is used to implement the couchdb.Doc interface
+func (e *Entry) SetRev(rev string) { e.DocRev = rev }
+
+// Log appends an entry to the audit log of the instance. The details are
+// optional. An error is only logged, as it should not prevent the action.
+func Log(i *instance.Instance, actor Actor, action, ip string, details map[string]string) {
+	entry := &Entry{
+		Action:  action,
+		Actor:   actor,
+		IP:      ip,
+		Time:    time.Now().UTC(),
+		Details: details,
+	}
+	if err := couchdb.CreateDoc(i, entry); err != nil {
+		i.Logger().Errorf("[audit] Cannot log %s by %s: %s", action, actor.Type, err)
+	}
+}
+
+// List returns the entries of the audit log, from the most recent to the
+// oldest. The cursor is modified in place.
+func List(i *instance.Instance, cursor couchdb.Cursor) ([]*Entry, error) {
+	req := &couchdb.ViewRequest{
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(i, consts.AuditByTimeView, req, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+
+	entries := make([]*Entry, len(res.Rows))
+	for k, row := range res.Rows {
+		var entry Entry
+		if err = json.Unmarshal(*row.Doc, &entry); err != nil {
+			return nil, err
+		}
+		entries[k] = &entry
+	}
+	return entries, nil
+}
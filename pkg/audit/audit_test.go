@@ -0,0 +1,52 @@
+package audit_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var testInstance *instance.Instance
+
+func TestLogAndList(t *testing.T) {
+	actor := audit.Actor{Type: audit.ActorApp, ID: "settings"}
+	audit.Log(testInstance, actor, audit.AppInstallation, "192.0.2.1",
+		map[string]string{"slug": "drive"})
+	audit.Log(testInstance, actor, audit.PermissionCreation, "192.0.2.1", nil)
+	audit.Log(testInstance, audit.Actor{Type: audit.ActorSession, ID: "123"},
+		audit.Login, "192.0.2.2", nil)
+
+	cursor := couchdb.NewKeyCursor(2, nil, "")
+	entries, err := audit.List(testInstance, cursor)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, audit.Login, entries[0].Action)
+		assert.Equal(t, audit.ActorSession, entries[0].Actor.Type)
+		assert.Equal(t, "192.0.2.2", entries[0].IP)
+		assert.Equal(t, audit.PermissionCreation, entries[1].Action)
+	}
+	assert.True(t, cursor.HasMore())
+
+	entries, err = audit.List(testInstance, cursor)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, audit.AppInstallation, entries[0].Action)
+		assert.Equal(t, "settings", entries[0].Actor.ID)
+		assert.Equal(t, "drive", entries[0].Details["slug"])
+	}
+	assert.False(t, cursor.HasMore())
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "audit_test")
+	testInstance = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
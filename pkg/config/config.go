@@ -2,14 +2,18 @@ package config
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -60,6 +64,9 @@ const (
 	SchemeMem = "mem"
 	// SchemeSwift is the URL scheme used to configure a swift filesystem.
 	SchemeSwift = "swift"
+	// SchemeS3 is the URL scheme used to configure a storage compatible with
+	// the S3 API.
+	SchemeS3 = "s3"
 )
 
 // AdminSecretFileName is the name of the file containing the administration
@@ -79,26 +86,88 @@ type Config struct {
 	AdminHost  string
 	AdminPort  int
 	NoReply    string
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For and
+	// X-Real-Ip headers are used to know the IP address of the clients.
+	TrustedProxies []*net.IPNet
 
 	Fs         Fs
 	CouchDB    CouchDB
 	Jobs       Jobs
 	Konnectors Konnectors
 	Mail       *gomail.DialerOptions
+	Tracing    Tracing
+	Search     Search
 
 	Cache                       RedisConfig
 	Lock                        RedisConfig
 	SessionStorage              RedisConfig
 	DownloadStorage             RedisConfig
 	KonnectorsOauthStateStorage RedisConfig
+	Realtime                    RedisConfig
+	RateLimitingStorage         RedisConfig
 
 	Contexts map[string]interface{}
 }
 
 // Fs contains the configuration values of the file-system
 type Fs struct {
-	Auth *url.Userinfo
-	URL  *url.URL
+	Auth       *url.Userinfo
+	URL        *url.URL
+	Versioning FsVersioning
+	// Deduplication enables the content-addressed storage of the files, where
+	// the identical contents are stored only once for all the instances.
+	Deduplication bool
+	Encryption    FsEncryption
+	// QuotaAlerts are the thresholds of the disk usage, in percent of the disk
+	// quota, that send a warning to the user when they are crossed. They are
+	// sorted in ascending order.
+	QuotaAlerts []int
+	// ThumbnailsSizes are the sizes of the thumbnails that can be generated on
+	// demand, like 256x256-crop, in addition to small, medium and large.
+	ThumbnailsSizes []string
+}
+
+// FsVersioning contains the configuration values for keeping the old
+// versions of the content of the files.
+type FsVersioning struct {
+	// MaxNumberToKeep is the maximal number of old versions kept for a file.
+	// The versioning is disabled when it is zero.
+	MaxNumberToKeep int
+	// MaxAge is the duration after which an old version is removed. There is
+	// no limit of age when it is zero.
+	MaxAge time.Duration
+}
+
+// Enabled returns true if the old versions of the files should be kept.
+func (v FsVersioning) Enabled() bool {
+	return v.MaxNumberToKeep > 0
+}
+
+// FsEncryption contains the configuration values for the encryption at rest
+// of the content of the files. Each instance has its own data key, that is
+// stored wrapped by the master key.
+type FsEncryption struct {
+	// MasterKey wraps the data keys of the instances. The encryption is
+	// disabled for the new instances when it is empty.
+	MasterKey []byte
+	// PreviousMasterKeys are the master keys replaced by MasterKey. They are
+	// kept to unwrap the data keys that have not been rotated yet.
+	PreviousMasterKeys [][]byte
+}
+
+// Enabled returns true if the content of the files of the new instances
+// should be encrypted.
+func (e FsEncryption) Enabled() bool {
+	return len(e.MasterKey) > 0
+}
+
+// MasterKeys returns all the known master keys, starting with the current one.
+func (e FsEncryption) MasterKeys() [][]byte {
+	keys := make([][]byte, 0, len(e.PreviousMasterKeys)+1)
+	if e.Enabled() {
+		keys = append(keys, e.MasterKey)
+	}
+	return append(keys, e.PreviousMasterKeys...)
 }
 
 // CouchDB contains the configuration values of the database
@@ -118,6 +187,25 @@ type Konnectors struct {
 	Cmd string
 }
 
+// Tracing contains the configuration values for the export of the traces
+type Tracing struct {
+	// Exporter is otlp or file, or empty to disable the tracing
+	Exporter string
+	// Endpoint is the URL of the OTLP/HTTP collector
+	Endpoint string
+	// File is the path of the file where the file exporter writes the spans
+	File string
+}
+
+// Search contains the configuration values for the full-text search
+type Search struct {
+	// Path is the directory where the indexes of the instances are stored.
+	// They are kept in memory when it is empty.
+	Path string
+	// Doctypes are the doctypes indexed in addition to io.cozy.files
+	Doctypes []string
+}
+
 // RedisConfig contains the configuration values for a redis system
 type RedisConfig struct {
 	Auth *url.Userinfo
@@ -253,6 +341,29 @@ func UseViper(v *viper.Viper) error {
 		return err
 	}
 
+	encryption, err := makeFsEncryption(v)
+	if err != nil {
+		return err
+	}
+	if encryption.Enabled() && v.GetBool("fs.deduplication") {
+		return fmt.Errorf("The encryption of the files can't be used with the deduplication")
+	}
+
+	quotaAlerts, err := makeFsQuotaAlerts(v)
+	if err != nil {
+		return err
+	}
+
+	thumbnailsSizes, err := makeFsThumbnailsSizes(v)
+	if err != nil {
+		return err
+	}
+
+	trustedProxies, err := makeTrustedProxies(v)
+	if err != nil {
+		return err
+	}
+
 	couchURL, couchAuth, err := parseURL(v.GetString("couchdb.url"))
 	if err != nil {
 		return err
@@ -262,16 +373,25 @@ func UseViper(v *viper.Viper) error {
 	}
 
 	config = &Config{
-		Host:       v.GetString("host"),
-		Port:       v.GetInt("port"),
-		Subdomains: v.GetString("subdomains"),
-		AdminHost:  v.GetString("admin.host"),
-		AdminPort:  v.GetInt("admin.port"),
-		Assets:     v.GetString("assets"),
-		Doctypes:   v.GetString("doctypes"),
-		NoReply:    v.GetString("mail.noreply_address"),
+		Host:           v.GetString("host"),
+		Port:           v.GetInt("port"),
+		Subdomains:     v.GetString("subdomains"),
+		AdminHost:      v.GetString("admin.host"),
+		AdminPort:      v.GetInt("admin.port"),
+		Assets:         v.GetString("assets"),
+		Doctypes:       v.GetString("doctypes"),
+		NoReply:        v.GetString("mail.noreply_address"),
+		TrustedProxies: trustedProxies,
 		Fs: Fs{
 			URL: fsURL,
+			Versioning: FsVersioning{
+				MaxNumberToKeep: v.GetInt("fs.versioning.max_number_of_versions_to_keep"),
+				MaxAge:          v.GetDuration("fs.versioning.max_age"),
+			},
+			Deduplication:   v.GetBool("fs.deduplication"),
+			Encryption:      encryption,
+			QuotaAlerts:     quotaAlerts,
+			ThumbnailsSizes: thumbnailsSizes,
 		},
 		CouchDB: CouchDB{
 			Auth: couchAuth,
@@ -289,6 +409,8 @@ func UseViper(v *viper.Viper) error {
 		SessionStorage:              NewRedisConfig(v.GetString("sessions.url")),
 		DownloadStorage:             NewRedisConfig(v.GetString("downloads.url")),
 		KonnectorsOauthStateStorage: NewRedisConfig(v.GetString("konnectors.oauthstate")),
+		Realtime:                    NewRedisConfig(v.GetString("realtime.url")),
+		RateLimitingStorage:         NewRedisConfig(v.GetString("rate_limiting.url")),
 		Mail: &gomail.DialerOptions{
 			Host:                      v.GetString("mail.host"),
 			Port:                      v.GetInt("mail.port"),
@@ -297,6 +419,15 @@ func UseViper(v *viper.Viper) error {
 			DisableTLS:                v.GetBool("mail.disable_tls"),
 			SkipCertificateValidation: v.GetBool("mail.skip_certificate_validation"),
 		},
+		Tracing: Tracing{
+			Exporter: v.GetString("tracing.exporter"),
+			Endpoint: v.GetString("tracing.endpoint"),
+			File:     v.GetString("tracing.file"),
+		},
+		Search: Search{
+			Path:     v.GetString("search.path"),
+			Doctypes: v.GetStringSlice("search.doctypes"),
+		},
 		Contexts: v.GetStringMap("contexts"),
 	}
 
@@ -396,3 +527,106 @@ func parseURL(u string) (*url.URL, *url.Userinfo, error) {
 	parsedURL.User = nil
 	return parsedURL, user, nil
 }
+
+// makeFsEncryption decodes the master keys of the configuration. They are
+// encoded in base64, and are 256 bits long.
+func makeFsEncryption(v *viper.Viper) (FsEncryption, error) {
+	var e FsEncryption
+	decode := func(encoded string) ([]byte, error) {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Invalid master key for the encryption of the files: it must be 32 bytes encoded in base64")
+		}
+		return key, nil
+	}
+	if encoded := v.GetString("fs.encryption.master_key"); encoded != "" {
+		key, err := decode(encoded)
+		if err != nil {
+			return e, err
+		}
+		e.MasterKey = key
+	}
+	for _, encoded := range v.GetStringSlice("fs.encryption.previous_master_keys") {
+		key, err := decode(encoded)
+		if err != nil {
+			return e, err
+		}
+		e.PreviousMasterKeys = append(e.PreviousMasterKeys, key)
+	}
+	return e, nil
+}
+
+// makeFsQuotaAlerts parses the thresholds of the quota alerts. They are
+// percents of the disk quota, like 80 or 95%.
+func makeFsQuotaAlerts(v *viper.Viper) ([]int, error) {
+	var alerts []int
+	for _, threshold := range v.GetStringSlice("fs.quota_alerts") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(threshold, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("Invalid threshold for the quota alerts: %s", threshold)
+		}
+		alerts = append(alerts, percent)
+	}
+	sort.Ints(alerts)
+	return alerts, nil
+}
+
+// defaultThumbnailsSizes are the sizes of the thumbnails generated on demand
+// when none are configured: square tiles for the galleries.
+var defaultThumbnailsSizes = []string{"128x128-crop", "256x256-crop", "512x512-crop"}
+
+// The width and height of the thumbnails generated on demand must be between
+// 16 and 2048 pixels.
+var thumbnailSizeRegexp = regexp.MustCompile(`^(\d{1,4})x(\d{1,4})(-crop)?$`)
+
+const (
+	minThumbnailSize = 16
+	maxThumbnailSize = 2048
+)
+
+// ThumbnailSize is a size of thumbnails that can be generated on demand.
+type ThumbnailSize struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool
+}
+
+// ParseThumbnailSize parses a size of thumbnails, like 300x200 or
+// 256x256-crop. The returned name is normalized, without the leading zeros.
+func ParseThumbnailSize(size string) (*ThumbnailSize, error) {
+	match := thumbnailSizeRegexp.FindStringSubmatch(size)
+	if match == nil {
+		return nil, fmt.Errorf("Invalid size for the thumbnails: %s", size)
+	}
+	width, _ := strconv.Atoi(match[1])
+	height, _ := strconv.Atoi(match[2])
+	if width < minThumbnailSize || width > maxThumbnailSize ||
+		height < minThumbnailSize || height > maxThumbnailSize {
+		return nil, fmt.Errorf("Invalid size for the thumbnails: %s", size)
+	}
+	return &ThumbnailSize{
+		Name:   fmt.Sprintf("%dx%d%s", width, height, match[3]),
+		Width:  width,
+		Height: height,
+		Crop:   match[3] != "",
+	}, nil
+}
+
+// makeFsThumbnailsSizes parses the sizes of the thumbnails that can be
+// generated on demand.
+func makeFsThumbnailsSizes(v *viper.Viper) ([]string, error) {
+	sizes := defaultThumbnailsSizes
+	if v.IsSet("fs.thumbnails_sizes") {
+		sizes = v.GetStringSlice("fs.thumbnails_sizes")
+	}
+	normalized := make([]string, 0, len(sizes))
+	for _, size := range sizes {
+		parsed, err := ParseThumbnailSize(strings.TrimSpace(size))
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, parsed.Name)
+	}
+	return normalized, nil
+}
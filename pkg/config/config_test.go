@@ -1,6 +1,7 @@
 package config
 
 import (
+	"net/http"
 	"os"
 	"path/filepath"
 	"testing"
@@ -80,3 +81,30 @@ log:
 	assert.Equal(t, "mail_password_val", GetConfig().Mail.Password)
 	assert.Equal(t, logrus.GetLevel(), logrus.WarnLevel)
 }
+
+func TestClientIP(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("trusted_proxies", []string{"10.0.0.1", "192.168.0.0/16"})
+	assert.NoError(t, UseViper(cfg))
+	defer UseViper(viper.New()) // #nosec
+
+	req := &http.Request{RemoteAddr: "1.2.3.4:5678", Header: http.Header{}}
+	assert.Equal(t, "1.2.3.4", ClientIP(req))
+
+	// The headers are ignored if the request does not come from a proxy
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	req.Header.Set("X-Real-Ip", "5.6.7.8")
+	assert.Equal(t, "1.2.3.4", ClientIP(req))
+
+	// The client is the last address that is not a trusted proxy
+	req.RemoteAddr = "10.0.0.1:5678"
+	req.Header.Set("X-Forwarded-For", "9.9.9.9, 5.6.7.8, 192.168.1.1")
+	assert.Equal(t, "5.6.7.8", ClientIP(req))
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "5.6.7.8", ClientIP(req))
+	req.Header.Del("X-Real-Ip")
+	assert.Equal(t, "10.0.0.1", ClientIP(req))
+
+	cfg.Set("trusted_proxies", []string{"not-an-ip"})
+	assert.Error(t, UseViper(cfg))
+}
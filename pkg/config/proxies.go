@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// defaultTrustedProxies are the reverse proxies trusted when none are
+// configured: a reverse proxy on the same host.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// makeTrustedProxies parses the IP addresses and networks (in the CIDR
+// notation) of the reverse proxies that are trusted for the X-Forwarded-For
+// and X-Real-Ip headers.
+func makeTrustedProxies(v *viper.Viper) ([]*net.IPNet, error) {
+	proxies := defaultTrustedProxies
+	if v.IsSet("trusted_proxies") {
+		proxies = v.GetStringSlice("trusted_proxies")
+	}
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q: %s", proxy, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// ClientIP returns the IP address of the client of an HTTP request. The
+// X-Forwarded-For and X-Real-Ip headers can be forged by the clients, so they
+// are only used when the request comes from a trusted proxy.
+func ClientIP(req *http.Request) string {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	var trusted []*net.IPNet
+	if config != nil {
+		trusted = config.TrustedProxies
+	}
+	if !isTrustedProxy(remote, trusted) {
+		return remote
+	}
+	if fwd := strings.Join(req.Header["X-Forwarded-For"], ","); fwd != "" {
+		// Each proxy appends the address of its client: the client of the
+		// stack is the last address that is not a trusted proxy
+		ips := strings.Split(fwd, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if i == 0 || !isTrustedProxy(ip, trusted) {
+				return ip
+			}
+		}
+	}
+	if ip := req.Header.Get("X-Real-Ip"); ip != "" {
+		return ip
+	}
+	return remote
+}
+
+func isTrustedProxy(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	minio "github.com/minio/minio-go"
+)
+
+var s3Client *minio.Client
+var s3Bucket string
+
+// InitS3Connection initialize the global S3 client, for a storage compatible
+// with the S3 API, like AWS S3 or MinIO. The URL is of the form
+// s3://host:port/bucket?AccessKeyID=...&SecretAccessKey=...&Region=...
+// The bucket is created if it does not exist. This is not a thread-safe
+// method.
+func InitS3Connection(s3URL *url.URL) error {
+	q := s3URL.Query()
+
+	bucket := strings.Trim(s3URL.Path, "/")
+	if bucket == "" {
+		return fmt.Errorf("s3: missing bucket in the URL %s", s3URL.Host)
+	}
+
+	secure := q.Get("DisableSSL") != "true"
+	region := q.Get("Region")
+	client, err := minio.NewWithRegion(s3URL.Host, q.Get("AccessKeyID"),
+		q.Get("SecretAccessKey"), secure, region)
+	if err != nil {
+		return err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err != nil {
+		log.Errorf("[s3] Could not reach the S3 server on %s: %s", s3URL.Host, err)
+		return err
+	}
+	if !exists {
+		if err = client.MakeBucket(bucket, region); err != nil {
+			log.Errorf("[s3] Could not create the bucket %s: %s", bucket, err)
+			return err
+		}
+		log.Infof("[s3] Created bucket %s", bucket)
+	}
+
+	s3Client = client
+	s3Bucket = bucket
+	log.Infof("[s3] Successfully connected to server %s", s3URL.Host)
+	return nil
+}
+
+// GetS3Client returns the S3 client created from the actual configuration,
+// and the name of the bucket where the objects are stored.
+func GetS3Client() (*minio.Client, string) {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Connection()")
+	}
+	return s3Client, s3Bucket
+}
@@ -14,18 +14,30 @@ const (
 	Konnectors = "io.cozy.konnectors"
 	// KonnectorResults doc type for konnector last execution result.
 	KonnectorResults = "io.cozy.konnectors.result"
+	// Audit doc type for the entries of the audit log
+	Audit = "io.cozy.audit"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
+	// Blobs doc type for the references to the blobs of the deduplicated VFS
+	Blobs = "io.cozy.blobs"
 	// Doctypes doc type for doctype list
 	Doctypes = "io.cozy.doctypes"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesVersions doc type for the old versions of the files content
+	FilesVersions = "io.cozy.files.versions"
+	// FilesUploads doc type for the sessions of resumable uploads
+	FilesUploads = "io.cozy.files.uploads"
 	// Intents doc type for intents persisted in couchdb
 	Intents = "io.cozy.intents"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
+	// JobDeadLetters doc type for the references to the dead-lettered jobs
+	JobDeadLetters = "io.cozy.jobs.dead_letters"
 	// JobEvents doc type for realt time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// JobLogs doc type for the logs of the execution of jobs
+	JobLogs = "io.cozy.jobs.logs"
 	// OAuthAccessCodes doc type for OAuth2 access codes
 	OAuthAccessCodes = "io.cozy.oauth.access_codes"
 	// OAuthClients doc type for OAuth2 clients
@@ -87,6 +99,9 @@ const (
 	DiskUsageID = "io.cozy.settings.disk-usage"
 	// InstanceSettingsID is the id of settings document for the instance
 	InstanceSettingsID = "io.cozy.settings.instance"
+	// TwoFactorID is the id of the settings JSON-API response for the
+	// two-factor authentication
+	TwoFactorID = "io.cozy.settings.two-factor"
 	// SharedWithMeDirID is the id of the directory where all the files received
 	// by sharing will end up.
 	SharedWithMeDirID = "io.cozy.sharings.shared-with-me-dir"
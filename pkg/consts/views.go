@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 4
+const IndexViewsVersion int = 7
 
 // GlobalIndexes is the index list required on the global databases to run
 // properly.
@@ -42,6 +42,21 @@ function(doc) {
 	Reduce: "_sum",
 }
 
+// DiskUsageByClassView is the view used for computing the disk usage of the
+// files by class, and of the files in the trash.
+var DiskUsageByClassView = &couchdb.View{
+	Name:    "disk-usage-by-class",
+	Doctype: Files,
+	Map: `
+function(doc) {
+  if (doc.type === 'file') {
+    emit([!!doc.trashed, doc.class], +doc.size);
+  }
+}
+`,
+	Reduce: "_sum",
+}
+
 // FilesReferencedByView is the view used for fetching files referenced by a
 // given document
 var FilesReferencedByView = &couchdb.View{
@@ -70,6 +85,19 @@ function(doc) {
 	Reduce: "_count",
 }
 
+// FilesVersionsByFileView is the view used for listing the old versions of a
+// file, from the oldest to the most recent, and for computing the disk usage
+// of these versions.
+var FilesVersionsByFileView = &couchdb.View{
+	Name:    "versions-by-file",
+	Doctype: FilesVersions,
+	Map: `
+function(doc) {
+  emit([doc.file_id, doc.created_at], +doc.size);
+}`,
+	Reduce: "_sum",
+}
+
 // PermissionsShareByCView is the view for fetching the permissions associated
 // to a document via a token code.
 var PermissionsShareByCView = &couchdb.View{
@@ -142,15 +170,45 @@ function(doc) {
 }`,
 }
 
+// JobsByDomainView is the view used to list the jobs of a domain, optionally
+// filtered by worker type and/or state, and sorted by their queued date. The
+// jobs can be stored in a global database, so this view is not in the Views
+// list: it is defined on the first use.
+var JobsByDomainView = &couchdb.View{
+	Name:    "jobs-by-domain",
+	Doctype: Jobs,
+	Map: `
+function(doc) {
+  emit([doc.domain, "", "", doc.queued_at]);
+  emit([doc.domain, doc.worker, "", doc.queued_at]);
+  emit([doc.domain, "", doc.state, doc.queued_at]);
+  emit([doc.domain, doc.worker, doc.state, doc.queued_at]);
+}`,
+}
+
+// AuditByTimeView is the view used to list the entries of the audit log,
+// sorted by date
+var AuditByTimeView = &couchdb.View{
+	Name:    "audit-by-time",
+	Doctype: Audit,
+	Map: `
+function(doc) {
+  emit(doc.time);
+}`,
+}
+
 // Views is the list of all views that are created by the stack.
 var Views = []*couchdb.View{
 	DiskUsageView,
+	DiskUsageByClassView,
 	FilesReferencedByView,
 	FilesByParentView,
+	FilesVersionsByFileView,
 	PermissionsShareByCView,
 	PermissionsShareByDocView,
 	SharedWithMePermissionsView,
 	SharedWithOthersPermissionsView,
+	AuditByTimeView,
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
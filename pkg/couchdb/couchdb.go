@@ -16,6 +16,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/trace"
 	"github.com/cozy/echo"
 	"github.com/google/go-querystring/query"
 	"github.com/sirupsen/logrus"
@@ -72,10 +73,11 @@ func rtevent(db Database, evtype string, doc, oldDoc Doc) {
 	domain := db.Prefix()
 	domain = domain[:len(domain)-1] // Strip the final '/'
 	realtime.GetHub().Publish(&realtime.Event{
-		Type:   evtype,
-		Doc:    doc.Clone(),
-		OldDoc: oldDoc,
-		Domain: domain,
+		Type:        evtype,
+		Doc:         doc.Clone(),
+		OldDoc:      oldDoc,
+		Domain:      domain,
+		TraceParent: trace.FromCarrier(db).TraceParent(),
 	})
 }
 
@@ -301,16 +303,22 @@ func makeRequest(db Database, method, path string, reqbody interface{}, resbody
 			req.SetBasicAuth(auth.Username(), p)
 		}
 	}
+	requestsCounter.WithLabelValues(method).Inc()
+	span := startSpan(db, method, path)
+	defer span.End()
 	resp, err := couchdbClient.Do(req)
 	// Possible err = mostly connection failure
 	if err != nil {
+		countError(method, 0)
 		err = newConnectionError(err)
+		span.SetError(err)
 		log.Error(err.Error())
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		countError(method, resp.StatusCode)
 		var body []byte
 		body, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -320,6 +328,8 @@ func makeRequest(db Database, method, path string, reqbody interface{}, resbody
 			err = newCouchdbError(resp.StatusCode, body)
 			log.Debug(err.Error())
 		}
+		span.SetAttribute("http.status_code", resp.StatusCode)
+		span.SetError(err)
 		return err
 	}
 	if resbody == nil {
@@ -703,9 +713,14 @@ func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interf
 	}
 	v.Add("include_docs", "true")
 
+	// The keys can't be repeated in the query-string, they are sent as a JSON
+	// array in the body.
+	body := struct {
+		Keys []string `json:"keys,omitempty"`
+	}{req.Keys}
 	var response AllDocsResponse
 	url := makeDBName(db, doctype) + "/_all_docs?" + v.Encode()
-	err = makeRequest(db, "POST", url, &req, &response)
+	err = makeRequest(db, "POST", url, &body, &response)
 	if err != nil {
 		return err
 	}
@@ -792,7 +807,7 @@ type FindRequest struct {
 // AllDocsRequest is used to build a _all_docs request
 type AllDocsRequest struct {
 	Descending bool     `url:"descending,omitempty"`
-	Keys       []string `url:"keys,omitempty"`
+	Keys       []string `url:"-"` // sent in the body of the request
 	Limit      int      `url:"limit,omitempty"`
 	Skip       int      `url:"skip,omitempty"`
 	StartKey   string   `url:"start_key,omitempty"`
@@ -134,6 +134,16 @@ func TestGetAllDocs(t *testing.T) {
 		assert.Equal(t, results[0].Test, "all_1")
 		assert.Equal(t, results[1].Test, "all_2")
 	}
+
+	// The missing documents are null in the results
+	var byKeys []*testDoc
+	req := &AllDocsRequest{Keys: []string{doc2.ID(), "missing", doc1.ID()}}
+	err = GetAllDocs(TestPrefix, TestDoctype, req, &byKeys)
+	if assert.NoError(t, err) && assert.Len(t, byKeys, 3) {
+		assert.Equal(t, byKeys[0].Test, "all_2")
+		assert.Nil(t, byKeys[1])
+		assert.Equal(t, byKeys[2].Test, "all_1")
+	}
 }
 
 func TestBulkUpdateDocs(t *testing.T) {
@@ -0,0 +1,45 @@
+package couchdb
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// requestsCounter counts the requests made to CouchDB, by HTTP method
+	requestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cozy",
+			Subsystem: "couchdb",
+			Name:      "requests_total",
+			Help:      "Number of requests made to CouchDB.",
+		},
+		[]string{"method"},
+	)
+
+	// errorsCounter counts the requests to CouchDB that have failed, by HTTP
+	// method and status. The status is "connection" when CouchDB has not
+	// responded.
+	errorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cozy",
+			Subsystem: "couchdb",
+			Name:      "errors_total",
+			Help:      "Number of requests made to CouchDB that have failed.",
+		},
+		[]string{"method", "status"},
+	)
+)
+
+func countError(method string, status int) {
+	label := "connection"
+	if status != 0 {
+		label = strconv.Itoa(status)
+	}
+	errorsCounter.WithLabelValues(method, label).Inc()
+}
+
+func init() {
+	prometheus.MustRegister(requestsCounter, errorsCounter)
+}
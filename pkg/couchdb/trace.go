@@ -0,0 +1,23 @@
+package couchdb
+
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/trace"
+)
+
+// startSpan returns a span for a request to CouchDB, as a child of the span
+// of the database if it is tied to a traced request, or nil
+func startSpan(db Database, method, path string) *trace.Span {
+	span := trace.FromCarrier(db).Child("couchdb "+method, trace.KindClient)
+	if span == nil {
+		return nil
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	span.SetAttribute("db.system", "couchdb")
+	span.SetAttribute("http.method", method)
+	span.SetAttribute("db.path", path)
+	return span
+}
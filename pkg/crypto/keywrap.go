@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+)
+
+// keyIDLength is the length of the identifier of a master key, at the start
+// of a wrapped key.
+const keyIDLength = 8
+
+var (
+	errKeyWrapInvalid = errors.New("keywrap: the wrapped key is not valid")
+	errKeyWrapUnknown = errors.New("keywrap: the key has been wrapped by an unknown master key")
+)
+
+// KeyID returns a short identifier of a master key, that does not reveal the
+// key.
+func KeyID(master []byte) []byte {
+	sum := sha256.Sum256(master)
+	return sum[:keyIDLength]
+}
+
+// WrapKey encrypts a key with a master key, with AES-256-GCM. The wrapped key
+// starts with the identifier of the master key, to find it when the key is
+// unwrapped.
+func WrapKey(master, key []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := GenerateRandomBytes(aead.NonceSize())
+	wrapped := append(KeyID(master), nonce...)
+	return aead.Seal(wrapped, nonce, key, nil), nil
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey, with the master key that was
+// used to wrap it among the given ones.
+func UnwrapKey(masters [][]byte, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < keyIDLength {
+		return nil, errKeyWrapInvalid
+	}
+	for _, master := range masters {
+		if !IsWrappedWith(master, wrapped) {
+			continue
+		}
+		aead, err := newGCM(master)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = wrapped[keyIDLength:]
+		if len(wrapped) < aead.NonceSize() {
+			return nil, errKeyWrapInvalid
+		}
+		nonce := wrapped[:aead.NonceSize()]
+		key, err := aead.Open(nil, nonce, wrapped[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, errKeyWrapInvalid
+		}
+		return key, nil
+	}
+	return nil, errKeyWrapUnknown
+}
+
+// IsWrappedWith returns true if the key has been wrapped by the given master
+// key.
+func IsWrappedWith(master, wrapped []byte) bool {
+	return len(wrapped) >= keyIDLength &&
+		bytes.Equal(KeyID(master), wrapped[:keyIDLength])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,37 @@
+package crypto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyWrap(t *testing.T) {
+	oldMaster := GenerateRandomBytes(32)
+	newMaster := GenerateRandomBytes(32)
+	key := GenerateRandomBytes(32)
+
+	wrapped, err := WrapKey(oldMaster, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, IsWrappedWith(oldMaster, wrapped))
+	assert.False(t, IsWrappedWith(newMaster, wrapped))
+
+	_, err = UnwrapKey([][]byte{newMaster}, wrapped)
+	assert.Error(t, err)
+	unwrapped, err := UnwrapKey([][]byte{newMaster, oldMaster}, wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	// The rotation of the master key keeps the same key
+	rewrapped, err := WrapKey(newMaster, unwrapped)
+	assert.NoError(t, err)
+	unwrapped, err = UnwrapKey([][]byte{newMaster}, rewrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, key, unwrapped)
+
+	wrapped[len(wrapped)-1] ^= 0xff
+	_, err = UnwrapKey([][]byte{oldMaster}, wrapped)
+	assert.Error(t, err)
+}
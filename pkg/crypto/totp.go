@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // #nosec
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TOTPSecretLen is the number of random bytes of a TOTP secret (160 bits, as
+// recommended by RFC 4226)
+const TOTPSecretLen = 20
+
+// TOTPPeriod is the number of seconds a TOTP passcode is valid
+const TOTPPeriod = 30
+
+// TOTPDigits is the number of digits of a TOTP passcode
+const TOTPDigits = 6
+
+// TOTPSkew is the number of periods before and after the current one for
+// which a passcode is still accepted, to allow some clock drift
+const TOTPSkew = 1
+
+// GenerateTOTPSecret returns a new random secret for TOTP
+func GenerateTOTPSecret() []byte {
+	return GenerateRandomBytes(TOTPSecretLen)
+}
+
+// EncodeTOTPSecret returns the secret in the base32 form used by the
+// authenticator applications.
+func EncodeTOTPSecret(secret []byte) string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(secret), "=")
+}
+
+// TOTPCounter returns the TOTP counter for the given time
+func TOTPCounter(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// TOTPPasscode returns the passcode for the given secret and counter, as
+// defined by RFC 6238 with HMAC-SHA1.
+func TOTPPasscode(secret []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, see RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, code%mod)
+}
+
+// ValidateTOTP checks the passcode for the given secret at the given time,
+// with a tolerance of TOTPSkew periods. It returns the counter of the matching
+// passcode, so that the caller can refuse a passcode already used.
+func ValidateTOTP(secret []byte, passcode string, t time.Time) (int64, bool) {
+	passcode = strings.Replace(passcode, " ", "", -1)
+	if len(passcode) != TOTPDigits {
+		return 0, false
+	}
+	current := TOTPCounter(t)
+	for counter := current - TOTPSkew; counter <= current+TOTPSkew; counter++ {
+		expected := TOTPPasscode(secret, counter)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(passcode)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI returns the otpauth:// URI used to enroll the secret in an
+// authenticator application, usually via a QR code.
+func TOTPURI(issuer, account string, secret []byte) string {
+	label := escapeTOTPLabel(issuer) + ":" + escapeTOTPLabel(account)
+	return fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s&digits=%d&period=%d",
+		label, EncodeTOTPSecret(secret), escapeTOTPLabel(issuer), TOTPDigits, TOTPPeriod)
+}
+
+func escapeTOTPLabel(s string) string {
+	return strings.NewReplacer(" ", "%20", ":", "%3A", "?", "%3F", "&", "%26", "=", "%3D").Replace(s)
+}
@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The test vectors of RFC 6238 (appendix B), truncated to 6 digits
+var totpVectors = []struct {
+	time     int64
+	passcode string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+}
+
+func TestTOTPPasscode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for _, v := range totpVectors {
+		counter := TOTPCounter(time.Unix(v.time, 0))
+		assert.Equal(t, v.passcode, TOTPPasscode(secret, counter))
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	now := time.Now()
+	counter := TOTPCounter(now)
+
+	c, ok := ValidateTOTP(secret, TOTPPasscode(secret, counter), now)
+	assert.True(t, ok)
+	assert.Equal(t, counter, c)
+	c, ok = ValidateTOTP(secret, TOTPPasscode(secret, counter-1), now)
+	assert.True(t, ok)
+	assert.Equal(t, counter-1, c)
+	_, ok = ValidateTOTP(secret, TOTPPasscode(secret, counter+2), now)
+	assert.False(t, ok)
+	_, ok = ValidateTOTP(secret, "12345", now)
+	assert.False(t, ok)
+
+	passcode := TOTPPasscode(secret, counter)
+	_, ok = ValidateTOTP(secret, passcode[:3]+" "+passcode[3:], now)
+	assert.True(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	uri := TOTPURI("Cozy", "cozy.tools:8080", secret)
+	assert.Equal(t, "otpauth://totp/Cozy:cozy.tools%3A8080?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&issuer=Cozy&digits=6&period=30", uri)
+}
@@ -2,17 +2,63 @@ package imexport
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"io"
+	"path"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
+// ArchiveVersion is the version of the layout of the archives. It is
+// incremented when an archive can no longer be imported by an older stack.
+const ArchiveVersion = 1
+
+const (
+	metadataName = "metadata.json"
+	triggersName = "triggers.json"
+	doctypesDir  = "doctypes"
+	filesDir     = "files"
+)
+
+// excludedDoctypes are the doctypes that are not exported: their documents
+// only make sense on the current host, or are rebuilt on import.
+var excludedDoctypes = []string{
+	consts.Files, // exported by walking the VFS
+	consts.FilesVersions,
+	consts.FilesUploads,
+	consts.Archives,
+	consts.Jobs,
+	consts.JobEvents,
+	consts.JobLogs,
+	consts.Queues,
+	consts.Sessions,
+	consts.OAuthAccessCodes,
+	consts.Triggers, // exported with the scheduler, in triggers.json
+}
+
+// Metadata is the content of the metadata.json file of an archive
+type Metadata struct {
+	Version        int       `json:"version"`
+	Domain         string    `json:"domain"`
+	Locale         string    `json:"locale"`
+	PassphraseHash []byte    `json:"passphrase_hash,omitempty"`
+	ExportedAt     time.Time `json:"exported_at"`
+	Doctypes       []string  `json:"doctypes"`
+}
+
 func writeFile(fs vfs.VFS, name string, tw *tar.Writer, doc *vfs.FileDoc) error {
 	file, err := fs.OpenFile(doc)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	hdr := &tar.Header{
 		Name:       name,
@@ -50,44 +96,205 @@ func createDir(name string, tw *tar.Writer, dir *vfs.DirDoc) error {
 	return err
 }
 
-func export(tw *tar.Writer, fs vfs.VFS) error {
-	root := "/Documents"
+// writeBuffer adds a regular file to the archive with the content of buf
+func writeBuffer(name string, tw *tar.Writer, buf *bytes.Buffer) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(buf.Len()),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, buf)
+	return err
+}
+
+// exportedFile is a directory or a file to write in the files/ part of the
+// archive
+type exportedFile struct {
+	name string
+	dir  *vfs.DirDoc
+	file *vfs.FileDoc
+}
+
+// walkFiles returns the documents of the directories and files, as JSON
+// lines, and the list of the directories and files. The trash is not
+// exported.
+func walkFiles(fs vfs.VFS) (*bytes.Buffer, []exportedFile, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	var files []exportedFile
 
-	err := vfs.Walk(fs, root, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
 		if err != nil {
 			return err
 		}
 
 		if dir != nil {
-			if err := createDir(name, tw, dir); err != nil {
-				return err
+			if dir.ID() == consts.TrashDirID {
+				return vfs.ErrSkipDir
 			}
-		}
-
-		if file != nil {
-			if err := writeFile(fs, name, tw, file); err != nil {
-				return err
+			if dir.ID() == consts.RootDirID {
+				return nil
 			}
-
+			cloned := *dir
+			cloned.DocRev = ""
+			files = append(files, exportedFile{name: name, dir: dir})
+			return enc.Encode(&cloned)
 		}
 
+		cloned := *file
+		cloned.DocRev = ""
+		if err := enc.Encode(&cloned); err != nil {
+			return err
+		}
+		files = append(files, exportedFile{name: name, file: file})
 		return nil
 	})
-	return err
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, files, nil
+}
+
+// dumpDoctype returns all the documents of a doctype, without their
+// revisions, as JSON lines.
+func dumpDoctype(db couchdb.Database, doctype string) (*bytes.Buffer, error) {
+	var docs []map[string]interface{}
+	err := couchdb.GetAllDocs(db, doctype, &couchdb.AllDocsRequest{}, &docs)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, doc := range docs {
+		delete(doc, "_rev")
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// dumpTriggers returns the triggers of the instance, without their
+// identifiers and domain, as JSON lines.
+func dumpTriggers(domain string) (*bytes.Buffer, error) {
+	triggers, err := stack.GetScheduler().GetAll(domain)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, t := range triggers {
+		infos := *t.Infos()
+		infos.TID = ""
+		infos.TRev = ""
+		infos.Domain = ""
+		if err := enc.Encode(&infos); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func isExcluded(doctype string) bool {
+	for _, excluded := range excludedDoctypes {
+		if doctype == excluded {
+			return true
+		}
+	}
+	return false
 }
 
-// Tardir tar doc directory
-func Tardir(w io.Writer, fs vfs.VFS) error {
+func export(tw *tar.Writer, i *instance.Instance) error {
+	fs := i.VFS()
+
+	alldoctypes, err := couchdb.AllDoctypes(i)
+	if err != nil {
+		return err
+	}
+	doctypes := []string{consts.Files}
+	for _, doctype := range alldoctypes {
+		if !isExcluded(doctype) {
+			doctypes = append(doctypes, doctype)
+		}
+	}
+
+	meta := &Metadata{
+		Version:        ArchiveVersion,
+		Domain:         i.Domain,
+		Locale:         i.Locale,
+		PassphraseHash: i.PassphraseHash,
+		ExportedAt:     time.Now(),
+		Doctypes:       doctypes,
+	}
+	buf := &bytes.Buffer{}
+	if err = json.NewEncoder(buf).Encode(meta); err != nil {
+		return err
+	}
+	if err = writeBuffer(metadataName, tw, buf); err != nil {
+		return err
+	}
+
+	// The documents are written before the content of the files, so that the
+	// import can recreate the tree and the files with the same identifiers.
+	buf, files, err := walkFiles(fs)
+	if err != nil {
+		return err
+	}
+	if err = writeBuffer(path.Join(doctypesDir, consts.Files+".json"), tw, buf); err != nil {
+		return err
+	}
+	for _, doctype := range doctypes[1:] {
+		if buf, err = dumpDoctype(i, doctype); err != nil {
+			return err
+		}
+		if err = writeBuffer(path.Join(doctypesDir, doctype+".json"), tw, buf); err != nil {
+			return err
+		}
+	}
+
+	if buf, err = dumpTriggers(i.Domain); err != nil {
+		return err
+	}
+	if err = writeBuffer(triggersName, tw, buf); err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := path.Join(filesDir, f.name)
+		if f.dir != nil {
+			err = createDir(name+"/", tw, f.dir)
+		} else {
+			err = writeFile(fs, name, tw, f.file)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export writes a tar.gz archive with all the data of an instance: the
+// metadata of the instance, the documents of its doctypes, its triggers and
+// the content of its files. The archive can be imported on another stack
+// with Import.
+func Export(w io.Writer, i *instance.Instance) error {
 	//gzip writer
 	gw := gzip.NewWriter(w)
-	defer gw.Close()
 
 	//tar writer
 	tw := tar.NewWriter(gw)
-	defer tw.Close()
-
-	err := export(tw, fs)
 
+	err := export(tw, i)
+	if cerr := tw.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if cerr := gw.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
 	return err
-
 }
@@ -0,0 +1,151 @@
+package imexport
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDoctype = "io.cozy.tests.imexport"
+const dstDomain = "imexport-dst.cozy.tools"
+
+var testInstance *instance.Instance
+
+func createFile(t *testing.T, fs vfs.VFS, name, dirID, content string) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, dirID, int64(len(content)), nil,
+		"text/plain", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	f, err := fs.CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	_, err = f.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	return doc
+}
+
+func TestExportImport(t *testing.T) {
+	fs := testInstance.VFS()
+	dir, err := vfs.MkdirAll(fs, "/Documents/imexport", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	file := createFile(t, fs, "hello.txt", dir.ID(), "hello world")
+	doc := couchdb.JSONDoc{
+		Type: testDoctype,
+		M:    map[string]interface{}{"_id": "foo", "bar": "baz"},
+	}
+	assert.NoError(t, couchdb.CreateNamedDocWithDB(testInstance, doc))
+
+	var buf bytes.Buffer
+	assert.NoError(t, Export(&buf, testInstance))
+	archive := buf.Bytes()
+
+	dst, err := instance.Create(&instance.Options{Domain: dstDomain})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, Import(dst, bytes.NewReader(archive)))
+
+	dstFs := dst.VFS()
+	d, err := dstFs.DirByPath("/Documents/imexport")
+	if assert.NoError(t, err) {
+		assert.Equal(t, dir.ID(), d.ID())
+	}
+	f, err := dstFs.FileByPath("/Documents/imexport/hello.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, file.ID(), f.ID())
+		content, err := dstFs.OpenFile(f)
+		if assert.NoError(t, err) {
+			data, err := ioutil.ReadAll(content)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello world", string(data))
+			content.Close()
+		}
+	}
+
+	var imported couchdb.JSONDoc
+	assert.NoError(t, couchdb.GetDoc(dst, testDoctype, "foo", &imported))
+	assert.Equal(t, "baz", imported.Get("bar"))
+
+	err = Import(dst, bytes.NewReader(archive))
+	assert.Equal(t, ErrNotFresh, err)
+}
+
+func TestExportSkipsTriggersDocs(t *testing.T) {
+	// The triggers are exported and imported through the scheduler, not as
+	// raw documents that would be duplicated with the triggers of the instance
+	trigger := couchdb.JSONDoc{
+		Type: consts.Triggers,
+		M:    map[string]interface{}{"type": "@event", "worker": "thumbnail"},
+	}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, trigger))
+	defer couchdb.DeleteDoc(testInstance, trigger) // #nosec
+
+	var buf bytes.Buffer
+	assert.NoError(t, Export(&buf, testInstance))
+	gr, err := gzip.NewReader(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		assert.NotEqual(t, doctypesDir+"/"+consts.Triggers+".json", hdr.Name)
+	}
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	domain := "imexport-invalid.cozy.tools"
+	instance.Destroy(domain) // #nosec
+	i, err := instance.Create(&instance.Options{Domain: domain})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer instance.Destroy(domain) // #nosec
+	err = Import(i, bytes.NewReader([]byte("not a tar.gz")))
+	assert.Equal(t, ErrInvalidArchive, err)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "imexport_test")
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		fmt.Println("Could not create temporary directory.")
+		os.Exit(1)
+	}
+	setup.AddCleanup(func() error { return os.RemoveAll(tempdir) })
+
+	config.GetConfig().Fs.URL = &url.URL{
+		Scheme: "file",
+		Host:   "localhost",
+		Path:   tempdir,
+	}
+
+	testInstance = setup.GetTestInstance()
+	instance.Destroy(dstDomain) // #nosec
+	setup.AddCleanup(func() error { return instance.Destroy(dstDomain) })
+
+	os.Exit(setup.Run())
+}
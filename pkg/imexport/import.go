@@ -0,0 +1,379 @@
+package imexport
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/scheduler"
+	"github.com/cozy/cozy-stack/pkg/stack"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+var (
+	// ErrInvalidArchive is used when the archive to import has not been
+	// made by Export
+	ErrInvalidArchive = errors.New("Invalid archive")
+	// ErrNotFresh is used when an archive is imported in an instance that
+	// already has some files
+	ErrNotFresh = errors.New("The instance is not fresh")
+)
+
+// errHasFile is used to stop walking the VFS when a file has been found
+var errHasFile = errors.New("has file")
+
+// isFresh returns true if the instance has no files. The directories of the
+// default tree are allowed.
+func isFresh(fs vfs.VFS) (bool, error) {
+	err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != nil {
+			return errHasFile
+		}
+		return nil
+	})
+	if err == errHasFile {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// appToInstall is a webapp or konnector to reinstall from its source
+type appToInstall struct {
+	appType apps.AppType
+	slug    string
+	source  string
+}
+
+type importer struct {
+	inst  *instance.Instance
+	fs    vfs.VFS
+	meta  *Metadata
+	files map[string]*vfs.FileDoc
+	apps  []appToInstall
+}
+
+// byFullpath sorts the directories so that the parents come before their
+// children
+type byFullpath []*vfs.DirDoc
+
+func (d byFullpath) Len() int           { return len(d) }
+func (d byFullpath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byFullpath) Less(i, j int) bool { return d[i].Fullpath < d[j].Fullpath }
+
+// importFilesDocs recreates the directories with their identifiers, and keeps
+// the documents of the files until their content is read from the archive.
+func (im *importer) importFilesDocs(r io.Reader) error {
+	var dirs []*vfs.DirDoc
+	var files []*vfs.FileDoc
+	dec := json.NewDecoder(r)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return ErrInvalidArchive
+		}
+		var doc struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return ErrInvalidArchive
+		}
+		if doc.Type == consts.DirType {
+			dir := &vfs.DirDoc{}
+			if err := json.Unmarshal(raw, dir); err != nil {
+				return ErrInvalidArchive
+			}
+			dirs = append(dirs, dir)
+		} else {
+			file := &vfs.FileDoc{}
+			if err := json.Unmarshal(raw, file); err != nil {
+				return ErrInvalidArchive
+			}
+			files = append(files, file)
+		}
+	}
+
+	sort.Sort(byFullpath(dirs))
+	paths := map[string]string{consts.RootDirID: "/"}
+	for _, dir := range dirs {
+		if dir.DocID == consts.RootDirID || dir.DocID == consts.TrashDirID {
+			continue
+		}
+		dir.DocRev = ""
+		// The directories of the default tree are created with the instance,
+		// but with other identifiers
+		existing, err := im.fs.DirByPath(dir.Fullpath)
+		if err == nil && existing.ID() != dir.ID() {
+			err = im.fs.DestroyDirAndContent(existing)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if existing == nil || existing.ID() != dir.ID() {
+			if err = im.fs.CreateDir(dir); err != nil {
+				return err
+			}
+		}
+		paths[dir.DocID] = dir.Fullpath
+	}
+
+	for _, file := range files {
+		parent, ok := paths[file.DirID]
+		if !ok {
+			im.inst.Logger().Warnf("[import] No parent for file %s", file.DocID)
+			continue
+		}
+		file.DocRev = ""
+		im.files[path.Join(parent, file.DocName)] = file
+	}
+	return nil
+}
+
+// importFileContent creates a file from its document and its content
+func (im *importer) importFileContent(name string, r io.Reader) error {
+	doc, ok := im.files[name]
+	if !ok {
+		im.inst.Logger().Warnf("[import] No document for file %s", name)
+		return nil
+	}
+	delete(im.files, name)
+	file, err := im.fs.CreateFile(doc, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// importDoc creates a document with its identifier, or overwrites the
+// document created with the instance that has the same identifier.
+func (im *importer) importDoc(doc couchdb.JSONDoc) error {
+	err := couchdb.CreateNamedDocWithDB(im.inst, doc)
+	if couchdb.IsConflictError(err) {
+		var old couchdb.JSONDoc
+		if err = couchdb.GetDoc(im.inst, doc.DocType(), doc.ID(), &old); err != nil {
+			return err
+		}
+		doc.SetRev(old.Rev())
+		err = couchdb.UpdateDoc(im.inst, doc)
+	}
+	return err
+}
+
+func (im *importer) importDoctype(doctype string, r io.Reader) error {
+	if doctype == consts.Files {
+		return im.importFilesDocs(r)
+	}
+	if isExcluded(doctype) {
+		return nil
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		doc := couchdb.JSONDoc{Type: doctype}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return ErrInvalidArchive
+		}
+		doc.SetRev("")
+
+		switch doctype {
+		case consts.Apps, consts.Konnectors:
+			// The applications are reinstalled from their source, as their
+			// code is not in the archive
+			appType := apps.Webapp
+			if doctype == consts.Konnectors {
+				appType = apps.Konnector
+			}
+			slug, _ := doc.Get("slug").(string)
+			source, _ := doc.Get("source").(string)
+			im.apps = append(im.apps, appToInstall{appType, slug, source})
+			continue
+		case consts.Permissions:
+			// The permissions of the applications are created by the
+			// installer
+			typ, _ := doc.Get("type").(string)
+			if typ == permissions.TypeWebapp || typ == permissions.TypeKonnector {
+				continue
+			}
+		}
+
+		if err := im.importDoc(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importTriggers adds the triggers of the archive to the scheduler, except
+// those that already exist, like the triggers created with the instance.
+func (im *importer) importTriggers(r io.Reader) error {
+	sched := stack.GetScheduler()
+	existing, err := sched.GetAll(im.inst.Domain)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var infos scheduler.TriggerInfos
+		if err = dec.Decode(&infos); err == io.EOF {
+			break
+		} else if err != nil {
+			return ErrInvalidArchive
+		}
+		if hasTrigger(existing, &infos) {
+			continue
+		}
+		infos.TID = ""
+		infos.TRev = ""
+		infos.Domain = im.inst.Domain
+		t, err := scheduler.NewTrigger(&infos)
+		if err != nil {
+			return err
+		}
+		if err = sched.Add(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasTrigger(triggers []scheduler.Trigger, infos *scheduler.TriggerInfos) bool {
+	for _, t := range triggers {
+		other := t.Infos()
+		if other.Type == infos.Type &&
+			other.WorkerType == infos.WorkerType &&
+			other.Arguments == infos.Arguments {
+			return true
+		}
+	}
+	return false
+}
+
+// importMetadata restores the locale and the passphrase of the instance
+func (im *importer) importMetadata(r io.Reader) error {
+	meta := &Metadata{}
+	if err := json.NewDecoder(r).Decode(meta); err != nil {
+		return ErrInvalidArchive
+	}
+	if meta.Version != ArchiveVersion {
+		return ErrInvalidArchive
+	}
+	im.meta = meta
+
+	i := im.inst
+	if meta.Locale != "" {
+		i.Locale = meta.Locale
+	}
+	if len(meta.PassphraseHash) > 0 {
+		i.PassphraseHash = meta.PassphraseHash
+		i.RegisterToken = nil
+	}
+	return instance.Update(i)
+}
+
+// installApps reinstalls the webapps and konnectors. A failure is logged but
+// does not stop the import, as the source may no longer be available.
+func (im *importer) installApps() {
+	i := im.inst
+	for _, app := range im.apps {
+		inst, err := apps.NewInstaller(i, i.AppsCopier(app.appType), &apps.InstallerOptions{
+			Operation: apps.Install,
+			Type:      app.appType,
+			SourceURL: app.source,
+			Slug:      app.slug,
+		})
+		if err == nil {
+			_, err = inst.RunSync()
+		}
+		if err != nil && err != apps.ErrAlreadyExists {
+			i.Logger().Errorf("[import] Could not install %s: %s", app.slug, err)
+		}
+	}
+}
+
+// Import reads an archive made by Export and restores its content in the
+// given instance. The instance must be fresh, ie it must not have any file.
+func Import(i *instance.Instance, r io.Reader) error {
+	fs := i.VFS()
+	fresh, err := isFresh(fs)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrNotFresh
+	}
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return ErrInvalidArchive
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+
+	im := &importer{
+		inst:  i,
+		fs:    fs,
+		files: make(map[string]*vfs.FileDoc),
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ErrInvalidArchive
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == metadataName {
+			err = im.importMetadata(tr)
+		} else if im.meta == nil {
+			// The metadata must be the first entry of the archive
+			err = ErrInvalidArchive
+		} else if hdr.Typeflag != tar.TypeReg {
+			continue
+		} else if name == triggersName {
+			err = im.importTriggers(tr)
+		} else if strings.HasPrefix(name, doctypesDir+"/") {
+			doctype := strings.TrimSuffix(path.Base(name), ".json")
+			err = im.importDoctype(doctype, tr)
+		} else if strings.HasPrefix(name, filesDir+"/") {
+			err = im.importFileContent(strings.TrimPrefix(name, filesDir), tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if im.meta == nil {
+		return ErrInvalidArchive
+	}
+	im.installApps()
+	return nil
+}
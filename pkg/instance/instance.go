@@ -22,10 +22,14 @@ import (
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/scheduler"
+	"github.com/cozy/cozy-stack/pkg/search"
 	"github.com/cozy/cozy-stack/pkg/settings"
 	"github.com/cozy/cozy-stack/pkg/stack"
+	"github.com/cozy/cozy-stack/pkg/trace"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfsdedup"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/leonelquinteros/gotext"
@@ -40,6 +44,7 @@ const (
 	PasswordResetTokenLen = 16
 	SessionSecretLen      = 64
 	OauthSecretLen        = 128
+	DataKeyLen            = 32
 )
 
 // passwordResetValidityDuration is the validity duration of the passphrase
@@ -80,6 +85,18 @@ type Instance struct {
 
 	BytesDiskQuota int64 `json:"disk_quota,string,omitempty"` // The total size in bytes allowed to the user
 
+	// TrashRetentionDays is the number of days after which the files and
+	// directories put in the trash are destroyed. They are kept until the
+	// trash is cleared by the user if it is zero.
+	TrashRetentionDays int `json:"trash_retention_days,omitempty"`
+	// TrashPurgeOnQuota is true when the oldest items of the trash can be
+	// destroyed to free some space when the disk quota is exceeded.
+	TrashPurgeOnQuota bool `json:"trash_purge_on_quota,omitempty"`
+	// QuotaAlert is the highest threshold of the quota alerts, in percent of
+	// the disk quota, crossed by the disk usage. It is kept to warn the user
+	// only once for each threshold.
+	QuotaAlert int `json:"quota_alert,omitempty"`
+
 	IndexViewsVersion int `json:"indexes_version"`
 
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
@@ -88,6 +105,19 @@ type Instance struct {
 	PassphraseResetToken []byte    `json:"passphrase_reset_token"`
 	PassphraseResetTime  time.Time `json:"passphrase_reset_time"`
 
+	// TwoFactorSecret is the TOTP secret used for the second factor of the
+	// login. It is empty when the two-factor authentication is disabled.
+	TwoFactorSecret []byte `json:"two_factor_secret,omitempty"`
+	// TwoFactorPendingSecret is the TOTP secret during the enrolment, until
+	// the user has confirmed it with a first passcode.
+	TwoFactorPendingSecret []byte `json:"two_factor_pending_secret,omitempty"`
+	// TwoFactorCounter is the TOTP counter of the last accepted passcode, to
+	// prevent it from being used twice.
+	TwoFactorCounter int64 `json:"two_factor_counter,omitempty"`
+	// RecoveryCodes are the hashes of the codes that can be used once
+	// instead of a TOTP passcode, if the user has lost their device.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
 	// Secure assets
 
 	// Register token is used on registration to prevent from stealing instances
@@ -100,18 +130,26 @@ type Instance struct {
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
-
-	vfs vfs.VFS
+	// WrappedDataKey is the key used to encrypt the content of the files,
+	// wrapped by the master key of the configuration. It is empty when the
+	// content is not encrypted.
+	WrappedDataKey []byte `json:"data_key,omitempty"`
+
+	vfs    vfs.VFS
+	cipher *vfs.Cipher
+	span   *trace.Span
 }
 
 // Options holds the parameters to create a new instance.
 type Options struct {
-	Domain    string
-	Locale    string
-	DiskQuota int64
-	Apps      []string
-	Dev       bool
-	Settings  couchdb.JSONDoc
+	Domain             string
+	Locale             string
+	DiskQuota          int64
+	TrashRetentionDays int
+	TrashPurgeOnQuota  bool
+	Apps               []string
+	Dev                bool
+	Settings           couchdb.JSONDoc
 }
 
 // DocType implements couchdb.Doc
@@ -143,13 +181,27 @@ func (i *Instance) Logger() *logrus.Entry {
 	return logger.WithDomain(i.Domain)
 }
 
+// Span returns the span of the traced request for which the instance has
+// been loaded, or nil. It implements the trace.Carrier interface, so that the
+// calls to CouchDB made with this instance are traced.
+func (i *Instance) Span() *trace.Span {
+	return i.span
+}
+
+// SetSpan ties the instance to a traced request, or to a job. The instances
+// are loaded for each request, so the span is not shared with other requests.
+func (i *Instance) SetSpan(span *trace.Span) {
+	i.span = span
+}
+
 // VFS returns the storage provider where the binaries for the current instance
 // are persisted
 func (i *Instance) VFS() vfs.VFS {
 	if i.vfs == nil {
 		panic("instance: calling VFS() before makeVFS()")
 	}
-	return i.vfs
+	fs := vfs.WithTrashPurge(i.vfs, i.TrashPurgeOnQuota)
+	return vfs.Traced(vfs.WithQuotaAlerts(fs, i, i.Domain), i.span)
 }
 
 func (i *Instance) makeVFS() error {
@@ -160,16 +212,100 @@ func (i *Instance) makeVFS() error {
 	mutex := lock.ReadWrite(i.Domain)
 	index := vfs.NewCouchdbIndexer(i)
 	disk := vfs.DiskThresholder(i)
-	var err error
+	cipher, err := i.dataCipher()
+	if err != nil {
+		return err
+	}
+	i.cipher = cipher
+	if config.GetConfig().Fs.Deduplication {
+		if cipher != nil {
+			return errors.New("instance: the deduplication can't be used with encrypted files")
+		}
+		var store vfs.BlobStore
+		if store, err = blobStore(fsURL); err != nil {
+			return err
+		}
+		// The files created before the deduplication was enabled are still
+		// in the storage of the instance, with its own lock as it is used
+		// while the lock of the deduplicated VFS is held.
+		var legacy vfs.VFS
+		legacyMutex := lock.ReadWrite(i.Domain + "/legacy")
+		if legacy, err = newVFS(fsURL, index, disk, legacyMutex, nil, i.Domain); err != nil {
+			return err
+		}
+		i.vfs, err = vfsdedup.New(index, disk, mutex, store, legacy, i.Domain)
+		return err
+	}
+	i.vfs, err = newVFS(fsURL, index, disk, mutex, cipher, i.Domain)
+	return err
+}
+
+// newVFS returns the VFS where the content of the files of an instance is
+// stored in its own directory or container.
+func newVFS(fsURL *url.URL, index vfs.Indexer, disk vfs.DiskThresholder, mutex lock.ErrorRWLocker, cipher *vfs.Cipher, domain string) (vfs.VFS, error) {
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(index, disk, mutex, fsURL, i.Domain)
+		return vfsafero.New(index, disk, mutex, cipher, fsURL, domain)
 	case config.SchemeSwift:
-		i.vfs, err = vfsswift.New(index, disk, mutex, i.Domain)
-	default:
-		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
+		return vfsswift.New(index, disk, mutex, cipher, domain)
+	case config.SchemeS3:
+		return vfss3.New(index, disk, mutex, cipher, domain)
 	}
-	return err
+	return nil, fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
+}
+
+// dataCipher returns the cipher for the content of the files of the instance,
+// or nil if it is not encrypted.
+func (i *Instance) dataCipher() (*vfs.Cipher, error) {
+	if len(i.WrappedDataKey) == 0 {
+		return nil, nil
+	}
+	masters := config.GetConfig().Fs.Encryption.MasterKeys()
+	key, err := crypto.UnwrapKey(masters, i.WrappedDataKey)
+	if err != nil {
+		return nil, fmt.Errorf("instance: cannot unwrap the data key: %s", err)
+	}
+	return vfs.NewCipher(key)
+}
+
+// RewrapDataKey wraps the data key of the instance with the current master
+// key, if it was wrapped by a previous one. The content of the files is not
+// re-encrypted, as the data key does not change. It returns true if the
+// instance has been updated.
+func (i *Instance) RewrapDataKey() (bool, error) {
+	enc := config.GetConfig().Fs.Encryption
+	if len(i.WrappedDataKey) == 0 || !enc.Enabled() ||
+		crypto.IsWrappedWith(enc.MasterKey, i.WrappedDataKey) {
+		return false, nil
+	}
+	key, err := crypto.UnwrapKey(enc.MasterKeys(), i.WrappedDataKey)
+	if err != nil {
+		return false, err
+	}
+	wrapped, err := crypto.WrapKey(enc.MasterKey, key)
+	if err != nil {
+		return false, err
+	}
+	i.WrappedDataKey = wrapped
+	if err = Update(i); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// blobStore returns the storage of the content of the files, shared by all
+// the instances, for the deduplicated mode of the VFS.
+func blobStore(fsURL *url.URL) (vfs.BlobStore, error) {
+	switch fsURL.Scheme {
+	case config.SchemeFile, config.SchemeMem:
+		return vfsafero.NewBlobStore(fsURL)
+	case config.SchemeSwift:
+		return vfsswift.NewBlobStore(config.GetSwiftConnection()), nil
+	case config.SchemeS3:
+		c, bucket := config.GetS3Client()
+		return vfss3.NewBlobStore(c, bucket), nil
+	}
+	return nil, fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 }
 
 // AppsCopier returns the application copier associated with the specified
@@ -190,6 +326,9 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 		return apps.NewAferoCopier(baseFS)
 	case config.SchemeSwift:
 		return apps.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+	case config.SchemeS3:
+		c, bucket := config.GetS3Client()
+		return apps.NewS3Copier(c, bucket, appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -206,6 +345,9 @@ func (i *Instance) AppsFileServer() apps.FileServer {
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
 		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Webapp)
+	case config.SchemeS3:
+		c, bucket := config.GetS3Client()
+		return apps.NewS3FileServer(c, bucket, apps.Webapp)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -222,22 +364,28 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
 		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Konnector)
+	case config.SchemeS3:
+		c, bucket := config.GetS3Client()
+		return apps.NewS3FileServer(c, bucket, apps.Konnector)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
 }
 
 // ThumbsFS returns the hidden filesystem for storing the thumbnails of the
-// photos/image
+// photos/image. They are encrypted like the content of the files.
 func (i *Instance) ThumbsFS() vfs.Thumbser {
 	fsURL := config.FsURL()
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.Domain, vfs.ThumbsDirName))
-		return vfsafero.NewThumbsFs(baseFS)
+		return vfsafero.NewThumbsFs(baseFS, i.cipher)
 	case config.SchemeSwift:
-		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain)
+		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain, i.cipher)
+	case config.SchemeS3:
+		c, bucket := config.GetS3Client()
+		return vfss3.NewThumbsFs(c, bucket, i.Domain, i.cipher)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -443,6 +591,8 @@ func Create(opts *Options) (*Instance, error) {
 	i.Locale = locale
 	i.Domain = domain
 	i.BytesDiskQuota = opts.DiskQuota
+	i.TrashRetentionDays = opts.TrashRetentionDays
+	i.TrashPurgeOnQuota = opts.TrashPurgeOnQuota
 	i.Dev = opts.Dev
 	i.IndexViewsVersion = consts.IndexViewsVersion
 
@@ -453,6 +603,12 @@ func Create(opts *Options) (*Instance, error) {
 	i.SessionSecret = crypto.GenerateRandomBytes(SessionSecretLen)
 	i.OAuthSecret = crypto.GenerateRandomBytes(OauthSecretLen)
 	i.CLISecret = crypto.GenerateRandomBytes(OauthSecretLen)
+	if enc := config.GetConfig().Fs.Encryption; enc.Enabled() {
+		key := crypto.GenerateRandomBytes(DataKeyLen)
+		if i.WrappedDataKey, err = crypto.WrapKey(enc.MasterKey, key); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := couchdb.CreateDB(couchdb.GlobalDB, consts.Instances); !couchdb.IsFileExists(err) {
 		if err != nil {
@@ -670,13 +826,18 @@ func Destroy(domain string) error {
 		return err
 	}
 	defer getCache().Revoke(domain)
+	// The VFS is deleted before the databases, as it may need its index to
+	// know the content to delete.
+	if err = i.VFS().Delete(); err != nil {
+		i.Logger().Errorf("Could not delete VFS: %s", err.Error())
+	}
+	if err = search.DeleteIndex(domain); err != nil {
+		i.Logger().Errorf("Could not delete the search index: %s", err.Error())
+	}
 	db := couchdb.SimpleDatabasePrefix(domain)
 	if err = couchdb.DeleteAllDBs(db); err != nil {
 		return err
 	}
-	if err = i.VFS().Delete(); err != nil {
-		i.Logger().Errorf("Could not delete VFS: %s", err.Error())
-	}
 	return couchdb.DeleteDoc(couchdb.GlobalDB, i)
 }
 
@@ -830,7 +991,8 @@ func (i *Instance) PickKey(audience string) ([]byte, error) {
 		return i.SessionSecret, nil
 	case permissions.RefreshTokenAudience,
 		permissions.AccessTokenAudience,
-		permissions.ShareAudience:
+		permissions.ShareAudience,
+		permissions.UnlockedShareAudience:
 		return i.OAuthSecret, nil
 	case permissions.CLIAudience:
 		return i.CLISecret, nil
@@ -3,6 +3,8 @@ package instance_test
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -251,6 +253,58 @@ func TestCheckPassphrase(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestTwoFactor(t *testing.T) {
+	inst, err := instance.Get("test.cozycloud.cc")
+	if !assert.NoError(t, err, "cant fetch instance") {
+		return
+	}
+	assert.False(t, inst.HasTwoFactor())
+	_, err = inst.ConfirmTwoFactor("123456")
+	assert.Equal(t, instance.ErrTwoFactorNotStarted, err)
+
+	uri, err := inst.StartTwoFactor()
+	assert.NoError(t, err)
+	assert.Contains(t, uri, "otpauth://totp/Cozy:test.cozycloud.cc?secret=")
+	secret := inst.TwoFactorPendingSecret
+	counter := crypto.TOTPCounter(time.Now())
+	_, err = inst.ConfirmTwoFactor(crypto.TOTPPasscode(secret, counter+3))
+	assert.Equal(t, instance.ErrInvalidPasscode, err)
+	codes, err := inst.ConfirmTwoFactor(crypto.TOTPPasscode(secret, counter))
+	assert.NoError(t, err)
+	assert.Len(t, codes, instance.RecoveryCodesCount)
+	assert.True(t, inst.HasTwoFactor())
+
+	inst, err = instance.Get("test.cozycloud.cc")
+	assert.NoError(t, err)
+	assert.True(t, inst.HasTwoFactor())
+	assert.Empty(t, inst.TwoFactorPendingSecret)
+
+	// A passcode can't be used twice
+	err = inst.CheckTwoFactor(crypto.TOTPPasscode(secret, counter))
+	assert.Equal(t, instance.ErrInvalidPasscode, err)
+	err = inst.CheckTwoFactor(crypto.TOTPPasscode(secret, counter+1))
+	assert.NoError(t, err)
+
+	// A recovery code can be used once
+	err = inst.CheckTwoFactor(codes[0])
+	assert.NoError(t, err)
+	assert.Len(t, inst.RecoveryCodes, instance.RecoveryCodesCount-1)
+	err = inst.CheckTwoFactor(codes[0])
+	assert.Equal(t, instance.ErrInvalidPasscode, err)
+
+	token, err := inst.BuildTwoFactorToken()
+	assert.NoError(t, err)
+	assert.True(t, inst.ValidateTwoFactorToken(token))
+	assert.False(t, inst.ValidateTwoFactorToken(token+"x"))
+
+	err = inst.DisableTwoFactor([]byte("not-passphrase"), codes[1])
+	assert.Equal(t, instance.ErrInvalidPassphrase, err)
+	err = inst.DisableTwoFactor([]byte("new-passphrase"), codes[1])
+	assert.NoError(t, err)
+	assert.False(t, inst.HasTwoFactor())
+	assert.Empty(t, inst.RecoveryCodes)
+}
+
 func TestRequestPassphraseReset(t *testing.T) {
 	instance.Destroy("test.cozycloud.cc.pass_reset")
 	in, err := instance.Create(&instance.Options{
@@ -368,6 +422,69 @@ func TestInstanceDestroy(t *testing.T) {
 	}
 }
 
+func TestEncryptedInstance(t *testing.T) {
+	enc := &config.GetConfig().Fs.Encryption
+	defer func() { *enc = config.FsEncryption{} }()
+	oldKey := crypto.GenerateRandomBytes(32)
+	enc.MasterKey = oldKey
+
+	i, err := instance.Create(&instance.Options{
+		Domain: "test.cozycloud.cc.encrypted",
+		Locale: "en",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, i.WrappedDataKey)
+
+	content := []byte("This content is encrypted at rest")
+	doc, err := vfs.NewFileDoc("secret.txt", consts.RootDirID, int64(len(content)),
+		nil, "text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := i.VFS().CreateFile(doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = f.Write(content)
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	// The master key is rotated
+	enc.MasterKey = crypto.GenerateRandomBytes(32)
+	enc.PreviousMasterKeys = [][]byte{oldKey}
+	rotated, err := i.RewrapDataKey()
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	rotated, err = i.RewrapDataKey()
+	assert.NoError(t, err)
+	assert.False(t, rotated)
+
+	// The content can still be read without the old master key, with a range
+	enc.PreviousMasterKeys = nil
+	i, err = instance.Get("test.cozycloud.cc.encrypted")
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err = i.VFS().FileByPath("/secret.txt")
+	if !assert.NoError(t, err) {
+		return
+	}
+	req := httptest.NewRequest("GET", "/files/download", nil)
+	req.Header.Set("Range", "bytes=5-11")
+	rec := httptest.NewRecorder()
+	assert.NoError(t, vfs.ServeFileContent(i.VFS(), doc, "", req, rec))
+	assert.Equal(t, 206, rec.Code)
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(body))
+
+	assert.NoError(t, instance.Destroy("test.cozycloud.cc.encrypted"))
+}
+
 func TestTranslate(t *testing.T) {
 	instance.LoadLocale("fr", `
 msgid "english"
@@ -406,6 +523,7 @@ func TestMain(m *testing.M) {
 	instance.Destroy("test.cozycloud.cc")
 	instance.Destroy("test2.cozycloud.cc")
 	instance.Destroy("test.cozycloud.cc.duplicate")
+	instance.Destroy("test.cozycloud.cc.encrypted")
 
 	os.RemoveAll("/usr/local/var/cozy2/")
 
@@ -414,6 +532,7 @@ func TestMain(m *testing.M) {
 	instance.Destroy("test.cozycloud.cc")
 	instance.Destroy("test2.cozycloud.cc")
 	instance.Destroy("test.cozycloud.cc.duplicate")
+	instance.Destroy("test.cozycloud.cc.encrypted")
 
 	os.Exit(res)
 }
@@ -0,0 +1,93 @@
+package instance
+
+import (
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/stack"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	humanize "github.com/dustin/go-humanize"
+)
+
+// QuotaAlertEvent is the document of the realtime event sent when the disk
+// usage crosses a threshold of the quota alerts. It is published on the
+// io.cozy.settings doctype, with the id of the disk-usage settings.
+type QuotaAlertEvent struct {
+	Used      int64 `json:"used,string"`
+	Quota     int64 `json:"quota,string"`
+	Threshold int   `json:"threshold"`
+}
+
+// ID implements the realtime.Doc interface
+func (e *QuotaAlertEvent) ID() string { return consts.DiskUsageID }
+
+// Rev implements the realtime.Doc interface
+func (e *QuotaAlertEvent) Rev() string { return "" }
+
+// DocType implements the realtime.Doc interface
+func (e *QuotaAlertEvent) DocType() string { return consts.Settings }
+
+// QuotaAlertLevel returns the highest threshold of the quota alerts crossed
+// by the disk usage, when it was last checked.
+func (i *Instance) QuotaAlertLevel() int {
+	return i.QuotaAlert
+}
+
+// SetQuotaAlertLevel records the highest threshold of the quota alerts crossed
+// by the disk usage. If it is higher than the previous one, the user is warned
+// by mail and a realtime event is sent.
+func (i *Instance) SetQuotaAlertLevel(level int, usage, quota int64) error {
+	// The check of the disk usage can be delayed, and the instance may have
+	// been updated since it was loaded: it is reloaded before the update.
+	fresh, err := Get(i.Domain)
+	if err != nil {
+		return err
+	}
+	previous := fresh.QuotaAlert
+	i.QuotaAlert = level
+	if level == previous {
+		return nil
+	}
+	fresh.QuotaAlert = level
+	if err = Update(fresh); err != nil {
+		i.QuotaAlert = previous
+		return err
+	}
+	if level <= previous {
+		return nil
+	}
+	realtime.GetHub().Publish(&realtime.Event{
+		Domain: i.Domain,
+		Type:   realtime.EventUpdate,
+		Doc:    &QuotaAlertEvent{Used: usage, Quota: quota, Threshold: level},
+	})
+	return i.sendQuotaAlertMail(level, usage, quota)
+}
+
+func (i *Instance) sendQuotaAlertMail(level int, usage, quota int64) error {
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, map[string]interface{}{
+		"mode":          "noreply",
+		"subject":       i.Translate("Mail Quota alert"),
+		"template_name": "quota_alert_" + i.Locale,
+		"template_values": map[string]string{
+			"BaseURL":   i.PageURL("/", nil),
+			"DriveLink": i.SubDomain(consts.DriveSlug).String(),
+			"Threshold": strconv.Itoa(level),
+			"Used":      humanize.Bytes(uint64(usage)),
+			"Quota":     humanize.Bytes(uint64(quota)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = stack.GetBroker().PushJob(&jobs.JobRequest{
+		Domain:     i.Domain,
+		WorkerType: "sendmail",
+		Message:    msg,
+	})
+	return err
+}
+
+var _ vfs.QuotaAlerter = &Instance{}
@@ -1,16 +1,85 @@
 package instance
 
-import "github.com/cozy/cozy-stack/pkg/scheduler"
+import (
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/scheduler"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/stack"
+)
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(domain string) []scheduler.TriggerInfos {
-	// Create/update/remove thumbnails when an image is created/updated/removed
-	return []scheduler.TriggerInfos{
+	// Create/update/remove thumbnails when an image, a video or a PDF is
+	// created/updated/removed
+	triggers := []scheduler.TriggerInfos{
 		{
 			Domain:     domain,
 			Type:       "@event",
 			WorkerType: "thumbnail",
-			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image,video:class",
 		},
+		{
+			Domain:     domain,
+			Type:       "@event",
+			WorkerType: "thumbnail",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:application/pdf:mime",
+		},
+		// Destroy the expired items of the trash, once a day
+		{
+			Domain:     domain,
+			Type:       "@every",
+			WorkerType: "trash",
+			Arguments:  "24h",
+		},
+	}
+	// Update the full-text search index when a document is changed
+	for _, doctype := range search.Doctypes() {
+		msg, _ := jobs.NewMessage(jobs.JSONEncoding, map[string]string{"doctype": doctype})
+		triggers = append(triggers, scheduler.TriggerInfos{
+			Domain:     domain,
+			Type:       "@event",
+			WorkerType: "index",
+			Arguments:  doctype + ":CREATED,UPDATED,DELETED",
+			Message:    msg,
+		})
+	}
+	return triggers
+}
+
+// AddMissingTriggers adds to the instance the triggers of Triggers that it
+// does not have, like for the instances created before a feature relying on
+// a trigger was added. It returns the number of triggers added.
+func (i *Instance) AddMissingTriggers() (int, error) {
+	sched := stack.GetScheduler()
+	existing, err := sched.GetAll(i.Domain)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, trigger := range Triggers(i.Domain) {
+		infos := trigger
+		if hasTrigger(existing, &infos) {
+			continue
+		}
+		t, err := scheduler.NewTrigger(&infos)
+		if err != nil {
+			return added, err
+		}
+		if err = sched.Add(t); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+func hasTrigger(triggers []scheduler.Trigger, infos *scheduler.TriggerInfos) bool {
+	for _, t := range triggers {
+		other := t.Infos()
+		if other.Type == infos.Type && other.WorkerType == infos.WorkerType &&
+			other.Arguments == infos.Arguments {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,175 @@
+package instance
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// RecoveryCodesCount is the number of recovery codes generated when the
+// two-factor authentication is enabled
+const RecoveryCodesCount = 10
+
+// recoveryCodeLen is the number of random bytes of a recovery code
+const recoveryCodeLen = 6
+
+// TwoFactorTokenMaxAge is the number of seconds the user has to type their
+// passcode after having entered their passphrase
+const TwoFactorTokenMaxAge = 5 * 60
+
+// totpIssuer is the name of the service shown by the authenticator apps
+const totpIssuer = "Cozy"
+
+var (
+	// ErrTwoFactorEnabled is returned when trying to enrol while the
+	// two-factor authentication is already enabled
+	ErrTwoFactorEnabled = errors.New("Two-factor authentication is already enabled")
+	// ErrTwoFactorDisabled is returned when the two-factor authentication is
+	// required but not enabled
+	ErrTwoFactorDisabled = errors.New("Two-factor authentication is not enabled")
+	// ErrTwoFactorNotStarted is returned when trying to confirm an enrolment
+	// that has not been started
+	ErrTwoFactorNotStarted = errors.New("Two-factor authentication enrolment has not been started")
+	// ErrInvalidPasscode is returned when the passcode or recovery code is
+	// invalid
+	ErrInvalidPasscode = errors.New("Invalid two-factor passcode")
+)
+
+// HasTwoFactor returns true if the two-factor authentication is enabled for
+// the instance
+func (i *Instance) HasTwoFactor() bool {
+	return len(i.TwoFactorSecret) > 0
+}
+
+// StartTwoFactor generates a new TOTP secret for the enrolment of the
+// two-factor authentication. It returns the otpauth:// URI to show to the
+// user, usually as a QR code. The two-factor authentication is enabled only
+// when the user confirms it with a first passcode.
+func (i *Instance) StartTwoFactor() (string, error) {
+	if i.HasTwoFactor() {
+		return "", ErrTwoFactorEnabled
+	}
+	i.TwoFactorPendingSecret = crypto.GenerateTOTPSecret()
+	if err := Update(i); err != nil {
+		return "", err
+	}
+	return crypto.TOTPURI(totpIssuer, i.Domain, i.TwoFactorPendingSecret), nil
+}
+
+// ConfirmTwoFactor enables the two-factor authentication if the passcode
+// matches the secret of the enrolment. It returns the recovery codes, that
+// are shown only once to the user.
+func (i *Instance) ConfirmTwoFactor(passcode string) ([]string, error) {
+	if i.HasTwoFactor() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if len(i.TwoFactorPendingSecret) == 0 {
+		return nil, ErrTwoFactorNotStarted
+	}
+	counter, ok := crypto.ValidateTOTP(i.TwoFactorPendingSecret, passcode, time.Now())
+	if !ok {
+		return nil, ErrInvalidPasscode
+	}
+	codes := make([]string, RecoveryCodesCount)
+	hashes := make([]string, RecoveryCodesCount)
+	for j := range codes {
+		codes[j] = hex.EncodeToString(crypto.GenerateRandomBytes(recoveryCodeLen))
+		hashes[j] = hashRecoveryCode(codes[j])
+	}
+	i.TwoFactorSecret = i.TwoFactorPendingSecret
+	i.TwoFactorPendingSecret = nil
+	i.TwoFactorCounter = counter
+	i.RecoveryCodes = hashes
+	if err := Update(i); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor disables the two-factor authentication. Both the
+// passphrase and a passcode (or a recovery code) are required.
+func (i *Instance) DisableTwoFactor(passphrase []byte, passcode string) error {
+	if !i.HasTwoFactor() {
+		return ErrTwoFactorDisabled
+	}
+	if err := i.CheckPassphrase(passphrase); err != nil {
+		return ErrInvalidPassphrase
+	}
+	if err := i.CheckTwoFactor(passcode); err != nil {
+		return err
+	}
+	i.TwoFactorSecret = nil
+	i.TwoFactorPendingSecret = nil
+	i.TwoFactorCounter = 0
+	i.RecoveryCodes = nil
+	return Update(i)
+}
+
+// CheckTwoFactor checks the second factor of the login: it can be a TOTP
+// passcode that has not already been used, or one of the recovery codes, that
+// is then removed.
+func (i *Instance) CheckTwoFactor(passcode string) error {
+	if !i.HasTwoFactor() {
+		return ErrTwoFactorDisabled
+	}
+	if counter, ok := crypto.ValidateTOTP(i.TwoFactorSecret, passcode, time.Now()); ok {
+		if counter <= i.TwoFactorCounter {
+			return ErrInvalidPasscode
+		}
+		i.TwoFactorCounter = counter
+		return Update(i)
+	}
+	hash := []byte(hashRecoveryCode(passcode))
+	for j, h := range i.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			codes := make([]string, 0, len(i.RecoveryCodes)-1)
+			codes = append(codes, i.RecoveryCodes[:j]...)
+			i.RecoveryCodes = append(codes, i.RecoveryCodes[j+1:]...)
+			return Update(i)
+		}
+	}
+	return ErrInvalidPasscode
+}
+
+// hashRecoveryCode returns the hash of a recovery code, as kept in the
+// instance. The codes are random, so a simple hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// BuildTwoFactorToken returns a token that proves that the passphrase has
+// been checked. It is given back with the passcode in the second step of the
+// login, and is valid for TwoFactorTokenMaxAge seconds.
+func (i *Instance) BuildTwoFactorToken() (string, error) {
+	token, err := crypto.EncodeAuthMessage(twoFactorMACConfig(i), []byte(i.Domain))
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// ValidateTwoFactorToken returns true if the token has been built by
+// BuildTwoFactorToken for this instance, and has not expired.
+func (i *Instance) ValidateTwoFactorToken(token string) bool {
+	value, err := crypto.DecodeAuthMessage(twoFactorMACConfig(i), []byte(token))
+	return err == nil && string(value) == i.Domain
+}
+
+// twoFactorMACConfig returns the options to authenticate the token of the
+// second step of the login. The session secret is used as key, so the tokens
+// are invalidated when the passphrase is changed.
+func twoFactorMACConfig(i *Instance) *crypto.MACConfig {
+	return &crypto.MACConfig{
+		Name:   "two_factor",
+		Key:    i.SessionSecret,
+		MaxAge: TwoFactorTokenMaxAge,
+		MaxLen: 256,
+	}
+}
@@ -19,6 +19,11 @@ const (
 	Done = "done"
 	// Errored state
 	Errored = "errored"
+	// Cancelled state
+	Cancelled = "cancelled"
+	// DeadLetter state, for the jobs that have failed after all their
+	// attempts
+	DeadLetter = "dead_letter"
 )
 
 const (
@@ -31,6 +36,15 @@ const (
 	WorkerType = "worker"
 )
 
+const (
+	// MinPriority is the lowest priority of a job
+	MinPriority = 1
+	// MaxPriority is the highest priority of a job
+	MaxPriority = 100
+	// DefaultPriority is the priority of the jobs pushed without one
+	DefaultPriority = 50
+)
+
 type (
 	// Broker interface is used to represent a job broker associated to a
 	// particular domain. A broker can be used to create jobs that are pushed in
@@ -46,6 +60,28 @@ type (
 
 		// GetJobsInfos returns the informations about a job.
 		GetJobInfos(domain, jobID string) (*JobInfos, error)
+
+		// ListJobs returns the jobs of a domain, from the most recent to the
+		// oldest. They can be filtered by worker type and state, when these
+		// parameters are not empty. The cursor is used for the pagination and
+		// is modified in place.
+		ListJobs(domain, workerType string, state State, cursor couchdb.Cursor) ([]*JobInfos, error)
+
+		// CancelJob cancels a queued or running job. A running job is
+		// cancelled via the context given to its worker function.
+		CancelJob(domain, jobID string) (*JobInfos, error)
+
+		// PurgeJobs removes the finished jobs of a domain that have been
+		// queued before the given date. It returns the number of removed jobs.
+		// The dead letters are kept.
+		PurgeJobs(domain string, before time.Time) (int, error)
+
+		// ReplayJob pushes again a dead-lettered job in its queue. The errors
+		// of the previous attempts are kept.
+		ReplayJob(domain, jobID string) (*JobInfos, error)
+
+		// DiscardJob removes a dead-lettered job.
+		DiscardJob(domain, jobID string) error
 	}
 
 	// State represent the state of a job.
@@ -70,18 +106,34 @@ type (
 		QueuedAt   time.Time   `json:"queued_at"`
 		StartedAt  time.Time   `json:"started_at,omitempty"`
 		Error      string      `json:"error,omitempty"`
+		Errors     []JobError  `json:"errors,omitempty"`
+		// TraceParent links the job to the traced request that has pushed it
+		TraceParent string `json:"trace_parent,omitempty"`
+	}
+
+	// JobError is the error of an attempt to execute a job
+	JobError struct {
+		Attempt int       `json:"attempt"`
+		Error   string    `json:"error"`
+		At      time.Time `json:"at"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
 	JobRequest struct {
-		Domain     string
-		WorkerType string
-		Message    *Message
-		Options    *JobOptions
+		Domain      string
+		WorkerType  string
+		Message     *Message
+		Options     *JobOptions
+		TraceParent string
 	}
 
 	// JobOptions struct contains the execution properties of the jobs.
 	JobOptions struct {
+		// Priority is a number between MinPriority and MaxPriority: inside
+		// the queue of a domain, the jobs with a higher priority are executed
+		// first, and the domains with jobs of higher priority are served more
+		// often.
+		Priority     int           `json:"priority"`
 		MaxExecCount int           `json:"max_exec_count"`
 		MaxExecTime  time.Duration `json:"max_exec_time"`
 		Timeout      time.Duration `json:"timeout"`
@@ -118,6 +170,29 @@ func (ji *JobInfos) Valid(key, value string) bool {
 	return false
 }
 
+// Priority returns the priority of the job, in the bounds of MinPriority and
+// MaxPriority
+func (ji *JobInfos) Priority() int {
+	if ji.Options == nil || ji.Options.Priority == 0 {
+		return DefaultPriority
+	}
+	p := ji.Options.Priority
+	if p < MinPriority {
+		return MinPriority
+	}
+	if p > MaxPriority {
+		return MaxPriority
+	}
+	return p
+}
+
+// Finished returns true if the job is done, errored, cancelled or
+// dead-lettered
+func (ji *JobInfos) Finished() bool {
+	return ji.State == Done || ji.State == Errored || ji.State == Cancelled ||
+		ji.State == DeadLetter
+}
+
 // ID implements the permissions.Validable interface
 func (jr *JobRequest) ID() string { return "" }
 
@@ -136,12 +211,13 @@ func (jr *JobRequest) Valid(key, value string) bool {
 // NewJobInfos creates a new JobInfos instance from a job request.
 func NewJobInfos(req *JobRequest) *JobInfos {
 	return &JobInfos{
-		Domain:     req.Domain,
-		WorkerType: req.WorkerType,
-		Message:    req.Message,
-		Options:    req.Options,
-		State:      Queued,
-		QueuedAt:   time.Now(),
+		Domain:      req.Domain,
+		WorkerType:  req.WorkerType,
+		Message:     req.Message,
+		Options:     req.Options,
+		State:       Queued,
+		QueuedAt:    time.Now(),
+		TraceParent: req.TraceParent,
 	}
 }
 
@@ -177,13 +253,16 @@ func (m *Message) Unmarshal(msg interface{}) error {
 
 func (w *WorkerConfig) clone() *WorkerConfig {
 	return &WorkerConfig{
-		WorkerFunc:   w.WorkerFunc,
-		WorkerCommit: w.WorkerCommit,
-		Concurrency:  w.Concurrency,
-		MaxExecCount: w.MaxExecCount,
-		MaxExecTime:  w.MaxExecTime,
-		Timeout:      w.Timeout,
-		RetryDelay:   w.RetryDelay,
+		WorkerFunc:        w.WorkerFunc,
+		WorkerCommit:      w.WorkerCommit,
+		Concurrency:       w.Concurrency,
+		DomainConcurrency: w.DomainConcurrency,
+		MaxExecCount:      w.MaxExecCount,
+		MaxExecTime:       w.MaxExecTime,
+		Timeout:           w.Timeout,
+		RetryDelay:        w.RetryDelay,
+		MaxRetryDelay:     w.MaxRetryDelay,
+		RetryJitter:       w.RetryJitter,
 	}
 }
 
@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// DeadLetter is a reference to a job that has failed after all its attempts.
+// The jobs can be stored in the database of their domain, so the references
+// are kept in the global database of the jobs, to list the dead letters of
+// all the domains.
+type DeadLetter struct {
+	DocID      string    `json:"_id,omitempty"`
+	DocRev     string    `json:"_rev,omitempty"`
+	Domain     string    `json:"domain"`
+	WorkerType string    `json:"worker"`
+	Error      string    `json:"error"`
+	DeadAt     time.Time `json:"dead_at"`
+}
+
+// ID implements the couchdb.Doc interface
+func (d *DeadLetter) ID() string { return d.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (d *DeadLetter) Rev() string { return d.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (d *DeadLetter) DocType() string { return consts.JobDeadLetters }
+
+// Clone implements the couchdb.Doc interface
+func (d *DeadLetter) Clone() couchdb.Doc {
+	cloned := *d
+	return &cloned
+}
+
+// SetID implements the couchdb.Doc interface
+func (d *DeadLetter) SetID(id string) { d.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (d *DeadLetter) SetRev(rev string) { d.DocRev = rev }
+
+type byDeadAt []*DeadLetter
+
+func (d byDeadAt) Len() int      { return len(d) }
+func (d byDeadAt) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byDeadAt) Less(i, j int) bool {
+	if !d[i].DeadAt.Equal(d[j].DeadAt) {
+		return d[i].DeadAt.Before(d[j].DeadAt)
+	}
+	return d[i].DocID < d[j].DocID
+}
+
+// cursor returns the position of the dead letter in the list, as the date
+// when the job was dead-lettered and its identifier.
+func (d *DeadLetter) cursor() string {
+	return strconv.FormatInt(d.DeadAt.UnixNano(), 10) + "_" + d.DocID
+}
+
+// before returns true if the dead letter comes before the cursor in the list
+func (d *DeadLetter) before(cursor string) bool {
+	parts := strings.SplitN(cursor, "_", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	nano, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	if at := d.DeadAt.UnixNano(); at != nano {
+		return at < nano
+	}
+	return d.DocID <= parts[1]
+}
+
+// GetDeadLetter returns the reference to a dead-lettered job
+func GetDeadLetter(jobID string) (*DeadLetter, error) {
+	dead := &DeadLetter{}
+	err := couchdb.GetDoc(couchdb.GlobalJobsDB, consts.JobDeadLetters, jobID, dead)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrNotFoundJob
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dead, nil
+}
+
+// ListDeadLetters returns a page of the references to the dead-lettered
+// jobs, from the oldest to the most recent. The domain and the worker type are
+// optional filters. At most limit references are returned (0 for no limit),
+// after the given cursor, and the cursor of the next page is returned, or an
+// empty string for the last page.
+func ListDeadLetters(domain, workerType string, limit int, cursor string) ([]*DeadLetter, string, error) {
+	var all []*DeadLetter
+	req := &couchdb.AllDocsRequest{}
+	err := couchdb.GetAllDocs(couchdb.GlobalJobsDB, consts.JobDeadLetters, req, &all)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, "", err
+	}
+	deads := make([]*DeadLetter, 0, len(all))
+	for _, dead := range all {
+		if domain != "" && dead.Domain != domain {
+			continue
+		}
+		if workerType != "" && dead.WorkerType != workerType {
+			continue
+		}
+		if cursor != "" && dead.before(cursor) {
+			continue
+		}
+		deads = append(deads, dead)
+	}
+	sort.Sort(byDeadAt(deads))
+	if limit <= 0 || len(deads) <= limit {
+		return deads, "", nil
+	}
+	deads = deads[:limit]
+	return deads, deads[limit-1].cursor(), nil
+}
+
+// addDeadLetter adds the reference to a job that has been dead-lettered
+func addDeadLetter(job *JobInfos) error {
+	dead := &DeadLetter{
+		DocID:      job.ID(),
+		Domain:     job.Domain,
+		WorkerType: job.WorkerType,
+		Error:      job.Error,
+		DeadAt:     time.Now(),
+	}
+	err := couchdb.CreateNamedDocWithDB(couchdb.GlobalJobsDB, dead)
+	if couchdb.IsConflictError(err) {
+		var old *DeadLetter
+		if old, err = GetDeadLetter(job.ID()); err != nil {
+			return err
+		}
+		dead.SetRev(old.Rev())
+		err = couchdb.UpdateDoc(couchdb.GlobalJobsDB, dead)
+	}
+	return err
+}
+
+// removeDeadLetter removes the reference to a dead-lettered job, if any
+func removeDeadLetter(jobID string) error {
+	dead, err := GetDeadLetter(jobID)
+	if err == ErrNotFoundJob {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(couchdb.GlobalJobsDB, dead)
+}
+
+// requeue resets the state of a dead-lettered job, so that it can be pushed
+// again in its queue. The errors of the previous attempts are kept.
+func (c *couchStorage) requeue(job *JobInfos) error {
+	if job.State != DeadLetter {
+		return ErrNotDeadLetter
+	}
+	job.State = Queued
+	job.QueuedAt = time.Now()
+	job.StartedAt = time.Time{}
+	job.Error = ""
+	if err := c.Update(job); err != nil {
+		return err
+	}
+	return removeDeadLetter(job.ID())
+}
+
+// discard removes a dead-lettered job, with its logs and its reference
+func (c *couchStorage) discard(job *JobInfos) error {
+	if job.State != DeadLetter {
+		return ErrNotDeadLetter
+	}
+	if err := couchdb.DeleteDoc(c.db, job); err != nil {
+		return err
+	}
+	if err := deleteLogs(job.Domain, job.ID()); err != nil {
+		return err
+	}
+	return removeDeadLetter(job.ID())
+}
@@ -11,4 +11,13 @@ var (
 	ErrUnknownWorker = errors.New("jobs: could not find worker")
 	// ErrUnknownMessageType is used for an unknown message encoding type
 	ErrUnknownMessageType = errors.New("jobs: unknown message encoding type")
+	// ErrNotDeadLetter is used when trying to replay or discard a job that is
+	// not dead-lettered
+	ErrNotDeadLetter = errors.New("jobs: job is not dead-lettered")
+	// ErrJobFinished is used when trying to cancel a job that is already
+	// finished
+	ErrJobFinished = errors.New("jobs: job is already finished")
+	// ErrJobCancelled is used when a job has been cancelled during its
+	// execution
+	ErrJobCancelled = errors.New("jobs: job has been cancelled")
 )
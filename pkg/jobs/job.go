@@ -1,6 +1,7 @@
 package jobs
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -20,6 +21,9 @@ type (
 		// No mutex, a Job is expected to be used from only one goroutine at a time
 		infos   *JobInfos
 		storage *couchStorage
+		// done is called by the worker when the job is finished, to release
+		// the slot of the domain in the broker
+		done func()
 	}
 )
 
@@ -45,6 +49,105 @@ func (c *couchStorage) Update(job *JobInfos) error {
 	return couchdb.UpdateDoc(c.db, job)
 }
 
+// execJobsView executes the view of the jobs, and defines it if it is missing
+func (c *couchStorage) execJobsView(req *couchdb.ViewRequest) (*couchdb.ViewResponse, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.JobsByDomainView, req, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return &res, nil
+	}
+	if couchdb.IsNotFoundError(err) {
+		views := []*couchdb.View{consts.JobsByDomainView}
+		if err = couchdb.DefineViews(c.db, views); err != nil {
+			return nil, err
+		}
+		err = couchdb.ExecView(c.db, consts.JobsByDomainView, req, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func jobsFromRows(rows []*couchdb.ViewResponseRow) ([]*JobInfos, error) {
+	jobs := make([]*JobInfos, 0, len(rows))
+	for _, row := range rows {
+		if row.Doc == nil {
+			continue
+		}
+		var job JobInfos
+		if err := json.Unmarshal(*row.Doc, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+func (c *couchStorage) List(domain, workerType string, state State, cursor couchdb.Cursor) ([]*JobInfos, error) {
+	req := &couchdb.ViewRequest{
+		StartKey:    []string{domain, workerType, string(state), couchdb.MaxString},
+		EndKey:      []string{domain, workerType, string(state)},
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+	res, err := c.execJobsView(req)
+	if err != nil {
+		return nil, err
+	}
+	cursor.UpdateFrom(res)
+	return jobsFromRows(res.Rows)
+}
+
+// purgeBatchSize is the number of jobs fetched at once for a purge
+const purgeBatchSize = 100
+
+func (c *couchStorage) Purge(domain string, before time.Time) (int, error) {
+	date, err := json.Marshal(before)
+	if err != nil {
+		return 0, err
+	}
+	// The dates are serialized as JSON strings in the view keys
+	var until string
+	if err = json.Unmarshal(date, &until); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, state := range []State{Done, Errored, Cancelled} {
+		for {
+			req := &couchdb.ViewRequest{
+				StartKey:    []string{domain, "", string(state)},
+				EndKey:      []string{domain, "", string(state), until},
+				Limit:       purgeBatchSize,
+				IncludeDocs: true,
+			}
+			res, err := c.execJobsView(req)
+			if err != nil {
+				return count, err
+			}
+			jobs, err := jobsFromRows(res.Rows)
+			if err != nil {
+				return count, err
+			}
+			for _, job := range jobs {
+				if err = couchdb.DeleteDoc(c.db, job); err != nil {
+					return count, err
+				}
+				if err = deleteLogs(job.Domain, job.ID()); err != nil {
+					return count, err
+				}
+				count++
+			}
+			if len(res.Rows) < purgeBatchSize {
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
 // Domain returns the associated domain
 func (j *Job) Domain() string {
 	return j.infos.Domain
@@ -55,6 +158,13 @@ func (j *Job) Infos() *JobInfos {
 	return j.infos
 }
 
+// release is called when the worker has finished with the job
+func (j *Job) release() {
+	if j.done != nil {
+		j.done()
+	}
+}
+
 // Logger returns a logger associated with the job domain
 func (j *Job) Logger() *logrus.Entry {
 	return logger.WithDomain(j.infos.Domain)
@@ -81,15 +191,35 @@ func (j *Job) Ack() error {
 	return j.persist()
 }
 
-// Nack sets the job infos state to Errored, set the specified error has the
-// error field and sends the new job infos on the channel.
-func (j *Job) Nack(err error) error {
+// Nack sets the specified error has the error field and keeps the errors of
+// the attempts. If the job has failed after all its attempts, its state is
+// set to DeadLetter and it is added to the dead letters. Else, its state is
+// set to Errored.
+func (j *Job) Nack(err error, attempts []JobError, deadLetter bool) error {
 	job := *j.infos
 	j.Logger().Debugf("[jobs] nack %s ", job.ID())
 	job.State = Errored
+	if deadLetter {
+		job.State = DeadLetter
+	}
 	job.Error = err.Error()
+	errors := make([]JobError, len(job.Errors), len(job.Errors)+len(attempts))
+	copy(errors, job.Errors)
+	for _, attempt := range attempts {
+		// The attempts are numbered from the first execution of the job,
+		// including the executions before a replay
+		attempt.Attempt = len(errors) + 1
+		errors = append(errors, attempt)
+	}
+	job.Errors = errors
 	j.infos = &job
-	return j.persist()
+	if err := j.persist(); err != nil {
+		return err
+	}
+	if !deadLetter {
+		return nil
+	}
+	return addDeadLetter(&job)
 }
 
 func (j *Job) persist() error {
@@ -0,0 +1,252 @@
+package jobs
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// MaxLogsSize is the maximal number of bytes of messages kept in the logs
+	// of a job. The next lines are dropped and the logs are marked as
+	// truncated.
+	MaxLogsSize = 256 * 1024
+	// MaxLogLineSize is the maximal size of the message of a line of logs
+	MaxLogLineSize = 4 * 1024
+	// LogsRetention is the duration the logs of a job are kept after their
+	// creation
+	LogsRetention = 30 * 24 * time.Hour
+)
+
+// LogLine is an entry of the logs of a job. The lines are also published on
+// the realtime hub, with the io.cozy.jobs.logs doctype, when they are written.
+type LogLine struct {
+	JobID   string    `json:"job_id"`
+	N       int       `json:"n"`
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// ID implements the realtime.Doc interface
+func (l *LogLine) ID() string { return l.JobID }
+
+// Rev implements the realtime.Doc interface
+func (l *LogLine) Rev() string { return "" }
+
+// DocType implements the realtime.Doc interface
+func (l *LogLine) DocType() string { return consts.JobLogs }
+
+// JobLogs is the document where the logs of a job are persisted. It has the
+// same identifier as the job, and is stored in the database of the domain.
+type JobLogs struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	Domain    string    `json:"domain"`
+	Lines     []LogLine `json:"lines"`
+	Size      int       `json:"size"`
+	Truncated bool      `json:"truncated"`
+	Finished  bool      `json:"finished"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ID implements the couchdb.Doc interface
+func (jl *JobLogs) ID() string { return jl.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (jl *JobLogs) Rev() string { return jl.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (jl *JobLogs) DocType() string { return consts.JobLogs }
+
+// Clone implements the couchdb.Doc interface
+func (jl *JobLogs) Clone() couchdb.Doc {
+	cloned := *jl
+	cloned.Lines = make([]LogLine, len(jl.Lines))
+	copy(cloned.Lines, jl.Lines)
+	return &cloned
+}
+
+// SetID implements the couchdb.Doc interface
+func (jl *JobLogs) SetID(id string) { jl.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (jl *JobLogs) SetRev(rev string) { jl.DocRev = rev }
+
+// Expired returns true if the logs are no longer kept
+func (jl *JobLogs) Expired(now time.Time) bool {
+	return now.After(jl.ExpiresAt)
+}
+
+// GetLogs returns the logs of a job. If the job has not logged anything yet,
+// or if its logs have expired, the returned logs have no lines.
+func GetLogs(domain, jobID string) (*JobLogs, error) {
+	db := couchdb.SimpleDatabasePrefix(domain)
+	logs := &JobLogs{}
+	err := couchdb.GetDoc(db, consts.JobLogs, jobID, logs)
+	if err == nil && logs.Expired(time.Now()) {
+		err = couchdb.DeleteDoc(db, logs)
+		logs = &JobLogs{}
+	} else if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		err = nil
+		logs = &JobLogs{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if logs.Lines == nil {
+		logs.DocID = jobID
+		logs.Domain = domain
+		logs.Lines = []LogLine{}
+	}
+	return logs, nil
+}
+
+// deleteLogs removes the logs of a job, if any
+func deleteLogs(domain, jobID string) error {
+	db := couchdb.SimpleDatabasePrefix(domain)
+	logs := &JobLogs{}
+	err := couchdb.GetDoc(db, consts.JobLogs, jobID, logs)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(db, logs)
+}
+
+// Logger returns the logger to use in a worker function. The entries are
+// written in the logs of the domain, like with logger.WithDomain, and the
+// entries with the info level or above are also kept in the logs of the job.
+func Logger(ctx context.Context) *logrus.Entry {
+	if sink, ok := ctx.Value(contextLogsKey).(*logSink); ok {
+		return sink.entry
+	}
+	domain, _ := ctx.Value(ContextDomainKey).(string)
+	return logger.WithDomain(domain)
+}
+
+// logSink is a logrus hook that keeps the lines of logs of a job in memory,
+// until they are flushed in CouchDB.
+type logSink struct {
+	mu    sync.Mutex
+	db    couchdb.Database
+	entry *logrus.Entry
+	logs  *JobLogs
+	dirty bool
+}
+
+func newLogSink(domain, jobID string) *logSink {
+	now := time.Now()
+	sink := &logSink{
+		db: couchdb.SimpleDatabasePrefix(domain),
+		logs: &JobLogs{
+			DocID:     jobID,
+			Domain:    domain,
+			Lines:     []LogLine{},
+			CreatedAt: now,
+			ExpiresAt: now.Add(LogsRetention),
+		},
+	}
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	l.Level = logrus.DebugLevel
+	l.Hooks.Add(sink)
+	sink.entry = l.WithField("job_id", jobID)
+	return sink
+}
+
+// Levels implements the logrus.Hook interface
+func (s *logSink) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements the logrus.Hook interface. The entry is forwarded to the
+// logger of the domain, and kept if its level is info or above.
+func (s *logSink) Fire(entry *logrus.Entry) error {
+	forward := logger.WithDomain(s.logs.Domain).WithFields(entry.Data)
+	switch entry.Level {
+	case logrus.DebugLevel:
+		forward.Debug(entry.Message)
+	case logrus.InfoLevel:
+		forward.Info(entry.Message)
+	case logrus.WarnLevel:
+		forward.Warn(entry.Message)
+	default:
+		// The fatal and panic levels are not forwarded as is, to not exit
+		// the process
+		forward.Error(entry.Message)
+	}
+	if entry.Level > logrus.InfoLevel {
+		return nil
+	}
+
+	msg := entry.Message
+	if len(msg) > MaxLogLineSize {
+		msg = msg[:MaxLogLineSize]
+	}
+
+	s.mu.Lock()
+	if s.logs.Truncated || s.logs.Size+len(msg) > MaxLogsSize {
+		s.logs.Truncated = true
+		s.dirty = true
+		s.mu.Unlock()
+		return nil
+	}
+	line := LogLine{
+		JobID:   s.logs.DocID,
+		N:       len(s.logs.Lines) + 1,
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: msg,
+	}
+	s.logs.Lines = append(s.logs.Lines, line)
+	s.logs.Size += len(msg)
+	s.dirty = true
+	s.mu.Unlock()
+
+	realtime.GetHub().Publish(&realtime.Event{
+		Domain: s.logs.Domain,
+		Type:   realtime.EventCreate,
+		Doc:    &line,
+	})
+	return nil
+}
+
+// flush persists the lines of logs received since the last flush
+func (s *logSink) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	var err error
+	if s.logs.Rev() == "" {
+		err = couchdb.CreateNamedDocWithDB(s.db, s.logs)
+	} else {
+		err = couchdb.UpdateDoc(s.db, s.logs)
+	}
+	if err == nil {
+		s.dirty = false
+	}
+	return err
+}
+
+// close marks the logs as finished and persists them, so that the clients
+// that tail them know that no more lines will come.
+func (s *logSink) close() error {
+	s.mu.Lock()
+	s.logs.Finished = true
+	s.dirty = true
+	s.mu.Unlock()
+	return s.flush()
+}
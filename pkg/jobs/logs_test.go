@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogSink(t *testing.T) {
+	oldMax := MaxLogsSize
+	MaxLogsSize = 20
+	defer func() { MaxLogsSize = oldMax }()
+
+	sink := newLogSink("cozy.tools:8080", "job-logs")
+	ctx := context.WithValue(NewWorkerContext("cozy.tools:8080", "logs/0"), contextLogsKey, sink)
+	log := Logger(ctx)
+	log.Infof("first %d", 1)
+	log.Debugf("debug lines are not kept")
+	log.Errorf("second %d", 2)
+	log.Warnf("this line is too long to be kept")
+	log.Infof("third")
+
+	logs := sink.logs
+	assert.True(t, sink.dirty)
+	assert.True(t, logs.Truncated)
+	if assert.Len(t, logs.Lines, 2) {
+		assert.Equal(t, "job-logs", logs.Lines[0].JobID)
+		assert.Equal(t, 1, logs.Lines[0].N)
+		assert.Equal(t, "info", logs.Lines[0].Level)
+		assert.Equal(t, "first 1", logs.Lines[0].Message)
+		assert.Equal(t, 2, logs.Lines[1].N)
+		assert.Equal(t, "error", logs.Lines[1].Level)
+		assert.Equal(t, "second 2", logs.Lines[1].Message)
+	}
+	assert.Equal(t, 15, logs.Size)
+
+	MaxLogsSize = oldMax
+	sink = newLogSink("cozy.tools:8080", "job-long-line")
+	ctx = context.WithValue(ctx, contextLogsKey, sink)
+	Logger(ctx).Info(strings.Repeat("a", MaxLogLineSize+10))
+	if assert.Len(t, sink.logs.Lines, 1) {
+		assert.Len(t, sink.logs.Lines[0].Message, MaxLogLineSize)
+	}
+
+	entry := Logger(NewWorkerContext("cozy.tools:8080", "logs/0"))
+	assert.Equal(t, "cozy.tools:8080", entry.Data["domain"])
+}
@@ -3,19 +3,36 @@ package jobs
 import (
 	"container/list"
 	"sync"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 )
 
 type (
 	// memQueue is a queue in-memory implementation of the Queue interface.
+	// The jobs are kept in a queue per domain, sorted by priority, and the
+	// domains are served with a weighted round-robin.
 	memQueue struct {
 		MaxCapacity int
 		Jobs        chan Job
 
-		list *list.List
-		run  bool
-		jmu  sync.RWMutex
+		domainConcurrency int
+		domains           []*domainQueue
+		running           map[string]int
+		size              int
+		run               bool
+		jmu               sync.RWMutex
+	}
+
+	// domainQueue contains the queued jobs of a domain, from the highest
+	// priority to the lowest, and in the order of arrival for the same
+	// priority.
+	domainQueue struct {
+		domain string
+		jobs   *list.List
+		// current is the current weight of the domain for the smooth
+		// weighted round-robin
+		current int
 	}
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
@@ -28,10 +45,11 @@ type (
 var globalStorage = &couchStorage{couchdb.GlobalJobsDB}
 
 // newMemQueue creates and a new in-memory queue.
-func newMemQueue(workerType string) *memQueue {
+func newMemQueue(workerType string, domainConcurrency int) *memQueue {
 	return &memQueue{
-		list: list.New(),
-		Jobs: make(chan Job),
+		Jobs:              make(chan Job),
+		domainConcurrency: domainConcurrency,
+		running:           make(map[string]int),
 	}
 }
 
@@ -39,34 +57,136 @@ func newMemQueue(workerType string) *memQueue {
 func (q *memQueue) Enqueue(job Job) error {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
-	q.list.PushBack(job)
-	if !q.run {
+	var dq *domainQueue
+	for _, d := range q.domains {
+		if d.domain == job.Domain() {
+			dq = d
+			break
+		}
+	}
+	if dq == nil {
+		dq = &domainQueue{domain: job.Domain(), jobs: list.New()}
+		q.domains = append(q.domains, dq)
+	}
+	priority := job.infos.Priority()
+	e := dq.jobs.Back()
+	for e != nil && e.Value.(Job).infos.Priority() < priority {
+		e = e.Prev()
+	}
+	if e == nil {
+		dq.jobs.PushFront(job)
+	} else {
+		dq.jobs.InsertAfter(job, e)
+	}
+	q.size++
+	q.wakeUp()
+	return nil
+}
+
+// wakeUp starts sending the jobs to the workers, if it was stopped. It must
+// be called with the lock held.
+func (q *memQueue) wakeUp() {
+	if !q.run && q.size > 0 {
 		q.run = true
 		go q.send()
 	}
-	return nil
 }
 
 func (q *memQueue) send() {
 	for {
 		q.jmu.Lock()
-		e := q.list.Front()
-		if e == nil {
+		job, ok := q.next()
+		if !ok {
 			q.run = false
 			q.jmu.Unlock()
 			return
 		}
-		q.list.Remove(e)
 		q.jmu.Unlock()
-		q.Jobs <- e.Value.(Job)
+		q.Jobs <- job
+	}
+}
+
+// next returns the next job to send to the workers, or false if no job can be
+// executed now. The domains are served with a smooth weighted round-robin,
+// where the weight of a domain is the priority of its first job. The domains
+// that have reached the limit of concurrent jobs are skipped. It must be
+// called with the lock held.
+func (q *memQueue) next() (Job, bool) {
+	var best *domainQueue
+	total := 0
+	for _, dq := range q.domains {
+		if q.domainConcurrency > 0 && q.running[dq.domain] >= q.domainConcurrency {
+			continue
+		}
+		weight := dq.jobs.Front().Value.(Job).infos.Priority()
+		dq.current += weight
+		total += weight
+		if best == nil || dq.current > best.current {
+			best = dq
+		}
+	}
+	if best == nil {
+		return Job{}, false
 	}
+	best.current -= total
+
+	job := best.jobs.Remove(best.jobs.Front()).(Job)
+	q.size--
+	if best.jobs.Len() == 0 {
+		q.removeDomain(best)
+	}
+	domain := best.domain
+	q.running[domain]++
+	job.done = func() { q.release(domain) }
+	return job, true
+}
+
+// release is called when a job of the domain is finished
+func (q *memQueue) release(domain string) {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	if q.running[domain] <= 1 {
+		delete(q.running, domain)
+	} else {
+		q.running[domain]--
+	}
+	q.wakeUp()
+}
+
+func (q *memQueue) removeDomain(dq *domainQueue) {
+	for i, d := range q.domains {
+		if d == dq {
+			q.domains = append(q.domains[:i], q.domains[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove removes a job from the queue. It returns false if the job was not
+// in the queue.
+func (q *memQueue) Remove(jobID string) bool {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	for _, dq := range q.domains {
+		for e := dq.jobs.Front(); e != nil; e = e.Next() {
+			if e.Value.(Job).infos.ID() == jobID {
+				dq.jobs.Remove(e)
+				q.size--
+				if dq.jobs.Len() == 0 {
+					q.removeDomain(dq)
+				}
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Len returns the length of the queue
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
 	defer q.jmu.RUnlock()
-	return q.list.Len()
+	return q.size
 }
 
 // NewMemBroker creates a new in-memory broker system.
@@ -77,7 +197,7 @@ func NewMemBroker(nbWorkers int, ws WorkersList) Broker {
 	setNbSlots(nbWorkers)
 	queues := make(map[string]*memQueue)
 	for workerType, conf := range ws {
-		q := newMemQueue(workerType)
+		q := newMemQueue(workerType, conf.DomainConcurrency)
 		queues[workerType] = q
 		w := &Worker{
 			Type: workerType,
@@ -125,6 +245,69 @@ func (b *memBroker) GetJobInfos(domain, jobID string) (*JobInfos, error) {
 	return globalStorage.Get(domain, jobID)
 }
 
+// ListJobs returns the jobs of a domain, filtered by worker type and state.
+func (b *memBroker) ListJobs(domain, workerType string, state State, cursor couchdb.Cursor) ([]*JobInfos, error) {
+	return globalStorage.List(domain, workerType, state, cursor)
+}
+
+// CancelJob removes a queued job from its queue, or cancels the context of a
+// running job, and marks it as cancelled.
+func (b *memBroker) CancelJob(domain, jobID string) (*JobInfos, error) {
+	infos, err := globalStorage.Get(domain, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if infos.Finished() {
+		return nil, ErrJobFinished
+	}
+	infos.State = Cancelled
+	if err = globalStorage.Update(infos); err != nil {
+		return nil, err
+	}
+	if q, ok := b.queues[infos.WorkerType]; ok {
+		q.Remove(jobID)
+	}
+	cancelRunningJob(jobID)
+	return infos, nil
+}
+
+// PurgeJobs removes the finished jobs queued before the given date.
+func (b *memBroker) PurgeJobs(domain string, before time.Time) (int, error) {
+	return globalStorage.Purge(domain, before)
+}
+
+// ReplayJob pushes again a dead-lettered job in its queue.
+func (b *memBroker) ReplayJob(domain, jobID string) (*JobInfos, error) {
+	infos, err := globalStorage.Get(domain, jobID)
+	if err != nil {
+		return nil, err
+	}
+	q, ok := b.queues[infos.WorkerType]
+	if !ok {
+		return nil, ErrUnknownWorker
+	}
+	if err = globalStorage.requeue(infos); err != nil {
+		return nil, err
+	}
+	j := Job{
+		infos:   infos,
+		storage: globalStorage,
+	}
+	if err = q.Enqueue(j); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// DiscardJob removes a dead-lettered job.
+func (b *memBroker) DiscardJob(domain, jobID string) error {
+	infos, err := globalStorage.Get(domain, jobID)
+	if err != nil {
+		return err
+	}
+	return globalStorage.discard(infos)
+}
+
 var (
 	_ Broker = &memBroker{}
 )
@@ -2,12 +2,15 @@ package jobs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -96,6 +99,85 @@ func TestInMemoryJobs(t *testing.T) {
 	w.Wait()
 }
 
+func newTestJob(id, domain string, priority int) Job {
+	return Job{infos: &JobInfos{
+		JobID:   id,
+		Domain:  domain,
+		Options: &JobOptions{Priority: priority},
+	}}
+}
+
+func nextJobIDs(q *memQueue, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		job, ok := q.next()
+		if !ok {
+			break
+		}
+		ids = append(ids, job.infos.ID())
+	}
+	return ids
+}
+
+func TestMemQueuePriorities(t *testing.T) {
+	q := newMemQueue("test", 0)
+	// Do not start the goroutine that sends the jobs to the workers
+	q.run = true
+
+	for i := 0; i < 4; i++ {
+		q.Enqueue(newTestJob("a"+strconv.Itoa(i), "a.cozy.local", 0))
+	}
+	q.Enqueue(newTestJob("b0", "b.cozy.local", 0))
+	q.Enqueue(newTestJob("b1", "b.cozy.local", 0))
+	q.Enqueue(newTestJob("c0", "c.cozy.local", 0))
+	q.Enqueue(newTestJob("a-urgent", "a.cozy.local", 90))
+	assert.Equal(t, 8, q.Len())
+
+	// The domains are served in turn, and the urgent job comes first for its
+	// domain
+	ids := nextJobIDs(q, 10)
+	assert.Equal(t, []string{"a-urgent", "b0", "c0", "a0", "b1", "a1", "a2", "a3"}, ids)
+	assert.Equal(t, 0, q.Len())
+
+	// A domain with jobs of a higher priority is served more often
+	for i := 0; i < 6; i++ {
+		q.Enqueue(newTestJob("x"+strconv.Itoa(i), "x.cozy.local", MaxPriority))
+		q.Enqueue(newTestJob("y"+strconv.Itoa(i), "y.cozy.local", DefaultPriority))
+	}
+	ids = nextJobIDs(q, 6)
+	var xs int
+	for _, id := range ids {
+		if strings.HasPrefix(id, "x") {
+			xs++
+		}
+	}
+	assert.Equal(t, 4, xs)
+}
+
+func TestMemQueueDomainConcurrency(t *testing.T) {
+	q := newMemQueue("test", 1)
+	q.run = true
+
+	q.Enqueue(newTestJob("a0", "a.cozy.local", 0))
+	q.Enqueue(newTestJob("a1", "a.cozy.local", 0))
+	q.Enqueue(newTestJob("b0", "b.cozy.local", 0))
+
+	first, ok := q.next()
+	assert.True(t, ok)
+	assert.Equal(t, "a0", first.infos.ID())
+	second, ok := q.next()
+	assert.True(t, ok)
+	assert.Equal(t, "b0", second.infos.ID())
+	_, ok = q.next()
+	assert.False(t, ok)
+
+	first.release()
+	third, ok := q.next()
+	assert.True(t, ok)
+	assert.Equal(t, "a1", third.infos.ID())
+	assert.Equal(t, 0, q.Len())
+}
+
 func TestUnknownWorkerError(t *testing.T) {
 	broker := NewMemBroker(1, WorkersList{})
 	_, err := broker.PushJob(&JobRequest{
@@ -267,3 +349,182 @@ func TestPanic(t *testing.T) {
 	assert.NoError(t, err)
 	w.Wait()
 }
+
+func TestRetryBackoff(t *testing.T) {
+	jitter := 0.1
+	tk := &task{
+		startTime: time.Now(),
+		conf: &WorkerConfig{
+			MaxExecCount:  20,
+			MaxExecTime:   time.Hour,
+			Timeout:       time.Second,
+			RetryDelay:    time.Second,
+			MaxRetryDelay: 10 * time.Second,
+			RetryJitter:   &jitter,
+		},
+	}
+	retry, delay, _ := tk.nextDelay()
+	assert.True(t, retry)
+	assert.Equal(t, time.Duration(0), delay)
+
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, exp := range expected {
+		tk.execCount = i + 1
+		retry, delay, _ = tk.nextDelay()
+		assert.True(t, retry)
+		exp = exp * time.Second
+		assert.True(t, delay >= exp-exp/10 && delay <= exp+exp/10,
+			"attempt %d: %s not around %s", i+1, delay, exp)
+	}
+
+	tk.execCount = 19
+	_, delay, _ = tk.nextDelay()
+	assert.True(t, delay <= 11*time.Second)
+	tk.execCount = 20
+	retry, _, _ = tk.nextDelay()
+	assert.False(t, retry)
+
+	// An explicit 0 disables the jitter
+	jitter = 0
+	tk.execCount = 2
+	_, delay, _ = tk.nextDelay()
+	assert.Equal(t, 2*time.Second, delay)
+	w := &Worker{Conf: &WorkerConfig{RetryJitter: &jitter}}
+	assert.Equal(t, 0.0, *w.defaultedConf(nil).RetryJitter)
+	w = &Worker{Conf: &WorkerConfig{}}
+	assert.Equal(t, defaultRetryJitter, *w.defaultedConf(nil).RetryJitter)
+}
+
+func TestErroredWithRetriesRemaining(t *testing.T) {
+	broker := NewMemBroker(1, WorkersList{
+		"errored": {
+			Concurrency:  1,
+			MaxExecCount: 5,
+			MaxExecTime:  50 * time.Millisecond,
+			RetryDelay:   100 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				return errors.New("failing")
+			},
+		},
+	})
+	domain := "errored.cozy.local"
+	job, err := broker.PushJob(&JobRequest{Domain: domain, WorkerType: "errored"})
+	assert.NoError(t, err)
+
+	// The retry would exceed the maximal execution time
+	infos, err := waitForState(broker, domain, job.ID(), Errored)
+	assert.NoError(t, err)
+	assert.Equal(t, "failing", infos.Error)
+	assert.Len(t, infos.Errors, 1)
+	_, err = GetDeadLetter(job.ID())
+	assert.Equal(t, ErrNotFoundJob, err)
+}
+
+func TestListDeadLettersPagination(t *testing.T) {
+	domain := "dead-pages.cozy.local"
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		job := &JobInfos{
+			JobID:      fmt.Sprintf("dead-page-%d", i),
+			Domain:     domain,
+			WorkerType: "dead",
+		}
+		assert.NoError(t, addDeadLetter(job))
+		dead, err := GetDeadLetter(job.ID())
+		assert.NoError(t, err)
+		// Give them distinct dates, in the reverse order of their ids
+		dead.DeadAt = now.Add(time.Duration(-i) * time.Minute)
+		assert.NoError(t, couchdb.UpdateDoc(couchdb.GlobalJobsDB, dead))
+		ids = append([]string{job.ID()}, ids...)
+		defer removeDeadLetter(job.ID()) // #nosec
+	}
+
+	var listed []string
+	cursor := ""
+	for {
+		deads, next, err := ListDeadLetters(domain, "", 2, cursor)
+		assert.NoError(t, err)
+		assert.True(t, len(deads) <= 2)
+		for _, dead := range deads {
+			listed = append(listed, dead.ID())
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, ids, listed)
+}
+
+func waitForState(broker Broker, domain, jobID string, state State) (*JobInfos, error) {
+	for i := 0; i < 100; i++ {
+		infos, err := broker.GetJobInfos(domain, jobID)
+		if err != nil || infos.State == state {
+			return infos, err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, errors.New("timeout")
+}
+
+func TestDeadLetter(t *testing.T) {
+	broker := NewMemBroker(1, WorkersList{
+		"dead": {
+			Concurrency:  1,
+			MaxExecCount: 2,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				return errors.New("always failing")
+			},
+		},
+	})
+	domain := "dead.cozy.local"
+	job, err := broker.PushJob(&JobRequest{Domain: domain, WorkerType: "dead"})
+	assert.NoError(t, err)
+
+	infos, err := waitForState(broker, domain, job.ID(), DeadLetter)
+	assert.NoError(t, err)
+	assert.True(t, infos.Finished())
+	assert.Equal(t, "always failing", infos.Error)
+	if assert.Len(t, infos.Errors, 2) {
+		assert.Equal(t, 1, infos.Errors[0].Attempt)
+		assert.Equal(t, 2, infos.Errors[1].Attempt)
+		assert.Equal(t, "always failing", infos.Errors[1].Error)
+	}
+
+	dead, err := GetDeadLetter(job.ID())
+	assert.NoError(t, err)
+	assert.Equal(t, domain, dead.Domain)
+	assert.Equal(t, "dead", dead.WorkerType)
+	deads, next, err := ListDeadLetters(domain, "", 0, "")
+	assert.NoError(t, err)
+	assert.Len(t, deads, 1)
+	assert.Equal(t, "", next)
+	deads, _, err = ListDeadLetters(domain, "other", 0, "")
+	assert.NoError(t, err)
+	assert.Len(t, deads, 0)
+
+	n, err := broker.PurgeJobs(domain, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = broker.ReplayJob(domain, job.ID())
+	assert.NoError(t, err)
+	_, err = GetDeadLetter(job.ID())
+	assert.Equal(t, ErrNotFoundJob, err)
+	infos, err = waitForState(broker, domain, job.ID(), DeadLetter)
+	assert.NoError(t, err)
+	if assert.Len(t, infos.Errors, 4) {
+		assert.Equal(t, 4, infos.Errors[3].Attempt)
+	}
+
+	err = broker.DiscardJob(domain, job.ID())
+	assert.NoError(t, err)
+	_, err = broker.GetJobInfos(domain, job.ID())
+	assert.Equal(t, ErrNotFoundJob, err)
+	_, err = GetDeadLetter(job.ID())
+	assert.Equal(t, ErrNotFoundJob, err)
+	err = broker.DiscardJob(domain, job.ID())
+	assert.Equal(t, ErrNotFoundJob, err)
+}
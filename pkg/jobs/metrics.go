@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// runDuration measures the time spent to execute the jobs, with their
+// retries, by worker type and final state
+var runDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "cozy",
+		Subsystem: "jobs",
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the execution of the jobs, retries included.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	},
+	[]string{"worker_type", "state"},
+)
+
+// observeRun records the duration of the execution of a job
+func observeRun(workerType string, start time.Time, err error) {
+	state := Done
+	if err == ErrJobCancelled {
+		state = Cancelled
+	} else if err != nil {
+		state = Errored
+	}
+	runDuration.WithLabelValues(workerType, state).Observe(time.Since(start).Seconds())
+}
+
+// queueLenDesc describes the gauge of the lengths of the queues
+var queueLenDesc = prometheus.NewDesc(
+	"cozy_jobs_queue_length",
+	"Number of jobs waiting in the queue of a worker type.",
+	[]string{"worker_type"}, nil,
+)
+
+// queueLenCollector reports the lengths of the queues of a broker, for all
+// the worker types, when the metrics are scraped.
+type queueLenCollector struct {
+	broker Broker
+}
+
+// NewQueueLenCollector returns a prometheus collector for the lengths of the
+// queues of the given broker.
+func NewQueueLenCollector(broker Broker) prometheus.Collector {
+	return &queueLenCollector{broker}
+}
+
+func (c *queueLenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLenDesc
+}
+
+func (c *queueLenCollector) Collect(ch chan<- prometheus.Metric) {
+	for workerType := range GetWorkersList() {
+		n, err := c.broker.QueueLen(workerType)
+		if err != nil {
+			log.Warnf("[metrics] Cannot get the queue length of %s: %s", workerType, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(queueLenDesc, prometheus.GaugeValue,
+			float64(n), workerType)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(runDuration)
+}
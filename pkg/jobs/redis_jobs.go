@@ -1,7 +1,9 @@
 package jobs
 
 import (
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -14,10 +16,148 @@ var log = logger.WithNamespace("redis-job")
 
 const redisPrefix = "j/"
 
+// redisCancelChannel is the pub/sub channel used to cancel the running jobs
+// on all the cozy-stack processes
+const redisCancelChannel = "j/cancel"
+
+// For each worker type, the jobs are kept in redis with these keys:
+//
+//   - j/<worker>/q/<domain> is a sorted set with the queued jobs of a domain,
+//     by priority and then by date
+//   - j/<worker>/domains is the set of the domains with queued jobs
+//   - j/<worker>/weights is a hash with the current weights of the domains
+//     for the smooth weighted round-robin
+//   - j/<worker>/running is a hash with the number of running jobs by domain
+//   - j/<worker>/signal is a list used to wake up the processes that wait for
+//     a job
+//   - j/<worker>/leases is a sorted set with the running jobs, as
+//     <domain>/<job-id>, by the date when their lease expires. The leases are
+//     extended by the process that runs the jobs, and the expired ones, left
+//     by a process that has crashed, are reaped to free their slots.
+func redisQueueKey(workerType, domain string) string {
+	return redisPrefix + workerType + "/q/" + domain
+}
+
+func redisWorkerKeys(workerType string) []string {
+	prefix := redisPrefix + workerType
+	return []string{
+		prefix + "/domains",
+		prefix + "/weights",
+		prefix + "/running",
+		prefix + "/signal",
+		prefix + "/leases",
+	}
+}
+
+// redisPriorityFactor is used to compute the score of a job in the sorted
+// set: the jobs with a higher priority have a lower score, and the jobs with
+// the same priority are sorted by their queued date, in milliseconds.
+const redisPriorityFactor = 1e13
+
+// redisLeaseTTL is the duration of the lease of a running job. The leases are
+// extended three times per TTL by the process that runs the jobs.
+var redisLeaseTTL = 1 * time.Minute
+
+// luaPush adds a job to the queue of its domain, and wakes up a process. The
+// signal list is trimmed, as a few signals are enough to wake up the
+// processes waiting for a job.
+const luaPush = `
+redis.call("ZADD", KEYS[6], ARGV[1], ARGV[2])
+redis.call("SADD", KEYS[1], ARGV[3])
+redis.call("LPUSH", KEYS[4], 1)
+redis.call("LTRIM", KEYS[4], 0, 99)
+return 1`
+
+// luaPop takes the next job to execute. The domains are served with a smooth
+// weighted round-robin, where the weight of a domain is the priority of its
+// first job, and the domains that have reached the limit of running jobs
+// (ARGV[2], 0 for no limit) are skipped. The weight is computed from the
+// score, with MaxPriority (ARGV[5]) and redisPriorityFactor (ARGV[6]). The
+// expired leases (before ARGV[3]) are reaped first, and a lease until ARGV[4]
+// is taken for the job. It returns domain/jobID, or nil if no job can be
+// executed now.
+const luaPop = `
+local limit = tonumber(ARGV[2])
+local maxPriority = tonumber(ARGV[5])
+local factor = tonumber(ARGV[6])
+for _, lease in ipairs(redis.call("ZRANGEBYSCORE", KEYS[5], "-inf", ARGV[3])) do
+  local domain = string.match(lease, "^[^/]*")
+  if redis.call("HINCRBY", KEYS[3], domain, -1) <= 0 then
+    redis.call("HDEL", KEYS[3], domain)
+  end
+  redis.call("ZREM", KEYS[5], lease)
+end
+local total = 0
+local best, bestCurrent
+for _, domain in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+  local head = redis.call("ZRANGE", ARGV[1] .. domain, 0, 0, "WITHSCORES")
+  if #head == 0 then
+    redis.call("SREM", KEYS[1], domain)
+    redis.call("HDEL", KEYS[2], domain)
+  else
+    local running = tonumber(redis.call("HGET", KEYS[3], domain) or "0")
+    if limit == 0 or running < limit then
+      local weight = maxPriority - math.floor(tonumber(head[2]) / factor)
+      local current = redis.call("HINCRBY", KEYS[2], domain, weight)
+      total = total + weight
+      if best == nil or current > bestCurrent then
+        best, bestCurrent = domain, current
+      end
+    end
+  end
+end
+if best == nil then
+  return nil
+end
+redis.call("HINCRBY", KEYS[2], best, -total)
+local key = ARGV[1] .. best
+local id = redis.call("ZRANGE", key, 0, 0)[1]
+redis.call("ZREM", key, id)
+if redis.call("ZCARD", key) == 0 then
+  redis.call("SREM", KEYS[1], best)
+  redis.call("HDEL", KEYS[2], best)
+end
+redis.call("HINCRBY", KEYS[3], best, 1)
+redis.call("ZADD", KEYS[5], ARGV[4], best .. "/" .. id)
+return best .. "/" .. id`
+
+// luaRelease removes the lease of a job (ARGV[1]) and decrements the number
+// of running jobs of its domain (ARGV[2]), unless the lease has already been
+// reaped. It wakes up a process, as a job of this domain may now be executed.
+const luaRelease = `
+if redis.call("ZREM", KEYS[5], ARGV[1]) == 1 then
+  if redis.call("HINCRBY", KEYS[3], ARGV[2], -1) <= 0 then
+    redis.call("HDEL", KEYS[3], ARGV[2])
+  end
+end
+redis.call("LPUSH", KEYS[4], 1)
+redis.call("LTRIM", KEYS[4], 0, 99)
+return 1`
+
+// luaExtend extends the leases (ARGV[2..n]) of the running jobs until
+// ARGV[1]. The leases that have already been reaped are not recreated.
+const luaExtend = `
+for i = 2, #ARGV do
+  redis.call("ZADD", KEYS[5], "XX", ARGV[1], ARGV[i])
+end
+return 1`
+
+// luaLen returns the number of queued jobs for a worker type
+const luaLen = `
+local n = 0
+for _, domain in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+  n = n + redis.call("ZCARD", ARGV[1] .. domain)
+end
+return n`
+
 type redisBroker struct {
 	client  *redis.Client
 	queues  map[string]chan Job
 	running bool
+
+	// leases are the jobs running on this process, by worker type
+	leasesMu sync.Mutex
+	leases   map[string]map[string]struct{}
 }
 
 // NewRedisBroker creates a new broker that will use redis to distribute
@@ -36,7 +176,7 @@ func NewRedisBroker(nbWorkers int, client *redis.Client) Broker {
 // Start polling jobs from redis queues
 func (b *redisBroker) Start(ws WorkersList) {
 	b.queues = make(map[string]chan Job)
-	var keys []string
+	b.running = true
 	for workerType, conf := range ws {
 		ch := make(chan Job)
 		b.queues[workerType] = ch
@@ -45,10 +185,11 @@ func (b *redisBroker) Start(ws WorkersList) {
 			Conf: conf,
 		}
 		w.Start(ch)
-		keys = append(keys, redisPrefix+workerType)
+		b.migrateLegacyQueue(workerType)
+		go b.pollLoop(workerType, conf.DomainConcurrency, ch)
 	}
-	b.running = true
-	go b.pollLoop(keys)
+	go b.cancelLoop()
+	go b.leaseLoop()
 }
 
 func (b *redisBroker) Stop() {
@@ -57,45 +198,165 @@ func (b *redisBroker) Stop() {
 
 var redisBRPopTimeout = 30 * time.Second
 
-func (b *redisBroker) pollLoop(keys []string) {
+// pollLoop takes the jobs of a worker type, and sends them to the workers.
+// When there is no job that can be executed, it waits for a signal, sent when
+// a job is pushed or when a job is finished.
+func (b *redisBroker) pollLoop(workerType string, domainConcurrency int, ch chan Job) {
+	keys := redisWorkerKeys(workerType)
 	for {
 		if !b.running {
 			return
 		}
-		results, err := b.client.BRPop(redisBRPopTimeout, keys...).Result()
-		if err != nil || len(results) < 2 {
-			time.Sleep(100 * time.Millisecond)
+		val, err := b.pop(workerType, domainConcurrency)
+		if err == redis.Nil {
+			b.client.BRPop(redisBRPopTimeout, keys[3])
 			continue
 		}
-
-		workerType := results[0][len(redisPrefix):]
-		ch, ok := b.queues[workerType]
-		if !ok {
-			log.Warnf("Unknown workerType: %s", workerType)
+		if err != nil {
+			log.Warnf("Cannot poll jobs for %s: %s", workerType, err)
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 
-		parts := strings.SplitN(results[1], "/", 2)
+		parts := strings.SplitN(val, "/", 2)
 		if len(parts) != 2 {
-			log.Warnf("Invalid key %s", results[1])
+			log.Warnf("Invalid key %s", val)
 			continue
 		}
-		infos, err := b.GetJobInfos(parts[0], parts[1])
+		job := Job{
+			storage: &couchStorage{
+				db: couchdb.SimpleDatabasePrefix(parts[0]),
+			},
+			done: b.releaser(workerType, parts[0], parts[1]),
+		}
+		job.infos, err = b.GetJobInfos(parts[0], parts[1])
 		if err != nil {
 			log.Warnf("Cannot find job %s on domain %s: %s", parts[1], parts[0], err)
+			job.release()
 			continue
 		}
 
-		job := Job{
-			infos: infos,
-			storage: &couchStorage{
-				db: couchdb.SimpleDatabasePrefix(parts[0]),
-			},
+		if job.infos.State == Cancelled {
+			job.release()
+			continue
 		}
+
 		ch <- job
 	}
 }
 
+// pop takes the next job to execute for a worker type, and returns its
+// domain/jobID. The job is leased to this process until it is released.
+func (b *redisBroker) pop(workerType string, domainConcurrency int) (string, error) {
+	keys := redisWorkerKeys(workerType)
+	prefix := redisQueueKey(workerType, "")
+	now := time.Now()
+	res, err := b.client.Eval(luaPop, keys, prefix, domainConcurrency,
+		redisMilliseconds(now), redisMilliseconds(now.Add(redisLeaseTTL)),
+		MaxPriority, strconv.FormatFloat(redisPriorityFactor, 'f', 0, 64)).Result()
+	if err != nil {
+		return "", err
+	}
+	val, _ := res.(string)
+	b.leasesMu.Lock()
+	if b.leases == nil {
+		b.leases = make(map[string]map[string]struct{})
+	}
+	if b.leases[workerType] == nil {
+		b.leases[workerType] = make(map[string]struct{})
+	}
+	b.leases[workerType][val] = struct{}{}
+	b.leasesMu.Unlock()
+	return val, nil
+}
+
+// releaser returns the function called when a job of the domain is finished
+func (b *redisBroker) releaser(workerType, domain, jobID string) func() {
+	return func() {
+		lease := domain + "/" + jobID
+		b.leasesMu.Lock()
+		delete(b.leases[workerType], lease)
+		b.leasesMu.Unlock()
+		keys := redisWorkerKeys(workerType)
+		if err := b.client.Eval(luaRelease, keys, lease, domain).Err(); err != nil {
+			log.Warnf("Cannot release a job for %s on domain %s: %s", workerType, domain, err)
+		}
+	}
+}
+
+// leaseLoop extends the leases of the jobs running on this process, so that
+// they are not reaped while they are still running.
+func (b *redisBroker) leaseLoop() {
+	ticker := time.NewTicker(redisLeaseTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !b.running {
+			return
+		}
+		deadline := redisMilliseconds(time.Now().Add(redisLeaseTTL))
+		b.leasesMu.Lock()
+		args := make(map[string][]interface{}, len(b.leases))
+		for workerType, leases := range b.leases {
+			for lease := range leases {
+				args[workerType] = append(args[workerType], lease)
+			}
+		}
+		b.leasesMu.Unlock()
+		for workerType, leases := range args {
+			keys := redisWorkerKeys(workerType)
+			argv := append([]interface{}{deadline}, leases...)
+			if err := b.client.Eval(luaExtend, keys, argv...).Err(); err != nil {
+				log.Warnf("Cannot extend the leases of %s: %s", workerType, err)
+			}
+		}
+	}
+}
+
+func redisMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// migrateLegacyQueue moves the jobs of the list used by the previous versions
+// of the stack, where the jobs of all the domains were in the same list, to
+// the queues of their domains.
+func (b *redisBroker) migrateLegacyQueue(workerType string) {
+	key := redisPrefix + workerType
+	for {
+		val, err := b.client.RPop(key).Result()
+		if err != nil {
+			if err != redis.Nil {
+				log.Warnf("Cannot migrate the jobs of %s: %s", key, err)
+			}
+			return
+		}
+		parts := strings.SplitN(val, "/", 2)
+		if len(parts) != 2 {
+			log.Warnf("Invalid key %s", val)
+			continue
+		}
+		infos, err := b.GetJobInfos(parts[0], parts[1])
+		if err == nil {
+			err = b.enqueue(infos)
+		}
+		if err != nil {
+			log.Warnf("Cannot migrate job %s on domain %s: %s", parts[1], parts[0], err)
+		}
+	}
+}
+
+// cancelLoop listens to the cancellations of jobs, that can be asked by any
+// process, and cancels the jobs running on this process.
+func (b *redisBroker) cancelLoop() {
+	sub := b.client.Subscribe(redisCancelChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		if !b.running {
+			return
+		}
+		cancelRunningJob(msg.Payload)
+	}
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(req *JobRequest) (*JobInfos, error) {
@@ -105,20 +366,33 @@ func (b *redisBroker) PushJob(req *JobRequest) (*JobInfos, error) {
 		return nil, err
 	}
 
-	key := redisPrefix + infos.WorkerType
-	val := infos.Domain + "/" + infos.JobID
-	if err := b.client.LPush(key, val).Err(); err != nil {
+	if err := b.enqueue(infos); err != nil {
 		return nil, err
 	}
 	return infos, nil
 }
 
+// enqueue adds a job to the queue of its domain in redis
+func (b *redisBroker) enqueue(infos *JobInfos) error {
+	keys := redisWorkerKeys(infos.WorkerType)
+	keys = append(keys, redisQueueKey(infos.WorkerType, infos.Domain))
+	queuedAt := redisMilliseconds(infos.QueuedAt)
+	score := float64(MaxPriority-infos.Priority())*redisPriorityFactor + float64(queuedAt)
+	scoreStr := strconv.FormatFloat(score, 'f', 0, 64)
+	return b.client.Eval(luaPush, keys, scoreStr, infos.JobID, infos.Domain).Err()
+}
+
 // QueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) QueueLen(workerType string) (int, error) {
-	key := redisPrefix + workerType
-	l, err := b.client.LLen(key).Result()
-	return int(l), err
+	keys := redisWorkerKeys(workerType)
+	prefix := redisQueueKey(workerType, "")
+	l, err := b.client.Eval(luaLen, keys, prefix).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, _ := l.(int64)
+	return int(n), nil
 }
 
 // GetJobInfos returns the informations about a job.
@@ -133,3 +407,68 @@ func (b *redisBroker) GetJobInfos(domain, jobID string) (*JobInfos, error) {
 	}
 	return &infos, nil
 }
+
+// ListJobs returns the jobs of a domain, filtered by worker type and state.
+func (b *redisBroker) ListJobs(domain, workerType string, state State, cursor couchdb.Cursor) ([]*JobInfos, error) {
+	storage := &couchStorage{db: couchdb.SimpleDatabasePrefix(domain)}
+	return storage.List(domain, workerType, state, cursor)
+}
+
+// CancelJob removes a queued job from its redis list, or asks the process that
+// runs it to cancel its context, and marks it as cancelled.
+func (b *redisBroker) CancelJob(domain, jobID string) (*JobInfos, error) {
+	infos, err := b.GetJobInfos(domain, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if infos.Finished() {
+		return nil, ErrJobFinished
+	}
+	infos.State = Cancelled
+	db := couchdb.SimpleDatabasePrefix(domain)
+	if err = couchdb.UpdateDoc(db, infos); err != nil {
+		return nil, err
+	}
+	key := redisQueueKey(infos.WorkerType, domain)
+	if err = b.client.ZRem(key, jobID).Err(); err != nil {
+		return nil, err
+	}
+	if !cancelRunningJob(jobID) {
+		if err = b.client.Publish(redisCancelChannel, jobID).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// PurgeJobs removes the finished jobs queued before the given date.
+func (b *redisBroker) PurgeJobs(domain string, before time.Time) (int, error) {
+	storage := &couchStorage{db: couchdb.SimpleDatabasePrefix(domain)}
+	return storage.Purge(domain, before)
+}
+
+// ReplayJob pushes again a dead-lettered job in its redis queue.
+func (b *redisBroker) ReplayJob(domain, jobID string) (*JobInfos, error) {
+	storage := &couchStorage{db: couchdb.SimpleDatabasePrefix(domain)}
+	infos, err := storage.Get(domain, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.requeue(infos); err != nil {
+		return nil, err
+	}
+	if err = b.enqueue(infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// DiscardJob removes a dead-lettered job.
+func (b *redisBroker) DiscardJob(domain, jobID string) error {
+	storage := &couchStorage{db: couchdb.SimpleDatabasePrefix(domain)}
+	infos, err := storage.Get(domain, jobID)
+	if err != nil {
+		return err
+	}
+	return storage.discard(infos)
+}
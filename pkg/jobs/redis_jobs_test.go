@@ -107,6 +107,96 @@ func TestRedisJobs(t *testing.T) {
 	time.Sleep(1 * time.Second)
 }
 
+func TestRedisPriorities(t *testing.T) {
+	workerType := "test-priorities"
+	keys := redisWorkerKeys(workerType)
+	client.Del(keys...)
+
+	broker := &redisBroker{client: client}
+	now := time.Now()
+	push := func(id, domain string, priority int) {
+		err := broker.enqueue(&JobInfos{
+			JobID:      id,
+			Domain:     domain,
+			WorkerType: workerType,
+			Options:    &JobOptions{Priority: priority},
+			QueuedAt:   now.Add(time.Duration(len(id)) * time.Millisecond),
+		})
+		assert.NoError(t, err)
+	}
+	pop := func(limit int) string {
+		res, err := broker.pop(workerType, limit)
+		if err == redis.Nil {
+			return ""
+		}
+		assert.NoError(t, err)
+		return res
+	}
+
+	push("a0", "a.cozy.local", 0)
+	push("a01", "a.cozy.local", 0)
+	push("b0", "b.cozy.local", 0)
+	push("a-urgent", "a.cozy.local", 90)
+	n, err := broker.QueueLen(workerType)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	assert.Equal(t, "a.cozy.local/a-urgent", pop(0))
+	assert.Equal(t, "b.cozy.local/b0", pop(0))
+	// The domain a has already 1 running job
+	assert.Equal(t, "", pop(1))
+	assert.Equal(t, "a.cozy.local/a0", pop(2))
+
+	broker.releaser(workerType, "a.cozy.local", "a-urgent")()
+	broker.releaser(workerType, "a.cozy.local", "a0")()
+	assert.Equal(t, "a.cozy.local/a01", pop(1))
+	assert.Equal(t, "", pop(0))
+	n, err = broker.QueueLen(workerType)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	client.Del(keys...)
+}
+
+func TestRedisReapLeases(t *testing.T) {
+	workerType := "test-leases"
+	keys := redisWorkerKeys(workerType)
+	client.Del(keys...)
+	defer client.Del(keys...)
+
+	crashed := &redisBroker{client: client}
+	broker := &redisBroker{client: client}
+	for _, id := range []string{"job1", "job2"} {
+		err := broker.enqueue(&JobInfos{
+			JobID:      id,
+			Domain:     "a.cozy.local",
+			WorkerType: workerType,
+			Options:    &JobOptions{},
+			QueuedAt:   time.Now(),
+		})
+		assert.NoError(t, err)
+	}
+	val, err := crashed.pop(workerType, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.cozy.local/job1", val)
+	_, err = broker.pop(workerType, 1)
+	assert.Equal(t, redis.Nil, err)
+
+	// The process has crashed and its lease is not extended
+	client.ZAdd(keys[4], redis.Z{Score: 0, Member: "a.cozy.local/job1"})
+	val, err = broker.pop(workerType, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.cozy.local/job2", val)
+
+	// A late release of the reaped job does not free another slot
+	crashed.releaser(workerType, "a.cozy.local", "job1")()
+	running, err := client.HGet(keys[2], "a.cozy.local").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "1", running)
+	broker.releaser(workerType, "a.cozy.local", "job2")()
+	_, err = client.HGet(keys[2], "a.cozy.local").Result()
+	assert.Equal(t, redis.Nil, err)
+}
+
 func TestMain(m *testing.M) {
 	redisBRPopTimeout = 1 * time.Second
 	config.UseTestFile()
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"math/rand"
 	"runtime"
+	"sync"
 	"time"
+
+	"github.com/cozy/cozy-stack/pkg/trace"
 )
 
 // contextKey are the keys used in the worker context
@@ -16,14 +19,18 @@ const (
 	ContextDomainKey contextKey = iota
 	// ContextWorkerKey is used to store the workerID string
 	ContextWorkerKey
+	// contextLogsKey is used to store the sink of the logs of the job
+	contextLogsKey
 )
 
 var (
-	defaultConcurrency  = runtime.NumCPU()
-	defaultMaxExecCount = 3
-	defaultMaxExecTime  = 60 * time.Second
-	defaultRetryDelay   = 60 * time.Millisecond
-	defaultTimeout      = 10 * time.Second
+	defaultConcurrency   = runtime.NumCPU()
+	defaultMaxExecCount  = 3
+	defaultMaxExecTime   = 60 * time.Second
+	defaultRetryDelay    = 60 * time.Millisecond
+	defaultMaxRetryDelay = 10 * time.Minute
+	defaultRetryJitter   = 0.1
+	defaultTimeout       = 10 * time.Second
 )
 
 type (
@@ -45,6 +52,18 @@ type (
 		MaxExecTime  time.Duration `json:"max_exec_time"`
 		Timeout      time.Duration `json:"timeout"`
 		RetryDelay   time.Duration `json:"retry_delay"`
+		// MaxRetryDelay is the upper bound of the delay between two attempts:
+		// the delay is doubled after each failed attempt, starting with
+		// RetryDelay.
+		MaxRetryDelay time.Duration `json:"max_retry_delay"`
+		// RetryJitter is the fraction of the delay that is randomly added or
+		// removed, so that the retries of many jobs are spread in time. It is
+		// 10% when not set, and an explicit 0 disables the jitter.
+		RetryJitter *float64 `json:"retry_jitter"`
+		// DomainConcurrency is the maximal number of jobs of the same domain
+		// executed at the same time by this worker, on all the cozy-stack
+		// processes. 0 means no limit.
+		DomainConcurrency int `json:"domain_concurrency"`
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -65,6 +84,37 @@ func setNbSlots(nb int) {
 	}
 }
 
+// runningJobs keeps the cancel functions of the jobs that are executed by the
+// workers of this process, indexed by job ID.
+var runningJobs = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+func registerRunningJob(jobID string, cancel context.CancelFunc) {
+	runningJobs.Lock()
+	runningJobs.cancels[jobID] = cancel
+	runningJobs.Unlock()
+}
+
+func unregisterRunningJob(jobID string) {
+	runningJobs.Lock()
+	delete(runningJobs.cancels, jobID)
+	runningJobs.Unlock()
+}
+
+// cancelRunningJob cancels the context of a job if it is executed by this
+// process. It returns false if the job was not running here.
+func cancelRunningJob(jobID string) bool {
+	runningJobs.Lock()
+	cancel, ok := runningJobs.cancels[jobID]
+	runningJobs.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
 // NewWorkerContext returns a context.Context usable by a worker.
 func NewWorkerContext(domain, workerID string) context.Context {
 	ctx := context.Background()
@@ -85,36 +135,72 @@ func (w *Worker) Start(jobs chan Job) {
 
 func (w *Worker) work(workerID string) {
 	for job := range w.jobs {
-		domain := job.Domain()
-		if domain == "" {
-			log.Errorf("[job] %s: missing domain from job request", workerID)
-			continue
-		}
-		parentCtx := NewWorkerContext(domain, workerID)
-		infos := job.Infos()
-		if err := job.AckConsumed(); err != nil {
-			log.Errorf("[job] %s: error acking consume job %s: %s",
-				workerID, infos.ID(), err.Error())
-			continue
-		}
-		t := &task{
-			ctx:      parentCtx,
-			infos:    infos,
-			conf:     w.defaultedConf(infos.Options),
-			workerID: workerID,
-		}
-		var err error
-		if err = t.run(); err != nil {
-			log.Errorf("[job] %s: error while performing job %s: %s",
-				workerID, infos.ID(), err.Error())
-			err = job.Nack(err)
-		} else {
-			err = job.Ack()
-		}
-		if err != nil {
-			log.Errorf("[job] %s: error while acking job done %s: %s",
-				workerID, infos.ID(), err.Error())
-		}
+		w.process(workerID, job)
+		// The slot of the domain is released when the job is finished, so
+		// that the broker can send another job of this domain
+		job.release()
+	}
+}
+
+func (w *Worker) process(workerID string, job Job) {
+	domain := job.Domain()
+	if domain == "" {
+		log.Errorf("[job] %s: missing domain from job request", workerID)
+		return
+	}
+	infos := job.Infos()
+	if infos.State == Cancelled {
+		return
+	}
+	sink := newLogSink(domain, infos.ID())
+	span := trace.StartRemote("job "+w.Type, infos.TraceParent, trace.KindConsumer)
+	span.SetAttribute("job.id", infos.ID())
+	span.SetAttribute("job.worker", w.Type)
+	span.SetAttribute("domain", domain)
+	defer span.End()
+	parentCtx := context.WithValue(NewWorkerContext(domain, workerID), contextLogsKey, sink)
+	parentCtx = trace.NewContext(parentCtx, span)
+	parentCtx, cancel := context.WithCancel(parentCtx)
+	registerRunningJob(infos.ID(), cancel)
+	if err := job.AckConsumed(); err != nil {
+		log.Errorf("[job] %s: error acking consume job %s: %s",
+			workerID, infos.ID(), err.Error())
+		unregisterRunningJob(infos.ID())
+		cancel()
+		return
+	}
+	t := &task{
+		ctx:      parentCtx,
+		infos:    infos,
+		conf:     w.defaultedConf(infos.Options),
+		logs:     sink,
+		workerID: workerID,
+	}
+	start := time.Now()
+	err := t.run()
+	observeRun(w.Type, start, err)
+	span.SetError(err)
+	unregisterRunningJob(infos.ID())
+	cancel()
+	if errl := sink.close(); errl != nil {
+		log.Errorf("[job] %s: error while saving the logs of job %s: %s",
+			workerID, infos.ID(), errl.Error())
+	}
+	if err == ErrJobCancelled {
+		// The state of the job has already been persisted by CancelJob
+		log.Infof("[job] %s: job %s has been cancelled", workerID, infos.ID())
+		return
+	}
+	if err != nil {
+		log.Errorf("[job] %s: error while performing job %s: %s",
+			workerID, infos.ID(), err.Error())
+		err = job.Nack(err, t.errors, t.exhausted())
+	} else {
+		err = job.Ack()
+	}
+	if err != nil {
+		log.Errorf("[job] %s: error while acking job done %s: %s",
+			workerID, infos.ID(), err.Error())
 	}
 }
 
@@ -132,6 +218,13 @@ func (w *Worker) defaultedConf(opts *JobOptions) *WorkerConfig {
 	if c.RetryDelay == 0 {
 		c.RetryDelay = defaultRetryDelay
 	}
+	if c.MaxRetryDelay == 0 {
+		c.MaxRetryDelay = defaultMaxRetryDelay
+	}
+	if c.RetryJitter == nil {
+		jitter := defaultRetryJitter
+		c.RetryJitter = &jitter
+	}
 	if c.Timeout == 0 {
 		c.Timeout = defaultTimeout
 	}
@@ -154,10 +247,12 @@ type task struct {
 	ctx   context.Context
 	infos *JobInfos
 	conf  *WorkerConfig
+	logs  *logSink
 
 	workerID  string
 	startTime time.Time
 	execCount int
+	errors    []JobError
 }
 
 func (t *task) run() (err error) {
@@ -172,24 +267,43 @@ func (t *task) run() (err error) {
 		}
 	}()
 	for {
+		if t.ctx.Err() != nil {
+			return ErrJobCancelled
+		}
 		retry, delay, timeout := t.nextDelay()
 		if !retry {
 			return err
 		}
 		if err != nil {
-			log.Warnf("[job] %s: error while performing job %s: %s (retry in %s)",
+			Logger(t.ctx).Warnf("[job] %s: error while performing job %s: %s (retry in %s)",
 				t.workerID, t.infos.ID(), err.Error(), delay)
 		}
 		if delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-t.ctx.Done():
+				return ErrJobCancelled
+			}
 		}
 		log.Debugf("[job] %s: executing job %s(%d) (timeout %s)",
 			t.workerID, t.infos.ID(), t.execCount, timeout)
 		ctx, cancel := context.WithTimeout(t.ctx, timeout)
-		if err = t.exec(ctx); err == nil {
+		err = t.exec(ctx)
+		// The logs are saved after each execution, so that they can be read
+		// while the job is retried
+		if errl := t.logs.flush(); errl != nil {
+			log.Warnf("[job] %s: error while saving the logs of job %s: %s",
+				t.workerID, t.infos.ID(), errl.Error())
+		}
+		if err == nil {
 			cancel()
 			break
 		}
+		t.errors = append(t.errors, JobError{
+			Attempt: t.execCount + 1,
+			Error:   err.Error(),
+			At:      time.Now(),
+		})
 		// Even though ctx should have expired already, it is good practice to call
 		// its cancelation function in any case. Failure to do so may keep the
 		// context and its parent alive longer than necessary.
@@ -199,6 +313,13 @@ func (t *task) run() (err error) {
 	return nil
 }
 
+// exhausted returns true if the task has failed after all its attempts, and
+// false if it has been stopped while some retries remain, by the maximal
+// execution time.
+func (t *task) exhausted() bool {
+	return t.execCount >= t.conf.MaxExecCount
+}
+
 func (t *task) exec(ctx context.Context) (err error) {
 	slot := <-slots
 	defer func() {
@@ -234,11 +355,17 @@ func (t *task) nextDelay() (bool, time.Duration, time.Duration) {
 		// on first execution, execute immediately
 		nextDelay = 0
 	} else {
+		// exponential backoff, bounded by the maximal retry delay (the
+		// shift can overflow for a large number of attempts)
 		nextDelay = c.RetryDelay << uint(t.execCount-1)
+		if nextDelay <= 0 || nextDelay > c.MaxRetryDelay {
+			nextDelay = c.MaxRetryDelay
+		}
 
-		// fuzzDelay number between delay * (1 +/- 0.1)
-		fuzzDelay := int(0.1 * float64(nextDelay))
-		nextDelay = nextDelay + time.Duration((rand.Intn(2*fuzzDelay) - fuzzDelay))
+		// fuzzDelay number between delay * (1 +/- jitter)
+		if fuzzDelay := int64(*c.RetryJitter * float64(nextDelay)); fuzzDelay > 0 {
+			nextDelay = nextDelay + time.Duration(rand.Int63n(2*fuzzDelay)-fuzzDelay)
+		}
 	}
 
 	if execTime+nextDelay > c.MaxExecTime {
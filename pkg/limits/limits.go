@@ -0,0 +1,186 @@
+// Package limits is used to protect the authentication endpoints against the
+// brute-force attacks. The failed attempts are counted per instance and per IP
+// address. After a few failures, the next attempts are delayed exponentially,
+// and after too many failures, they are refused for a while and the owner of
+// the instance is warned by mail.
+package limits
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/stack"
+)
+
+// Kind is the type of the attempts that are counted together
+type Kind string
+
+const (
+	// Login is for the passphrase and the second factor on the login form
+	Login Kind = "login"
+	// PassphraseReset is for the renewals of the passphrase with a reset
+	// token
+	PassphraseReset Kind = "passphrase_reset"
+	// OAuthToken is for the exchange of a code or a refresh token for an
+	// access token
+	OAuthToken Kind = "oauth_token"
+	// Admin is for the basic authentication of the admin server
+	Admin Kind = "admin"
+	// Share is for the passwords of the shares by link
+	Share Kind = "share"
+)
+
+const (
+	// FailuresWindow is the duration for which the failed attempts are counted
+	FailuresWindow = 1 * time.Hour
+	// DelayThreshold is the number of failed attempts after which the next
+	// attempts are delayed
+	DelayThreshold = 5
+	// BaseDelay is the delay after DelayThreshold failed attempts. It is
+	// doubled on each new failure.
+	BaseDelay = 1 * time.Second
+	// MaxDelay is the maximal delay between two attempts
+	MaxDelay = 1 * time.Minute
+	// IPLockoutThreshold is the number of failed attempts from an IP address
+	// after which this address is locked out
+	IPLockoutThreshold = 10
+	// InstanceLockoutThreshold is the number of failed attempts on an
+	// instance after which this instance is locked out
+	InstanceLockoutThreshold = 30
+	// LockoutDuration is the duration of a lockout
+	LockoutDuration = 15 * time.Minute
+)
+
+// ErrRateLimited is returned when an attempt is refused, because of the
+// previous failed attempts
+type ErrRateLimited struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	return fmt.Sprintf("Too many attempts, retry in %s", e.RetryAfter)
+}
+
+// counter is a key in the store, with its lockout threshold
+type counter struct {
+	key       string
+	threshold int64
+}
+
+func counters(i *instance.Instance, ip string, kind Kind) []counter {
+	var list []counter
+	if i != nil {
+		list = append(list, counter{string(kind) + ":" + i.Domain, InstanceLockoutThreshold})
+	}
+	if ip != "" {
+		list = append(list, counter{string(kind) + ":ip:" + ip, IPLockoutThreshold})
+	}
+	return list
+}
+
+// Check returns an ErrRateLimited error if the attempts on this instance, or
+// from this IP address, are currently refused. The instance can be nil for the
+// attempts that are not tied to an instance.
+func Check(i *instance.Instance, ip string, kind Kind) error {
+	s := getStore()
+	var wait time.Duration
+	for _, c := range counters(i, ip, kind) {
+		d, err := s.BlockedFor(c.key)
+		if err != nil {
+			logger.WithNamespace("limits").Warnf("Cannot check %s: %s", c.key, err)
+			continue
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return &ErrRateLimited{RetryAfter: wait}
+	}
+	return nil
+}
+
+// Failure records a failed attempt. The next attempts are delayed, or refused
+// if there were too many failures, in which case the owner of the instance is
+// warned by mail.
+func Failure(i *instance.Instance, ip string, kind Kind) {
+	s := getStore()
+	log := logger.WithNamespace("limits")
+	lockout := false
+	for _, c := range counters(i, ip, kind) {
+		n, err := s.Increment(c.key, FailuresWindow)
+		if err != nil {
+			log.Warnf("Cannot count a failure for %s: %s", c.key, err)
+			continue
+		}
+		var d time.Duration
+		if n >= c.threshold {
+			d = LockoutDuration
+			if n == c.threshold {
+				log.Warnf("Lockout of %s after %d failed attempts", c.key, n)
+				lockout = true
+			}
+		} else if n >= DelayThreshold {
+			d = nextDelay(n)
+		}
+		if d > 0 {
+			if err = s.Block(c.key, d); err != nil {
+				log.Warnf("Cannot block %s: %s", c.key, err)
+			}
+		}
+	}
+	if lockout && i != nil {
+		if err := sendLockoutMail(i, ip, kind); err != nil {
+			i.Logger().Errorf("[limits] Cannot send the lockout mail: %s", err)
+		}
+	}
+}
+
+// Success resets the counters of failed attempts, after a successful one.
+func Success(i *instance.Instance, ip string, kind Kind) {
+	s := getStore()
+	for _, c := range counters(i, ip, kind) {
+		if err := s.Reset(c.key); err != nil {
+			logger.WithNamespace("limits").Warnf("Cannot reset %s: %s", c.key, err)
+		}
+	}
+}
+
+// nextDelay returns the delay before the next attempt, after n failures
+func nextDelay(n int64) time.Duration {
+	d := BaseDelay
+	for k := int64(DelayThreshold); k < n && d < MaxDelay; k++ {
+		d *= 2
+	}
+	if d > MaxDelay {
+		d = MaxDelay
+	}
+	return d
+}
+
+func sendLockoutMail(i *instance.Instance, ip string, kind Kind) error {
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, map[string]interface{}{
+		"mode":          "noreply",
+		"subject":       i.Translate("Mail Lockout"),
+		"template_name": "lockout_" + i.Locale,
+		"template_values": map[string]string{
+			"BaseURL":  i.PageURL("/", nil),
+			"Kind":     string(kind),
+			"IP":       ip,
+			"Duration": strconv.Itoa(int(LockoutDuration / time.Minute)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = stack.GetBroker().PushJob(&jobs.JobRequest{
+		Domain:     i.Domain,
+		WorkerType: "sendmail",
+		Message:    msg,
+	})
+	return err
+}
@@ -0,0 +1,137 @@
+package limits
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextDelay(t *testing.T) {
+	assert.Equal(t, BaseDelay, nextDelay(DelayThreshold))
+	assert.Equal(t, 2*BaseDelay, nextDelay(DelayThreshold+1))
+	assert.Equal(t, 4*BaseDelay, nextDelay(DelayThreshold+2))
+	assert.Equal(t, MaxDelay, nextDelay(DelayThreshold+20))
+	assert.Equal(t, MaxDelay, nextDelay(1000))
+}
+
+func testStore(t *testing.T, s store) {
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	defer s.Reset(key)
+
+	n, err := s.Increment(key, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+	n, err = s.Increment(key, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, n)
+
+	d, err := s.BlockedFor(key)
+	assert.NoError(t, err)
+	assert.Zero(t, d)
+	assert.NoError(t, s.Block(key, time.Minute))
+	d, err = s.BlockedFor(key)
+	assert.NoError(t, err)
+	assert.True(t, d > 50*time.Second && d <= time.Minute)
+
+	assert.NoError(t, s.Reset(key))
+	d, err = s.BlockedFor(key)
+	assert.NoError(t, err)
+	assert.Zero(t, d)
+	n, err = s.Increment(key, time.Minute)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, newMemStore())
+}
+
+func TestMemStoreExpiration(t *testing.T) {
+	s := newMemStore()
+	_, err := s.Increment("expire", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Block("expire", 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	n, err := s.Increment("expire", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+	d, err := s.BlockedFor("expire")
+	assert.NoError(t, err)
+	assert.Zero(t, d)
+}
+
+func TestMemStoreSweep(t *testing.T) {
+	s := newMemStore()
+	_, err := s.Increment("old", 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Block("old", 10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	s.nextSweep = time.Now()
+	_, err = s.Increment("new", time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, s.counters, 1)
+	assert.Contains(t, s.counters, "new")
+	assert.Empty(t, s.blocks)
+}
+
+func TestRedisStore(t *testing.T) {
+	conf := config.NewRedisConfig("redis://localhost:6379/0")
+	cl := conf.Client()
+	testStore(t, &redisStore{cl: cl})
+
+	s := &redisStore{cl: cl}
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	defer s.Reset(key)
+	_, err := s.Increment(key, time.Minute)
+	assert.NoError(t, err)
+	_, err = s.Increment(key, time.Minute)
+	assert.NoError(t, err)
+	ttl, err := cl.PTTL(redisCounterNS + key).Result()
+	assert.NoError(t, err)
+	assert.True(t, ttl > 50*time.Second && ttl <= time.Minute)
+}
+
+func TestFailures(t *testing.T) {
+	globalStore = newMemStore()
+	defer func() { globalStore = nil }()
+	ip := "192.0.2.1"
+
+	for i := 1; i < DelayThreshold; i++ {
+		assert.NoError(t, Check(nil, ip, Admin))
+		Failure(nil, ip, Admin)
+	}
+	assert.NoError(t, Check(nil, ip, Admin))
+	Failure(nil, ip, Admin)
+	err := Check(nil, ip, Admin)
+	if assert.Error(t, err) {
+		limited, ok := err.(*ErrRateLimited)
+		assert.True(t, ok)
+		assert.True(t, limited.RetryAfter <= BaseDelay)
+	}
+
+	// The counters are kept per kind and per IP address
+	assert.NoError(t, Check(nil, ip, Login))
+	assert.NoError(t, Check(nil, "192.0.2.2", Admin))
+
+	for i := DelayThreshold; i < IPLockoutThreshold; i++ {
+		Failure(nil, ip, Admin)
+	}
+	err = Check(nil, ip, Admin)
+	if assert.Error(t, err) {
+		limited, ok := err.(*ErrRateLimited)
+		assert.True(t, ok)
+		assert.True(t, limited.RetryAfter > MaxDelay)
+		assert.True(t, limited.RetryAfter <= LockoutDuration)
+	}
+
+	Success(nil, ip, Admin)
+	assert.NoError(t, Check(nil, ip, Admin))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	os.Exit(m.Run())
+}
@@ -0,0 +1,183 @@
+package limits
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/go-redis/redis"
+)
+
+// store keeps the counters of failed attempts and the blocked keys. It can be
+// in memory for a single stack, or in redis to share it between several
+// stacks.
+type store interface {
+	// Increment adds one to the counter for the given key, and returns its
+	// new value. The counter expires after window, from its first increment.
+	Increment(key string, window time.Duration) (int64, error)
+	// Block refuses the attempts for the given key during d.
+	Block(key string, d time.Duration) error
+	// BlockedFor returns how long the attempts are still refused for the
+	// given key, or zero if they are allowed.
+	BlockedFor(key string) (time.Duration, error)
+	// Reset removes the counter and the block for the given key.
+	Reset(key string) error
+}
+
+type memCounter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// memSweepInterval is the minimal duration between two sweeps of the expired
+// counters and blocks of the memory store.
+const memSweepInterval = time.Minute
+
+type memStore struct {
+	mu        sync.Mutex
+	counters  map[string]*memCounter
+	blocks    map[string]time.Time
+	nextSweep time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		counters: make(map[string]*memCounter),
+		blocks:   make(map[string]time.Time),
+	}
+}
+
+func (s *memStore) Increment(key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		s.sweep(now)
+	}
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expiresAt) {
+		c = &memCounter{expiresAt: now.Add(window)}
+		s.counters[key] = c
+	}
+	c.value++
+	return c.value, nil
+}
+
+// sweep removes the expired counters and blocks, as the keys of the attempts
+// that are not retried are never read again.
+func (s *memStore) sweep(now time.Time) {
+	for key, c := range s.counters {
+		if now.After(c.expiresAt) {
+			delete(s.counters, key)
+		}
+	}
+	for key, until := range s.blocks {
+		if now.After(until) {
+			delete(s.blocks, key)
+		}
+	}
+	s.nextSweep = now.Add(memSweepInterval)
+}
+
+func (s *memStore) Block(key string, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks[key] = time.Now().Add(d)
+	return nil
+}
+
+func (s *memStore) BlockedFor(key string) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.blocks[key]
+	if !ok {
+		return 0, nil
+	}
+	d := until.Sub(time.Now())
+	if d <= 0 {
+		delete(s.blocks, key)
+		return 0, nil
+	}
+	return d, nil
+}
+
+func (s *memStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.counters, key)
+	delete(s.blocks, key)
+	return nil
+}
+
+// luaIncrement increments the counter and sets its expiration on the first
+// increment, in one atomic step: a counter can't be left without expiration.
+const luaIncrement = `local n = redis.call("incr", KEYS[1]) if n == 1 then redis.call("pexpire", KEYS[1], ARGV[1]) end return n`
+
+type subRedisInterface interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	PTTL(key string) *redis.DurationCmd
+	Del(keys ...string) *redis.IntCmd
+}
+
+const (
+	redisCounterNS = "limits:counter:"
+	redisBlockNS   = "limits:block:"
+)
+
+type redisStore struct {
+	cl subRedisInterface
+}
+
+func (s *redisStore) Increment(key string, window time.Duration) (int64, error) {
+	ttl := strconv.FormatInt(int64(window/time.Millisecond), 10)
+	res, err := s.cl.Eval(luaIncrement, []string{redisCounterNS + key}, ttl).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected result for the counter %s: %v", key, res)
+	}
+	return n, nil
+}
+
+func (s *redisStore) Block(key string, d time.Duration) error {
+	return s.cl.Set(redisBlockNS+key, 1, d).Err()
+}
+
+func (s *redisStore) BlockedFor(key string) (time.Duration, error) {
+	d, err := s.cl.PTTL(redisBlockNS + key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// PTTL returns a negative value if the key does not exist
+	if d <= 0 {
+		return 0, nil
+	}
+	return d, nil
+}
+
+func (s *redisStore) Reset(key string) error {
+	return s.cl.Del(redisCounterNS+key, redisBlockNS+key).Err()
+}
+
+var globalStore store
+var globalStoreMutex sync.Mutex
+
+func getStore() store {
+	globalStoreMutex.Lock()
+	defer globalStoreMutex.Unlock()
+	if globalStore != nil {
+		return globalStore
+	}
+	cli := config.GetConfig().RateLimitingStorage.Client()
+	if cli == nil {
+		globalStore = newMemStore()
+	} else {
+		globalStore = &redisStore{cl: cli}
+	}
+	return globalStore
+}
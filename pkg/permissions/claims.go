@@ -20,6 +20,10 @@ const (
 	// ShareAudience is the audience field of JWT for access tokens
 	ShareAudience = "share"
 
+	// UnlockedShareAudience is the audience field of JWT for the tokens given
+	// after the password of a share has been checked
+	UnlockedShareAudience = "unlocked"
+
 	// RegistrationTokenAudience is the audience field of JWT for registration tokens
 	RegistrationTokenAudience = "registration"
 
@@ -33,6 +37,10 @@ const (
 // TokenValidityDuration is the duration where a token is valid in seconds (1 week)
 var TokenValidityDuration = 7 * 24 * time.Hour
 
+// UnlockedShareTokenValidity is the duration where an unlocked token, given
+// after the password of a share has been checked, is valid
+var UnlockedShareTokenValidity = 1 * time.Hour
+
 // Claims is used for JWT used in OAuth2 flow and applications token
 type Claims struct {
 	jwt.StandardClaims
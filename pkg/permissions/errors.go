@@ -38,4 +38,18 @@ var (
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
+
+	// ErrSharePasswordRequired is used when a share code is used without its
+	// password having been checked.
+	ErrSharePasswordRequired = echo.NewHTTPError(http.StatusUnauthorized,
+		"A password is required for this share")
+
+	// ErrInvalidSharePassword is used when the password of a share is wrong.
+	ErrInvalidSharePassword = echo.NewHTTPError(http.StatusUnauthorized,
+		"Invalid password for this share")
+
+	// ErrMaxDownloads is used when the maximal number of downloads of a share
+	// has been reached.
+	ErrMaxDownloads = echo.NewHTTPError(http.StatusForbidden,
+		"The maximal number of downloads has been reached")
 )
@@ -1,13 +1,17 @@
 package permissions
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/crypto"
 )
 
 // Permission is a storable object containing a set of rules and
@@ -20,6 +24,23 @@ type Permission struct {
 	Permissions Set               `json:"permissions,omitempty"`
 	ExpiresAt   int               `json:"expires_at,omitempty"`
 	Codes       map[string]string `json:"codes,omitempty"`
+
+	// Password is the hash of the password of a share by link, if any
+	Password []byte `json:"password,omitempty"`
+	// MaxDownloads is the number of times the files of a share by link can
+	// be downloaded (no limit if 0), and Downloads counts them.
+	MaxDownloads int `json:"max_downloads,omitempty"`
+	Downloads    int `json:"downloads,omitempty"`
+}
+
+// ShareOptions are the optional restrictions of a share by link
+type ShareOptions struct {
+	// ExpiresAt is the unix timestamp after which the codes are refused
+	ExpiresAt int
+	// Password is the password, in clear, asked before showing the share
+	Password string
+	// MaxDownloads is the maximal number of downloads
+	MaxDownloads int
 }
 
 const (
@@ -85,6 +106,74 @@ func (p *Permission) RemoveRule(rule Rule) {
 	p.Permissions = newperms
 }
 
+// Expired returns true if the permission doc has an expiration date, and it
+// is in the past
+func (p *Permission) Expired() bool {
+	return p.ExpiresAt != 0 && int64(p.ExpiresAt) < time.Now().Unix()
+}
+
+// HasPassword returns true if a password is required to use the codes
+func (p *Permission) HasPassword() bool {
+	return len(p.Password) > 0
+}
+
+// CheckPassword checks the password of a share by link
+func (p *Permission) CheckPassword(password string) error {
+	if _, err := crypto.CompareHashAndPassphrase(p.Password, []byte(password)); err != nil {
+		return ErrInvalidSharePassword
+	}
+	return nil
+}
+
+// CanDownload returns true if the maximal number of downloads has not been
+// reached
+func (p *Permission) CanDownload() bool {
+	return p.MaxDownloads == 0 || p.Downloads < p.MaxDownloads
+}
+
+// maxDownloadRetries is the number of times the counter of downloads is
+// reloaded and saved again when another download has updated it concurrently
+const maxDownloadRetries = 5
+
+// CountDownload checks that the maximal number of downloads has not been
+// reached and counts a new download. On a conflict, the document is reloaded
+// to not lose the downloads counted by the concurrent requests.
+func (p *Permission) CountDownload(db couchdb.Database) error {
+	for i := 0; ; i++ {
+		if !p.CanDownload() {
+			return ErrMaxDownloads
+		}
+		p.Downloads++
+		err := couchdb.UpdateDoc(db, p)
+		if err == nil || !couchdb.IsConflictError(err) || i >= maxDownloadRetries {
+			return err
+		}
+		fresh, err := GetByID(db, p.ID())
+		if err != nil {
+			return err
+		}
+		*p = *fresh
+	}
+}
+
+// LockFingerprint returns a hash of the password and of the codes of a share
+// by link. It is put in the unlocked tokens, so that they are no longer valid
+// when the password is changed or the codes revoked.
+func (p *Permission) LockFingerprint() string {
+	names := make([]string, 0, len(p.Codes))
+	for name := range p.Codes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	h.Write(p.Password) // #nosec
+	for _, name := range names {
+		h.Write([]byte{0})             // #nosec
+		h.Write([]byte(p.Codes[name])) // #nosec
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // PatchCodes replace the permission docs codes
 func (p *Permission) PatchCodes(codes map[string]string) {
 	p.Codes = codes
@@ -221,6 +310,10 @@ func GetForShareCode(db couchdb.Database, tokenCode string) (*Permission, error)
 		return nil, err
 	}
 
+	if pdoc.Expired() {
+		return nil, ErrExpiredToken
+	}
+
 	return &pdoc, nil
 }
 
@@ -282,8 +375,8 @@ func updateAppSet(db couchdb.Database, doc *Permission, typ, docType, slug strin
 	return doc, nil
 }
 
-// CreateShareSet creates a Permission doc for sharing
-func CreateShareSet(db couchdb.Database, parent *Permission, codes map[string]string, set Set) (*Permission, error) {
+// CreateShareSet creates a Permission doc for sharing. The options can be nil.
+func CreateShareSet(db couchdb.Database, parent *Permission, codes map[string]string, set Set, opts *ShareOptions) (*Permission, error) {
 	if parent.Type == TypeRegister || parent.Type == TypeSharing {
 		return nil, ErrOnlyAppCanCreateSubSet
 	}
@@ -300,6 +393,18 @@ func CreateShareSet(db couchdb.Database, parent *Permission, codes map[string]st
 		Codes:       codes,
 	}
 
+	if opts != nil {
+		doc.ExpiresAt = opts.ExpiresAt
+		doc.MaxDownloads = opts.MaxDownloads
+		if opts.Password != "" {
+			hash, err := crypto.GenerateFromPassphrase([]byte(opts.Password))
+			if err != nil {
+				return nil, err
+			}
+			doc.Password = hash
+		}
+	}
+
 	err := couchdb.CreateDoc(db, doc)
 	if err != nil {
 		return nil, err
@@ -320,3 +320,19 @@ func (t *validableFile) DocType() string { return "io.cozy.files" }
 func (t *validableFile) Valid(f, e string) bool {
 	return f == "path" && strings.HasPrefix(t.path, e)
 }
+
+func TestLockFingerprint(t *testing.T) {
+	p := &Permission{
+		Password: []byte("hash"),
+		Codes:    map[string]string{"bob": "code1", "jane": "code2"},
+	}
+	fingerprint := p.LockFingerprint()
+	assert.Equal(t, fingerprint, p.LockFingerprint())
+
+	p.Password = []byte("other")
+	assert.NotEqual(t, fingerprint, p.LockFingerprint())
+
+	p.Password = []byte("hash")
+	delete(p.Codes, "jane")
+	assert.NotEqual(t, fingerprint, p.LockFingerprint())
+}
@@ -6,13 +6,17 @@ import (
 	"sync/atomic"
 )
 
-var globalMemHub = &memHub{topics: make(map[string]*topic)}
+var globalMemHub = newMemHub()
 
 type memHub struct {
 	sync.RWMutex
 	topics map[string]*topic
 }
 
+func newMemHub() *memHub {
+	return &memHub{topics: make(map[string]*topic)}
+}
+
 func (h *memHub) Publish(e *Event) {
 	topic := h.get(e.Domain, e.Doc.DocType())
 	if topic != nil {
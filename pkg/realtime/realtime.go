@@ -1,5 +1,12 @@
 package realtime
 
+import (
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/go-redis/redis"
+)
+
 // Basic data events
 const (
 	EventCreate = "CREATED"
@@ -20,6 +27,9 @@ type Event struct {
 	Type   string
 	Doc    Doc
 	OldDoc Doc
+	// TraceParent links the event to the traced request that has caused it,
+	// if any, so that the jobs triggered by this event are in the same trace.
+	TraceParent string `json:",omitempty"`
 }
 
 // The following API is inspired by https://github.com/gocontrib/pubsub
@@ -46,7 +56,36 @@ type EventChannel interface {
 	Close() error
 }
 
-// GetHub returns the global hub
+var globalHub Hub
+var globalHubMu sync.Mutex
+
+// GetHub returns the global hub. If redis is configured for realtime, the
+// events are dispatched to the subscribers of all the cozy-stack processes.
 func GetHub() Hub {
+	globalHubMu.Lock()
+	defer globalHubMu.Unlock()
+	if globalHub != nil {
+		return globalHub
+	}
+	var cli *redis.Client
+	if conf := config.GetConfig(); conf != nil {
+		cli = conf.Realtime.Client()
+	}
+	if cli == nil {
+		globalHub = globalMemHub
+	} else {
+		globalHub = newRedisHub(cli)
+	}
+	return globalHub
+}
+
+// GetLocalHub returns a hub that only receives the events published by the
+// current process. It can be used to do something exactly once per event in
+// a cluster of cozy-stack processes, like pushing the jobs of the @event
+// triggers.
+func GetLocalHub() Hub {
+	if h, ok := GetHub().(*redisHub); ok {
+		return h.local
+	}
 	return globalMemHub
 }
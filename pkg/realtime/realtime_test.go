@@ -1,10 +1,12 @@
 package realtime
 
 import (
+	"encoding/json"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,6 +19,9 @@ type testDoc struct {
 func (t *testDoc) ID() string      { return t.id }
 func (t *testDoc) Rev() string     { return t.rev }
 func (t *testDoc) DocType() string { return t.doctype }
+func (t *testDoc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"_id": t.id, "_rev": t.rev})
+}
 
 func TestRealtime(t *testing.T) {
 	h := GetHub()
@@ -91,3 +96,80 @@ func TestRealtime(t *testing.T) {
 		},
 	})
 }
+
+func TestRedisRealtime(t *testing.T) {
+	cli := config.NewRedisConfig("redis://localhost:6379/0").Client()
+	// Two hubs on the same redis simulate two cozy-stack processes
+	h1 := newRedisHub(cli)
+	h2 := newRedisHub(cli)
+
+	c1 := h1.Subscribe("testing", "io.cozy.testobject")
+	c2 := h2.Subscribe("testing", "io.cozy.testobject")
+	c3 := h2.SubscribeAll()
+	l2 := h2.local.SubscribeAll()
+
+	wg := sync.WaitGroup{}
+	wg.Add(3)
+	go func() {
+		e := <-c1.Read()
+		assert.Equal(t, "foo", e.Doc.ID())
+		_, isTestDoc := e.Doc.(*testDoc)
+		assert.True(t, isTestDoc)
+		wg.Done()
+	}()
+	go func() {
+		e := <-c2.Read()
+		assert.Equal(t, "foo", e.Doc.ID())
+		assert.Equal(t, "1-abc", e.Doc.Rev())
+		assert.Equal(t, "io.cozy.testobject", e.Doc.DocType())
+		assert.Equal(t, EventCreate, e.Type)
+		wg.Done()
+	}()
+	go func() {
+		e := <-c3.Read()
+		assert.Equal(t, "testing", e.Domain)
+		assert.Equal(t, "foo", e.Doc.ID())
+		wg.Done()
+	}()
+	go func() {
+		for e := range l2.Read() {
+			t.Errorf("Unexpected local event on h2: %v", e)
+		}
+	}()
+
+	time.AfterFunc(1*time.Millisecond, func() {
+		h1.Publish(&Event{
+			Domain: "testing",
+			Type:   EventCreate,
+			Doc: &testDoc{
+				doctype: "io.cozy.testobject",
+				id:      "foo",
+				rev:     "1-abc",
+			},
+		})
+	})
+
+	wg.Wait()
+	assert.NoError(t, c1.Close())
+	assert.NoError(t, c2.Close())
+	assert.NoError(t, c3.Close())
+	assert.NoError(t, l2.Close())
+}
+
+func TestJSONDocValid(t *testing.T) {
+	doc, err := unmarshalJSONDoc("io.cozy.files", []byte(`{
+		"_id": "foo",
+		"class": "image",
+		"tags": ["bar", "baz"],
+		"referenced_by": [{"type": "io.cozy.photos.albums", "id": "album1"}]
+	}`))
+	assert.NoError(t, err)
+	assert.True(t, doc.Valid("class", "image"))
+	assert.False(t, doc.Valid("class", "video"))
+	assert.True(t, doc.Valid("tags", "baz"))
+	assert.True(t, doc.Valid("referenced_by", "io.cozy.photos.albums/album1"))
+	assert.True(t, doc.Valid("referenced_by", "album1"))
+	assert.False(t, doc.Valid("referenced_by", "io.cozy.photos.albums/album2"))
+	assert.False(t, doc.Valid("referenced_by", "io.cozy.contacts/album1"))
+	assert.False(t, doc.Valid("missing", "foo"))
+}
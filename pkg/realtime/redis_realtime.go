@@ -0,0 +1,214 @@
+package realtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/go-redis/redis"
+)
+
+// eventsRedisChannel is the redis pub/sub channel used to dispatch the events
+// to all the cozy-stack processes.
+const eventsRedisChannel = "realtime:events"
+
+// nodeIDSize is the size of the random identifier of a process, used to
+// ignore the events coming back from redis that were published locally.
+const nodeIDSize = 16
+
+type redisHub struct {
+	c      *redis.Client
+	nodeID string
+	// mem is used to dispatch the events (local or from other processes) to
+	// the subscribers of this process.
+	mem *memHub
+	// local only receives the events published by this process.
+	local *memHub
+}
+
+// redisEvent is the format of the events in the redis channel. The documents
+// are serialized in JSON and sent with their doctype.
+type redisEvent struct {
+	Node        string           `json:"node"`
+	Domain      string           `json:"domain"`
+	Type        string           `json:"type"`
+	DocType     string           `json:"doctype"`
+	Doc         json.RawMessage  `json:"doc"`
+	OldDoc      *json.RawMessage `json:"old,omitempty"`
+	TraceParent string           `json:"traceparent,omitempty"`
+}
+
+func newRedisHub(c *redis.Client) *redisHub {
+	hub := &redisHub{
+		c:      c,
+		nodeID: utils.RandomString(nodeIDSize),
+		mem:    newMemHub(),
+		local:  newMemHub(),
+	}
+	sub := c.Subscribe(eventsRedisChannel)
+	// Wait for the confirmation of the subscription, so that the events
+	// published after the creation of the hub are not lost.
+	if _, err := sub.Receive(); err != nil {
+		logger.WithNamespace("realtime-redis").
+			Errorf("Could not subscribe to %s: %s", eventsRedisChannel, err)
+	}
+	go hub.start(sub)
+	return hub
+}
+
+func (h *redisHub) start(sub *redis.PubSub) {
+	log := logger.WithNamespace("realtime-redis")
+	for msg := range sub.Channel() {
+		var re redisEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &re); err != nil {
+			log.Warnf("Invalid event on redis: %s", err)
+			continue
+		}
+		if re.Node == h.nodeID {
+			continue
+		}
+		e, err := re.toEvent()
+		if err != nil {
+			log.Warnf("Invalid document in event on redis: %s", err)
+			continue
+		}
+		h.mem.Publish(e)
+	}
+}
+
+func (h *redisHub) Publish(e *Event) {
+	h.mem.Publish(e)
+	h.local.Publish(e)
+	re, err := newRedisEvent(h.nodeID, e)
+	if err == nil {
+		var buf []byte
+		if buf, err = json.Marshal(re); err == nil {
+			err = h.c.Publish(eventsRedisChannel, string(buf)).Err()
+		}
+	}
+	if err != nil {
+		logger.WithDomain(e.Domain).
+			Errorf("[realtime] Could not publish event on redis: %s", err)
+	}
+}
+
+func (h *redisHub) Subscribe(domain, topicName string) EventChannel {
+	return h.mem.Subscribe(domain, topicName)
+}
+
+func (h *redisHub) SubscribeAll() EventChannel {
+	return h.mem.SubscribeAll()
+}
+
+func newRedisEvent(nodeID string, e *Event) (*redisEvent, error) {
+	doc, err := json.Marshal(e.Doc)
+	if err != nil {
+		return nil, err
+	}
+	re := &redisEvent{
+		Node:        nodeID,
+		Domain:      e.Domain,
+		Type:        e.Type,
+		DocType:     e.Doc.DocType(),
+		Doc:         doc,
+		TraceParent: e.TraceParent,
+	}
+	if e.OldDoc != nil {
+		old, err := json.Marshal(e.OldDoc)
+		if err != nil {
+			return nil, err
+		}
+		raw := json.RawMessage(old)
+		re.OldDoc = &raw
+	}
+	return re, nil
+}
+
+func (re *redisEvent) toEvent() (*Event, error) {
+	doc, err := unmarshalJSONDoc(re.DocType, re.Doc)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		Domain:      re.Domain,
+		Type:        re.Type,
+		Doc:         doc,
+		TraceParent: re.TraceParent,
+	}
+	if re.OldDoc != nil {
+		old, err := unmarshalJSONDoc(re.DocType, *re.OldDoc)
+		if err != nil {
+			return nil, err
+		}
+		e.OldDoc = old
+	}
+	return e, nil
+}
+
+// jsonDoc is the Doc used for the events coming from another process, where
+// the original type of the document is lost.
+type jsonDoc struct {
+	m       map[string]interface{}
+	doctype string
+}
+
+func unmarshalJSONDoc(doctype string, b []byte) (*jsonDoc, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &jsonDoc{m: m, doctype: doctype}, nil
+}
+
+func (j *jsonDoc) ID() string {
+	id, _ := j.m["_id"].(string)
+	return id
+}
+
+func (j *jsonDoc) Rev() string {
+	rev, _ := j.m["_rev"].(string)
+	return rev
+}
+
+func (j *jsonDoc) DocType() string { return j.doctype }
+
+func (j *jsonDoc) MarshalJSON() ([]byte, error) {
+	return json.Marshal(j.m)
+}
+
+// Valid implements permissions.Validable on jsonDoc, so that the @event
+// triggers can use a selector on the events coming from another process.
+func (j *jsonDoc) Valid(field, value string) bool {
+	switch v := j.m[field].(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if ref, ok := item.(map[string]interface{}); ok {
+				if validReference(ref, value) {
+					return true
+				}
+			} else if fmt.Sprint(item) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	default:
+		return fmt.Sprint(v) == value
+	}
+}
+
+// validReference checks a reference, like the items of referenced_by, with
+// the same syntax as the permissions: "doctype/id" or just "id".
+func validReference(ref map[string]interface{}, value string) bool {
+	typ, _ := ref["type"].(string)
+	id, _ := ref["id"].(string)
+	if parts := strings.SplitN(value, "/", 2); len(parts) == 2 {
+		return typ == parts[0] && id == parts[1]
+	}
+	return id == value
+}
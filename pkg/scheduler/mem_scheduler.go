@@ -173,6 +173,8 @@ func (s *MemScheduler) schedule(t Trigger) {
 		if _, err := s.broker.PushJob(req); err != nil {
 			log.Errorf("[jobs] trigger %s(%s): Could not schedule a new job: %s",
 				t.Type(), t.Infos().TID, err.Error())
+		} else {
+			countFiring(t)
 		}
 	}
 	s.log.Infof("[jobs] trigger %s(%s): Closing trigger",
@@ -0,0 +1,23 @@
+package scheduler
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// firingsCounter counts the jobs pushed by the triggers, by type of trigger
+// and worker type
+var firingsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "scheduler",
+		Name:      "trigger_firings_total",
+		Help:      "Number of jobs pushed by the triggers.",
+	},
+	[]string{"trigger_type", "worker_type"},
+)
+
+func countFiring(t Trigger) {
+	firingsCounter.WithLabelValues(t.Type(), t.Infos().WorkerType).Inc()
+}
+
+func init() {
+	prometheus.MustRegister(firingsCounter)
+}
@@ -103,7 +103,9 @@ func (s *RedisScheduler) pollLoop() {
 func (s *RedisScheduler) startEventDispatcher() {
 	eventsCh := make(chan *realtime.Event, 100)
 	go func() {
-		c := realtime.GetHub().SubscribeAll()
+		// Only the events published by this process are dispatched here: each
+		// process pushes the jobs for its own events.
+		c := realtime.GetLocalHub().SubscribeAll()
 		defer func() {
 			c.Close()
 			close(eventsCh)
@@ -153,6 +155,7 @@ func (s *RedisScheduler) eventLoop(ch <-chan *realtime.Event) {
 					event.Domain, triggerID, err.Error())
 				continue
 			}
+			countFiring(t)
 		}
 	}
 }
@@ -195,6 +198,7 @@ func (s *RedisScheduler) Poll(now int64) error {
 			if _, err = s.broker.PushJob(job); err != nil {
 				return err
 			}
+			countFiring(t)
 			if err = s.deleteTrigger(t); err != nil {
 				return err
 			}
@@ -203,6 +207,7 @@ func (s *RedisScheduler) Poll(now int64) error {
 			if _, err = s.broker.PushJob(job); err != nil {
 				return err
 			}
+			countFiring(t)
 			score, err := strconv.ParseInt(results[1].(string), 10, 64)
 			var prev time.Time
 			if err != nil {
@@ -10,6 +10,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/scheduler"
@@ -56,6 +57,26 @@ func (b *mockBroker) GetJobInfos(domain, id string) (*jobs.JobInfos, error) {
 	return nil, errors.New("Not implemented")
 }
 
+func (b *mockBroker) ListJobs(domain, workerType string, state jobs.State, cursor couchdb.Cursor) ([]*jobs.JobInfos, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) CancelJob(domain, id string) (*jobs.JobInfos, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) PurgeJobs(domain string, before time.Time) (int, error) {
+	return 0, errors.New("Not implemented")
+}
+
+func (b *mockBroker) ReplayJob(domain, id string) (*jobs.JobInfos, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (b *mockBroker) DiscardJob(domain, id string) error {
+	return errors.New("Not implemented")
+}
+
 func TestRedisSchedulerWithTimeTriggers(t *testing.T) {
 	var wAt sync.WaitGroup
 	var wIn sync.WaitGroup
@@ -119,7 +140,8 @@ func TestRedisSchedulerWithTimeTriggers(t *testing.T) {
 
 	ts, err := sch.GetAll(instanceName)
 	assert.NoError(t, err)
-	assert.Len(t, ts, 3) // 1 @event for thumbnails + 1 @at + 1 @in
+	// The triggers of the instance + 1 @at + 1 @in
+	assert.Len(t, ts, len(instance.Triggers(instanceName))+2)
 
 	for _, trigger := range ts {
 		switch trigger.Infos().TID {
@@ -128,9 +150,9 @@ func TestRedisSchedulerWithTimeTriggers(t *testing.T) {
 		case inID:
 			assert.Equal(t, in, trigger.Infos())
 		default:
-			// Just ignore the @event trigger for generating thumbnails
+			// Just ignore the @event and @every triggers of the instance
 			infos := trigger.Infos()
-			if infos.Type != "@event" || infos.WorkerType != "thumbnail" {
+			if infos.Type != "@event" && infos.Type != "@every" {
 				t.Fatalf("unknown trigger ID %s", trigger.Infos().TID)
 			}
 		}
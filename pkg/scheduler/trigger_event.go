@@ -57,7 +57,9 @@ func (t *EventTrigger) Valid(key, value string) bool {
 func (t *EventTrigger) Schedule() <-chan *jobs.JobRequest {
 	ch := make(chan *jobs.JobRequest)
 	go func() {
-		c := realtime.GetHub().Subscribe(t.infos.Domain, t.mask.Type)
+		// Only the events published by this process are listened: with a
+		// redis hub, each process pushes the jobs for its own events.
+		c := realtime.GetLocalHub().Subscribe(t.infos.Domain, t.mask.Type)
 		defer func() {
 			c.Close()
 			close(ch)
@@ -91,10 +93,11 @@ func (t *EventTrigger) Trigger(e *realtime.Event) *jobs.JobRequest {
 		logger.WithNamespace("event-trigger").Error(err)
 	}
 	return &jobs.JobRequest{
-		Domain:     t.infos.Domain,
-		WorkerType: t.infos.WorkerType,
-		Message:    msg,
-		Options:    t.infos.Options,
+		Domain:      t.infos.Domain,
+		WorkerType:  t.infos.WorkerType,
+		Message:     msg,
+		Options:     t.infos.Options,
+		TraceParent: e.TraceParent,
 	}
 }
 
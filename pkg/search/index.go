@@ -0,0 +1,265 @@
+package search
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// Document is what is indexed for a document of the instance: its name, if
+// it has one, and its textual content.
+type Document struct {
+	DocType string `json:"doctype"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// rebuildBatchSize is the number of documents sent at once to an index that
+// is rebuilt.
+const rebuildBatchSize = 100
+
+// errNoIndex is used when an index stored on disk has not been created yet
+var errNoIndex = errors.New("search: the index does not exist")
+
+// The indexes stored in memory, when search.path is empty, can't be reopened
+// and are kept for the life of the process.
+var (
+	memIndexesMu sync.Mutex
+	memIndexes   = make(map[string]bleve.Index)
+)
+
+// Doctypes returns the list of the doctypes that are indexed
+func Doctypes() []string {
+	doctypes := []string{consts.Files}
+	for _, doctype := range config.GetConfig().Search.Doctypes {
+		if doctype != consts.Files {
+			doctypes = append(doctypes, doctype)
+		}
+	}
+	return doctypes
+}
+
+func newMapping() mapping.IndexMapping {
+	doctype := bleve.NewTextFieldMapping()
+	doctype.Analyzer = keyword.Name
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("doctype", doctype)
+	doc.AddFieldMappingsAt("name", bleve.NewTextFieldMapping())
+	doc.AddFieldMappingsAt("content", bleve.NewTextFieldMapping())
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	return m
+}
+
+func indexPath(domain string) string {
+	return filepath.Join(config.GetConfig().Search.Path, domain)
+}
+
+// indexLock returns the lock that must be held while the index of an
+// instance stored on disk is opened.
+func indexLock(domain string) lock.ErrorRWLocker {
+	return lock.ReadWrite("search/" + domain)
+}
+
+func memIndex(domain string) (bleve.Index, error) {
+	memIndexesMu.Lock()
+	defer memIndexesMu.Unlock()
+	if index, ok := memIndexes[domain]; ok {
+		return index, nil
+	}
+	index, err := bleve.NewMemOnly(newMapping())
+	if err != nil {
+		return nil, err
+	}
+	memIndexes[domain] = index
+	return index, nil
+}
+
+// withIndex calls fn with the index of the instance. An index stored on disk
+// is opened for the call and closed after, under the lock of the index: the
+// processes of the stack that share the directory of the indexes can use them
+// in turn, and no index is kept opened. The index is opened read-only if
+// write is false, and errNoIndex is returned if it does not exist.
+func withIndex(domain string, write bool, fn func(index bleve.Index) error) error {
+	if config.GetConfig().Search.Path == "" {
+		index, err := memIndex(domain)
+		if err != nil {
+			return err
+		}
+		return fn(index)
+	}
+
+	mu := indexLock(domain)
+	if write {
+		if lockerr := mu.Lock(); lockerr != nil {
+			return lockerr
+		}
+		defer mu.Unlock()
+	} else {
+		if lockerr := mu.RLock(); lockerr != nil {
+			return lockerr
+		}
+		defer mu.RUnlock()
+	}
+
+	var index bleve.Index
+	var err error
+	path := indexPath(domain)
+	if write {
+		index, err = bleve.Open(path)
+		if err == bleve.ErrorIndexPathDoesNotExist {
+			index, err = bleve.New(path, newMapping())
+		}
+	} else {
+		index, err = bleve.OpenUsing(path, map[string]interface{}{"read_only": true})
+		if err == bleve.ErrorIndexPathDoesNotExist {
+			err = errNoIndex
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = fn(index)
+	if errc := index.Close(); err == nil {
+		err = errc
+	}
+	return err
+}
+
+func docKey(doctype, id string) string {
+	return doctype + "/" + id
+}
+
+func splitKey(key string) (doctype, id string) {
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return "", key
+	}
+	return parts[0], parts[1]
+}
+
+// Index adds or replaces a document in the index of the instance
+func Index(domain, id string, doc *Document) error {
+	return withIndex(domain, true, func(index bleve.Index) error {
+		return index.Index(docKey(doc.DocType, id), doc)
+	})
+}
+
+// Remove removes a document from the index of the instance
+func Remove(domain, doctype, id string) error {
+	return withIndex(domain, true, func(index bleve.Index) error {
+		return index.Delete(docKey(doctype, id))
+	})
+}
+
+// Batch is used to fill an index that is rebuilt
+type Batch struct {
+	index bleve.Index
+	batch *bleve.Batch
+}
+
+// Index adds a document to the rebuilt index
+func (b *Batch) Index(id string, doc *Document) error {
+	if err := b.batch.Index(docKey(doc.DocType, id), doc); err != nil {
+		return err
+	}
+	if b.batch.Size() < rebuildBatchSize {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *Batch) flush() error {
+	if b.batch.Size() == 0 {
+		return nil
+	}
+	err := b.index.Batch(b.batch)
+	b.batch.Reset()
+	return err
+}
+
+// Rebuild replaces the index of an instance by a new one, filled by the fill
+// function. The new index is built aside, without holding the lock of the
+// index: the searches use the old index meanwhile, and the changes indexed
+// during the rebuild are lost.
+func Rebuild(domain string, fill func(b *Batch) error) error {
+	var index bleve.Index
+	var tmp string
+	var err error
+	if config.GetConfig().Search.Path == "" {
+		index, err = bleve.NewMemOnly(newMapping())
+	} else {
+		tmp = indexPath(domain) + ".rebuild-" + utils.RandomString(8)
+		index, err = bleve.New(tmp, newMapping())
+	}
+	if err != nil {
+		return err
+	}
+
+	b := &Batch{index: index, batch: index.NewBatch()}
+	if err = fill(b); err == nil {
+		err = b.flush()
+	}
+
+	if tmp == "" {
+		if err != nil {
+			index.Close() // #nosec
+			return err
+		}
+		memIndexesMu.Lock()
+		old, ok := memIndexes[domain]
+		memIndexes[domain] = index
+		memIndexesMu.Unlock()
+		if ok {
+			return old.Close()
+		}
+		return nil
+	}
+
+	if errc := index.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		os.RemoveAll(tmp) // #nosec
+		return err
+	}
+	mu := indexLock(domain)
+	if lockerr := mu.Lock(); lockerr != nil {
+		os.RemoveAll(tmp) // #nosec
+		return lockerr
+	}
+	defer mu.Unlock()
+	if err = os.RemoveAll(indexPath(domain)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, indexPath(domain))
+}
+
+// DeleteIndex closes and removes the index of an instance
+func DeleteIndex(domain string) error {
+	if config.GetConfig().Search.Path == "" {
+		memIndexesMu.Lock()
+		defer memIndexesMu.Unlock()
+		if index, ok := memIndexes[domain]; ok {
+			delete(memIndexes, domain)
+			return index.Close()
+		}
+		return nil
+	}
+	mu := indexLock(domain)
+	if lockerr := mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer mu.Unlock()
+	return os.RemoveAll(indexPath(domain))
+}
@@ -0,0 +1,108 @@
+// Package search is the full-text search on the files and the documents of
+// the instances. Each instance has its own index, fed by the index worker
+// from the realtime events on the indexed doctypes, and rebuilt by the
+// reindex worker.
+package search
+
+import (
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// batchSize is the number of hits fetched at once from the index, before
+// they are filtered by the permissions.
+const batchSize = 100
+
+// maxScanned is the maximal number of hits looked at for a search, to avoid
+// scanning the whole index when the permissions reject most of them.
+const maxScanned = 1000
+
+// Hit is a document that matches the query
+type Hit struct {
+	DocType string
+	ID      string
+	Score   float64
+}
+
+// Query is a search in the index of an instance
+type Query struct {
+	// Q is the text searched, in the names and the contents
+	Q string
+	// DocType restricts the search to one doctype, if not empty
+	DocType string
+	// Limit is the maximal number of hits returned
+	Limit int
+	// Filter is called with each batch of hits, to keep only the documents
+	// that the caller can read. It must keep the order of the hits.
+	Filter func(hits []Hit) []Hit
+}
+
+// makeQuery combines, for the terms of the text, a fuzzy match in the names
+// and the contents, and a match of a substring of the names.
+func makeQuery(q *Query) query.Query {
+	name := bleve.NewMatchQuery(q.Q)
+	name.SetField("name")
+	name.SetFuzziness(1)
+	name.SetBoost(2)
+	content := bleve.NewMatchQuery(q.Q)
+	content.SetField("content")
+	content.SetFuzziness(1)
+	queries := []query.Query{name, content}
+	for _, term := range strings.Fields(strings.ToLower(q.Q)) {
+		term = strings.NewReplacer("*", "", "?", "").Replace(term)
+		if term == "" {
+			continue
+		}
+		substr := bleve.NewWildcardQuery("*" + term + "*")
+		substr.SetField("name")
+		queries = append(queries, substr)
+	}
+	var textQuery query.Query = bleve.NewDisjunctionQuery(queries...)
+	if q.DocType != "" {
+		doctype := bleve.NewTermQuery(q.DocType)
+		doctype.SetField("doctype")
+		textQuery = bleve.NewConjunctionQuery(textQuery, doctype)
+	}
+	return textQuery
+}
+
+// Search returns the documents of the instance that match the query, from
+// the most relevant to the least one.
+func Search(domain string, q *Query) ([]Hit, error) {
+	textQuery := makeQuery(q)
+	hits := []Hit{}
+	err := withIndex(domain, false, func(index bleve.Index) error {
+		for from := 0; from < maxScanned && len(hits) < q.Limit; from += batchSize {
+			req := bleve.NewSearchRequestOptions(textQuery, batchSize, from, false)
+			res, err := index.Search(req)
+			if err != nil {
+				return err
+			}
+			batch := make([]Hit, len(res.Hits))
+			for i, match := range res.Hits {
+				doctype, id := splitKey(match.ID)
+				batch[i] = Hit{DocType: doctype, ID: id, Score: match.Score}
+			}
+			if q.Filter != nil {
+				batch = q.Filter(batch)
+			}
+			if rest := q.Limit - len(hits); len(batch) > rest {
+				batch = batch[:rest]
+			}
+			hits = append(hits, batch...)
+			if len(res.Hits) < batchSize {
+				break
+			}
+		}
+		return nil
+	})
+	if err == errNoIndex {
+		return hits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
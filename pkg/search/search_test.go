@@ -0,0 +1,173 @@
+package search
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/stretchr/testify/assert"
+)
+
+const domain = "search.cozy.tools"
+
+func ids(hits []Hit) []string {
+	res := make([]string, len(hits))
+	for i, hit := range hits {
+		res[i] = hit.ID
+	}
+	return res
+}
+
+func TestSearch(t *testing.T) {
+	assert.NoError(t, Index(domain, "file1", &Document{
+		DocType: consts.Files,
+		Name:    "invoice-2018-03.pdf",
+		Content: "Electricity bill for the month of March",
+	}))
+	assert.NoError(t, Index(domain, "file2", &Document{
+		DocType: consts.Files,
+		Name:    "holidays.jpg",
+	}))
+	assert.NoError(t, Index(domain, "contact1", &Document{
+		DocType: "io.cozy.contacts",
+		Name:    "Alice Martin",
+		Content: "Alice Martin\nalice@example.com\nElectricity Company",
+	}))
+
+	// Match on the content, with a typo
+	hits, err := Search(domain, &Query{Q: "electrisity", Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, hits, 2)
+	assert.Contains(t, ids(hits), "file1")
+	assert.Contains(t, ids(hits), "contact1")
+
+	// Match on a substring of the name
+	hits, err = Search(domain, &Query{Q: "liday", Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file2"}, ids(hits))
+
+	// Filter on the doctype
+	hits, err = Search(domain, &Query{Q: "electricity", DocType: "io.cozy.contacts", Limit: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, "io.cozy.contacts", hits[0].DocType)
+		assert.Equal(t, "contact1", hits[0].ID)
+	}
+
+	// Filter with the permissions
+	hits, err = Search(domain, &Query{
+		Q:     "electricity",
+		Limit: 10,
+		Filter: func(hits []Hit) []Hit {
+			var allowed []Hit
+			for _, hit := range hits {
+				if hit.DocType == consts.Files {
+					allowed = append(allowed, hit)
+				}
+			}
+			return allowed
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file1"}, ids(hits))
+
+	// Limit
+	hits, err = Search(domain, &Query{Q: "electricity", Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+
+	// Removal
+	assert.NoError(t, Remove(domain, consts.Files, "file1"))
+	hits, err = Search(domain, &Query{Q: "electricity", Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"contact1"}, ids(hits))
+
+	// Another instance has its own index
+	hits, err = Search("other."+domain, &Query{Q: "electricity", Limit: 10})
+	assert.NoError(t, err)
+	assert.Empty(t, hits)
+
+	assert.NoError(t, DeleteIndex(domain))
+	hits, err = Search(domain, &Query{Q: "electricity", Limit: 10})
+	assert.NoError(t, err)
+	assert.Empty(t, hits)
+}
+
+func TestRebuild(t *testing.T) {
+	rebuilt := "rebuild." + domain
+	defer DeleteIndex(rebuilt) // #nosec
+	assert.NoError(t, Index(rebuilt, "old", &Document{
+		DocType: consts.Files,
+		Name:    "old-invoice.pdf",
+	}))
+
+	err := Rebuild(rebuilt, func(b *Batch) error {
+		for i := 0; i < rebuildBatchSize+10; i++ {
+			err := b.Index(fmt.Sprintf("file%d", i), &Document{
+				DocType: consts.Files,
+				Name:    fmt.Sprintf("invoice-%d.pdf", i),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	hits, err := Search(rebuilt, &Query{Q: "invoice", Limit: 1000})
+	assert.NoError(t, err)
+	assert.Len(t, hits, rebuildBatchSize+10)
+	assert.NotContains(t, ids(hits), "old")
+}
+
+func TestIndexOnDisk(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cozy-search")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	config.GetConfig().Search.Path = tempdir
+	defer func() { config.GetConfig().Search.Path = "" }()
+
+	// No index is created for a search
+	hits, err := Search(domain, &Query{Q: "holidays", Limit: 10})
+	assert.NoError(t, err)
+	assert.Empty(t, hits)
+	_, err = os.Stat(filepath.Join(tempdir, domain))
+	assert.True(t, os.IsNotExist(err))
+
+	// The index is closed after each operation, and reopened for the next one
+	assert.NoError(t, Index(domain, "file2", &Document{
+		DocType: consts.Files,
+		Name:    "holidays.jpg",
+	}))
+	hits, err = Search(domain, &Query{Q: "holidays", Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file2"}, ids(hits))
+
+	err = Rebuild(domain, func(b *Batch) error {
+		return b.Index("file3", &Document{DocType: consts.Files, Name: "holidays-2.jpg"})
+	})
+	assert.NoError(t, err)
+	hits, err = Search(domain, &Query{Q: "holidays", Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file3"}, ids(hits))
+
+	assert.NoError(t, DeleteIndex(domain))
+	_, err = os.Stat(filepath.Join(tempdir, domain))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	config.GetConfig().Search.Path = ""
+	res := m.Run()
+	DeleteIndex(domain)            // #nosec
+	DeleteIndex("other." + domain) // #nosec
+	os.Exit(res)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -28,15 +29,27 @@ var (
 	ErrNoCookie = errors.New("No session cookie")
 	// ErrInvalidID is returned by GetSession if the cookie contains wrong ID
 	ErrInvalidID = errors.New("Session cookie has wrong ID")
+	// ErrTwoFactorRequired is returned by GetSession if the session has been
+	// opened without the second factor, and the two-factor authentication is
+	// now enabled for the instance
+	ErrTwoFactorRequired = errors.New("Session has not been opened with the second factor")
 )
 
 // A Session is an instance opened in a browser
 type Session struct {
-	Instance *instance.Instance `json:"-"`
-	DocID    string             `json:"_id,omitempty"`
-	DocRev   string             `json:"_rev,omitempty"`
-	LastSeen time.Time          `json:"last_seen,omitempty"`
-	Closed   bool               `json:"closed"`
+	Instance  *instance.Instance `json:"-"`
+	DocID     string             `json:"_id,omitempty"`
+	DocRev    string             `json:"_rev,omitempty"`
+	CreatedAt time.Time          `json:"created_at"`
+	LastSeen  time.Time          `json:"last_seen,omitempty"`
+	Closed    bool               `json:"closed"`
+	// UserAgent and IP describe the browser that has opened the session, to
+	// help the user recognize it in the list of their sessions
+	UserAgent string `json:"user_agent,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	// TwoFactor is true if the second factor has been checked when the
+	// session was opened
+	TwoFactor bool `json:"two_factor,omitempty"`
 }
 
 // DocType implements couchdb.Doc
@@ -65,17 +78,74 @@ func (s *Session) OlderThan(t time.Duration) bool {
 	return time.Now().After(s.LastSeen.Add(t))
 }
 
-// New creates a session in couchdb for the given instance
-func New(i *instance.Instance) (*Session, error) {
+// New creates a session in couchdb for the given instance. The request is
+// used to keep the user-agent and IP address of the browser, and can be nil.
+// twoFactor tells if the second factor has been checked to open this session.
+func New(i *instance.Instance, req *http.Request, twoFactor bool) (*Session, error) {
+	now := time.Now()
 	var s = &Session{
-		Instance: i,
-		LastSeen: time.Now(),
-		Closed:   false,
+		Instance:  i,
+		CreatedAt: now,
+		LastSeen:  now,
+		Closed:    false,
+		TwoFactor: twoFactor,
+	}
+	if req != nil {
+		s.UserAgent = req.UserAgent()
+		s.IP = config.ClientIP(req)
 	}
 
 	return s, couchdb.CreateDoc(i, s)
 }
 
+// Get returns the session with the given identifier
+func Get(i *instance.Instance, sessionID string) (*Session, error) {
+	var s Session
+	err := couchdb.GetDoc(i, consts.Sessions, sessionID, &s)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrInvalidID
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Instance = i
+	return &s, nil
+}
+
+// GetAll returns all the sessions of the instance
+func GetAll(i *instance.Instance) ([]*Session, error) {
+	var list []*Session
+	err := couchdb.GetAllDocs(i, consts.Sessions, &couchdb.AllDocsRequest{}, &list)
+	if couchdb.IsNoDatabaseError(err) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		s.Instance = i
+	}
+	return list, nil
+}
+
+// DeleteOthers deletes all the sessions of the instance, except the one with
+// the given identifier (it can be empty to delete all the sessions)
+func DeleteOthers(i *instance.Instance, sessionID string) error {
+	list, err := GetAll(i)
+	if err != nil {
+		return err
+	}
+	for _, s := range list {
+		if s.ID() == sessionID {
+			continue
+		}
+		if err := couchdb.DeleteDoc(i, s); err != nil && !couchdb.IsNotFoundError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetSession retrieves the session from a echo.Context
 func GetSession(c echo.Context, i *instance.Instance) (*Session, error) {
 	var s Session
@@ -99,13 +169,20 @@ func GetSession(c echo.Context, i *instance.Instance) (*Session, error) {
 	}
 
 	err = couchdb.GetDoc(i, consts.Sessions, string(sessionID), &s)
-	// invalid session id
+	// invalid session id, or the session has been revoked
 	if couchdb.IsNotFoundError(err) {
 		return nil, ErrInvalidID
 	}
 	if err != nil {
 		return nil, err
 	}
+	if s.Closed {
+		return nil, ErrInvalidID
+	}
+	s.Instance = i
+	if i.HasTwoFactor() && !s.TwoFactor {
+		return nil, ErrTwoFactorRequired
+	}
 
 	// if the session is older than half its maxAgeDuration,
 	// save the new LastSeen
@@ -0,0 +1,317 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+const (
+	// queueSize is the number of ended spans that can wait for the exporter.
+	// The spans are dropped when the queue is full.
+	queueSize = 2048
+	// batchSize is the maximal number of spans exported at once
+	batchSize = 256
+	// flushInterval is the maximal duration a span waits before its export
+	flushInterval = 5 * time.Second
+)
+
+// serviceName is the name of the service in the exported traces
+const serviceName = "cozy-stack"
+
+var log = logger.WithNamespace("trace")
+
+// Exporter sends the spans to a backend
+type Exporter interface {
+	Export(spans []*SpanData) error
+	Close() error
+}
+
+// Init configures the exporter of the traces
+func Init(conf config.Tracing) error {
+	var e Exporter
+	var err error
+	switch conf.Exporter {
+	case "":
+		return nil
+	case "otlp":
+		e, err = NewOTLPExporter(conf.Endpoint)
+	case "file":
+		e, err = NewFileExporter(conf.File)
+	default:
+		err = fmt.Errorf("trace: unknown exporter %q", conf.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+	Use(e)
+	return nil
+}
+
+// processor batches the ended spans and sends them to the exporter, in its
+// own goroutine.
+type processor struct {
+	exporter Exporter
+	queue    chan *SpanData
+	done     chan struct{}
+}
+
+var (
+	procMu sync.RWMutex
+	proc   *processor
+)
+
+// Enabled returns true if the spans are exported
+func Enabled() bool {
+	procMu.RLock()
+	defer procMu.RUnlock()
+	return proc != nil
+}
+
+// Use sets the exporter of the spans. The previous exporter, if any, is
+// flushed and closed. Use(nil) disables the tracing.
+func Use(e Exporter) {
+	procMu.Lock()
+	old := proc
+	proc = nil
+	if e != nil {
+		proc = &processor{
+			exporter: e,
+			queue:    make(chan *SpanData, queueSize),
+			done:     make(chan struct{}),
+		}
+		go proc.loop()
+	}
+	procMu.Unlock()
+	if old != nil {
+		close(old.queue)
+		<-old.done
+	}
+}
+
+func export(data *SpanData) {
+	procMu.RLock()
+	defer procMu.RUnlock()
+	if proc == nil {
+		return
+	}
+	select {
+	case proc.queue <- data:
+	default:
+		log.Warnf("Queue is full, dropping span %s", data.Name)
+	}
+}
+
+func (p *processor) loop() {
+	defer close(p.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]*SpanData, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.exporter.Export(batch); err != nil {
+			log.Errorf("Cannot export %d spans: %s", len(batch), err)
+		}
+		batch = make([]*SpanData, 0, batchSize)
+	}
+	for {
+		select {
+		case data, ok := <-p.queue:
+			if !ok {
+				flush()
+				if err := p.exporter.Close(); err != nil {
+					log.Errorf("Cannot close the exporter: %s", err)
+				}
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// fileExporter writes the spans in a file, one JSON object per line. It is
+// useful for testing without a collector.
+type fileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter returns an exporter that appends the spans to the given
+// file, as JSON lines.
+func NewFileExporter(filename string) (Exporter, error) {
+	if filename == "" {
+		return nil, fmt.Errorf("trace: missing file for the file exporter")
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: f}, nil
+}
+
+func (e *fileExporter) Export(spans []*SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := json.NewEncoder(e.file)
+	for _, span := range spans {
+		if err := enc.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *fileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// otlpExporter sends the spans to an OpenTelemetry collector, with the
+// OTLP/HTTP protocol and the JSON encoding.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+// NewOTLPExporter returns an exporter that sends the spans to the OTLP/HTTP
+// collector at the given endpoint, like http://localhost:4318.
+func NewOTLPExporter(endpoint string) (Exporter, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("trace: missing endpoint for the otlp exporter")
+	}
+	u := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(u, "/v1/traces") {
+		u += "/v1/traces"
+	}
+	return &otlpExporter{
+		url:    u,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (e *otlpExporter) Export(spans []*SpanData) error {
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("trace: collector responded with %d: %s",
+			res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() error { return nil }
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpKinds are the values of the kinds of spans in the OTLP protocol
+var otlpKinds = map[Kind]int{
+	KindInternal: 1,
+	KindServer:   2,
+	KindClient:   3,
+	KindConsumer: 5,
+}
+
+// otlpRequest returns the body of an OTLP request for the given spans. In the
+// JSON encoding, the identifiers are in hexadecimal and the 64 bits integers
+// are strings.
+func otlpRequest(spans []*SpanData) map[string]interface{} {
+	list := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		span := otlpSpan{
+			TraceID:      s.TraceID,
+			SpanID:       s.SpanID,
+			ParentSpanID: s.ParentID,
+			Name:         s.Name,
+			Kind:         otlpKinds[s.Kind],
+			Start:        strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		for k, v := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpKeyValue{k, otlpValue(v)})
+		}
+		if s.Error != "" {
+			span.Status = otlpStatus{Code: 2, Message: s.Error}
+		}
+		list[i] = span
+	}
+	resource := map[string]interface{}{
+		"attributes": []otlpKeyValue{
+			{"service.name", otlpValue(serviceName)},
+		},
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": resource,
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": serviceName},
+						"spans": list,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
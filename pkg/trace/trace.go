@@ -0,0 +1,268 @@
+// Package trace is used to follow a request through the stack: a span is
+// started for the HTTP request, and child spans are created for the calls to
+// CouchDB, the operations on the VFS and the jobs pushed by this request. The
+// spans are exported to an OTLP collector, or to a local file.
+//
+// The tracing is disabled when no exporter is configured. In this case, the
+// spans are nil, and all the methods of a nil span are no-op, so the callers
+// don't have to check if the tracing is enabled.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is the role of a span in the trace
+type Kind string
+
+const (
+	// KindInternal is for an operation inside the stack
+	KindInternal Kind = "internal"
+	// KindServer is for the handling of an HTTP request
+	KindServer Kind = "server"
+	// KindClient is for a request sent to another service, like CouchDB
+	KindClient Kind = "client"
+	// KindConsumer is for the execution of a job
+	KindConsumer Kind = "consumer"
+)
+
+// TraceParentHeader is the HTTP header used to propagate the trace context,
+// as defined by https://www.w3.org/TR/trace-context/
+const TraceParentHeader = "traceparent"
+
+const (
+	traceIDLen = 16
+	spanIDLen  = 8
+)
+
+// Carrier is implemented by the objects that are tied to a traced request,
+// like the instances, so that the packages that receive them can add their
+// own spans.
+type Carrier interface {
+	Span() *Span
+}
+
+// Span is an operation of a trace, with its duration. It is safe to use a
+// span from several goroutines.
+type Span struct {
+	mu         sync.Mutex
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       Kind
+	start      time.Time
+	attributes map[string]interface{}
+	err        string
+	ended      bool
+}
+
+// SpanData is the immutable copy of an ended span, given to the exporters
+type SpanData struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       Kind                   `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+// Start returns a new span, at the root of a new trace. It returns nil if the
+// tracing is disabled.
+func Start(name string, kind Kind) *Span {
+	if !Enabled() {
+		return nil
+	}
+	return newSpan(randomID(traceIDLen), "", name, kind)
+}
+
+// StartRemote returns a new span, whose parent is given by a traceparent
+// value, like the one of the HTTP header. If the traceparent is empty or
+// invalid, the span is at the root of a new trace. It returns nil if the
+// tracing is disabled.
+func StartRemote(name, traceparent string, kind Kind) *Span {
+	if !Enabled() {
+		return nil
+	}
+	traceID, parentID, ok := ParseTraceParent(traceparent)
+	if !ok {
+		return Start(name, kind)
+	}
+	return newSpan(traceID, parentID, name, kind)
+}
+
+// FromCarrier returns the span of the given object if it is a Carrier, or nil
+func FromCarrier(v interface{}) *Span {
+	if c, ok := v.(Carrier); ok {
+		return c.Span()
+	}
+	return nil
+}
+
+func newSpan(traceID, parentID, name string, kind Kind) *Span {
+	return &Span{
+		traceID:  traceID,
+		spanID:   randomID(spanIDLen),
+		parentID: parentID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+}
+
+// Child returns a new span, in the same trace, whose parent is s
+func (s *Span) Child(name string, kind Kind) *Span {
+	if s == nil {
+		return nil
+	}
+	return newSpan(s.traceID, s.spanID, name, kind)
+}
+
+// SetName changes the name of the span, when it is known only at the end of
+// the operation, like the route of an HTTP request.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute adds a key-value pair to the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, if err is not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End records the end of the operation, and sends the span to the exporter.
+// The calls after the first one are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := &SpanData{
+		TraceID:    s.traceID,
+		SpanID:     s.spanID,
+		ParentID:   s.parentID,
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attributes,
+		Error:      s.err,
+	}
+	// The map is now owned by the exporter
+	s.attributes = nil
+	s.mu.Unlock()
+	export(data)
+}
+
+// TraceID returns the identifier of the trace, in hexadecimal
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.traceID
+}
+
+// SpanID returns the identifier of the span, in hexadecimal
+func (s *Span) SpanID() string {
+	if s == nil {
+		return ""
+	}
+	return s.spanID
+}
+
+// TraceParent returns the traceparent value to propagate the span to
+// another process or to a job, or an empty string for a nil span.
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.traceID, s.spanID)
+}
+
+// ParseTraceParent extracts the trace and parent span identifiers from a
+// traceparent value.
+func ParseTraceParent(traceparent string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, spanID = strings.ToLower(parts[1]), strings.ToLower(parts[2])
+	if !isHexID(traceID, traceIDLen) || !isHexID(spanID, spanIDLen) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// isHexID returns true if id is the hexadecimal form of n bytes, not all
+// zero, as required for the identifiers of traces and spans.
+func isHexID(id string, n int) bool {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != n {
+		return false
+	}
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// NewContext returns a copy of the context that carries the span
+func NewContext(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// FromContext returns the span of the context, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
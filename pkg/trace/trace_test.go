@@ -0,0 +1,130 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, ok := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+
+	_, _, ok = ParseTraceParent("")
+	assert.False(t, ok)
+	_, _, ok = ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-01")
+	assert.False(t, ok)
+	_, _, ok = ParseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	assert.False(t, ok)
+	_, _, ok = ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-xyz067aa0ba902b7-01")
+	assert.False(t, ok)
+	_, _, ok = ParseTraceParent("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.False(t, ok)
+}
+
+func TestDisabled(t *testing.T) {
+	Use(nil)
+	span := Start("test", KindInternal)
+	assert.Nil(t, span)
+	// The methods of a nil span are no-op
+	child := span.Child("child", KindClient)
+	assert.Nil(t, child)
+	child.SetAttribute("foo", "bar")
+	child.SetError(errors.New("failure"))
+	child.End()
+	assert.Equal(t, "", child.TraceParent())
+}
+
+func TestFileExporter(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "cozy-trace")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	filename := path.Join(tmp, "traces.json")
+	e, err := NewFileExporter(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	Use(e)
+
+	root := StartRemote("GET /files/:file-id",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", KindServer)
+	if !assert.NotNil(t, root) {
+		Use(nil)
+		return
+	}
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID())
+	child := root.Child("couchdb GET", KindClient)
+	child.SetAttribute("http.status_code", 404)
+	child.SetError(errors.New("not_found"))
+	child.End()
+	child.End()
+	root.End()
+
+	// Use flushes the spans of the previous exporter
+	Use(nil)
+
+	f, err := os.Open(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	var spans []*SpanData
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s SpanData
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &s))
+		spans = append(spans, &s)
+	}
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	assert.Equal(t, "couchdb GET", spans[0].Name)
+	assert.Equal(t, root.TraceID(), spans[0].TraceID)
+	assert.Equal(t, root.SpanID(), spans[0].ParentID)
+	assert.Equal(t, "not_found", spans[0].Error)
+	assert.EqualValues(t, 404, spans[0].Attributes["http.status_code"])
+	assert.Equal(t, "GET /files/:file-id", spans[1].Name)
+	assert.Equal(t, "00f067aa0ba902b7", spans[1].ParentID)
+	assert.Equal(t, KindServer, spans[1].Kind)
+}
+
+func TestOTLPRequest(t *testing.T) {
+	span := &SpanData{
+		TraceID:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:     "00f067aa0ba902b7",
+		Name:       "job thumbnail",
+		Kind:       KindConsumer,
+		Attributes: map[string]interface{}{"job.id": "123"},
+		Error:      "timeout",
+	}
+	body, err := json.Marshal(otlpRequest([]*SpanData{span}))
+	assert.NoError(t, err)
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &req))
+	if assert.Len(t, req.ResourceSpans, 1) && assert.Len(t, req.ResourceSpans[0].ScopeSpans, 1) {
+		spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, "00f067aa0ba902b7", spans[0].SpanID)
+			assert.Equal(t, 5, spans[0].Kind)
+			assert.Equal(t, 2, spans[0].Status.Code)
+			assert.Equal(t, "job.id", spans[0].Attributes[0].Key)
+			assert.Equal(t, "123", spans[0].Attributes[0].Value["stringValue"])
+		}
+	}
+}
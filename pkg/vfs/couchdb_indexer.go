@@ -65,6 +65,68 @@ func (c *couchdbIndexer) DiskUsage() (int64, error) {
 	if !ok {
 		return 0, ErrWrongCouchdbState
 	}
+	versions, err := c.versionsUsage()
+	if err != nil {
+		return 0, err
+	}
+	return int64(f64) + versions, nil
+}
+
+func (c *couchdbIndexer) DiskUsageDetails() (*DiskUsageDetails, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.DiskUsageByClassView, &couchdb.ViewRequest{
+		Reduce:     true,
+		GroupLevel: 2,
+	}, &doc)
+	if err != nil {
+		return nil, err
+	}
+	details := &DiskUsageDetails{ByClass: make(map[string]int64)}
+	for _, row := range doc.Rows {
+		// The key is [trashed, class]
+		key, ok := row.Key.([]interface{})
+		if !ok || len(key) != 2 {
+			return nil, ErrWrongCouchdbState
+		}
+		f64, ok := row.Value.(float64)
+		if !ok {
+			return nil, ErrWrongCouchdbState
+		}
+		if trashed, _ := key[0].(bool); trashed {
+			details.Trash += int64(f64)
+			continue
+		}
+		class, _ := key[1].(string)
+		details.ByClass[class] += int64(f64)
+	}
+	details.Versions, err = c.versionsUsage()
+	if err != nil {
+		return nil, err
+	}
+	return details, nil
+}
+
+// versionsUsage computes the total size of the old versions of the files.
+func (c *couchdbIndexer) versionsUsage() (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.FilesVersionsByFileView, &couchdb.ViewRequest{
+		Reduce: true,
+	}, &doc)
+	// the database of the versions is only created with its views, and there
+	// is nothing to count if it does not exist.
+	if couchdb.IsNotFoundError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	f64, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
 	return int64(f64), nil
 }
 
@@ -371,3 +433,85 @@ func (c *couchdbIndexer) DirChildExists(dirID, name string) (bool, error) {
 	}
 	return int(f64) > 0, nil
 }
+
+func (c *couchdbIndexer) CreateVersion(v *Version) error {
+	return couchdb.CreateDoc(c.db, v)
+}
+
+func (c *couchdbIndexer) DeleteVersion(v *Version) error {
+	return couchdb.DeleteDoc(c.db, v)
+}
+
+func (c *couchdbIndexer) VersionByID(versionID string) (*Version, error) {
+	v := &Version{}
+	err := couchdb.GetDoc(c.db, consts.FilesVersions, versionID, v)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c *couchdbIndexer) AllVersions(fileID string) ([]*Version, error) {
+	// consts.FilesVersionsByFileView keys are [fileID, createdAt]
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(c.db, consts.FilesVersionsByFileView, &couchdb.ViewRequest{
+		StartKey:    []string{fileID},
+		EndKey:      []string{fileID, couchdb.MaxString},
+		IncludeDocs: true,
+	}, &res)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]*Version, len(res.Rows))
+	for i, row := range res.Rows {
+		var v Version
+		if err := json.Unmarshal(*row.Doc, &v); err != nil {
+			return nil, err
+		}
+		versions[i] = &v
+	}
+	return versions, nil
+}
+
+func (c *couchdbIndexer) CreateUploadSession(s *UploadSession) error {
+	return couchdb.CreateDoc(c.db, s)
+}
+
+func (c *couchdbIndexer) UpdateUploadSession(s *UploadSession) error {
+	return couchdb.UpdateDoc(c.db, s)
+}
+
+func (c *couchdbIndexer) DeleteUploadSession(s *UploadSession) error {
+	return couchdb.DeleteDoc(c.db, s)
+}
+
+func (c *couchdbIndexer) UploadSessionByID(sessionID string) (*UploadSession, error) {
+	s := &UploadSession{}
+	err := couchdb.GetDoc(c.db, consts.FilesUploads, sessionID, s)
+	if couchdb.IsNotFoundError(err) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *couchdbIndexer) AllUploadSessions() ([]*UploadSession, error) {
+	var sessions []*UploadSession
+	err := couchdb.GetAllDocs(c.db, consts.FilesUploads, &couchdb.AllDocsRequest{}, &sessions)
+	if couchdb.IsNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
@@ -26,6 +26,8 @@ type DirDoc struct {
 	// Parent directory identifier
 	DirID       string `json:"dir_id"`
 	RestorePath string `json:"restore_path,omitempty"`
+	// TrashedAt is the date when the directory was put in the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -199,6 +201,7 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 		Name:        &olddoc.DocName,
 		DirID:       &olddoc.DirID,
 		RestorePath: &olddoc.RestorePath,
+		TrashedAt:   olddoc.TrashedAt,
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
 	}, patch, cdate)
@@ -218,6 +221,9 @@ func ModifyDirMetadata(fs VFS, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error)
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	if newdoc.RestorePath != "" {
+		newdoc.TrashedAt = patch.TrashedAt
+	}
 	newdoc.CreatedAt = cdate
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.ReferencedBy = olddoc.ReferencedBy
@@ -255,6 +261,7 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now()
 
 	if err = setTrashedForFilesInsideDir(fs, olddoc, true); err != nil {
 		return nil, err
@@ -265,6 +272,7 @@ func TrashDir(fs VFS, olddoc *DirDoc) (*DirDoc, error) {
 		newdoc, err = ModifyDirMetadata(fs, olddoc, &DocPatch{
 			DirID:       &trashDirID,
 			RestorePath: &restorePath,
+			TrashedAt:   &trashedAt,
 			Name:        &name,
 		})
 		return err
@@ -0,0 +1,417 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+)
+
+// The encrypted content of a file starts with a header, made of a magic
+// string and of a random prefix for the nonces. It is followed by the chunks
+// of the plain content, of encChunkSize bytes except for the last one, each
+// sealed with AES-256-GCM. The nonce of a chunk is made of the prefix and of
+// the index of the chunk, and its additional data tells if it is the last
+// chunk: the chunks can't be reordered, and a truncated content is detected.
+const (
+	encMagic      = "CZE1"
+	encPrefixSize = 8
+	encHeaderSize = len(encMagic) + encPrefixSize
+	encChunkSize  = 64 << 10 // 64 KiB
+	encOverhead   = 16       // the GCM tag
+)
+
+var (
+	encNotLast = []byte{0}
+	encLast    = []byte{1}
+)
+
+// Cipher encrypts and decrypts the content of the files of an instance with
+// its data key. A nil *Cipher is valid, and leaves the content in clear.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a cipher for the given 256 bits data key.
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New("vfs: the data key must be 32 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead}, nil
+}
+
+// EncryptedSize returns the size of the stored content for a plain content
+// of the given size. A negative size is returned unchanged.
+func (c *Cipher) EncryptedSize(size int64) int64 {
+	if c == nil || size < 0 {
+		return size
+	}
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encHeaderSize) + size + chunks*encOverhead
+}
+
+// PlainSize returns the size of the plain content for a stored content of
+// the given size. It is the reverse of EncryptedSize, and it is used when the
+// plain size is not known, as for the thumbnails.
+func (c *Cipher) PlainSize(size int64) int64 {
+	if c == nil || size < 0 {
+		return size
+	}
+	size -= int64(encHeaderSize)
+	sealed := int64(encChunkSize + encOverhead)
+	chunks, rest := size/sealed, size%sealed
+	if rest == 0 && chunks > 0 {
+		return chunks * encChunkSize
+	}
+	if rest < encOverhead {
+		return 0
+	}
+	return chunks*encChunkSize + rest - encOverhead
+}
+
+func (c *Cipher) nonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], uint32(index))
+	return nonce
+}
+
+// EncryptWriter returns a writer that encrypts what is written before
+// sending it to w. It must be closed to write the last chunk.
+func (c *Cipher) EncryptWriter(w io.WriteCloser) io.WriteCloser {
+	if c == nil {
+		return w
+	}
+	return &encryptWriter{
+		c:      c,
+		w:      w,
+		prefix: crypto.GenerateRandomBytes(encPrefixSize),
+		buf:    make([]byte, 0, encChunkSize),
+	}
+}
+
+type encryptWriter struct {
+	c      *Cipher
+	w      io.WriteCloser
+	prefix []byte
+	buf    []byte // the plain content of the current chunk
+	out    []byte // the sealed chunk
+	index  int64
+	err    error
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is sealed only when more content comes, as the last
+		// chunk is sealed differently
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	if e.index == 0 {
+		header := append([]byte(encMagic), e.prefix...)
+		if _, err := e.w.Write(header); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	ad := encNotLast
+	if last {
+		ad = encLast
+	}
+	e.out = e.c.aead.Seal(e.out[:0], e.c.nonce(e.prefix, e.index), e.buf, ad)
+	if _, err := e.w.Write(e.out); err != nil {
+		e.err = err
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+func (e *encryptWriter) Close() error {
+	err := e.err
+	if err == nil {
+		err = e.seal(true)
+	}
+	if errc := e.w.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	return err
+}
+
+// DecryptFile returns a file handler for reading the plain content of an
+// encrypted file, with the given plain size. The header is read immediately.
+func (c *Cipher) DecryptFile(f File, size int64) (File, error) {
+	if c == nil {
+		return f, nil
+	}
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close() // #nosec
+		return nil, ErrInvalidEncryptedContent
+	}
+	if !bytes.Equal(header[:len(encMagic)], []byte(encMagic)) {
+		f.Close() // #nosec
+		return nil, ErrInvalidEncryptedContent
+	}
+	chunks := (size + encChunkSize - 1) / encChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return &decryptFile{
+		c:      c,
+		f:      f,
+		size:   size,
+		chunks: chunks,
+		prefix: header[len(encMagic):],
+		fpos:   int64(encHeaderSize),
+		index:  -1,
+	}, nil
+}
+
+// decryptFile gives a random access to the plain content of an encrypted
+// file. It decrypts the chunk where the content is read, and keeps it for the
+// next reads. The underlying file is only read sequentially, with a seek when
+// a chunk is not the next one, as some backends can't do better.
+type decryptFile struct {
+	mu     sync.Mutex
+	c      *Cipher
+	f      File
+	size   int64 // size of the plain content
+	chunks int64 // number of chunks
+	prefix []byte
+	pos    int64 // position in the plain content for Read and Seek
+	fpos   int64 // position in the underlying file
+	index  int64 // index of the decrypted chunk
+	chunk  []byte
+	sealed []byte
+}
+
+// readChunk returns the plain content of the chunk with the given index
+func (d *decryptFile) readChunk(index int64) ([]byte, error) {
+	if index == d.index {
+		return d.chunk, nil
+	}
+	length := d.size - index*encChunkSize
+	if length > encChunkSize {
+		length = encChunkSize
+	}
+	off := int64(encHeaderSize) + index*(encChunkSize+encOverhead)
+	if d.fpos != off {
+		if _, err := d.f.Seek(off, io.SeekStart); err != nil {
+			return nil, err
+		}
+		d.fpos = off
+	}
+	if cap(d.sealed) < encChunkSize+encOverhead {
+		d.sealed = make([]byte, encChunkSize+encOverhead)
+	}
+	sealed := d.sealed[:length+encOverhead]
+	n, err := io.ReadFull(d.f, sealed)
+	d.fpos += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrInvalidEncryptedContent
+	}
+	if err != nil {
+		return nil, err
+	}
+	ad := encNotLast
+	if index == d.chunks-1 {
+		ad = encLast
+	}
+	d.chunk, err = d.c.aead.Open(d.chunk[:0], d.c.nonce(d.prefix, index), sealed, ad)
+	if err != nil {
+		d.index = -1
+		return nil, ErrInvalidEncryptedContent
+	}
+	d.index = index
+	return d.chunk, nil
+}
+
+func (d *decryptFile) readAt(p []byte, off int64) (int, error) {
+	read := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return read, io.EOF
+		}
+		index := off / encChunkSize
+		chunk, err := d.readChunk(index)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p, chunk[off-index*encChunkSize:])
+		p = p[n:]
+		off += int64(n)
+		read += n
+	}
+	return read, nil
+}
+
+func (d *decryptFile) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	// Read at most until the end of the current chunk
+	end := (d.pos/encChunkSize + 1) * encChunkSize
+	if int64(len(p)) > end-d.pos {
+		p = p[:end-d.pos]
+	}
+	n, err := d.readAt(p, d.pos)
+	d.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *decryptFile) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readAt(p, off)
+}
+
+func (d *decryptFile) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptFile) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *decryptFile) Close() error {
+	return d.f.Close()
+}
+
+// DecryptReader returns a reader of the plain content of an encrypted
+// content, that is read sequentially.
+func (c *Cipher) DecryptReader(r io.ReadCloser) io.ReadCloser {
+	if c == nil {
+		return r
+	}
+	return &decryptReader{
+		c:      c,
+		r:      bufio.NewReaderSize(r, encChunkSize+encOverhead+1),
+		closer: r,
+		sealed: make([]byte, encChunkSize+encOverhead),
+	}
+}
+
+type decryptReader struct {
+	c      *Cipher
+	r      *bufio.Reader
+	closer io.Closer
+	prefix []byte
+	index  int64
+	sealed []byte
+	plain  []byte // the decrypted content not yet read
+	done   bool
+	err    error
+}
+
+func (d *decryptReader) next() error {
+	if d.prefix == nil {
+		header := make([]byte, encHeaderSize)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return ErrInvalidEncryptedContent
+		}
+		if !bytes.Equal(header[:len(encMagic)], []byte(encMagic)) {
+			return ErrInvalidEncryptedContent
+		}
+		d.prefix = header[len(encMagic):]
+	}
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch err {
+	case nil:
+		// A full chunk is the last one if nothing follows it
+		if _, errp := d.r.Peek(1); errp == io.EOF {
+			last = true
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return ErrInvalidEncryptedContent
+	default:
+		return err
+	}
+	ad := encNotLast
+	if last {
+		ad = encLast
+	}
+	d.plain, err = d.c.aead.Open(d.plain[:0], d.c.nonce(d.prefix, d.index), d.sealed[:n], ad)
+	if err != nil {
+		return ErrInvalidEncryptedContent
+	}
+	d.index++
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.closer.Close()
+}
@@ -0,0 +1,116 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// memFile is a File on a content in memory
+type memFile struct {
+	*bytes.Reader
+}
+
+func (f *memFile) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (f *memFile) Close() error                { return nil }
+
+// memWriter is a io.WriteCloser that keeps the content in memory
+type memWriter struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *memWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func encryptContent(t *testing.T, c *Cipher, plain []byte) []byte {
+	w := &memWriter{}
+	enc := c.EncryptWriter(w)
+	// Write by small pieces, to cross the limits of the chunks
+	for p := plain; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err := enc.Write(p[:n])
+		assert.NoError(t, err)
+		p = p[n:]
+	}
+	assert.NoError(t, enc.Close())
+	assert.True(t, w.closed)
+	return w.Bytes()
+}
+
+func TestEncryption(t *testing.T) {
+	c, err := NewCipher(crypto.GenerateRandomBytes(32))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, size := range []int{0, 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 5} {
+		plain := crypto.GenerateRandomBytes(size)
+		encrypted := encryptContent(t, c, plain)
+		assert.Equal(t, c.EncryptedSize(int64(size)), int64(len(encrypted)))
+		assert.Equal(t, int64(size), c.PlainSize(int64(len(encrypted))))
+		if size > 0 {
+			assert.NotContains(t, string(encrypted), string(plain))
+		}
+
+		// Sequential read
+		r := c.DecryptReader(ioutil.NopCloser(bytes.NewReader(encrypted)))
+		buf, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, buf)
+
+		// Random access
+		f, err := c.DecryptFile(&memFile{bytes.NewReader(encrypted)}, int64(size))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		end, err := f.Seek(0, io.SeekEnd)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(size), end)
+		if size > 10 {
+			p := make([]byte, 10)
+			off := int64(size - 10)
+			n, err := f.ReadAt(p, off)
+			assert.NoError(t, err)
+			assert.Equal(t, 10, n)
+			assert.Equal(t, plain[off:], p)
+			_, err = f.Seek(int64(size/2), io.SeekStart)
+			assert.NoError(t, err)
+			buf, err = ioutil.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, plain[size/2:], buf)
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		assert.NoError(t, err)
+		buf, err = ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, plain, buf)
+		assert.NoError(t, f.Close())
+	}
+
+	// A tampered or truncated content is detected
+	plain := crypto.GenerateRandomBytes(2 * encChunkSize)
+	encrypted := encryptContent(t, c, plain)
+	tampered := append([]byte{}, encrypted...)
+	tampered[encHeaderSize+10] ^= 0xff
+	_, err = ioutil.ReadAll(c.DecryptReader(ioutil.NopCloser(bytes.NewReader(tampered))))
+	assert.Equal(t, ErrInvalidEncryptedContent, err)
+	truncated := encrypted[:encHeaderSize+encChunkSize+encOverhead]
+	_, err = ioutil.ReadAll(c.DecryptReader(ioutil.NopCloser(bytes.NewReader(truncated))))
+	assert.Equal(t, ErrInvalidEncryptedContent, err)
+
+	// The nil cipher leaves the content in clear
+	var none *Cipher
+	assert.Equal(t, plain, encryptContent(t, none, plain))
+	assert.Equal(t, int64(42), none.EncryptedSize(42))
+	assert.Equal(t, int64(42), none.PlainSize(42))
+}
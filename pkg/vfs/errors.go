@@ -17,6 +17,9 @@ var (
 	// ErrInvalidHash is used when the given hash does not match the
 	// calculated one
 	ErrInvalidHash = errors.New("Invalid hash")
+	// ErrInvalidEncryptedContent is used when the encrypted content of a
+	// file can't be decrypted
+	ErrInvalidEncryptedContent = errors.New("Invalid encrypted content")
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
 	ErrContentLengthMismatch = errors.New("Content length does not match")
@@ -40,4 +43,16 @@ var (
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
 	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	// ErrVersionNotFound is used when the asked version of a file does not
+	// exist
+	ErrVersionNotFound = errors.New("Version of the file not found")
+	// ErrUploadSessionNotFound is used when the session of a resumable upload
+	// does not exist or has expired
+	ErrUploadSessionNotFound = errors.New("Upload session not found")
+	// ErrUploadOffsetMismatch is used when a chunk is sent for an offset that
+	// is not the current offset of the upload
+	ErrUploadOffsetMismatch = errors.New("Offset does not match the current offset of the upload")
+	// ErrUploadIncomplete is used when finalizing an upload that has not
+	// received all its content
+	ErrUploadIncomplete = errors.New("The upload has not received all its content")
 )
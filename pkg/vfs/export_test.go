@@ -0,0 +1,19 @@
+package vfs
+
+import "time"
+
+// SetQuotaCheckInterval changes the minimal delay between two checks of the
+// disk usage for the quota alerts, and returns a function to restore it.
+func SetQuotaCheckInterval(d time.Duration) func() {
+	previous := quotaCheckInterval
+	quotaCheckInterval = d
+	return func() { quotaCheckInterval = previous }
+}
+
+// PendingQuotaChecks returns the number of domains where the disk usage has
+// been checked recently for the quota alerts.
+func PendingQuotaChecks() int {
+	quotaChecksMu.Lock()
+	defer quotaChecksMu.Unlock()
+	return len(quotaChecks)
+}
@@ -29,6 +29,8 @@ type FileDoc struct {
 	// Parent directory identifier
 	DirID       string `json:"dir_id,omitempty"`
 	RestorePath string `json:"restore_path,omitempty"`
+	// TrashedAt is the date when the file was put in the trash
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -41,6 +43,10 @@ type FileDoc struct {
 	Trashed    bool     `json:"trashed"`
 	Tags       []string `json:"tags"`
 
+	// SHA256Sum is the strong hash of the content, that is used to address
+	// it in the deduplicated mode of the VFS.
+	SHA256Sum []byte `json:"sha256sum,omitempty"`
+
 	Metadata Metadata `json:"metadata,omitempty"`
 
 	ReferencedBy []couchdb.DocReference `json:"referenced_by,omitempty"`
@@ -49,6 +55,10 @@ type FileDoc struct {
 	// since we use FileDoc as immutable data-structures.
 	fullpath string
 
+	// Identifier of the upload session that creates the file, if any, so
+	// that its reservation is not counted in the quota check.
+	uploadSessionID string
+
 	// NOTE: Do not forget to propagate changes made to this structure to the
 	// structure DirOrFileDoc in pkg/vfs/vfs.go.
 }
@@ -67,6 +77,8 @@ func (f *FileDoc) Clone() couchdb.Doc {
 	cloned := *f
 	cloned.MD5Sum = make([]byte, len(f.MD5Sum))
 	copy(cloned.MD5Sum, f.MD5Sum)
+	cloned.SHA256Sum = make([]byte, len(f.SHA256Sum))
+	copy(cloned.SHA256Sum, f.SHA256Sum)
 	cloned.Tags = make([]string, len(f.Tags))
 	copy(cloned.Tags, f.Tags)
 	cloned.ReferencedBy = make([]couchdb.DocReference, len(f.ReferencedBy))
@@ -220,6 +232,7 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 		Name:        &oname,
 		DirID:       &olddoc.DirID,
 		RestorePath: &olddoc.RestorePath,
+		TrashedAt:   olddoc.TrashedAt,
 		Tags:        &olddoc.Tags,
 		UpdatedAt:   &olddoc.UpdatedAt,
 		Executable:  &olddoc.Executable,
@@ -257,6 +270,9 @@ func ModifyFileMetadata(fs VFS, olddoc *FileDoc, patch *DocPatch) (*FileDoc, err
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	if trashed {
+		newdoc.TrashedAt = patch.TrashedAt
+	}
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.Metadata = olddoc.Metadata
 	newdoc.ReferencedBy = olddoc.ReferencedBy
@@ -283,12 +299,14 @@ func TrashFile(fs VFS, olddoc *FileDoc) (*FileDoc, error) {
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	trashedAt := time.Now()
 
 	var newdoc *FileDoc
 	tryOrUseSuffix(olddoc.DocName, conflictFormat, func(name string) error {
 		newdoc, err = ModifyFileMetadata(fs, olddoc, &DocPatch{
 			DirID:       &trashDirID,
 			RestorePath: &restorePath,
+			TrashedAt:   &trashedAt,
 			Name:        &name,
 		})
 		return err
@@ -1,8 +1,10 @@
 package vfs
 
 import (
+	"fmt"
 	"image"
 	"io"
+	"io/ioutil"
 	"time"
 
 	// Packages image/... are not used explicitly in the code below,
@@ -20,7 +22,7 @@ import (
 // MetadataExtractorVersion is the version number of the metadata extractor.
 // It will be used later to know which files can be re-examined to get more
 // metadata when the extractor is improved.
-const MetadataExtractorVersion = 2
+const MetadataExtractorVersion = 3
 
 // Metadata is a list of metadata specific to each mimetype:
 // id3 for music, exif for jpegs, etc.
@@ -49,6 +51,14 @@ func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
 		e = NewExifExtractor()
 	case "image/png", "image/gif":
 		e = NewImageExtractor()
+	case "application/pdf":
+		e = NewPdfExtractor()
+	default:
+		if _, ok := audioParsers[doc.Mime]; ok {
+			e = NewAudioExtractor(doc.Mime)
+		} else if _, ok := videoParsers[doc.Mime]; ok {
+			e = NewVideoExtractor(doc.Mime)
+		}
 	}
 	if e != nil {
 		return &e
@@ -56,6 +66,74 @@ func NewMetaExtractor(doc *FileDoc) *MetaExtractor {
 	return nil
 }
 
+// streamExtractor runs the parser of a format in a goroutine, on the content
+// written in the extractor. The parser reads the content only forward, and
+// fills the metadata with what it finds, even if it fails later.
+type streamExtractor struct {
+	w  *io.PipeWriter
+	r  *io.PipeReader
+	ch chan Metadata
+}
+
+// parser reads a file in a format to fill its metadata
+type parser func(r io.Reader, m Metadata) error
+
+func newStreamExtractor(parse parser) *streamExtractor {
+	e := &streamExtractor{}
+	e.r, e.w = io.Pipe()
+	e.ch = make(chan Metadata)
+	go func() {
+		m := NewMetadata()
+		parseSafely(parse, e.r, m) // #nosec
+		e.r.Close()
+		e.ch <- m
+	}()
+	return e
+}
+
+// parseSafely calls the parser, and turns its panics into errors: a bug in a
+// parser, triggered by a crafted file, must not crash the stack.
+func parseSafely(parse parser, r io.Reader, m Metadata) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("vfs: panic in the metadata parser: %v", rec)
+		}
+	}()
+	return parse(r, m)
+}
+
+// Write is called to push some bytes to the extractor
+func (e *streamExtractor) Write(p []byte) (n int, err error) {
+	return e.w.Write(p)
+}
+
+// Close is called when all the bytes has been pushed, to finalize the extraction
+func (e *streamExtractor) Close() error {
+	return e.w.Close()
+}
+
+// Abort is called when the extractor can be discarded
+func (e *streamExtractor) Abort(err error) {
+	e.w.CloseWithError(err)
+	<-e.ch
+}
+
+// Result is called to get the extracted metadata
+func (e *streamExtractor) Result() Metadata {
+	return <-e.ch
+}
+
+// skip discards the next n bytes of r
+func skip(r io.Reader, n int64) error {
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
+
+// seconds returns a duration in seconds, rounded to the millisecond
+func seconds(d float64) float64 {
+	return float64(int64(d*1000+0.5)) / 1000
+}
+
 // ImageExtractor is used to extract width/height from images
 type ImageExtractor struct {
 	w  *io.PipeWriter
@@ -83,6 +161,17 @@ func (e *ImageExtractor) Start() {
 	}
 }
 
+// parseSafely calls the parser, and turns its panics into errors: a bug in a
+// parser, triggered by a crafted file, must not crash the stack.
+func parseSafely(parse parser, r io.Reader, m Metadata) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("vfs: panic in the metadata parser: %v", rec)
+		}
+	}()
+	return parse(r, m)
+}
+
 // Write is called to push some bytes to the extractor
 func (e *ImageExtractor) Write(p []byte) (n int, err error) {
 	return e.w.Write(p)
@@ -141,6 +230,17 @@ func (e *ExifExtractor) Start() {
 	}
 }
 
+// parseSafely calls the parser, and turns its panics into errors: a bug in a
+// parser, triggered by a crafted file, must not crash the stack.
+func parseSafely(parse parser, r io.Reader, m Metadata) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("vfs: panic in the metadata parser: %v", rec)
+		}
+	}()
+	return parse(r, m)
+}
+
 // Write is called to push some bytes to the extractor
 func (e *ExifExtractor) Write(p []byte) (n int, err error) {
 	e.im.Write(p)
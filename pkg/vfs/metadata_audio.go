@@ -0,0 +1,592 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxTagSize is the maximal size of the tags read in memory. The tags can
+// include a cover, and it is not worth reading a big cover just to get the
+// title of a song.
+const maxTagSize = 16 << (2 * 10) // 16 MiB
+
+var errMetadataFormat = errors.New("vfs: unexpected format for the metadata")
+
+// audioParsers are the parsers for the audio formats, by mime type
+var audioParsers = map[string]parser{
+	"audio/mpeg":   parseMP3,
+	"audio/mp3":    parseMP3,
+	"audio/flac":   parseFLAC,
+	"audio/x-flac": parseFLAC,
+	"audio/ogg":    parseOgg,
+	"audio/opus":   parseOgg,
+	"audio/vorbis": parseOgg,
+	"audio/mp4":    parseMP4,
+	"audio/m4a":    parseMP4,
+	"audio/x-m4a":  parseMP4,
+}
+
+// AudioExtractor is used to extract the tags (title, artist, album) and the
+// duration of the audio files
+type AudioExtractor struct {
+	*streamExtractor
+}
+
+// NewAudioExtractor returns an extractor for the audio files of the given
+// mime type
+func NewAudioExtractor(mime string) *AudioExtractor {
+	parse, ok := audioParsers[mime]
+	if !ok {
+		parse = parseNothing
+	}
+	return &AudioExtractor{newStreamExtractor(parse)}
+}
+
+func parseNothing(r io.Reader, m Metadata) error {
+	return nil
+}
+
+// countingReader counts the bytes read, to know the size of the file
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readTail reads r until the end, and returns its last n bytes
+func readTail(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, 32*1024)
+	tail := make([]byte, 0, n)
+	for {
+		k, err := r.Read(buf)
+		if k >= n {
+			tail = append(tail[:0], buf[k-n:k]...)
+		} else if k > 0 {
+			tail = append(tail, buf[:k]...)
+			if len(tail) > n {
+				tail = append(tail[:0], tail[len(tail)-n:]...)
+			}
+		}
+		if err == io.EOF {
+			return tail, nil
+		}
+		if err != nil {
+			return tail, err
+		}
+	}
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// decodeUTF16 decodes an UTF-16 text, with an optional BOM
+func decodeUTF16(b []byte, bigEndian bool) string {
+	if len(b) >= 2 {
+		if b[0] == 0xfe && b[1] == 0xff {
+			bigEndian = true
+			b = b[2:]
+		} else if b[0] == 0xff && b[1] == 0xfe {
+			bigEndian = false
+			b = b[2:]
+		}
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if bigEndian {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		} else {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+// id3Frames are the ID3v2 frames of the tags, for ID3v2.3/2.4 and ID3v2.2
+var id3Frames = map[string]string{
+	"TIT2": "title",
+	"TPE1": "artist",
+	"TALB": "album",
+	"TT2":  "title",
+	"TP1":  "artist",
+	"TAL":  "album",
+}
+
+func synchsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+// id3Text decodes the content of an ID3v2 text frame
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var text string
+	switch data[0] {
+	case 0:
+		text = latin1(data[1:])
+	case 1:
+		text = decodeUTF16(data[1:], false)
+	case 2:
+		text = decodeUTF16(data[1:], true)
+	case 3:
+		text = string(data[1:])
+	}
+	// ID3v2.4 separates the values of a frame with a NUL character, and
+	// only the first one is kept
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text)
+}
+
+// readID3v2 reads an ID3v2 tag, at the start of an audio file
+func readID3v2(r io.Reader, m Metadata) error {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[0:3]) != "ID3" {
+		return errMetadataFormat
+	}
+	version, flags := header[3], header[5]
+	size := synchsafe(header[6:10])
+	var footer int64
+	if flags&0x10 != 0 {
+		footer = 10
+	}
+	if size > maxTagSize {
+		return skip(r, size+footer)
+	}
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return err
+	}
+	if err := skip(r, footer); err != nil {
+		return err
+	}
+	if version < 4 && flags&0x80 != 0 {
+		tag = bytes.Replace(tag, []byte{0xff, 0}, []byte{0xff}, -1)
+	}
+	if version >= 3 && flags&0x40 != 0 && len(tag) >= 4 {
+		n := synchsafe(tag[0:4])
+		if version == 3 {
+			n = int64(binary.BigEndian.Uint32(tag[0:4])) + 4
+		}
+		if n > int64(len(tag)) {
+			return errMetadataFormat
+		}
+		tag = tag[n:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int64
+		switch version {
+		case 2:
+			size = int64(tag[3])<<16 | int64(tag[4])<<8 | int64(tag[5])
+		case 3:
+			size = int64(binary.BigEndian.Uint32(tag[4:8]))
+		default:
+			size = synchsafe(tag[4:8])
+		}
+		if size > int64(len(tag)-headerLen) {
+			break
+		}
+		data := tag[headerLen : headerLen+int(size)]
+		if version >= 3 {
+			// The compressed and encrypted frames are ignored
+			frameFlags := tag[9]
+			switch {
+			case version == 3 && frameFlags&0xc0 != 0:
+				data = nil
+			case version == 3 && frameFlags&0x20 != 0 && len(data) > 0:
+				data = data[1:]
+			case version == 4 && frameFlags&0x0c != 0:
+				data = nil
+			case version == 4:
+				if frameFlags&0x40 != 0 && len(data) > 0 {
+					data = data[1:]
+				}
+				if frameFlags&0x01 != 0 && len(data) >= 4 {
+					data = data[4:]
+				}
+				if frameFlags&0x02 != 0 {
+					data = bytes.Replace(data, []byte{0xff, 0}, []byte{0xff}, -1)
+				}
+			}
+		}
+		if key, ok := id3Frames[id]; ok {
+			if text := id3Text(data); text != "" {
+				m[key] = text
+			}
+		} else if id == "TLEN" || id == "TLE" {
+			if ms, err := strconv.Atoi(id3Text(data)); err == nil && ms > 0 {
+				m["duration"] = seconds(float64(ms) / 1000)
+			}
+		}
+		tag = tag[headerLen+int(size):]
+	}
+	return nil
+}
+
+// readID3v1 reads the ID3v1 tag, in the last 128 bytes of an audio file
+func readID3v1(tail []byte, m Metadata) bool {
+	if len(tail) != 128 || string(tail[0:3]) != "TAG" {
+		return false
+	}
+	fields := []struct {
+		key   string
+		value []byte
+	}{
+		{"title", tail[3:33]},
+		{"artist", tail[33:63]},
+		{"album", tail[63:93]},
+	}
+	for _, field := range fields {
+		if _, ok := m[field.key]; ok {
+			continue
+		}
+		value := bytes.TrimRight(field.value, "\x00 ")
+		if len(value) > 0 {
+			m[field.key] = latin1(value)
+		}
+	}
+	return true
+}
+
+// The bitrates of MPEG audio, in kbit/s, for MPEG-1 layers I, II and III,
+// MPEG-2 layer I, and MPEG-2 layers II and III.
+var mpegBitrates = [5][14]int{
+	{32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// mpegFrame is the header of a frame of MPEG audio
+type mpegFrame struct {
+	mpeg1      bool
+	mono       bool
+	bitrate    int // bit/s
+	sampleRate int // Hz
+	samples    int // samples per frame
+}
+
+func parseMPEGHeader(h []byte) (*mpegFrame, bool) {
+	if h[0] != 0xff || h[1]&0xe0 != 0xe0 {
+		return nil, false
+	}
+	version := (h[1] >> 3) & 3 // 0: MPEG-2.5, 2: MPEG-2, 3: MPEG-1
+	layer := (h[1] >> 1) & 3   // 1: layer III, 2: layer II, 3: layer I
+	bitrateIndex := h[2] >> 4
+	rateIndex := (h[2] >> 2) & 3
+	if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return nil, false
+	}
+	f := &mpegFrame{
+		mpeg1: version == 3,
+		mono:  h[3]>>6 == 3,
+	}
+	f.sampleRate = [3]int{44100, 48000, 32000}[rateIndex]
+	var row int
+	switch {
+	case f.mpeg1:
+		row = 3 - int(layer)
+	case layer == 3:
+		row = 3
+	default:
+		row = 4
+	}
+	f.bitrate = mpegBitrates[row][bitrateIndex-1] * 1000
+	switch version {
+	case 2:
+		f.sampleRate /= 2
+	case 0:
+		f.sampleRate /= 4
+	}
+	switch {
+	case layer == 3:
+		f.samples = 384
+	case layer == 1 && !f.mpeg1:
+		f.samples = 576
+	default:
+		f.samples = 1152
+	}
+	return f, true
+}
+
+// vbrFrames returns the number of frames announced by the Xing/Info or VBRI
+// header in the first frame, or 0 if there is no such header.
+func vbrFrames(f *mpegFrame, b []byte) int64 {
+	offset := 4 + 32
+	switch {
+	case f.mpeg1 && f.mono, !f.mpeg1 && !f.mono:
+		offset = 4 + 17
+	case !f.mpeg1 && f.mono:
+		offset = 4 + 9
+	}
+	if len(b) >= offset+12 {
+		if tag := string(b[offset : offset+4]); tag == "Xing" || tag == "Info" {
+			if binary.BigEndian.Uint32(b[offset+4:])&1 != 0 {
+				return int64(binary.BigEndian.Uint32(b[offset+8:]))
+			}
+			return 0
+		}
+	}
+	if len(b) >= 4+32+18 && string(b[36:40]) == "VBRI" {
+		return int64(binary.BigEndian.Uint32(b[4+32+14:]))
+	}
+	return 0
+}
+
+// maxSync is the maximal number of bytes skipped to find the first frame
+const maxSync = 64 * 1024
+
+// parseMP3 reads the ID3 tags of a MP3 file, and computes its duration from
+// the Xing header for a VBR file, or from its size and bitrate.
+func parseMP3(r io.Reader, m Metadata) error {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	if h, err := br.Peek(3); err == nil && string(h) == "ID3" {
+		if err = readID3v2(br, m); err != nil {
+			return err
+		}
+	}
+
+	var frame *mpegFrame
+	for i := 0; frame == nil; i++ {
+		h, err := br.Peek(4)
+		if err != nil {
+			return err
+		}
+		if i > maxSync {
+			return errMetadataFormat
+		}
+		if f, ok := parseMPEGHeader(h); ok {
+			frame = f
+		} else if _, err = br.Discard(1); err != nil {
+			return err
+		}
+	}
+	start := cr.n - int64(br.Buffered())
+	b, _ := br.Peek(4 + 32 + 18)
+	if frames := vbrFrames(frame, b); frames > 0 {
+		m["duration"] = seconds(float64(frames) * float64(frame.samples) / float64(frame.sampleRate))
+	}
+
+	_, hasTitle := m["title"]
+	_, hasDuration := m["duration"]
+	if hasTitle && hasDuration {
+		return nil
+	}
+	tail, err := readTail(br, 128)
+	if err != nil {
+		return err
+	}
+	size := cr.n - start
+	if readID3v1(tail, m) {
+		size -= 128
+	}
+	if !hasDuration && size > 0 {
+		m["duration"] = seconds(float64(size) * 8 / float64(frame.bitrate))
+	}
+	return nil
+}
+
+// vorbisFields are the fields of the Vorbis comments, used by FLAC, Ogg
+// Vorbis and Opus, for the tags.
+var vorbisFields = map[string]string{
+	"TITLE":  "title",
+	"ARTIST": "artist",
+	"ALBUM":  "album",
+}
+
+// parseVorbisComment reads the tags in a Vorbis comment
+func parseVorbisComment(data []byte, m Metadata) {
+	if len(data) < 4 {
+		return
+	}
+	n := uint64(binary.LittleEndian.Uint32(data))
+	if n+4 > uint64(len(data)) {
+		return
+	}
+	data = data[4+n:]
+	if len(data) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count && len(data) >= 4; i++ {
+		n := uint64(binary.LittleEndian.Uint32(data))
+		if n+4 > uint64(len(data)) {
+			return
+		}
+		comment := string(data[4 : 4+n])
+		data = data[4+n:]
+		parts := strings.SplitN(comment, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, ok := vorbisFields[strings.ToUpper(parts[0])]
+		if _, exists := m[key]; ok && !exists && parts[1] != "" {
+			m[key] = parts[1]
+		}
+	}
+}
+
+// parseFLAC reads the STREAMINFO and VORBIS_COMMENT blocks of a FLAC file
+func parseFLAC(r io.Reader, m Metadata) error {
+	br := bufio.NewReader(r)
+	if h, err := br.Peek(3); err == nil && string(h) == "ID3" {
+		if err = readID3v2(br, m); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	if string(header) != "fLaC" {
+		return errMetadataFormat
+	}
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return err
+		}
+		last := header[0]&0x80 != 0
+		typ := header[0] & 0x7f
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		if (typ != 0 && typ != 4) || size > maxTagSize {
+			if err := skip(br, size); err != nil {
+				return err
+			}
+		} else {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return err
+			}
+			if typ == 4 {
+				parseVorbisComment(data, m)
+			} else if len(data) >= 18 {
+				rate := int64(data[10])<<12 | int64(data[11])<<4 | int64(data[12])>>4
+				samples := int64(data[13]&0x0f)<<32 | int64(binary.BigEndian.Uint32(data[14:18]))
+				if rate > 0 && samples > 0 {
+					m["duration"] = seconds(float64(samples) / float64(rate))
+				}
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// parseOgg reads the headers of the first logical stream of an Ogg file, for
+// Vorbis and Opus, and computes its duration from the granule position of its
+// last page.
+func parseOgg(r io.Reader, m Metadata) error {
+	header := make([]byte, 27)
+	segments := make([]byte, 255)
+	var serial uint32
+	var packets [][]byte
+	var packet []byte
+	var tooBig bool
+	var rate float64
+	var preskip, granule int64
+	for page := 0; ; page++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		if string(header[0:4]) != "OggS" {
+			break
+		}
+		if page == 0 {
+			serial = binary.LittleEndian.Uint32(header[14:18])
+		}
+		n := int(header[26])
+		if _, err := io.ReadFull(r, segments[:n]); err != nil {
+			return err
+		}
+		size := 0
+		for _, s := range segments[:n] {
+			size += int(s)
+		}
+		if binary.LittleEndian.Uint32(header[14:18]) != serial || len(packets) >= 2 {
+			if g := int64(binary.LittleEndian.Uint64(header[6:14])); g > 0 {
+				granule = g
+			}
+			if err := skip(r, int64(size)); err != nil {
+				return err
+			}
+			continue
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		for _, s := range segments[:n] {
+			if !tooBig {
+				packet = append(packet, body[:s]...)
+				if len(packet) > maxTagSize {
+					packet, tooBig = nil, true
+				}
+			}
+			body = body[s:]
+			if s < 255 {
+				packets = append(packets, packet)
+				packet, tooBig = nil, false
+			}
+		}
+		if len(packets) >= 2 {
+			rate, preskip = parseOggHeaders(packets[0], packets[1], m)
+		}
+	}
+	if rate > 0 && granule > preskip {
+		m["duration"] = seconds(float64(granule-preskip) / rate)
+	}
+	return nil
+}
+
+// parseOggHeaders reads the identification and comment packets of Vorbis and
+// Opus, and returns the rate of the granule positions and the number of
+// samples to skip at the start.
+func parseOggHeaders(id, comment []byte, m Metadata) (rate float64, preskip int64) {
+	switch {
+	case len(id) >= 16 && string(id[0:7]) == "\x01vorbis":
+		rate = float64(binary.LittleEndian.Uint32(id[12:16]))
+		if len(comment) > 7 && string(comment[0:7]) == "\x03vorbis" {
+			parseVorbisComment(comment[7:], m)
+		}
+	case len(id) >= 12 && string(id[0:8]) == "OpusHead":
+		rate = 48000
+		preskip = int64(binary.LittleEndian.Uint16(id[10:12]))
+		if len(comment) > 8 && string(comment[0:8]) == "OpusTags" {
+			parseVorbisComment(comment[8:], m)
+		}
+	}
+	return rate, preskip
+}
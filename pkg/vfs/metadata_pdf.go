@@ -0,0 +1,346 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxObjectSize is the maximal size of the text kept in memory between two
+// objects of a PDF file. It is the case for the cross-reference tables.
+const maxObjectSize = 1 << (2 * 10) // 1 MiB
+
+// maxObjectStreamSize is the maximal size of a decompressed object stream
+const maxObjectStreamSize = 16 << (2 * 10) // 16 MiB
+
+var (
+	pdfLengthRegexp = regexp.MustCompile(`/Length\s+(\d+)(\s+\d+\s+R)?`)
+	pdfFirstRegexp  = regexp.MustCompile(`/First\s+(\d+)`)
+	pdfPagesRegexp  = regexp.MustCompile(`/Type\s*/Pages\b`)
+	pdfCountRegexp  = regexp.MustCompile(`/Count\s+(\d+)`)
+	pdfInfoRegexp   = regexp.MustCompile(`/(Producer|Creator|CreationDate|ModDate|Author)\b`)
+	pdfTitleRegexp  = regexp.MustCompile(`/Title\s*[(<]`)
+	pdfAuthorRegexp = regexp.MustCompile(`/Author\s*[(<]`)
+	pdfObjStmRegexp = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+)
+
+// PdfExtractor is used to extract the number of pages, the title and the
+// author of the PDF files
+type PdfExtractor struct {
+	*streamExtractor
+}
+
+// NewPdfExtractor returns an extractor for the PDF files
+func NewPdfExtractor() *PdfExtractor {
+	return &PdfExtractor{newStreamExtractor(parsePDF)}
+}
+
+// pdfInfo is what is collected while reading a PDF file
+type pdfInfo struct {
+	pages     int
+	title     string
+	author    string
+	encrypted bool
+}
+
+// parsePDF reads a PDF file from its start to its end, without using the
+// cross-reference table. The content of the streams is skipped, except for
+// the object streams, where the objects can be compressed.
+func parsePDF(r io.Reader, m Metadata) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(5)
+	if err != nil {
+		return err
+	}
+	if string(magic) != "%PDF-" {
+		return errMetadataFormat
+	}
+
+	info := &pdfInfo{}
+	defer func() {
+		if info.pages > 0 {
+			m["pages"] = info.pages
+		}
+		// The strings of an encrypted file can't be read
+		if !info.encrypted && info.title != "" {
+			m["title"] = info.title
+		}
+		if !info.encrypted && info.author != "" {
+			m["author"] = info.author
+		}
+	}()
+
+	var obj []byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			info.parseObject(obj)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		obj = append(obj, c)
+		if c == 'j' && bytes.HasSuffix(obj, []byte("endobj")) {
+			info.parseObject(obj)
+			obj = obj[:0]
+		} else if (c == '\r' || c == '\n') && isStreamStart(obj) {
+			if c == '\r' {
+				if next, err := br.Peek(1); err == nil && next[0] == '\n' {
+					br.ReadByte() // #nosec
+				}
+			}
+			info.parseObject(obj)
+			if err = info.readStream(br, obj); err != nil {
+				return err
+			}
+			obj = obj[:0]
+		} else if len(obj) > maxObjectSize {
+			obj = append(obj[:0], obj[len(obj)-maxObjectSize/2:]...)
+		}
+	}
+}
+
+// isStreamStart returns true if obj ends with a dictionary, the stream
+// keyword and an end of line.
+func isStreamStart(obj []byte) bool {
+	text := bytes.TrimRight(obj[:len(obj)-1], "\r")
+	if !bytes.HasSuffix(text, []byte("stream")) {
+		return false
+	}
+	text = bytes.TrimRight(text[:len(text)-len("stream")], " \t\r\n\f\x00")
+	return bytes.HasSuffix(text, []byte(">>"))
+}
+
+// readStream reads the data of a stream, whose dictionary is at the end of
+// obj. The object streams are decompressed and their objects are parsed, the
+// other streams are skipped.
+func (info *pdfInfo) readStream(br *bufio.Reader, obj []byte) error {
+	dict := obj
+	if i := bytes.LastIndex(obj, []byte("obj")); i >= 0 {
+		dict = obj[i:]
+	}
+	length := int64(-1)
+	if match := pdfLengthRegexp.FindSubmatch(dict); match != nil && len(match[2]) == 0 {
+		length, _ = strconv.ParseInt(string(match[1]), 10, 64)
+	}
+	isObjStm := pdfObjStmRegexp.Match(dict) && bytes.Contains(dict, []byte("/FlateDecode"))
+
+	var data []byte
+	if length >= 0 {
+		if !isObjStm || length > maxObjectStreamSize {
+			return skip(br, length)
+		}
+		data = make([]byte, length)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return err
+		}
+	} else {
+		var buf *bytes.Buffer
+		if isObjStm {
+			buf = &bytes.Buffer{}
+		}
+		if err := skipToEndstream(br, buf); err != nil {
+			return err
+		}
+		if buf == nil {
+			return nil
+		}
+		data = buf.Bytes()
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(zr, maxObjectStreamSize))
+	if err != nil && len(content) == 0 {
+		return nil
+	}
+	match := pdfFirstRegexp.FindSubmatch(dict)
+	if match == nil {
+		return nil
+	}
+	first, _ := strconv.Atoi(string(match[1]))
+	if first > len(content) {
+		return nil
+	}
+	// The header has a pair of numbers for each object: its number and its
+	// offset after first.
+	header := bytes.Fields(content[:first])
+	var offsets []int
+	for i := 1; i < len(header); i += 2 {
+		offset, err := strconv.Atoi(string(header[i]))
+		if err != nil || offset < 0 || first+offset > len(content) {
+			return nil
+		}
+		offsets = append(offsets, first+offset)
+	}
+	for i, start := range offsets {
+		end := len(content)
+		if i+1 < len(offsets) && offsets[i+1] >= start {
+			end = offsets[i+1]
+		}
+		info.parseObject(content[start:end])
+	}
+	return nil
+}
+
+// skipToEndstream discards the data of a stream until the endstream keyword.
+// The data is written to buf if it is not nil.
+func skipToEndstream(br *bufio.Reader, buf *bytes.Buffer) error {
+	keyword := []byte("endstream")
+	var last []byte
+	for {
+		chunk, err := br.ReadSlice('m')
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+		if buf != nil {
+			if buf.Len()+len(chunk) > maxObjectStreamSize {
+				return errMetadataFormat
+			}
+			buf.Write(chunk)
+		}
+		last = append(last, chunk...)
+		if len(last) > len(keyword) {
+			last = append(last[:0], last[len(last)-len(keyword):]...)
+		}
+		if err == nil && bytes.Equal(last, keyword) {
+			if buf != nil {
+				data := bytes.TrimSuffix(buf.Bytes(), keyword)
+				data = bytes.TrimRight(data, "\r\n")
+				buf.Truncate(len(data))
+			}
+			return nil
+		}
+	}
+}
+
+// parseObject looks for the page count, the title and the author in the
+// text of an object.
+func (info *pdfInfo) parseObject(obj []byte) {
+	if bytes.Contains(obj, []byte("/Encrypt")) {
+		info.encrypted = true
+	}
+	if pdfPagesRegexp.Match(obj) {
+		if match := pdfCountRegexp.FindSubmatch(obj); match != nil {
+			if count, err := strconv.Atoi(string(match[1])); err == nil && count > info.pages {
+				info.pages = count
+			}
+		}
+	}
+	// The outlines have a title, but also a parent
+	if !pdfInfoRegexp.Match(obj) || bytes.Contains(obj, []byte("/Parent")) {
+		return
+	}
+	if loc := pdfTitleRegexp.FindIndex(obj); loc != nil {
+		if title, ok := pdfString(obj[loc[1]-1:]); ok && title != "" {
+			info.title = title
+		}
+	}
+	if loc := pdfAuthorRegexp.FindIndex(obj); loc != nil {
+		if author, ok := pdfString(obj[loc[1]-1:]); ok && author != "" {
+			info.author = author
+		}
+	}
+}
+
+// pdfString parses the literal or hexadecimal string at the start of s
+func pdfString(s []byte) (string, bool) {
+	if len(s) == 0 {
+		return "", false
+	}
+	if s[0] == '<' {
+		end := bytes.IndexByte(s, '>')
+		if end < 0 {
+			return "", false
+		}
+		digits := make([]byte, 0, end)
+		for _, c := range s[1:end] {
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' && c != '\f' {
+				digits = append(digits, c)
+			}
+		}
+		if len(digits)%2 == 1 {
+			digits = append(digits, '0')
+		}
+		text := make([]byte, len(digits)/2)
+		if _, err := hex.Decode(text, digits); err != nil {
+			return "", false
+		}
+		return pdfText(text), true
+	}
+
+	var text []byte
+	depth := 0
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", false
+			}
+			switch e := s[i]; e {
+			case 'n':
+				text = append(text, '\n')
+			case 'r':
+				text = append(text, '\r')
+			case 't':
+				text = append(text, '\t')
+			case 'b':
+				text = append(text, '\b')
+			case 'f':
+				text = append(text, '\f')
+			case '\r':
+				// A backslash at the end of a line continues the string
+				if i+1 < len(s) && s[i+1] == '\n' {
+					i++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for j := 0; j < 2 && i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '7'; j++ {
+						i++
+						v = v*8 + int(s[i]-'0')
+					}
+					text = append(text, byte(v))
+				} else {
+					text = append(text, e)
+				}
+			}
+		case '(':
+			depth++
+			text = append(text, c)
+		case ')':
+			if depth == 0 {
+				return pdfText(text), true
+			}
+			depth--
+			text = append(text, c)
+		default:
+			text = append(text, c)
+		}
+	}
+	return "", false
+}
+
+// pdfText decodes a text string of PDF: UTF-16BE with a BOM, UTF-8 with a BOM
+// for PDF 2.0, or else PDFDocEncoding, that is close to Latin-1.
+func pdfText(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		return decodeUTF16(b, true)
+	}
+	if len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf && utf8.Valid(b[3:]) {
+		return string(b[3:])
+	}
+	return latin1(b)
+}
@@ -1,8 +1,13 @@
 package vfs
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
@@ -58,3 +63,291 @@ func TestExifMetadataExtractor(t *testing.T) {
 	assert.True(t, ok, "height is present")
 	assert.Equal(t, 294, h)
 }
+
+func extractMetadata(t *testing.T, mime string, content []byte) Metadata {
+	extractor := NewMetaExtractor(&FileDoc{Mime: mime})
+	if !assert.NotNil(t, extractor) {
+		return Metadata{}
+	}
+	// The extractor can stop reading before the end of the content
+	_, err := (*extractor).Write(content)
+	if err != io.ErrClosedPipe {
+		assert.NoError(t, err)
+	}
+	(*extractor).Close()
+	return (*extractor).Result()
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func makeID3v2(frames ...[]byte) []byte {
+	body := concat(frames...)
+	size := len(body)
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return concat(header, body)
+}
+
+func makeID3Frame(id string, text []byte) []byte {
+	return concat([]byte(id), be32(uint32(len(text))), []byte{0, 0}, text)
+}
+
+// makeMP3 returns the frames of a MPEG-1 layer III stream, at 128 kbit/s and
+// 44.1 kHz, with a Xing header in the first frame if xing is not zero.
+func makeMP3(frames int, xing uint32) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		if i == 0 && xing > 0 {
+			copy(frame[36:], concat([]byte("Xing"), be32(1), be32(xing)))
+		}
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func TestMP3MetadataExtractor(t *testing.T) {
+	tag := makeID3v2(
+		makeID3Frame("TIT2", []byte("\x00Caf\xe9")),
+		makeID3Frame("TPE1", []byte("\x01\xff\xfeA\x00l\x00i\x00c\x00e\x00")),
+		makeID3Frame("TALB", []byte("\x03Été")),
+	)
+	meta := extractMetadata(t, "audio/mpeg", concat(tag, makeMP3(100, 0)))
+	assert.Equal(t, MetadataExtractorVersion, meta["extractor_version"])
+	assert.Equal(t, "Café", meta["title"])
+	assert.Equal(t, "Alice", meta["artist"])
+	assert.Equal(t, "Été", meta["album"])
+	// 100 frames of 417 bytes at 128 kbit/s
+	assert.Equal(t, 2.606, meta["duration"])
+
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "Song")
+	copy(v1[33:], "Bob")
+	meta = extractMetadata(t, "audio/mpeg", concat(makeMP3(10, 1000), v1))
+	assert.Equal(t, "Song", meta["title"])
+	assert.Equal(t, "Bob", meta["artist"])
+	assert.Nil(t, meta["album"])
+	// 1000 frames of 1152 samples at 44.1 kHz
+	assert.Equal(t, 26.122, meta["duration"])
+}
+
+func makeVorbisComment(comments ...string) []byte {
+	parts := [][]byte{le32(4), []byte("test"), le32(uint32(len(comments)))}
+	for _, comment := range comments {
+		parts = append(parts, le32(uint32(len(comment))), []byte(comment))
+	}
+	return concat(parts...)
+}
+
+func TestFLACMetadataExtractor(t *testing.T) {
+	info := make([]byte, 34)
+	// 44.1 kHz, 2 channels, 16 bits per sample, 441000 samples
+	binary.BigEndian.PutUint64(info[10:], 44100<<44|1<<41|15<<36|441000)
+	comment := makeVorbisComment("title=Nocturne", "ARTIST=Chopin", "Album=Piano")
+	flac := concat(
+		[]byte("fLaC"),
+		[]byte{0x00, 0, 0, byte(len(info))}, info,
+		[]byte{0x84, 0, 0, byte(len(comment))}, comment,
+		make([]byte, 1000),
+	)
+	meta := extractMetadata(t, "audio/flac", flac)
+	assert.Equal(t, "Nocturne", meta["title"])
+	assert.Equal(t, "Chopin", meta["artist"])
+	assert.Equal(t, "Piano", meta["album"])
+	assert.Equal(t, 10.0, meta["duration"])
+}
+
+func makeOggPage(seq uint32, granule uint64, packet []byte) []byte {
+	g := make([]byte, 8)
+	binary.LittleEndian.PutUint64(g, granule)
+	return concat([]byte("OggS\x00\x00"), g, le32(42), le32(seq), le32(0),
+		[]byte{1, byte(len(packet))}, packet)
+}
+
+func TestOggMetadataExtractor(t *testing.T) {
+	// Opus, with a pre-skip of 312 samples
+	head := concat([]byte("OpusHead\x01\x02"), []byte{0x38, 0x01}, le32(48000), []byte{0, 0, 0})
+	tags := concat([]byte("OpusTags"), makeVorbisComment("TITLE=Podcast", "ARTIST=Carol"))
+	ogg := concat(
+		makeOggPage(0, 0, head),
+		makeOggPage(1, 0, tags),
+		makeOggPage(2, 48000, make([]byte, 100)),
+		makeOggPage(3, 2*48000+312, make([]byte, 100)),
+	)
+	meta := extractMetadata(t, "audio/ogg", ogg)
+	assert.Equal(t, "Podcast", meta["title"])
+	assert.Equal(t, "Carol", meta["artist"])
+	assert.Nil(t, meta["album"])
+	assert.Equal(t, 2.0, meta["duration"])
+}
+
+func makeBox(typ string, children ...[]byte) []byte {
+	body := concat(children...)
+	return concat(be32(uint32(8+len(body))), []byte(typ), body)
+}
+
+func TestVideoMP4MetadataExtractor(t *testing.T) {
+	created := time.Date(2018, time.March, 15, 12, 0, 0, 0, time.UTC)
+	mvhd := make([]byte, 100)
+	copy(mvhd[4:], be32(uint32(created.Unix()+mp4Epoch)))
+	copy(mvhd[12:], be32(1000))
+	copy(mvhd[16:], be32(12345))
+	tkhd := make([]byte, 84)
+	copy(tkhd[76:], be32(1920<<16))
+	copy(tkhd[80:], be32(1080<<16))
+	hdlr := concat(make([]byte, 8), []byte("vide"), make([]byte, 13))
+	stsd := concat(make([]byte, 4), be32(1), be32(16), []byte("avc1"), make([]byte, 8))
+	trak := makeBox("trak",
+		makeBox("tkhd", tkhd),
+		makeBox("mdia",
+			makeBox("hdlr", hdlr),
+			makeBox("minf", makeBox("stbl", makeBox("stsd", stsd)))))
+	ilst := makeBox("ilst",
+		makeBox("\xa9nam", makeBox("data", be32(1), be32(0), []byte("Holidays"))))
+	meta := makeBox("meta", make([]byte, 4), makeBox("hdlr", make([]byte, 25)), ilst)
+	mp4 := concat(
+		makeBox("ftyp", []byte("isom"), be32(512)),
+		makeBox("mdat", make([]byte, 10000)),
+		makeBox("moov", makeBox("mvhd", mvhd), trak, makeBox("udta", meta)),
+	)
+
+	m := extractMetadata(t, "video/mp4", mp4)
+	assert.Equal(t, 12.345, m["duration"])
+	assert.Equal(t, 1920, m["width"])
+	assert.Equal(t, 1080, m["height"])
+	assert.Equal(t, "h264", m["codec"])
+	assert.Equal(t, created, m["datetime"])
+	assert.Equal(t, "Holidays", m["title"])
+}
+
+func makeElement(id uint64, body []byte) []byte {
+	var idBytes []byte
+	for v := id; v > 0; v >>= 8 {
+		idBytes = append([]byte{byte(v)}, idBytes...)
+	}
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	return concat(idBytes, size, body)
+}
+
+func makeUintElement(id uint64, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return makeElement(id, b)
+}
+
+func TestVideoMatroskaMetadataExtractor(t *testing.T) {
+	created := time.Date(2019, time.July, 1, 8, 30, 0, 0, time.UTC)
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(12345))
+	info := makeElement(infoID, concat(
+		makeUintElement(timecodeScaleID, 1000000),
+		makeElement(durationID, duration),
+		makeUintElement(dateUTCID, uint64(created.Sub(mkvEpoch))),
+	))
+	tracks := makeElement(tracksID, concat(
+		makeElement(trackEntryID, concat(
+			makeUintElement(trackTypeID, 2),
+			makeElement(codecID, []byte("A_OPUS")),
+		)),
+		makeElement(trackEntryID, concat(
+			makeUintElement(trackTypeID, 1),
+			makeElement(codecID, []byte("V_VP9")),
+			makeElement(videoID, concat(
+				makeUintElement(pixelWidthID, 640),
+				makeUintElement(pixelHeightID, 360),
+			)),
+		)),
+	))
+	webm := concat(
+		makeElement(ebmlID, makeElement(0x4282, []byte("webm"))),
+		// The segment and the clusters have an unknown size
+		[]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		makeElement(0x114D9B74, make([]byte, 20)),
+		info,
+		tracks,
+		[]byte{0x1f, 0x43, 0xb6, 0x75, 0xff},
+		make([]byte, 10000),
+	)
+
+	m := extractMetadata(t, "video/webm", webm)
+	assert.Equal(t, 12.345, m["duration"])
+	assert.Equal(t, 640, m["width"])
+	assert.Equal(t, 360, m["height"])
+	assert.Equal(t, "vp9", m["codec"])
+	assert.Equal(t, created, m["datetime"])
+}
+
+func TestPdfMetadataExtractor(t *testing.T) {
+	content := "BT /F1 12 Tf (endobj << /Type /Pages /Count 99 >>) Tj ET"
+	pdf := "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n" +
+		"1 0 obj\n<< /Type /Catalog /Pages 2 0 R /Outlines 5 0 R >>\nendobj\n" +
+		"2 0 obj\n<< /Type /Pages /Kids [3 0 R 7 0 R 8 0 R] /Count 3 >>\nendobj\n" +
+		"3 0 obj\n<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>\nendobj\n" +
+		"4 0 obj\n<< /Length " + strconv.Itoa(len(content)) + " >>\nstream\r\n" + content + "\nendstream\nendobj\n" +
+		"5 0 obj\n<< /Title (Chapter 1) /Parent 1 0 R /Author (Nobody) >>\nendobj\n" +
+		"6 0 obj\n<< /Title (Le caf\\351 \\(noir\\)) /Author <FEFF0041006C006900630065> /Producer (test) >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 6 0 R >>\n%%EOF\n"
+	m := extractMetadata(t, "application/pdf", []byte(pdf))
+	assert.Equal(t, 3, m["pages"])
+	assert.Equal(t, "Le café (noir)", m["title"])
+	assert.Equal(t, "Alice", m["author"])
+
+	// The objects are compressed in an object stream, with an indirect length
+	pages := "<< /Type /Pages /Kids [] /Count 12 >>\n"
+	info := "<< /Title (Report) /Author (Bob) /Creator (test) >>\n"
+	objects := pages + info
+	header := "2 0 10 " + strconv.Itoa(len(pages)) + " "
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte(header + objects))
+	zw.Close()
+	pdf = "%PDF-1.5\n" +
+		"1 0 obj\n<< /Type /ObjStm /N 2 /First " + strconv.Itoa(len(header)) +
+		" /Filter /FlateDecode /Length 3 0 R >>\nstream\n" + compressed.String() + "\nendstream\nendobj\n" +
+		"3 0 obj\n" + strconv.Itoa(compressed.Len()) + "\nendobj\n%%EOF\n"
+	m = extractMetadata(t, "application/pdf", []byte(pdf))
+	assert.Equal(t, 12, m["pages"])
+	assert.Equal(t, "Report", m["title"])
+	assert.Equal(t, "Bob", m["author"])
+
+	// A negative offset in the header of an object stream is ignored
+	header = "2 0 -50 " + strconv.Itoa(len(pages)) + " "
+	compressed.Reset()
+	zw = zlib.NewWriter(&compressed)
+	zw.Write([]byte(header + objects))
+	zw.Close()
+	pdf = "%PDF-1.5\n" +
+		"1 0 obj\n<< /Type /ObjStm /N 2 /First " + strconv.Itoa(len(header)) +
+		" /Filter /FlateDecode /Length " + strconv.Itoa(compressed.Len()) +
+		" >>\nstream\n" + compressed.String() + "\nendstream\nendobj\n%%EOF\n"
+	m = extractMetadata(t, "application/pdf", []byte(pdf))
+	assert.Nil(t, m["pages"])
+	assert.Nil(t, m["title"])
+
+	// The strings of an encrypted file are not readable
+	pdf = "%PDF-1.4\n" +
+		"1 0 obj\n<< /Type /Pages /Kids [] /Count 2 >>\nendobj\n" +
+		"2 0 obj\n<< /Title (\x8a\x01) /Producer (\x13\x37) >>\nendobj\n" +
+		"trailer\n<< /Info 2 0 R /Encrypt 3 0 R >>\n%%EOF\n"
+	m = extractMetadata(t, "application/pdf", []byte(pdf))
+	assert.Equal(t, 2, m["pages"])
+	assert.Nil(t, m["title"])
+}
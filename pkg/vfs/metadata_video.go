@@ -0,0 +1,442 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// maxMoovSize is the maximal size of the moov box of a MP4 file, read in
+// memory to find the metadata.
+const maxMoovSize = 64 << (2 * 10) // 64 MiB
+
+// maxElementSize is the maximal size of the Info and Tracks elements of a
+// Matroska file, read in memory to find the metadata.
+const maxElementSize = 16 << (2 * 10) // 16 MiB
+
+// mp4Epoch is the number of seconds between 1904-01-01, the epoch of the
+// dates in MP4 files, and 1970-01-01.
+const mp4Epoch = 2082844800
+
+// mkvEpoch is the epoch of the dates in Matroska files
+var mkvEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// videoParsers are the parsers for the video formats, by mime type
+var videoParsers = map[string]parser{
+	"video/mp4":        parseMP4,
+	"video/quicktime":  parseMP4,
+	"video/x-m4v":      parseMP4,
+	"video/3gpp":       parseMP4,
+	"video/webm":       parseMatroska,
+	"video/x-matroska": parseMatroska,
+}
+
+// videoCodecs are the names of the video codecs, for the MP4 sample entries
+// and the Matroska codec IDs. The other codecs keep their identifier.
+var videoCodecs = map[string]string{
+	"avc1":             "h264",
+	"avc3":             "h264",
+	"V_MPEG4/ISO/AVC":  "h264",
+	"hvc1":             "h265",
+	"hev1":             "h265",
+	"V_MPEGH/ISO/HEVC": "h265",
+	"mp4v":             "mpeg4",
+	"V_MPEG4/ISO/ASP":  "mpeg4",
+	"vp08":             "vp8",
+	"V_VP8":            "vp8",
+	"vp09":             "vp9",
+	"V_VP9":            "vp9",
+	"av01":             "av1",
+	"V_AV1":            "av1",
+	"V_THEORA":         "theora",
+}
+
+func codecName(id string) string {
+	if name, ok := videoCodecs[id]; ok {
+		return name
+	}
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// VideoExtractor is used to extract the duration, the resolution, the codec
+// and the creation date of the video files
+type VideoExtractor struct {
+	*streamExtractor
+}
+
+// NewVideoExtractor returns an extractor for the video files of the given
+// mime type
+func NewVideoExtractor(mime string) *VideoExtractor {
+	parse, ok := videoParsers[mime]
+	if !ok {
+		parse = parseNothing
+	}
+	return &VideoExtractor{newStreamExtractor(parse)}
+}
+
+// eachBox calls fn for each MP4 box in data
+func eachBox(data []byte, fn func(typ string, body []byte)) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return
+		}
+		fn(typ, data[header:size])
+		data = data[size:]
+	}
+}
+
+// findBox returns the body of the first box found by following the path of
+// box types, or nil.
+func findBox(data []byte, path ...string) []byte {
+	for _, typ := range path {
+		var found []byte
+		eachBox(data, func(t string, body []byte) {
+			if t == typ && found == nil {
+				found = body
+			}
+		})
+		if found == nil {
+			return nil
+		}
+		data = found
+	}
+	return data
+}
+
+// parseMP4 looks for the moov box of a MP4 or QuickTime file. It can be at the
+// start or at the end of the file, and the other boxes are skipped.
+func parseMP4(r io.Reader, m Metadata) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		typ := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// The last box goes to the end of the file
+			return nil
+		case 1:
+			if _, err := io.ReadFull(r, header); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return errMetadataFormat
+		}
+		if typ != "moov" {
+			if err := skip(r, size-headerSize); err != nil {
+				return err
+			}
+			continue
+		}
+		if size-headerSize > maxMoovSize {
+			return errMetadataFormat
+		}
+		moov := make([]byte, size-headerSize)
+		if _, err := io.ReadFull(r, moov); err != nil {
+			return err
+		}
+		parseMoov(moov, m)
+		return nil
+	}
+}
+
+func parseMoov(moov []byte, m Metadata) {
+	if mvhd := findBox(moov, "mvhd"); len(mvhd) >= 20 {
+		var created, duration uint64
+		var timescale uint32
+		if mvhd[0] == 1 && len(mvhd) >= 32 {
+			created = binary.BigEndian.Uint64(mvhd[4:12])
+			timescale = binary.BigEndian.Uint32(mvhd[20:24])
+			duration = binary.BigEndian.Uint64(mvhd[24:32])
+		} else {
+			created = uint64(binary.BigEndian.Uint32(mvhd[4:8]))
+			timescale = binary.BigEndian.Uint32(mvhd[12:16])
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+		}
+		if timescale > 0 && duration > 0 && duration != math.MaxUint32 {
+			m["duration"] = seconds(float64(duration) / float64(timescale))
+		}
+		if created > mp4Epoch {
+			m["datetime"] = time.Unix(int64(created-mp4Epoch), 0).UTC()
+		}
+	}
+
+	eachBox(moov, func(typ string, trak []byte) {
+		if typ != "trak" {
+			return
+		}
+		if _, ok := m["width"]; ok {
+			return
+		}
+		hdlr := findBox(trak, "mdia", "hdlr")
+		if len(hdlr) < 12 || string(hdlr[8:12]) != "vide" {
+			return
+		}
+		if tkhd := findBox(trak, "tkhd"); len(tkhd) >= 8 {
+			// The width and height are fixed-point 16.16 numbers, at the end
+			m["width"] = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-8:]) >> 16)
+			m["height"] = int(binary.BigEndian.Uint32(tkhd[len(tkhd)-4:]) >> 16)
+		}
+		if stsd := findBox(trak, "mdia", "minf", "stbl", "stsd"); len(stsd) >= 16 {
+			m["codec"] = codecName(string(stsd[12:16]))
+		}
+	})
+
+	meta := findBox(moov, "udta", "meta")
+	if meta == nil {
+		meta = findBox(moov, "meta")
+	}
+	// The meta box is a full box in MP4, but not in QuickTime
+	if len(meta) >= 8 && string(meta[4:8]) != "hdlr" {
+		meta = meta[4:]
+	}
+	eachBox(findBox(meta, "ilst"), func(typ string, item []byte) {
+		var key string
+		switch typ {
+		case "\xa9nam":
+			key = "title"
+		case "\xa9ART":
+			key = "artist"
+		case "\xa9alb":
+			key = "album"
+		default:
+			return
+		}
+		// The data box has a type and a locale before the value
+		if data := findBox(item, "data"); len(data) > 8 {
+			m[key] = string(data[8:])
+		}
+	})
+}
+
+// The IDs of the Matroska elements
+const (
+	ebmlID          = 0x1A45DFA3
+	segmentID       = 0x18538067
+	infoID          = 0x1549A966
+	tracksID        = 0x1654AE6B
+	clusterID       = 0x1F43B675
+	timecodeScaleID = 0x2AD7B1
+	durationID      = 0x4489
+	dateUTCID       = 0x4461
+	trackEntryID    = 0xAE
+	trackTypeID     = 0x83
+	codecID         = 0x86
+	videoID         = 0xE0
+	pixelWidthID    = 0xB0
+	pixelHeightID   = 0xBA
+)
+
+// readElementHeader reads the ID and the size of an EBML element. The size is
+// -1 when it is unknown.
+func readElementHeader(r io.ByteReader) (id uint64, size int64, err error) {
+	id, _, err = readVint(r, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	s, unknown, err := readVint(r, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if unknown || s > math.MaxInt64 {
+		return id, -1, nil
+	}
+	return id, int64(s), nil
+}
+
+// readVint reads a variable-length integer of EBML. The length marker is kept
+// for the IDs, and removed for the sizes.
+func readVint(r io.ByteReader, keepMarker bool) (v uint64, allOnes bool, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	length := 1
+	mask := byte(0x80)
+	for length <= 8 && b&mask == 0 {
+		mask >>= 1
+		length++
+	}
+	if length > 8 {
+		return 0, false, errMetadataFormat
+	}
+	allOnes = b&(mask-1) == mask-1
+	v = uint64(b &^ mask)
+	if keepMarker {
+		v = uint64(b)
+	}
+	for i := 1; i < length; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		allOnes = allOnes && c == 0xff
+		v = v<<8 | uint64(c)
+	}
+	return v, allOnes, nil
+}
+
+// eachElement calls fn for each EBML element in data
+func eachElement(data []byte, fn func(id uint64, body []byte)) {
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		id, size, err := readElementHeader(r)
+		if err != nil || size < 0 || size > int64(r.Len()) {
+			return
+		}
+		start := len(data) - r.Len()
+		fn(id, data[start:start+int(size)])
+		if _, err = r.Seek(size, io.SeekCurrent); err != nil {
+			return
+		}
+	}
+}
+
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// parseMatroska reads the Info and Tracks elements of a Matroska or WebM
+// file. They are before the clusters, where the frames are.
+func parseMatroska(r io.Reader, m Metadata) error {
+	br := bufio.NewReader(r)
+	id, size, err := readElementHeader(br)
+	if err != nil {
+		return err
+	}
+	if id != ebmlID || size < 0 {
+		return errMetadataFormat
+	}
+	if err = skip(br, size); err != nil {
+		return err
+	}
+	if id, _, err = readElementHeader(br); err != nil {
+		return err
+	}
+	if id != segmentID {
+		return errMetadataFormat
+	}
+
+	var hasInfo, hasTracks bool
+	for !hasInfo || !hasTracks {
+		id, size, err := readElementHeader(br)
+		if err != nil {
+			return err
+		}
+		if id == clusterID || size < 0 {
+			return nil
+		}
+		if (id != infoID && id != tracksID) || size > maxElementSize {
+			if err = skip(br, size); err != nil {
+				return err
+			}
+			continue
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(br, data); err != nil {
+			return err
+		}
+		if id == infoID {
+			parseMatroskaInfo(data, m)
+			hasInfo = true
+		} else {
+			parseMatroskaTracks(data, m)
+			hasTracks = true
+		}
+	}
+	return nil
+}
+
+func parseMatroskaInfo(info []byte, m Metadata) {
+	scale := 1000000.0 // The default scale is in milliseconds
+	var duration float64
+	eachElement(info, func(id uint64, body []byte) {
+		switch id {
+		case timecodeScaleID:
+			scale = float64(ebmlUint(body))
+		case durationID:
+			duration = ebmlFloat(body)
+		case dateUTCID:
+			if len(body) == 8 {
+				ns := int64(binary.BigEndian.Uint64(body))
+				m["datetime"] = mkvEpoch.Add(time.Duration(ns))
+			}
+		}
+	})
+	if duration > 0 {
+		m["duration"] = seconds(duration * scale / 1e9)
+	}
+}
+
+func parseMatroskaTracks(tracks []byte, m Metadata) {
+	eachElement(tracks, func(id uint64, entry []byte) {
+		if _, ok := m["width"]; ok || id != trackEntryID {
+			return
+		}
+		var isVideo bool
+		var codec string
+		var width, height uint64
+		eachElement(entry, func(id uint64, body []byte) {
+			switch id {
+			case trackTypeID:
+				isVideo = ebmlUint(body) == 1
+			case codecID:
+				codec = string(bytes.TrimRight(body, "\x00"))
+			case videoID:
+				eachElement(body, func(id uint64, body []byte) {
+					switch id {
+					case pixelWidthID:
+						width = ebmlUint(body)
+					case pixelHeightID:
+						height = ebmlUint(body)
+					}
+				})
+			}
+		})
+		if !isVideo {
+			return
+		}
+		m["width"] = int(width)
+		m["height"] = int(height)
+		if codec != "" {
+			m["codec"] = codecName(codec)
+		}
+	})
+}
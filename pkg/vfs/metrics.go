@@ -0,0 +1,19 @@
+package vfs
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// BytesWritten counts the bytes written in the files, by backend. It is
+// incremented by the implementations of the VFS.
+var BytesWritten = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "cozy",
+		Subsystem: "vfs",
+		Name:      "bytes_written_total",
+		Help:      "Number of bytes written in the files.",
+	},
+	[]string{"backend"},
+)
+
+func init() {
+	prometheus.MustRegister(BytesWritten)
+}
@@ -0,0 +1,188 @@
+package vfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// quotaCheckInterval is the minimal delay between two checks of the disk
+// usage of an instance for the quota alerts, as the disk usage is computed
+// by a CouchDB view. The changes made meanwhile are checked when it has
+// elapsed.
+var quotaCheckInterval = 10 * time.Second
+
+// quotaAlertMargin is how far, in percent of the disk quota, the disk usage
+// must fall below a threshold before it is no longer considered as crossed.
+// It avoids warning the user again each time the usage goes back and forth
+// around a threshold.
+const quotaAlertMargin = 5
+
+// quotaChecks are the domains where the disk usage has been checked less
+// than quotaCheckInterval ago. They are removed when the interval ends.
+var (
+	quotaChecksMu sync.Mutex
+	quotaChecks   = make(map[string]*quotaCheck)
+)
+
+// quotaCheck is pending when a change has been made since the last check. The
+// VFS of the last change is used for the next check.
+type quotaCheck struct {
+	pending bool
+	fs      *alertVFS
+}
+
+// QuotaAlerter can be implemented by the owner of a VFS, to be warned when
+// the disk usage crosses one of the thresholds of the quota alerts.
+type QuotaAlerter interface {
+	// QuotaAlertLevel returns the highest threshold, in percent of the disk
+	// quota, that was crossed when the disk usage was last checked, or 0.
+	QuotaAlertLevel() int
+	// SetQuotaAlertLevel is called when the highest threshold crossed by the
+	// disk usage has changed. The level is 0 when no threshold is crossed.
+	SetQuotaAlertLevel(level int, usage, quota int64) error
+}
+
+// WithQuotaAlerts returns a VFS that checks the disk usage after the files
+// have been written or destroyed, to warn the alerter when it crosses a
+// threshold. The checks are throttled for the given domain. It returns the
+// VFS unchanged if there are no thresholds in the configuration.
+func WithQuotaAlerts(fs VFS, alerter QuotaAlerter, domain string) VFS {
+	if len(config.GetConfig().Fs.QuotaAlerts) == 0 {
+		return fs
+	}
+	return &alertVFS{fs, alerter, domain}
+}
+
+type alertVFS struct {
+	VFS
+	alerter QuotaAlerter
+	domain  string
+}
+
+// alertFile is a file that checks the disk usage when it is closed
+type alertFile struct {
+	File
+	fs *alertVFS
+}
+
+func (f *alertFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		f.fs.throttleCheckQuota()
+	}
+	return err
+}
+
+func (a *alertVFS) CreateFile(newdoc, olddoc *FileDoc) (File, error) {
+	file, err := a.VFS.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	return &alertFile{file, a}, nil
+}
+
+func (a *alertVFS) DestroyFile(doc *FileDoc) error {
+	err := a.VFS.DestroyFile(doc)
+	if err == nil {
+		a.throttleCheckQuota()
+	}
+	return err
+}
+
+func (a *alertVFS) DestroyDirContent(doc *DirDoc) error {
+	err := a.VFS.DestroyDirContent(doc)
+	if err == nil {
+		a.throttleCheckQuota()
+	}
+	return err
+}
+
+func (a *alertVFS) DestroyDirAndContent(doc *DirDoc) error {
+	err := a.VFS.DestroyDirAndContent(doc)
+	if err == nil {
+		a.throttleCheckQuota()
+	}
+	return err
+}
+
+// throttleCheckQuota checks the disk usage now, or at the end of the interval
+// if it was checked recently for the domain. The alerts are best effort: they
+// must not make the write or the destruction fail.
+func (a *alertVFS) throttleCheckQuota() {
+	if quotaCheckInterval <= 0 {
+		a.checkQuota() // #nosec
+		return
+	}
+	quotaChecksMu.Lock()
+	if check, ok := quotaChecks[a.domain]; ok {
+		check.pending = true
+		check.fs = a
+		quotaChecksMu.Unlock()
+		return
+	}
+	quotaChecks[a.domain] = &quotaCheck{}
+	quotaChecksMu.Unlock()
+	a.checkQuota() // #nosec
+	time.AfterFunc(quotaCheckInterval, func() { endQuotaCheckInterval(a.domain) })
+}
+
+// endQuotaCheckInterval removes the domain from quotaChecks, and checks the
+// disk usage again if it has changed during the interval.
+func endQuotaCheckInterval(domain string) {
+	quotaChecksMu.Lock()
+	check := quotaChecks[domain]
+	delete(quotaChecks, domain)
+	quotaChecksMu.Unlock()
+	if check != nil && check.pending {
+		check.fs.throttleCheckQuota()
+	}
+}
+
+func (a *alertVFS) checkQuota() error {
+	quota := a.DiskQuota()
+	current := a.alerter.QuotaAlertLevel()
+	if quota <= 0 && current == 0 {
+		return nil
+	}
+	var usage int64
+	if quota > 0 {
+		var err error
+		if usage, err = a.DiskUsage(); err != nil {
+			return err
+		}
+	}
+	thresholds := config.GetConfig().Fs.QuotaAlerts
+	level := CrossedThreshold(usage, quota, thresholds)
+	if level < current {
+		// A threshold is still crossed until the usage falls a margin below
+		margin := quota * quotaAlertMargin / 100
+		if withMargin := CrossedThreshold(usage+margin, quota, thresholds); withMargin > level {
+			level = withMargin
+		}
+		if level > current {
+			level = current
+		}
+	}
+	if level == current {
+		return nil
+	}
+	return a.alerter.SetQuotaAlertLevel(level, usage, quota)
+}
+
+// CrossedThreshold returns the highest threshold, in percent of the disk
+// quota, that is crossed by the disk usage, or 0 if there are none. The
+// thresholds must be sorted in ascending order.
+func CrossedThreshold(usage, quota int64, thresholds []int) int {
+	level := 0
+	if quota <= 0 {
+		return level
+	}
+	for _, threshold := range thresholds {
+		if usage*100 >= int64(threshold)*quota {
+			level = threshold
+		}
+	}
+	return level
+}
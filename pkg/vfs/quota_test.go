@@ -0,0 +1,152 @@
+package vfs_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+// usageVFS is a VFS where the disk usage is known in advance, and where the
+// files are not written
+type usageVFS struct {
+	vfs.VFS
+	mu           sync.Mutex
+	usage, quota int64
+}
+
+func (u *usageVFS) setUsage(usage int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.usage = usage
+}
+
+func (u *usageVFS) DiskUsage() (int64, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.usage, nil
+}
+func (u *usageVFS) DiskQuota() int64 { return u.quota }
+func (u *usageVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	return nopFile{}, nil
+}
+func (u *usageVFS) DestroyFile(doc *vfs.FileDoc) error { return nil }
+
+type nopFile struct{ vfs.File }
+
+func (nopFile) Close() error { return nil }
+
+type alerter struct {
+	mu     sync.Mutex
+	level  int
+	alerts []int
+}
+
+func (a *alerter) QuotaAlertLevel() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.level
+}
+func (a *alerter) SetQuotaAlertLevel(level int, usage, quota int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.level = level
+	a.alerts = append(a.alerts, level)
+	return nil
+}
+func (a *alerter) sent() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]int(nil), a.alerts...)
+}
+
+func TestCrossedThreshold(t *testing.T) {
+	thresholds := []int{80, 95}
+	assert.Equal(t, 0, vfs.CrossedThreshold(500, 1000, thresholds))
+	assert.Equal(t, 0, vfs.CrossedThreshold(799, 1000, thresholds))
+	assert.Equal(t, 80, vfs.CrossedThreshold(800, 1000, thresholds))
+	assert.Equal(t, 80, vfs.CrossedThreshold(949, 1000, thresholds))
+	assert.Equal(t, 95, vfs.CrossedThreshold(950, 1000, thresholds))
+	assert.Equal(t, 95, vfs.CrossedThreshold(1200, 1000, thresholds))
+	assert.Equal(t, 0, vfs.CrossedThreshold(1200, 0, thresholds))
+	assert.Equal(t, 0, vfs.CrossedThreshold(1200, 1000, nil))
+}
+
+func TestQuotaAlerts(t *testing.T) {
+	a := &alerter{}
+	u := &usageVFS{VFS: fs, usage: 100, quota: 1000}
+
+	// Nothing is checked without thresholds
+	assert.Equal(t, u, vfs.WithQuotaAlerts(u, a, "alerts.example.net"))
+
+	config.GetConfig().Fs.QuotaAlerts = []int{80, 95}
+	defer func() { config.GetConfig().Fs.QuotaAlerts = nil }()
+	defer vfs.SetQuotaCheckInterval(0)()
+	afs := vfs.WithQuotaAlerts(u, a, "alerts.example.net")
+
+	write := func(usage int64) {
+		u.setUsage(usage)
+		f, err := afs.CreateFile(&vfs.FileDoc{}, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+
+	write(500)
+	assert.Empty(t, a.sent())
+	write(850)
+	assert.Equal(t, []int{80}, a.sent())
+	write(900)
+	assert.Equal(t, []int{80}, a.sent())
+	write(990)
+	assert.Equal(t, []int{80, 95}, a.sent())
+	write(920)
+	assert.Equal(t, []int{80, 95}, a.sent())
+	write(400)
+	assert.Equal(t, []int{80, 95, 0}, a.sent())
+	write(820)
+	assert.Equal(t, []int{80, 95, 0, 80}, a.sent())
+
+	// A threshold is still crossed until the usage falls a margin below it,
+	// so the user is not warned again for small changes around it
+	write(790)
+	write(820)
+	assert.Equal(t, []int{80, 95, 0, 80}, a.sent())
+
+	// The disk usage is also checked when a file is destroyed
+	u.setUsage(500)
+	assert.NoError(t, afs.DestroyFile(&vfs.FileDoc{}))
+	assert.Equal(t, []int{80, 95, 0, 80, 0}, a.sent())
+}
+
+func TestQuotaAlertsThrottled(t *testing.T) {
+	a := &alerter{}
+	u := &usageVFS{VFS: fs, usage: 100, quota: 1000}
+
+	config.GetConfig().Fs.QuotaAlerts = []int{80, 95}
+	defer func() { config.GetConfig().Fs.QuotaAlerts = nil }()
+	defer vfs.SetQuotaCheckInterval(100 * time.Millisecond)()
+	afs := vfs.WithQuotaAlerts(u, a, "throttled.example.net")
+
+	write := func(usage int64) {
+		u.setUsage(usage)
+		f, err := afs.CreateFile(&vfs.FileDoc{}, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+	}
+
+	write(850)
+	assert.Equal(t, []int{80}, a.sent())
+
+	// The writes made just after are checked later, only once
+	write(900)
+	write(990)
+	assert.Equal(t, []int{80}, a.sent())
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, []int{80, 95}, a.sent())
+
+	// The domain is forgotten when nothing has changed during an interval
+	assert.Equal(t, 0, vfs.PendingQuotaChecks())
+}
@@ -0,0 +1,101 @@
+package vfs
+
+import (
+	"github.com/cozy/cozy-stack/pkg/trace"
+)
+
+// Traced returns a VFS that adds a child of the given span for each operation
+// on the content of the files and directories. It returns the VFS unchanged
+// if the span is nil.
+func Traced(fs VFS, span *trace.Span) VFS {
+	if span == nil {
+		return fs
+	}
+	return &tracedVFS{fs, span}
+}
+
+type tracedVFS struct {
+	VFS
+	span *trace.Span
+}
+
+// tracedFile is a file whose span ends when it is closed
+type tracedFile struct {
+	File
+	span *trace.Span
+}
+
+func (f *tracedFile) Close() error {
+	err := f.File.Close()
+	f.span.SetError(err)
+	f.span.End()
+	return err
+}
+
+func (t *tracedVFS) start(op string) *trace.Span {
+	return t.span.Child("vfs "+op, trace.KindInternal)
+}
+
+// endSpan ends the span of an operation and returns its error
+func endSpan(span *trace.Span, err error) error {
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// openTraced wraps the file returned by an operation, to end its span when
+// the file is closed
+func openTraced(span *trace.Span, file File, err error) (File, error) {
+	if err != nil {
+		return nil, endSpan(span, err)
+	}
+	return &tracedFile{file, span}, nil
+}
+
+func (t *tracedVFS) CreateDir(doc *DirDoc) error {
+	span := t.start("CreateDir")
+	span.SetAttribute("dir.id", doc.ID())
+	return endSpan(span, t.VFS.CreateDir(doc))
+}
+
+func (t *tracedVFS) CreateFile(newdoc, olddoc *FileDoc) (File, error) {
+	span := t.start("CreateFile")
+	span.SetAttribute("file.size", newdoc.ByteSize)
+	if olddoc != nil {
+		span.SetAttribute("file.id", olddoc.ID())
+	}
+	file, err := t.VFS.CreateFile(newdoc, olddoc)
+	return openTraced(span, file, err)
+}
+
+func (t *tracedVFS) OpenFile(doc *FileDoc) (File, error) {
+	span := t.start("OpenFile")
+	span.SetAttribute("file.id", doc.ID())
+	file, err := t.VFS.OpenFile(doc)
+	return openTraced(span, file, err)
+}
+
+func (t *tracedVFS) OpenFileVersion(doc *FileDoc, version *Version) (File, error) {
+	span := t.start("OpenFileVersion")
+	span.SetAttribute("file.id", doc.ID())
+	file, err := t.VFS.OpenFileVersion(doc, version)
+	return openTraced(span, file, err)
+}
+
+func (t *tracedVFS) DestroyFile(doc *FileDoc) error {
+	span := t.start("DestroyFile")
+	span.SetAttribute("file.id", doc.ID())
+	return endSpan(span, t.VFS.DestroyFile(doc))
+}
+
+func (t *tracedVFS) DestroyDirContent(doc *DirDoc) error {
+	span := t.start("DestroyDirContent")
+	span.SetAttribute("dir.id", doc.ID())
+	return endSpan(span, t.VFS.DestroyDirContent(doc))
+}
+
+func (t *tracedVFS) DestroyDirAndContent(doc *DirDoc) error {
+	span := t.start("DestroyDirAndContent")
+	span.SetAttribute("dir.id", doc.ID())
+	return endSpan(span, t.VFS.DestroyDirAndContent(doc))
+}
@@ -0,0 +1,153 @@
+package vfs
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// trashItem is a file or a directory at the root of the trash
+type trashItem struct {
+	dir       *DirDoc
+	file      *FileDoc
+	trashedAt time.Time
+}
+
+func (t *trashItem) destroy(fs VFS) error {
+	if t.dir != nil {
+		return fs.DestroyDirAndContent(t.dir)
+	}
+	return fs.DestroyFile(t.file)
+}
+
+type byTrashedAt []*trashItem
+
+func (b byTrashedAt) Len() int           { return len(b) }
+func (b byTrashedAt) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTrashedAt) Less(i, j int) bool { return b[i].trashedAt.Before(b[j].trashedAt) }
+
+// trashItems returns the files and directories at the root of the trash,
+// from the oldest to the most recently trashed. The items that were trashed
+// before the trashed_at field was introduced are dated by their last update,
+// which is when they were moved to the trash, without modifying them.
+func trashItems(fs VFS) ([]*trashItem, error) {
+	trash, err := fs.DirByID(consts.TrashDirID)
+	if err != nil {
+		return nil, err
+	}
+	var items []*trashItem
+	iter := fs.DirIterator(trash, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		item := &trashItem{dir: d, file: f}
+		if d != nil {
+			item.trashedAt = d.UpdatedAt
+			if d.TrashedAt != nil {
+				item.trashedAt = *d.TrashedAt
+			}
+		} else {
+			item.trashedAt = f.UpdatedAt
+			if f.TrashedAt != nil {
+				item.trashedAt = *f.TrashedAt
+			}
+		}
+		items = append(items, item)
+	}
+	sort.Sort(byTrashedAt(items))
+	return items, nil
+}
+
+// DestroyExpiredTrash destroys the files and directories that were put in the
+// trash before the given date.
+func DestroyExpiredTrash(fs VFS, before time.Time) error {
+	items, err := trashItems(fs)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if !item.trashedAt.Before(before) {
+			break
+		}
+		if err = item.destroy(fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FreeTrashSpace destroys the oldest files and directories of the trash until
+// size bytes can be added to the VFS without exceeding the disk quota. It
+// stops when the trash is empty, even if there is still not enough space.
+func FreeTrashSpace(fs VFS, size int64) error {
+	quota := fs.DiskQuota()
+	if quota <= 0 {
+		return nil
+	}
+	usage, err := fs.DiskUsage()
+	if err != nil || usage+size <= quota {
+		return err
+	}
+	items, err := trashItems(fs)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err = item.destroy(fs); err != nil {
+			return err
+		}
+		if usage, err = fs.DiskUsage(); err != nil {
+			return err
+		}
+		if usage+size <= quota {
+			break
+		}
+	}
+	return nil
+}
+
+// WithTrashPurge returns a VFS that destroys the oldest items of the trash
+// when a file can't be created because the disk quota is exceeded, and then
+// retries to create it. It returns the VFS unchanged if purge is false.
+func WithTrashPurge(fs VFS, purge bool) VFS {
+	if !purge {
+		return fs
+	}
+	return &purgeVFS{fs}
+}
+
+type purgeVFS struct {
+	VFS
+}
+
+func (p *purgeVFS) CreateFile(newdoc, olddoc *FileDoc) (File, error) {
+	file, err := p.VFS.CreateFile(newdoc, olddoc)
+	if err != ErrFileTooBig {
+		return file, err
+	}
+	// The lock of the VFS is no longer held here, so the items of the trash
+	// can be destroyed. The space to free is computed like in the quota check
+	// of CreateFile.
+	size := newdoc.ByteSize
+	if olddoc != nil && !Versioning().Enabled() {
+		size -= olddoc.Size()
+	}
+	if size < 1 {
+		size = 1
+	}
+	reserved, err := ReservedUploadSpace(p.VFS, newdoc)
+	if err != nil {
+		return nil, err
+	}
+	size += reserved
+	if err = FreeTrashSpace(p.VFS, size); err != nil {
+		return nil, err
+	}
+	return p.VFS.CreateFile(newdoc, olddoc)
+}
@@ -0,0 +1,300 @@
+package vfs
+
+import (
+	"io"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// UploadSessionTTL is the duration after which an upload session that has
+// not been finalized expires
+var UploadSessionTTL = 24 * time.Hour
+
+// UploadSession is a struct containing the informations about a resumable
+// upload. The content is sent in several chunks, that are kept until the
+// upload is finalized and the file created. It implements the couchdb.Doc
+// interface.
+type UploadSession struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	// Name and DirID of the file to create
+	Name  string `json:"name"`
+	DirID string `json:"dir_id"`
+	// FileID is the identifier of the file when its content is overwritten
+	FileID string `json:"file_id,omitempty"`
+
+	Size       int64    `json:"size,string"`
+	MD5Sum     []byte   `json:"md5sum"`
+	Mime       string   `json:"mime"`
+	Class      string   `json:"class"`
+	Executable bool     `json:"executable"`
+	Tags       []string `json:"tags"`
+
+	// Offset is the number of bytes already received
+	Offset int64         `json:"offset,string"`
+	Chunks []UploadChunk `json:"chunks"`
+
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UploadChunk is a part of the content of a resumable upload
+type UploadChunk struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset,string"`
+	Size   int64  `json:"size,string"`
+}
+
+// ID returns the upload session identifier
+func (s *UploadSession) ID() string { return s.DocID }
+
+// Rev returns the upload session revision
+func (s *UploadSession) Rev() string { return s.DocRev }
+
+// DocType returns the upload session document type
+func (s *UploadSession) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (s *UploadSession) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.MD5Sum = make([]byte, len(s.MD5Sum))
+	copy(cloned.MD5Sum, s.MD5Sum)
+	cloned.Tags = make([]string, len(s.Tags))
+	copy(cloned.Tags, s.Tags)
+	cloned.Chunks = make([]UploadChunk, len(s.Chunks))
+	copy(cloned.Chunks, s.Chunks)
+	return &cloned
+}
+
+// SetID changes the upload session identifier
+func (s *UploadSession) SetID(id string) { s.DocID = id }
+
+// SetRev changes the upload session revision
+func (s *UploadSession) SetRev(rev string) { s.DocRev = rev }
+
+// Expired returns true if the session can no longer be used
+func (s *UploadSession) Expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
+
+// CreateUploadSession checks that the upload can be done and saves the
+// session. The size of the file is reserved on the disk quota, so that the
+// file can still be created when all the chunks have been received.
+func CreateUploadSession(fs VFS, s *UploadSession) error {
+	if s.Size <= 0 {
+		return ErrContentLengthMismatch
+	}
+	if len(s.MD5Sum) == 0 {
+		return ErrInvalidHash
+	}
+	if err := checkFileName(s.Name); err != nil {
+		return err
+	}
+	parent, err := fs.DirByID(s.DirID)
+	if err != nil {
+		return ErrParentDoesNotExist
+	}
+	if parent.DocID == consts.TrashDirID || parent.RestorePath != "" {
+		return ErrParentInTrash
+	}
+
+	now := time.Now()
+	reserved, err := reservedUploadSize(fs, now)
+	if err != nil {
+		return err
+	}
+	if quota := fs.DiskQuota(); quota > 0 {
+		usage, err := fs.DiskUsage()
+		if err != nil {
+			return err
+		}
+		var oldsize int64
+		if s.FileID != "" && !Versioning().Enabled() {
+			if olddoc, err := fs.FileByID(s.FileID); err == nil {
+				oldsize = olddoc.ByteSize
+			}
+		}
+		if s.Size-oldsize > quota-usage-reserved {
+			return ErrFileTooBig
+		}
+	}
+
+	s.Offset = 0
+	s.Chunks = []UploadChunk{}
+	s.CreatedAt = now
+	s.ExpiresAt = now.Add(UploadSessionTTL)
+	return fs.CreateUploadSession(s)
+}
+
+// reservedUploadSize returns the number of bytes reserved by the ongoing
+// upload sessions. The expired sessions are destroyed.
+func reservedUploadSize(fs VFS, now time.Time) (int64, error) {
+	sessions, err := fs.AllUploadSessions()
+	if err != nil {
+		return 0, err
+	}
+	var reserved int64
+	for _, s := range sessions {
+		if s.Expired(now) {
+			if err = DestroyUploadSession(fs, s); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		reserved += s.Size
+	}
+	return reserved, nil
+}
+
+// ReservedUploadSpace returns the number of bytes reserved on the disk quota
+// by the ongoing upload sessions, except the session that is finalized to
+// create the given file. It is used by the quota check of CreateFile.
+func ReservedUploadSpace(indexer Indexer, doc *FileDoc) (int64, error) {
+	sessions, err := indexer.AllUploadSessions()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var reserved int64
+	for _, s := range sessions {
+		if !s.Expired(now) && s.ID() != doc.uploadSessionID {
+			reserved += s.Size
+		}
+	}
+	return reserved, nil
+}
+
+// GetUploadSession returns the upload session with the given identifier, if
+// it has not expired.
+func GetUploadSession(fs VFS, sessionID string) (*UploadSession, error) {
+	s, err := fs.UploadSessionByID(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if s.Expired(time.Now()) {
+		return nil, ErrUploadSessionNotFound
+	}
+	return s, nil
+}
+
+// WriteUploadChunk saves a chunk of content for the upload session. The
+// offset must be the current offset of the session, and the chunk must not
+// go beyond the announced size of the file.
+func WriteUploadChunk(fs VFS, s *UploadSession, offset int64, r io.Reader) error {
+	if s.Expired(time.Now()) {
+		return ErrUploadSessionNotFound
+	}
+	if offset != s.Offset {
+		return ErrUploadOffsetMismatch
+	}
+
+	chunk := UploadChunk{ID: makeSecret(), Offset: offset}
+	w, err := fs.CreateUploadChunk(s.ID(), chunk.ID)
+	if err != nil {
+		return err
+	}
+	// Read one more byte than the remaining size to detect the chunks that
+	// are too large
+	chunk.Size, err = io.Copy(w, io.LimitReader(r, s.Size-offset+1))
+	if cerr := w.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err == nil && offset+chunk.Size > s.Size {
+		err = ErrContentLengthMismatch
+	}
+	if err == nil && chunk.Size == 0 {
+		return fs.DestroyUploadChunk(s.ID(), chunk.ID)
+	}
+	if err == nil {
+		s.Chunks = append(s.Chunks, chunk)
+		s.Offset += chunk.Size
+		if err = fs.UpdateUploadSession(s); err != nil {
+			s.Chunks = s.Chunks[:len(s.Chunks)-1]
+			s.Offset -= chunk.Size
+		}
+		if couchdb.IsConflictError(err) {
+			err = ErrConflict
+		}
+	}
+	if err != nil {
+		fs.DestroyUploadChunk(s.ID(), chunk.ID) // #nosec
+		return err
+	}
+	return nil
+}
+
+// FinalizeUploadSession creates the file, or its new content, from the
+// chunks of the upload session, and then destroys the session. The md5sum
+// given at the creation of the session is checked against the whole content.
+func FinalizeUploadSession(fs VFS, s *UploadSession) (*FileDoc, error) {
+	if s.Expired(time.Now()) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if s.Offset != s.Size {
+		return nil, ErrUploadIncomplete
+	}
+
+	var olddoc *FileDoc
+	name, dirID := s.Name, s.DirID
+	if s.FileID != "" {
+		var err error
+		if olddoc, err = fs.FileByID(s.FileID); err != nil {
+			return nil, err
+		}
+		name, dirID = olddoc.DocName, olddoc.DirID
+	}
+
+	newdoc, err := NewFileDoc(name, dirID, s.Size, s.MD5Sum, s.Mime, s.Class,
+		time.Now(), s.Executable, false, s.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if olddoc != nil {
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+	}
+	// The space reserved by this session can be used for its file
+	newdoc.uploadSessionID = s.ID()
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range s.Chunks {
+		if err = copyUploadChunk(fs, s, chunk, file); err != nil {
+			break
+		}
+	}
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = DestroyUploadSession(fs, s); err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+func copyUploadChunk(fs VFS, s *UploadSession, chunk UploadChunk, w io.Writer) error {
+	r, err := fs.OpenUploadChunk(s.ID(), chunk.ID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// DestroyUploadSession removes the chunks and the document of an upload
+// session.
+func DestroyUploadSession(fs VFS, s *UploadSession) error {
+	if err := fs.DestroyUploadChunks(s); err != nil {
+		return err
+	}
+	return fs.DeleteUploadSession(s)
+}
@@ -0,0 +1,159 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Version is a struct containing the informations about an old version of
+// the content of a file. It implements the couchdb.Doc interface.
+type Version struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+
+	// Identifier of the file
+	FileID string `json:"file_id"`
+	// Name of the file when this version was its content
+	DocName string `json:"name"`
+
+	// CreatedAt is the date when the content of the file was replaced and
+	// this version was created
+	CreatedAt time.Time `json:"created_at"`
+	// UpdatedAt is the date of the last modification of this content
+	UpdatedAt time.Time `json:"updated_at"`
+
+	ByteSize  int64    `json:"size,string"`
+	MD5Sum    []byte   `json:"md5sum"`
+	SHA256Sum []byte   `json:"sha256sum,omitempty"`
+	Mime      string   `json:"mime"`
+	Class     string   `json:"class"`
+	Metadata  Metadata `json:"metadata,omitempty"`
+}
+
+// ID returns the version identifier
+func (v *Version) ID() string { return v.DocID }
+
+// Rev returns the version revision
+func (v *Version) Rev() string { return v.DocRev }
+
+// DocType returns the version document type
+func (v *Version) DocType() string { return consts.FilesVersions }
+
+// Clone implements couchdb.Doc
+func (v *Version) Clone() couchdb.Doc {
+	cloned := *v
+	cloned.MD5Sum = make([]byte, len(v.MD5Sum))
+	copy(cloned.MD5Sum, v.MD5Sum)
+	cloned.SHA256Sum = make([]byte, len(v.SHA256Sum))
+	copy(cloned.SHA256Sum, v.SHA256Sum)
+	return &cloned
+}
+
+// SetID changes the version identifier
+func (v *Version) SetID(id string) { v.DocID = id }
+
+// SetRev changes the version revision
+func (v *Version) SetRev(rev string) { v.DocRev = rev }
+
+// NewVersion returns a version with the content of the given file document,
+// that is going to be replaced.
+func NewVersion(file *FileDoc) *Version {
+	return &Version{
+		FileID:    file.ID(),
+		DocName:   file.DocName,
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: file.UpdatedAt,
+		ByteSize:  file.ByteSize,
+		MD5Sum:    file.MD5Sum,
+		SHA256Sum: file.SHA256Sum,
+		Mime:      file.Mime,
+		Class:     file.Class,
+		Metadata:  file.Metadata,
+	}
+}
+
+// Versioning returns the configured policy for keeping the old versions of
+// the files.
+func Versioning() config.FsVersioning {
+	return config.GetConfig().Fs.Versioning
+}
+
+// VersionsToClean returns the versions that should be removed to respect the
+// given policy. The versions must be sorted from the oldest to the most
+// recent, as returned by Indexer.AllVersions.
+func VersionsToClean(versions []*Version, policy config.FsVersioning, now time.Time) []*Version {
+	var toClean []*Version
+	for i, v := range versions {
+		tooMany := len(versions)-i > policy.MaxNumberToKeep
+		tooOld := policy.MaxAge > 0 && now.Sub(v.CreatedAt) > policy.MaxAge
+		if tooMany || tooOld {
+			toClean = append(toClean, v)
+		}
+	}
+	return toClean
+}
+
+// ServeVersionContent replies to a http request using the content of an old
+// version of a file.
+func ServeVersionContent(fs VFS, doc *FileDoc, version *Version, disposition string, req *http.Request, w http.ResponseWriter) error {
+	header := w.Header()
+	header.Set("Content-Type", version.Mime)
+	if disposition != "" {
+		header.Set("Content-Disposition", ContentDisposition(disposition, version.DocName))
+	}
+
+	if header.Get("Range") == "" {
+		eTag := base64.StdEncoding.EncodeToString(version.MD5Sum)
+		header.Set("Etag", eTag)
+	}
+
+	content, err := fs.OpenFileVersion(doc, version)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	http.ServeContent(w, req, version.DocName, version.UpdatedAt, content)
+	return nil
+}
+
+// RestoreVersion replaces the content of the file by the content of the
+// given old version. With versioning enabled, the current content is kept as
+// a new version.
+func RestoreVersion(fs VFS, olddoc *FileDoc, version *Version) (*FileDoc, error) {
+	if version.FileID != olddoc.ID() {
+		return nil, ErrVersionNotFound
+	}
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.ByteSize = version.ByteSize
+	newdoc.MD5Sum = version.MD5Sum
+	newdoc.Mime = version.Mime
+	newdoc.Class = version.Class
+	newdoc.Metadata = version.Metadata
+	newdoc.UpdatedAt = time.Now()
+
+	content, err := fs.OpenFileVersion(olddoc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
@@ -0,0 +1,35 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionsToClean(t *testing.T) {
+	now := time.Now()
+	versions := []*Version{
+		{DocID: "v1", CreatedAt: now.Add(-72 * time.Hour)},
+		{DocID: "v2", CreatedAt: now.Add(-48 * time.Hour)},
+		{DocID: "v3", CreatedAt: now.Add(-1 * time.Hour)},
+	}
+
+	toClean := VersionsToClean(versions, config.FsVersioning{MaxNumberToKeep: 5}, now)
+	assert.Len(t, toClean, 0)
+
+	toClean = VersionsToClean(versions, config.FsVersioning{MaxNumberToKeep: 2}, now)
+	if assert.Len(t, toClean, 1) {
+		assert.Equal(t, "v1", toClean[0].DocID)
+	}
+
+	toClean = VersionsToClean(versions, config.FsVersioning{
+		MaxNumberToKeep: 5,
+		MaxAge:          24 * time.Hour,
+	}, now)
+	if assert.Len(t, toClean, 2) {
+		assert.Equal(t, "v1", toClean[0].DocID)
+		assert.Equal(t, "v2", toClean[1].DocID)
+	}
+}
@@ -30,6 +30,12 @@ const (
 	TrashDirName = "/.cozy_trash"
 	// ThumbsDirName is the path of the directory for thumbnails
 	ThumbsDirName = "/.thumbs"
+	// VersionsDirName is the path of the directory for the old versions of
+	// the files
+	VersionsDirName = "/.cozy_versions"
+	// UploadsDirName is the path of the directory for the chunks of the
+	// resumable uploads
+	UploadsDirName = "/.cozy_uploads"
 	// WebappsDirName is the path of the directory in which apps are stored
 	WebappsDirName = "/.cozy_apps"
 	// KonnectorsDirName is the path of the directory in which konnectors source
@@ -72,6 +78,21 @@ type Fs interface {
 	// OpenFile return a file handler for reading associated with the given file
 	// document. The file handler implements io.ReadCloser and io.Seeker.
 	OpenFile(doc *FileDoc) (File, error)
+	// OpenFileVersion returns a file handler for reading the content of an old
+	// version of the given file.
+	OpenFileVersion(doc *FileDoc, version *Version) (File, error)
+	// DestroyVersion destroys an old version of a file.
+	DestroyVersion(version *Version) error
+
+	// CreateUploadChunk returns a writer for a new chunk of a resumable
+	// upload.
+	CreateUploadChunk(sessionID, chunkID string) (io.WriteCloser, error)
+	// OpenUploadChunk returns a reader on a chunk of a resumable upload.
+	OpenUploadChunk(sessionID, chunkID string) (io.ReadCloser, error)
+	// DestroyUploadChunk destroys a chunk of a resumable upload.
+	DestroyUploadChunk(sessionID, chunkID string) error
+	// DestroyUploadChunks destroys all the chunks of a resumable upload.
+	DestroyUploadChunks(session *UploadSession) error
 }
 
 // File is a reader, writer, seeker, closer iterface reprsenting an opened
@@ -84,6 +105,14 @@ type File interface {
 	io.Closer
 }
 
+// DiskUsageDetails is the breakdown of the disk usage of a VFS. The files in
+// the trash are not counted in their class.
+type DiskUsageDetails struct {
+	ByClass  map[string]int64
+	Trash    int64
+	Versions int64
+}
+
 // Indexer is an interface providing a common set of method for indexing layer
 // of our VFS.
 //
@@ -92,8 +121,12 @@ type File interface {
 type Indexer interface {
 	InitIndex() error
 
-	// DiskUsage computes the total size of the files contained in the VFS.
+	// DiskUsage computes the total size of the files contained in the VFS,
+	// including their old versions.
 	DiskUsage() (int64, error)
+	// DiskUsageDetails computes the breakdown of the disk usage between the
+	// classes of files, the trash and the old versions.
+	DiskUsageDetails() (*DiskUsageDetails, error)
 
 	// CreateFileDoc creates and add in the index a new file document.
 	CreateFileDoc(doc *FileDoc) error
@@ -151,6 +184,34 @@ type Indexer interface {
 	DirBatch(*DirDoc, couchdb.Cursor) ([]DirOrFileDoc, error)
 	DirLength(*DirDoc) (int, error)
 	DirChildExists(dirID, filename string) (bool, error)
+
+	// CreateVersion adds in the index the document of an old version of a
+	// file.
+	CreateVersion(v *Version) error
+	// DeleteVersion removes from the index the document of an old version of
+	// a file.
+	DeleteVersion(v *Version) error
+	// VersionByID returns the old version of a file with the specified
+	// identifier.
+	VersionByID(versionID string) (*Version, error)
+	// AllVersions returns the old versions of a file, from the oldest to the
+	// most recent.
+	AllVersions(fileID string) ([]*Version, error)
+
+	// CreateUploadSession adds in the index the document of a new session of
+	// resumable upload.
+	CreateUploadSession(s *UploadSession) error
+	// UpdateUploadSession updates the document of a session of resumable
+	// upload.
+	UpdateUploadSession(s *UploadSession) error
+	// DeleteUploadSession removes from the index the document of a session of
+	// resumable upload.
+	DeleteUploadSession(s *UploadSession) error
+	// UploadSessionByID returns the session of resumable upload with the
+	// specified identifier.
+	UploadSessionByID(sessionID string) (*UploadSession, error)
+	// AllUploadSessions returns all the sessions of resumable upload.
+	AllUploadSessions() ([]*UploadSession, error)
 }
 
 // DiskThresholder it an interface that can be implemeted to known how many space
@@ -165,10 +226,33 @@ type DiskThresholder interface {
 type Thumbser interface {
 	CreateThumb(img *FileDoc, format string) (io.WriteCloser, error)
 	RemoveThumb(img *FileDoc, format string) error
+	// RemoveThumbs removes all the thumbnails of a file, including the ones
+	// generated on demand.
+	RemoveThumbs(img *FileDoc) error
 	ServeThumbContent(w http.ResponseWriter, req *http.Request,
 		img *FileDoc, format string) error
 }
 
+// BlobStore is a flat storage of binary objects, used by the deduplicated mode
+// of the VFS, where the content of the files is shared by all the instances
+// and addressed by its hash. The names of the blobs are made of segments
+// separated by slashes.
+type BlobStore interface {
+	// CreateBlob returns a writer for a new blob. A blob with the same name is
+	// replaced.
+	CreateBlob(name string) (io.WriteCloser, error)
+	// OpenBlob returns a file handler for reading the content of a blob.
+	OpenBlob(name string) (File, error)
+	// RenameBlob changes the name of a blob. A blob with the new name is
+	// replaced.
+	RenameBlob(oldname, newname string) error
+	// RemoveBlob removes a blob. It is not an error if the blob does not
+	// exist.
+	RemoveBlob(name string) error
+	// RemoveBlobs removes all the blobs whose names start with dir + "/".
+	RemoveBlobs(dir string) error
+}
+
 // VFS is composed of the Indexer and Fs interface. It is the common interface
 // used thoughout the stack to access the VFS.
 type VFS interface {
@@ -200,6 +284,7 @@ type DocPatch struct {
 	Name        *string    `json:"name,omitempty"`
 	DirID       *string    `json:"dir_id,omitempty"`
 	RestorePath *string    `json:"restore_path,omitempty"`
+	TrashedAt   *time.Time `json:"-"` // Only set when a file or directory is trashed
 	Tags        *[]string  `json:"tags,omitempty"`
 	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
 	Executable  *bool      `json:"executable,omitempty"`
@@ -219,6 +304,7 @@ type DirOrFileDoc struct {
 	Executable bool     `json:"executable"`
 	Trashed    bool     `json:"trashed"`
 	Metadata   Metadata `json:"metadata,omitempty"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
 }
 
 // Refine returns either a DirDoc or FileDoc pointer depending on the type of
@@ -235,6 +321,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			DocName:      fd.DocName,
 			DirID:        fd.DirID,
 			RestorePath:  fd.RestorePath,
+			TrashedAt:    fd.TrashedAt,
 			CreatedAt:    fd.CreatedAt,
 			UpdatedAt:    fd.UpdatedAt,
 			ByteSize:     fd.ByteSize,
@@ -246,6 +333,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			Tags:         fd.Tags,
 			Metadata:     fd.Metadata,
 			ReferencedBy: fd.ReferencedBy,
+			SHA256Sum:    fd.SHA256Sum,
 		}
 	}
 	return nil, nil
@@ -616,6 +704,10 @@ func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error
 		patch.RestorePath = data.RestorePath
 	}
 
+	if patch.TrashedAt == nil {
+		patch.TrashedAt = data.TrashedAt
+	}
+
 	if patch.Name == nil {
 		patch.Name = data.Name
 	}
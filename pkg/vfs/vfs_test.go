@@ -3,6 +3,9 @@ package vfs_test
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -23,7 +26,11 @@ import (
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfsdedup"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/ncw/swift/swifttest"
 	"github.com/stretchr/testify/assert"
 )
@@ -757,6 +764,360 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.True(t, os.IsNotExist(err))
 }
 
+func TestTrashPurge(t *testing.T) {
+	diskUsage, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+	diskQuota = diskUsage + 1<<(1*10) // 1KB free
+	defer func() { diskQuota = 0 }()
+
+	write := func(fs vfs.VFS, name string) (*vfs.FileDoc, error) {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, 800, nil, "", "",
+			time.Now(), false, false, nil)
+		if err != nil {
+			return nil, err
+		}
+		f, err := fs.CreateFile(doc, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, bytes.NewReader(crypto.GenerateRandomBytes(800)))
+		if errc := f.Close(); err == nil {
+			err = errc
+		}
+		return doc, err
+	}
+
+	doc, err := write(fs, "to-purge")
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc, err = vfs.TrashFile(fs, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The trash is kept if the purge is not enabled
+	_, err = write(vfs.WithTrashPurge(fs, false), "after-purge")
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+
+	_, err = write(vfs.WithTrashPurge(fs, true), "after-purge")
+	assert.NoError(t, err)
+	_, err = fs.FileByID(doc.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVersioning(t *testing.T) {
+	config.GetConfig().Fs.Versioning = config.FsVersioning{MaxNumberToKeep: 2}
+	defer func() { config.GetConfig().Fs.Versioning = config.FsVersioning{} }()
+
+	writeContent := func(olddoc *vfs.FileDoc, content string) *vfs.FileDoc {
+		newdoc, err := vfs.NewFileDoc("versioned", consts.RootDirID, -1, nil,
+			"text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := fs.CreateFile(newdoc, olddoc)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, err = io.Copy(f, strings.NewReader(content))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+		return newdoc
+	}
+
+	doc := writeContent(nil, "one")
+	doc = writeContent(doc, "two")
+	doc = writeContent(doc, "three")
+	doc = writeContent(doc, "four")
+	if doc == nil {
+		return
+	}
+
+	versions, err := fs.AllVersions(doc.ID())
+	assert.NoError(t, err)
+	if !assert.Len(t, versions, 2) {
+		return
+	}
+	assert.Equal(t, doc.ID(), versions[0].FileID)
+	assert.Equal(t, int64(len("two")), versions[0].ByteSize)
+
+	f, err := fs.OpenFileVersion(doc, versions[1])
+	if assert.NoError(t, err) {
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "three", string(buf))
+		assert.NoError(t, f.Close())
+	}
+
+	used, err := fs.DiskUsage()
+	assert.NoError(t, err)
+
+	doc, err = vfs.RestoreVersion(fs, doc, versions[0])
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = fs.OpenFile(doc)
+	if assert.NoError(t, err) {
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "two", string(buf))
+		assert.NoError(t, f.Close())
+	}
+
+	// "four" is now kept as a version, and "two" has been pruned
+	versions, err = fs.AllVersions(doc.ID())
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, int64(len("three")), versions[0].ByteSize)
+		assert.Equal(t, int64(len("four")), versions[1].ByteSize)
+	}
+	used2, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, used, used2)
+
+	err = fs.DestroyFile(doc)
+	assert.NoError(t, err)
+	versions, err = fs.AllVersions(doc.ID())
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+}
+
+func TestUploadSession(t *testing.T) {
+	diskQuota = 1 << (1 * 10) // 1KB
+	defer func() { diskQuota = 0 }()
+
+	content := "one, two, three"
+	sum := md5.Sum([]byte(content))
+
+	tooBig := &vfs.UploadSession{
+		Name:   "upload-too-big",
+		DirID:  consts.RootDirID,
+		Size:   diskQuota + 1,
+		MD5Sum: sum[:],
+	}
+	assert.Equal(t, vfs.ErrFileTooBig, vfs.CreateUploadSession(fs, tooBig))
+
+	s := &vfs.UploadSession{
+		Name:   "uploaded",
+		DirID:  consts.RootDirID,
+		Size:   int64(len(content)),
+		MD5Sum: sum[:],
+		Mime:   "text/plain",
+		Class:  "text",
+	}
+	if !assert.NoError(t, vfs.CreateUploadSession(fs, s)) {
+		return
+	}
+
+	// The size of the file is reserved on the quota
+	other := &vfs.UploadSession{
+		Name:   "upload-other",
+		DirID:  consts.RootDirID,
+		Size:   diskQuota - int64(len(content)/2),
+		MD5Sum: sum[:],
+	}
+	assert.Equal(t, vfs.ErrFileTooBig, vfs.CreateUploadSession(fs, other))
+	// Even for a file created without an upload session
+	regular, err := vfs.NewFileDoc("regular", consts.RootDirID, other.Size, nil,
+		"text/plain", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	_, err = fs.CreateFile(regular, nil)
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+
+	err = vfs.WriteUploadChunk(fs, s, 0, strings.NewReader("one, "))
+	assert.NoError(t, err)
+	err = vfs.WriteUploadChunk(fs, s, 0, strings.NewReader("one, "))
+	assert.Equal(t, vfs.ErrUploadOffsetMismatch, err)
+	_, err = vfs.FinalizeUploadSession(fs, s)
+	assert.Equal(t, vfs.ErrUploadIncomplete, err)
+
+	s, err = vfs.GetUploadSession(fs, s.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(5), s.Offset)
+	err = vfs.WriteUploadChunk(fs, s, 5, strings.NewReader("two, three and more"))
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+	err = vfs.WriteUploadChunk(fs, s, 5, strings.NewReader("two, three"))
+	assert.NoError(t, err)
+
+	doc, err := vfs.FinalizeUploadSession(fs, s)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "uploaded", doc.DocName)
+	f, err := fs.OpenFile(doc)
+	if assert.NoError(t, err) {
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(buf))
+		assert.NoError(t, f.Close())
+	}
+
+	_, err = vfs.GetUploadSession(fs, s.ID())
+	assert.Equal(t, vfs.ErrUploadSessionNotFound, err)
+	assert.NoError(t, fs.DestroyFile(doc))
+}
+
+func TestDeduplication(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cozy-blobs")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	store, err := vfsafero.NewBlobStore(&url.URL{Scheme: "file", Host: "localhost", Path: tempdir})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	content := "the same content in two instances"
+	sum := sha256.Sum256([]byte(content))
+	hexsum := hex.EncodeToString(sum[:])
+	blob := path.Join(tempdir, ".cozy_blobs", "blobs", hexsum[:2], hexsum)
+
+	var instances []vfs.VFS
+	var docs []*vfs.FileDoc
+	for _, domain := range []string{"io.cozy.vfs.dedup1", "io.cozy.vfs.dedup2"} {
+		dfs, rollback, err := newDedupFS(domain, store, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer rollback()
+		doc, err := vfs.NewFileDoc("shared", consts.RootDirID, -1, nil,
+			"text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := dfs.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.Copy(f, strings.NewReader(content))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		assert.Equal(t, sum[:], doc.SHA256Sum)
+		instances = append(instances, dfs)
+		docs = append(docs, doc)
+	}
+
+	// The content is stored once, but counted in the quota of each instance
+	blobs, err := ioutil.ReadDir(path.Dir(blob))
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 1)
+	for _, dfs := range instances {
+		used, err := dfs.DiskUsage()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(content)), used)
+	}
+
+	// The blob is kept while it is referenced by a file
+	assert.NoError(t, instances[0].DestroyFile(docs[0]))
+	_, err = os.Stat(blob)
+	assert.NoError(t, err)
+	f, err := instances[1].OpenFile(docs[1])
+	if assert.NoError(t, err) {
+		buf, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(buf))
+		assert.NoError(t, f.Close())
+	}
+
+	assert.NoError(t, instances[1].DestroyFile(docs[1]))
+	_, err = os.Stat(blob)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDeduplicationLegacyFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cozy-legacy")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	domain := "io.cozy.vfs.legacy"
+	fsURL := &url.URL{Scheme: "file", Host: "localhost", Path: tempdir}
+	store, err := vfsafero.NewBlobStore(fsURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	index := vfs.NewCouchdbIndexer(couchdb.SimpleDatabasePrefix(domain))
+	legacy, err := vfsafero.New(index, &diskImpl{}, lock.ReadWrite(domain+"/legacy"), nil, fsURL, domain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, os.MkdirAll(path.Join(tempdir, domain), 0755)) {
+		return
+	}
+	dfs, rollback, err := newDedupFS(domain, store, legacy)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rollback()
+
+	// The files are created before the deduplicated mode is enabled
+	content := "created before the deduplication"
+	var docs []*vfs.FileDoc
+	for _, name := range []string{"legacy1", "legacy2"} {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil,
+			"text/plain", "text", time.Now(), false, false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := legacy.CreateFile(doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.Copy(f, strings.NewReader(content))
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		assert.Empty(t, doc.SHA256Sum)
+		docs = append(docs, doc)
+	}
+
+	readContent := func(doc *vfs.FileDoc) {
+		f, err := dfs.OpenFile(doc)
+		if assert.NoError(t, err) {
+			buf, err := ioutil.ReadAll(f)
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(buf))
+			assert.NoError(t, f.Close())
+		}
+	}
+	readContent(docs[0])
+
+	// The content is moved to a blob when the file is renamed
+	newdoc := docs[0].Clone().(*vfs.FileDoc)
+	newdoc.DocName = "renamed"
+	if !assert.NoError(t, dfs.UpdateFileDoc(docs[0], newdoc)) {
+		return
+	}
+	renamed, err := dfs.FileByPath("/renamed")
+	if !assert.NoError(t, err) {
+		return
+	}
+	sum := sha256.Sum256([]byte(content))
+	assert.Equal(t, sum[:], renamed.SHA256Sum)
+	readContent(renamed)
+
+	// The legacy content is removed with the file
+	legacyPath := path.Join(tempdir, domain, "legacy2")
+	_, err = os.Stat(legacyPath)
+	assert.NoError(t, err)
+	assert.NoError(t, dfs.DestroyFile(docs[1]))
+	_, err = os.Stat(legacyPath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = dfs.FileByID(docs[1].ID())
+	assert.Error(t, err)
+
+	assert.NoError(t, dfs.DestroyFile(renamed))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -767,7 +1128,7 @@ func TestMain(m *testing.M) {
 	}
 
 	var rollback func()
-	fs, rollback, err = makeAferoFS()
+	fs, rollback, err = makeAferoFS(nil)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -783,10 +1144,39 @@ func TestMain(m *testing.M) {
 	res2 := m.Run()
 	rollback()
 
-	os.Exit(res1 + res2)
+	fs, rollback, err = makeS3FS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res3 := m.Run()
+	rollback()
+
+	fs, rollback, err = makeDedupFS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res4 := m.Run()
+	rollback()
+
+	cipher, err := vfs.NewCipher(crypto.GenerateRandomBytes(32))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fs, rollback, err = makeAferoFS(cipher)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res5 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3 + res4 + res5)
 }
 
-func makeAferoFS() (vfs.VFS, func(), error) {
+func makeAferoFS(cipher *vfs.Cipher) (vfs.VFS, func(), error) {
 	tempdir, err := ioutil.TempDir("", "cozy-stack")
 	if err != nil {
 		return nil, nil, errors.New("could not create temporary directory")
@@ -794,7 +1184,7 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 
 	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
 	index := vfs.NewCouchdbIndexer(db)
-	aferoFs, err := vfsafero.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
+	aferoFs, err := vfsafero.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"), cipher,
 		&url.URL{Scheme: "file", Host: "localhost", Path: tempdir}, "io.cozy.vfs.test")
 	if err != nil {
 		return nil, nil, err
@@ -814,6 +1204,10 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
 	err = aferoFs.InitFs()
 	if err != nil {
 		return nil, nil, err
@@ -822,6 +1216,8 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 	return aferoFs, func() {
 		os.RemoveAll(tempdir)
 		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
 	}, nil
 }
 
@@ -842,7 +1238,7 @@ func makeSwiftFS() (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
-	swiftFs, err := vfsswift.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"),
+	swiftFs, err := vfsswift.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"), nil,
 		"io.cozy.vfs.test")
 	if err != nil {
 		return nil, nil, err
@@ -862,6 +1258,10 @@ func makeSwiftFS() (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
 	err = swiftFs.InitFs()
 	if err != nil {
 		return nil, nil, err
@@ -869,8 +1269,145 @@ func makeSwiftFS() (vfs.VFS, func(), error) {
 
 	return swiftFs, func() {
 		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
 		if swiftSrv != nil {
 			swiftSrv.Close()
 		}
 	}, nil
 }
+
+func makeS3FS() (vfs.VFS, func(), error) {
+	db := couchdb.SimpleDatabasePrefix("io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	faker := gofakes3.New(s3mem.New())
+	s3Srv := httptest.NewServer(faker.Server())
+	s3URL, err := url.Parse(s3Srv.URL)
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	err = config.InitS3Connection(&url.URL{
+		Scheme:   "s3",
+		Host:     s3URL.Host,
+		Path:     "/cozy-test",
+		RawQuery: "AccessKeyID=s3test&SecretAccessKey=s3test&Region=us-east-1&DisableSSL=true",
+	})
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	s3Fs, err := vfss3.New(index, &diskImpl{}, lock.ReadWrite("io.cozy.vfs.test"), nil,
+		"io.cozy.vfs.test")
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		s3Srv.Close()
+	}, nil
+}
+
+func makeDedupFS() (vfs.VFS, func(), error) {
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		return nil, nil, errors.New("could not create temporary directory")
+	}
+
+	// The references to the blobs of the previous runs are obsolete
+	err = couchdb.ResetDB(couchdb.GlobalDB, consts.Blobs)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return nil, nil, err
+	}
+
+	store, err := vfsafero.NewBlobStore(&url.URL{Scheme: "file", Host: "localhost", Path: tempdir})
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return nil, nil, err
+	}
+
+	dedupFs, rollback, err := newDedupFS("io.cozy.vfs.test", store, nil)
+	if err != nil {
+		os.RemoveAll(tempdir)
+		return nil, nil, err
+	}
+
+	return dedupFs, func() {
+		rollback()
+		os.RemoveAll(tempdir)
+		couchdb.DeleteDB(couchdb.GlobalDB, consts.Blobs)
+	}, nil
+}
+
+func newDedupFS(domain string, store vfs.BlobStore, legacy vfs.VFS) (vfs.VFS, func(), error) {
+	db := couchdb.SimpleDatabasePrefix(domain)
+	index := vfs.NewCouchdbIndexer(db)
+	dedupFs, err := vfsdedup.New(index, &diskImpl{}, lock.ReadWrite(domain), store, legacy, domain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
+		return nil, nil, err
+	}
+
+	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.FilesVersions)); err != nil {
+		return nil, nil, err
+	}
+
+	err = dedupFs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dedupFs, func() {
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+	}, nil
+}
@@ -0,0 +1,78 @@
+package vfsafero
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/spf13/afero"
+)
+
+// blobsDirName is the directory, next to the directories of the instances,
+// where the blobs of the deduplicated mode are stored. It can't be mistaken
+// for the domain of an instance.
+const blobsDirName = ".cozy_blobs"
+
+// NewBlobStore returns a vfs.BlobStore for the deduplicated mode, using the
+// same storage url as New.
+func NewBlobStore(fsURL *url.URL) (vfs.BlobStore, error) {
+	var fs afero.Fs
+	switch fsURL.Scheme {
+	case "file":
+		if fsURL.Path == "" {
+			return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
+				fsURL.String())
+		}
+		fs = afero.NewBasePathFs(afero.NewOsFs(), path.Join(fsURL.Path, blobsDirName))
+	case "mem":
+		fs = afero.NewMemMapFs()
+	default:
+		return nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
+	}
+	return &blobStore{fs}, nil
+}
+
+type blobStore struct {
+	fs afero.Fs
+}
+
+func (b *blobStore) CreateBlob(name string) (io.WriteCloser, error) {
+	name = path.Join("/", name)
+	if err := b.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return b.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+}
+
+func (b *blobStore) OpenBlob(name string) (vfs.File, error) {
+	f, err := b.fs.Open(path.Join("/", name))
+	if err != nil {
+		return nil, err
+	}
+	return &aferoFileOpen{f}, nil
+}
+
+func (b *blobStore) RenameBlob(oldname, newname string) error {
+	newname = path.Join("/", newname)
+	if err := b.fs.MkdirAll(path.Dir(newname), 0755); err != nil {
+		return err
+	}
+	return b.fs.Rename(path.Join("/", oldname), newname)
+}
+
+func (b *blobStore) RemoveBlob(name string) error {
+	err := b.fs.Remove(path.Join("/", name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (b *blobStore) RemoveBlobs(dir string) error {
+	return b.fs.RemoveAll(path.Join("/", dir))
+}
+
+var _ vfs.BlobStore = &blobStore{}
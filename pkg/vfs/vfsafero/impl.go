@@ -11,8 +11,10 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/spf13/afero"
 )
@@ -24,9 +26,10 @@ type aferoVFS struct {
 	vfs.Indexer
 	vfs.DiskThresholder
 
-	fs  afero.Fs
-	mu  lock.ErrorRWLocker
-	pth string
+	fs     afero.Fs
+	mu     lock.ErrorRWLocker
+	cipher *vfs.Cipher
+	pth    string
 
 	// whether or not the localfilesystem requires an initialisation of its root
 	// directory
@@ -37,8 +40,9 @@ type aferoVFS struct {
 // storage url.
 //
 // The supported scheme of the storage url are file://, for an OS-FS store, and
-// mem:// for an in-memory store. The backend used is the afero package.
-func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsURL *url.URL, domain string) (vfs.VFS, error) {
+// mem:// for an in-memory store. The backend used is the afero package. The
+// content of the files is encrypted with the cipher, if it is not nil.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, cipher *vfs.Cipher, fsURL *url.URL, domain string) (vfs.VFS, error) {
 	if fsURL.Scheme != "mem" && fsURL.Path == "" {
 		return nil, fmt.Errorf("vfsafero: please check the supplied fs url: %s",
 			fsURL.String())
@@ -60,9 +64,10 @@ func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, fsU
 		Indexer:         index,
 		DiskThresholder: disk,
 
-		fs:  fs,
-		mu:  mu,
-		pth: pth,
+		fs:     fs,
+		mu:     mu,
+		cipher: cipher,
+		pth:    pth,
 		// for now, only the file:// scheme needs a specific initialisation of its
 		// root directory.
 		osFS: fsURL.Scheme == "file",
@@ -138,12 +143,18 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		if err != nil {
 			return nil, err
 		}
+		// the space reserved by the ongoing upload sessions is not available
+		reserved, err := vfs.ReservedUploadSpace(afs, newdoc)
+		if err != nil {
+			return nil, err
+		}
 
+		// the old content is not freed if it is kept as a version
 		var oldsize int64
-		if olddoc != nil {
+		if olddoc != nil && !vfs.Versioning().Enabled() {
 			oldsize = olddoc.Size()
 		}
-		maxsize = diskQuota - diskUsage
+		maxsize = diskQuota - diskUsage - reserved
 		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
 			return nil, vfs.ErrFileTooBig
 		}
@@ -190,7 +201,7 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 
 	return &aferoFileCreation{
 		w: 0,
-		f: f,
+		f: afs.cipher.EncryptWriter(f),
 
 		afs:     afs,
 		newdoc:  newdoc,
@@ -268,9 +279,116 @@ func (afs *aferoVFS) destroyFile(doc *vfs.FileDoc) error {
 	if err != nil {
 		return err
 	}
+	versions, err := afs.Indexer.AllVersions(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = afs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	if len(versions) > 0 {
+		afs.fs.RemoveAll(versionsDir(doc.ID())) // #nosec
+	}
 	return afs.Indexer.DeleteFileDoc(doc)
 }
 
+func (afs *aferoVFS) DestroyVersion(v *vfs.Version) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	return afs.destroyVersion(v)
+}
+
+func (afs *aferoVFS) destroyVersion(v *vfs.Version) error {
+	err := afs.fs.Remove(versionPath(v))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return afs.Indexer.DeleteVersion(v)
+}
+
+// keepVersion moves the backup of the old content of a file in the
+// directory of the versions, and removes the versions that are no longer
+// wanted by the versioning policy.
+func (afs *aferoVFS) keepVersion(olddoc *vfs.FileDoc, bakpath string) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	v := vfs.NewVersion(olddoc)
+	if err := afs.Indexer.CreateVersion(v); err != nil {
+		return err
+	}
+	err := afs.fs.MkdirAll(versionsDir(v.FileID), 0755)
+	if err == nil {
+		err = afs.fs.Rename(bakpath, versionPath(v))
+	}
+	if err != nil {
+		afs.Indexer.DeleteVersion(v) // #nosec
+		return err
+	}
+	versions, err := afs.Indexer.AllVersions(v.FileID)
+	if err != nil {
+		return err
+	}
+	for _, old := range vfs.VersionsToClean(versions, vfs.Versioning(), time.Now()) {
+		if err = afs.destroyVersion(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionsDir(fileID string) string {
+	return path.Join(vfs.VersionsDirName, fileID)
+}
+
+func versionPath(v *vfs.Version) string {
+	return path.Join(versionsDir(v.FileID), v.ID())
+}
+
+func (afs *aferoVFS) CreateUploadChunk(sessionID, chunkID string) (io.WriteCloser, error) {
+	if err := afs.fs.MkdirAll(uploadsDir(sessionID), 0755); err != nil {
+		return nil, err
+	}
+	f, err := afs.fs.OpenFile(uploadChunkPath(sessionID, chunkID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return afs.cipher.EncryptWriter(f), nil
+}
+
+func (afs *aferoVFS) OpenUploadChunk(sessionID, chunkID string) (io.ReadCloser, error) {
+	f, err := afs.fs.Open(uploadChunkPath(sessionID, chunkID))
+	if err != nil {
+		return nil, err
+	}
+	return afs.cipher.DecryptReader(f), nil
+}
+
+func (afs *aferoVFS) DestroyUploadChunk(sessionID, chunkID string) error {
+	err := afs.fs.Remove(uploadChunkPath(sessionID, chunkID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (afs *aferoVFS) DestroyUploadChunks(s *vfs.UploadSession) error {
+	return afs.fs.RemoveAll(uploadsDir(s.ID()))
+}
+
+func uploadsDir(sessionID string) string {
+	return path.Join(vfs.UploadsDirName, sessionID)
+}
+
+func uploadChunkPath(sessionID, chunkID string) string {
+	return path.Join(uploadsDir(sessionID), chunkID)
+}
+
 func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := afs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
@@ -284,7 +402,25 @@ func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &aferoFileOpen{f}, nil
+	return afs.cipher.DecryptFile(&aferoFileOpen{f}, doc.ByteSize)
+}
+
+func (afs *aferoVFS) OpenFileVersion(doc *vfs.FileDoc, v *vfs.Version) (vfs.File, error) {
+	if v.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	f, err := afs.fs.Open(versionPath(v))
+	if os.IsNotExist(err) {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return afs.cipher.DecryptFile(&aferoFileOpen{f}, v.ByteSize)
 }
 
 // UpdateFileDoc overrides the indexer's one since the afero.Fs is by essence
@@ -428,7 +564,7 @@ func (f *aferoFileOpen) Close() error {
 //
 // aferoFileCreation implements io.WriteCloser.
 type aferoFileCreation struct {
-	f       afero.File         // file handle
+	f       io.WriteCloser     // file handle
 	w       int64              // total size written
 	afs     *aferoVFS          // parent vfs
 	newdoc  *vfs.FileDoc       // new document
@@ -460,6 +596,7 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		return n, err
 	}
 
+	vfs.BytesWritten.WithLabelValues("afero").Add(float64(n))
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
 		f.err = vfs.ErrFileTooBig
@@ -485,7 +622,14 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 
 func (f *aferoFileCreation) Close() (err error) {
 	defer func() {
-		if err == nil && f.olddoc != nil {
+		if err == nil && f.olddoc != nil && vfs.Versioning().Enabled() {
+			// keep the backup as an old version of the file
+			if errv := f.afs.keepVersion(f.olddoc, f.bakpath); errv != nil {
+				logger.WithNamespace("vfsafero").
+					Warnf("Could not keep a version of %s: %s", f.olddoc.ID(), errv)
+				f.afs.fs.Remove(f.bakpath) // #nosec
+			}
+		} else if err == nil && f.olddoc != nil {
 			// remove the backup if no error occured
 			f.afs.fs.Remove(f.bakpath) // #nosec
 		} else if err != nil && f.olddoc != nil {
@@ -11,13 +11,15 @@ import (
 	"github.com/spf13/afero"
 )
 
-// NewThumbsFs creates a new thumb filesystem base on a afero.Fs.
-func NewThumbsFs(fs afero.Fs) vfs.Thumbser {
-	return &thumbs{fs}
+// NewThumbsFs creates a new thumb filesystem base on a afero.Fs. The
+// thumbnails are encrypted with the cipher, if not nil.
+func NewThumbsFs(fs afero.Fs, cipher *vfs.Cipher) vfs.Thumbser {
+	return &thumbs{fs, cipher}
 }
 
 type thumbs struct {
-	fs afero.Fs
+	fs     afero.Fs
+	cipher *vfs.Cipher
 }
 
 func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, error) {
@@ -27,13 +29,31 @@ func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, e
 			return nil, err
 		}
 	}
-	return t.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE, 0640)
+	f, err := t.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return t.cipher.EncryptWriter(f), nil
 }
 
 func (t *thumbs) RemoveThumb(img *vfs.FileDoc, format string) error {
 	return t.fs.Remove(t.makeName(img, format))
 }
 
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc) error {
+	pattern := t.makeName(img, "*")
+	names, err := afero.Glob(t.fs, pattern)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = t.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request,
 	img *vfs.FileDoc, format string) error {
 	name := t.makeName(img, format)
@@ -45,8 +65,12 @@ func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request,
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	http.ServeContent(w, req, name, s.ModTime(), f)
+	content, err := t.cipher.DecryptFile(f, t.cipher.PlainSize(s.Size()))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	http.ServeContent(w, req, name, s.ModTime(), content)
 	return nil
 }
 
@@ -0,0 +1,809 @@
+// Package vfsdedup is the deduplicated mode of the VFS: the content of the
+// files is stored in blobs addressed by their SHA-256, that are shared by all
+// the instances. A blob is destroyed when no file or version references it.
+package vfsdedup
+
+// #nosec
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/sirupsen/logrus"
+)
+
+// dedupVFS is a struct implementing the vfs.VFS interface where the content
+// of the files is kept in a vfs.BlobStore shared by the instances. As the
+// blobs are not named after the files, the directories and the names of the
+// files exist only in the index.
+//
+// The files created before the deduplicated mode was enabled have no SHA-256:
+// their content is still read from the legacy storage of the instance. As
+// this storage is organized by paths, their content is moved to a blob
+// before they are renamed, moved or overwritten.
+type dedupVFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+
+	store  vfs.BlobStore
+	legacy vfs.VFS // storage of the files created before, may be nil
+	domain string
+	mu     lock.ErrorRWLocker
+	log    *logrus.Entry
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// blob store. The legacy VFS, if not nil, is used for the content of the files
+// created before the deduplicated mode was enabled. It must not use the same
+// lock as the deduplicated VFS.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, store vfs.BlobStore, legacy vfs.VFS, domain string) (vfs.VFS, error) {
+	if domain == "" {
+		return nil, fmt.Errorf("vfsdedup: specified domain is empty")
+	}
+	return &dedupVFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		store:  store,
+		legacy: legacy,
+		domain: domain,
+		mu:     mu,
+		log:    logger.WithDomain(domain),
+	}, nil
+}
+
+func (dfs *dedupVFS) InitFs() error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	return dfs.Indexer.InitIndex()
+}
+
+// Delete releases the blobs of the files and versions of the instance, and
+// removes its pending uploads. It must be called before the deletion of the
+// index.
+func (dfs *dedupVFS) Delete() error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	root, err := dfs.Indexer.DirByID(consts.RootDirID)
+	if err != nil {
+		return err
+	}
+	if err = dfs.releaseDirContent(root); err != nil {
+		return err
+	}
+	if err = dfs.store.RemoveBlobs(uploadsDir(dfs.domain)); err != nil {
+		return err
+	}
+	if err = dfs.store.RemoveBlobs(tmpDir(dfs.domain)); err != nil {
+		return err
+	}
+	if dfs.legacy != nil {
+		return dfs.legacy.Delete()
+	}
+	return nil
+}
+
+func (dfs *dedupVFS) releaseDirContent(doc *vfs.DirDoc) error {
+	iter := dfs.Indexer.DirIterator(doc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			err = dfs.releaseDirContent(d)
+		} else {
+			err = dfs.releaseFile(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dfs *dedupVFS) releaseFile(doc *vfs.FileDoc) error {
+	versions, err := dfs.Indexer.AllVersions(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = releaseBlob(dfs.store, v.SHA256Sum); err != nil {
+			return err
+		}
+	}
+	return releaseBlob(dfs.store, doc.SHA256Sum)
+}
+
+func (dfs *dedupVFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	exists, err := dfs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return dfs.Indexer.CreateDirDoc(doc)
+	}
+	return dfs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (dfs *dedupVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer dfs.mu.Unlock()
+
+	// The quota is computed from the size of the files of the instance, even
+	// if their content is shared with other instances.
+	diskQuota := dfs.DiskQuota()
+
+	var maxsize, newsize int64
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := dfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		// the space reserved by the ongoing upload sessions is not available
+		reserved, err := vfs.ReservedUploadSpace(dfs, newdoc)
+		if err != nil {
+			return nil, err
+		}
+
+		// the old content is not freed if it is kept as a version
+		var oldsize int64
+		if olddoc != nil && !vfs.Versioning().Enabled() {
+			oldsize = olddoc.Size()
+		}
+		maxsize = diskQuota - diskUsage - reserved
+		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
+			return nil, vfs.ErrFileTooBig
+		}
+	} else {
+		maxsize = -1 // no limit
+	}
+
+	if olddoc != nil {
+		// the old content may be kept as a version, that needs a blob
+		if err := dfs.importLegacy(olddoc); err != nil {
+			return nil, err
+		}
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := dfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = dfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+
+		// When added to the index, the document is first considered hidden. This
+		// flag will only be removed at the end of the upload when all its metadata
+		// are known. See the Close() method.
+		newdoc.Trashed = true
+
+		if newdoc.ID() == "" {
+			err = dfs.Indexer.CreateFileDoc(newdoc)
+		} else {
+			err = dfs.Indexer.CreateNamedFileDoc(newdoc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The content is written in a temporary blob, as its hash is known only
+	// at the end of the upload.
+	tmp := tmpDir(dfs.domain) + "/" + utils.RandomString(32)
+	w, err := dfs.store.CreateBlob(tmp)
+	if err != nil {
+		if olddoc == nil {
+			dfs.Indexer.DeleteFileDoc(newdoc) // #nosec
+		}
+		return nil, err
+	}
+
+	return &dedupFileCreation{
+		w:       w,
+		fs:      dfs,
+		tmp:     tmp,
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		maxsize: maxsize,
+		md5:     md5.New(), // #nosec
+		sha256:  sha256.New(),
+		meta:    vfs.NewMetaExtractor(newdoc),
+	}, nil
+}
+
+func (dfs *dedupVFS) DestroyDirContent(doc *vfs.DirDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	return dfs.destroyDirContent(doc)
+}
+
+func (dfs *dedupVFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	return dfs.destroyDirAndContent(doc)
+}
+
+func (dfs *dedupVFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	return dfs.destroyFile(doc)
+}
+
+func (dfs *dedupVFS) destroyDirContent(doc *vfs.DirDoc) error {
+	iter := dfs.Indexer.DirIterator(doc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			err = dfs.destroyDirAndContent(d)
+		} else {
+			err = dfs.destroyFile(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dfs *dedupVFS) destroyDirAndContent(doc *vfs.DirDoc) error {
+	if err := dfs.destroyDirContent(doc); err != nil {
+		return err
+	}
+	return dfs.Indexer.DeleteDirDoc(doc)
+}
+
+// destroyFile removes the file from the index before releasing its blobs: if
+// the release fails, a blob is kept for nothing, but no file is left without
+// content.
+func (dfs *dedupVFS) destroyFile(doc *vfs.FileDoc) error {
+	versions, err := dfs.Indexer.AllVersions(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = dfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	if len(doc.SHA256Sum) == 0 && dfs.legacy != nil {
+		// the legacy VFS removes both the content and the document
+		err = dfs.legacy.DestroyFile(doc)
+		if err == nil || !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = dfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	return releaseBlob(dfs.store, doc.SHA256Sum)
+}
+
+func (dfs *dedupVFS) DestroyVersion(v *vfs.Version) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	return dfs.destroyVersion(v)
+}
+
+func (dfs *dedupVFS) destroyVersion(v *vfs.Version) error {
+	if len(v.SHA256Sum) == 0 && dfs.legacy != nil {
+		return dfs.legacy.DestroyVersion(v)
+	}
+	if err := dfs.Indexer.DeleteVersion(v); err != nil {
+		return err
+	}
+	return releaseBlob(dfs.store, v.SHA256Sum)
+}
+
+// keepVersion keeps the old content of a file as a version: the reference to
+// the blob is transferred from the file to the version. The versions that are
+// no longer wanted by the versioning policy are removed.
+func (dfs *dedupVFS) keepVersion(olddoc *vfs.FileDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	v := vfs.NewVersion(olddoc)
+	if err := dfs.Indexer.CreateVersion(v); err != nil {
+		return err
+	}
+	if err := dfs.cleanVersions(v.FileID); err != nil {
+		dfs.log.Warnf("[vfsdedup] Could not clean the versions of %s: %s",
+			v.FileID, err)
+	}
+	return nil
+}
+
+func (dfs *dedupVFS) cleanVersions(fileID string) error {
+	versions, err := dfs.Indexer.AllVersions(fileID)
+	if err != nil {
+		return err
+	}
+	for _, old := range vfs.VersionsToClean(versions, vfs.Versioning(), time.Now()) {
+		if err = dfs.destroyVersion(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dfs *dedupVFS) CreateUploadChunk(sessionID, chunkID string) (io.WriteCloser, error) {
+	return dfs.store.CreateBlob(uploadChunkName(dfs.domain, sessionID, chunkID))
+}
+
+func (dfs *dedupVFS) OpenUploadChunk(sessionID, chunkID string) (io.ReadCloser, error) {
+	return dfs.store.OpenBlob(uploadChunkName(dfs.domain, sessionID, chunkID))
+}
+
+func (dfs *dedupVFS) DestroyUploadChunk(sessionID, chunkID string) error {
+	return dfs.store.RemoveBlob(uploadChunkName(dfs.domain, sessionID, chunkID))
+}
+
+func (dfs *dedupVFS) DestroyUploadChunks(s *vfs.UploadSession) error {
+	return dfs.store.RemoveBlobs(uploadsDir(dfs.domain) + "/" + s.ID())
+}
+
+func tmpDir(domain string) string {
+	return "tmp/" + domain
+}
+
+func uploadsDir(domain string) string {
+	return "uploads/" + domain
+}
+
+func uploadChunkName(domain, sessionID, chunkID string) string {
+	return uploadsDir(domain) + "/" + sessionID + "/" + chunkID
+}
+
+func (dfs *dedupVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if len(doc.SHA256Sum) == 0 {
+		if dfs.legacy == nil {
+			return nil, os.ErrNotExist
+		}
+		return dfs.legacy.OpenFile(doc)
+	}
+	return dfs.store.OpenBlob(blobName(doc.SHA256Sum))
+}
+
+func (dfs *dedupVFS) OpenFileVersion(doc *vfs.FileDoc, v *vfs.Version) (vfs.File, error) {
+	if v.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if len(v.SHA256Sum) == 0 {
+		if dfs.legacy == nil {
+			return nil, vfs.ErrVersionNotFound
+		}
+		return dfs.legacy.OpenFileVersion(doc, v)
+	}
+	f, err := dfs.store.OpenBlob(blobName(v.SHA256Sum))
+	if os.IsNotExist(err) {
+		return nil, vfs.ErrVersionNotFound
+	}
+	return f, err
+}
+
+// UpdateFileDoc overrides the indexer's one to check that the new name of the
+// file is not already used, as there is nothing else to enforce it.
+//
+// @override Indexer.UpdateFileDoc
+func (dfs *dedupVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := dfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+		if len(olddoc.SHA256Sum) == 0 {
+			if err = dfs.importLegacy(olddoc); err != nil {
+				return err
+			}
+			newdoc.SetRev(olddoc.Rev())
+			newdoc.SHA256Sum = olddoc.SHA256Sum
+		}
+	}
+	return dfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UpdateDirDoc overrides the indexer's one to check that the new name of the
+// directory is not already used, as there is nothing else to enforce it.
+//
+// @override Indexer.UpdateDirDoc
+func (dfs *dedupVFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := dfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer dfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		if strings.HasPrefix(newdoc.Fullpath, olddoc.Fullpath+"/") {
+			return vfs.ErrForbiddenDocMove
+		}
+		exists, err := dfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+		if err = dfs.importLegacyDir(olddoc); err != nil {
+			return err
+		}
+	}
+	return dfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+// importLegacy moves the content of a file created before the deduplicated
+// mode was enabled to a blob, and updates the document, in place, with its
+// SHA-256. The copy in the legacy storage is removed with the instance.
+func (dfs *dedupVFS) importLegacy(doc *vfs.FileDoc) error {
+	if len(doc.SHA256Sum) > 0 || dfs.legacy == nil {
+		return nil
+	}
+	r, err := dfs.legacy.OpenFile(doc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp := tmpDir(dfs.domain) + "/" + utils.RandomString(32)
+	w, err := dfs.store.CreateBlob(tmp)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(w, h), r)
+	if errc := w.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		dfs.store.RemoveBlob(tmp) // #nosec
+		return err
+	}
+
+	sum := h.Sum(nil)
+	if err = acquireBlob(dfs.store, sum, written, tmp); err != nil {
+		return err
+	}
+	newdoc := doc.Clone().(*vfs.FileDoc)
+	newdoc.SHA256Sum = sum
+	if err = dfs.Indexer.UpdateFileDoc(doc, newdoc); err != nil {
+		releaseBlob(dfs.store, sum) // #nosec
+		return err
+	}
+	*doc = *newdoc
+	return nil
+}
+
+// importLegacyDir moves the content of the files of a directory and its
+// sub-directories that were created before the deduplicated mode was enabled
+// to blobs.
+func (dfs *dedupVFS) importLegacyDir(doc *vfs.DirDoc) error {
+	if dfs.legacy == nil {
+		return nil
+	}
+	iter := dfs.Indexer.DirIterator(doc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			err = dfs.importLegacyDir(d)
+		} else {
+			err = dfs.importLegacy(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dfs *dedupVFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.DirByID(fileID)
+}
+
+func (dfs *dedupVFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.DirByPath(name)
+}
+
+func (dfs *dedupVFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.FileByID(fileID)
+}
+
+func (dfs *dedupVFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.FileByPath(name)
+}
+
+func (dfs *dedupVFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.FilePath(doc)
+}
+
+func (dfs *dedupVFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.DirOrFileByID(fileID)
+}
+
+func (dfs *dedupVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := dfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer dfs.mu.RUnlock()
+	return dfs.Indexer.DirOrFileByPath(name)
+}
+
+// dedupFileCreation represents a file open for writing. It is used to create
+// a file or to modify the content of a file.
+//
+// dedupFileCreation implements io.WriteCloser.
+type dedupFileCreation struct {
+	w        io.WriteCloser     // writer of the temporary blob
+	written  int64              // total size written
+	fs       *dedupVFS          // parent vfs
+	tmp      string             // name of the temporary blob
+	newdoc   *vfs.FileDoc       // new document
+	olddoc   *vfs.FileDoc       // old document
+	maxsize  int64              // maximum size allowed for the file
+	md5      hash.Hash          // md5 we build up along the file
+	sha256   hash.Hash          // sha256 we build up along the file
+	meta     *vfs.MetaExtractor // extracts metadata from the content
+	acquired bool               // a reference to the blob has been acquired
+	err      error              // write error
+}
+
+func (f *dedupFileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *dedupFileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *dedupFileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *dedupFileCreation) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	n, err := f.w.Write(p)
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+
+	vfs.BytesWritten.WithLabelValues("dedup").Add(float64(n))
+	f.written += int64(n)
+	if f.maxsize >= 0 && f.written > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return n, f.err
+	}
+
+	size := f.newdoc.ByteSize
+	if size >= 0 && f.written > size {
+		f.err = vfs.ErrContentLengthMismatch
+		return n, f.err
+	}
+
+	if f.meta != nil {
+		if _, err = (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	f.md5.Write(p[:n])    // #nosec
+	f.sha256.Write(p[:n]) // #nosec
+	return n, nil
+}
+
+func (f *dedupFileCreation) Close() (err error) {
+	defer func() {
+		if err != nil {
+			f.fs.store.RemoveBlob(f.tmp) // #nosec
+			if f.acquired {
+				releaseBlob(f.fs.store, f.newdoc.SHA256Sum) // #nosec
+			}
+			// If an error has occured that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				f.fs.Indexer.DeleteFileDoc(f.newdoc) // #nosec
+			}
+		} else if f.olddoc != nil {
+			f.releaseOld()
+		}
+	}()
+
+	if err = f.w.Close(); err != nil {
+		if f.meta != nil {
+			(*f.meta).Abort(err)
+		}
+		if f.err == nil {
+			f.err = err
+		}
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.written
+
+	if f.meta != nil {
+		if errc := (*f.meta).Close(); errc == nil {
+			newdoc.Metadata = (*f.meta).Result()
+		}
+	}
+
+	md5sum := f.md5.Sum(nil)
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	}
+
+	if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		return vfs.ErrInvalidHash
+	}
+
+	if newdoc.ByteSize < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if newdoc.ByteSize != written {
+		return vfs.ErrContentLengthMismatch
+	}
+
+	newdoc.SHA256Sum = f.sha256.Sum(nil)
+	if err = acquireBlob(f.fs.store, newdoc.SHA256Sum, written, f.tmp); err != nil {
+		return err
+	}
+	f.acquired = true
+
+	// The document is already added to the index when closing the file creation
+	// handler. When updating the content of the document with the final
+	// informations (size, md5, ...) we can reuse the same document as olddoc.
+	if olddoc == nil || !olddoc.Trashed {
+		newdoc.Trashed = false
+	}
+	if olddoc == nil {
+		olddoc = newdoc
+	}
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	// If we reach a conflict error, the document has been modified while
+	// uploading the content of the file. The new content is put on the
+	// current revision, and it replaces the content of this revision.
+	if couchdb.IsConflictError(err) {
+		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		if err != nil {
+			return err
+		}
+		if f.olddoc != nil {
+			f.olddoc = resdoc.Clone().(*vfs.FileDoc)
+		} else {
+			resdoc.Trashed = newdoc.Trashed
+		}
+		resdoc.Metadata = newdoc.Metadata
+		resdoc.ByteSize = newdoc.ByteSize
+		resdoc.MD5Sum = newdoc.MD5Sum
+		resdoc.SHA256Sum = newdoc.SHA256Sum
+		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	return err
+}
+
+// releaseOld keeps the old content of an updated file as a version, or
+// releases its blob if the versioning is disabled.
+func (f *dedupFileCreation) releaseOld() {
+	if vfs.Versioning().Enabled() {
+		if err := f.fs.keepVersion(f.olddoc); err != nil {
+			f.fs.log.Warnf("[vfsdedup] Could not keep a version of %s: %s",
+				f.olddoc.ID(), err)
+		} else {
+			return
+		}
+	}
+	if err := releaseBlob(f.fs.store, f.olddoc.SHA256Sum); err != nil {
+		f.fs.log.Warnf("[vfsdedup] Could not release the old content of %s: %s",
+			f.olddoc.ID(), err)
+	}
+}
+
+var (
+	_ vfs.VFS  = &dedupVFS{}
+	_ vfs.File = &dedupFileCreation{}
+)
@@ -0,0 +1,119 @@
+package vfsdedup
+
+import (
+	"encoding/hex"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// blobRef is the document, in the global database, that counts the files and
+// versions of all the instances that have a blob for content. The identifier
+// of the document is the hexadecimal SHA-256 of the content.
+type blobRef struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	Size   int64  `json:"size,string"`
+	Refs   int    `json:"refs"`
+}
+
+// ID returns the blob reference identifier
+func (r *blobRef) ID() string { return r.DocID }
+
+// Rev returns the blob reference revision
+func (r *blobRef) Rev() string { return r.DocRev }
+
+// DocType returns the blob reference document type
+func (r *blobRef) DocType() string { return consts.Blobs }
+
+// SetID changes the blob reference identifier
+func (r *blobRef) SetID(id string) { r.DocID = id }
+
+// SetRev changes the blob reference revision
+func (r *blobRef) SetRev(rev string) { r.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (r *blobRef) Clone() couchdb.Doc {
+	cloned := *r
+	return &cloned
+}
+
+// blobName returns the name of the blob for the given SHA-256. The blobs are
+// spread in 256 directories to avoid having too many entries in one of them.
+func blobName(sum []byte) string {
+	h := hex.EncodeToString(sum)
+	return "blobs/" + h[:2] + "/" + h
+}
+
+// blobLock returns the lock that must be held while the references to a blob
+// are changed. The blobs are distributed among 256 locks.
+func blobLock(sum []byte) lock.ErrorRWLocker {
+	return lock.ReadWrite("blobs/" + hex.EncodeToString(sum[:1]))
+}
+
+// acquireBlob adds a reference to the blob with the given SHA-256. The
+// content has been written in the tmp blob: it becomes the blob if it is the
+// first reference, and it is removed else.
+func acquireBlob(store vfs.BlobStore, sum []byte, size int64, tmp string) error {
+	mu := blobLock(sum)
+	if lockerr := mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer mu.Unlock()
+
+	ref := &blobRef{}
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Blobs, hex.EncodeToString(sum), ref)
+	if couchdb.IsNotFoundError(err) {
+		name := blobName(sum)
+		if err = store.RenameBlob(tmp, name); err != nil {
+			return err
+		}
+		ref = &blobRef{DocID: hex.EncodeToString(sum), Size: size, Refs: 1}
+		if err = couchdb.CreateNamedDocWithDB(couchdb.GlobalDB, ref); err != nil {
+			store.RemoveBlob(name) // #nosec
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	ref.Refs++
+	if err = couchdb.UpdateDoc(couchdb.GlobalDB, ref); err != nil {
+		return err
+	}
+	// The same content is already stored
+	return store.RemoveBlob(tmp)
+}
+
+// releaseBlob removes a reference to the blob with the given SHA-256. The blob
+// is destroyed when it is no longer referenced.
+func releaseBlob(store vfs.BlobStore, sum []byte) error {
+	// The files created before the deduplicated mode was enabled have no blob
+	if len(sum) == 0 {
+		return nil
+	}
+	mu := blobLock(sum)
+	if lockerr := mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer mu.Unlock()
+
+	ref := &blobRef{}
+	err := couchdb.GetDoc(couchdb.GlobalDB, consts.Blobs, hex.EncodeToString(sum), ref)
+	if couchdb.IsNotFoundError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ref.Refs--
+	if ref.Refs > 0 {
+		return couchdb.UpdateDoc(couchdb.GlobalDB, ref)
+	}
+	if err = couchdb.DeleteDoc(couchdb.GlobalDB, ref); err != nil {
+		return err
+	}
+	return store.RemoveBlob(blobName(sum))
+}
@@ -0,0 +1,49 @@
+package vfss3
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+// blobsPrefix is the prefix of the blobs of the deduplicated mode in the
+// bucket. It can't be mistaken for the domain of an instance.
+const blobsPrefix = ".cozy_blobs/"
+
+// NewBlobStore returns a vfs.BlobStore for the deduplicated mode, based on
+// S3.
+func NewBlobStore(c *minio.Client, bucket string) vfs.BlobStore {
+	return &blobStore{c: c, bucket: bucket}
+}
+
+type blobStore struct {
+	c      *minio.Client
+	bucket string
+}
+
+func (b *blobStore) CreateBlob(name string) (io.WriteCloser, error) {
+	return newObjectWriter(b.c, b.bucket, blobsPrefix+name, -1, ""), nil
+}
+
+func (b *blobStore) OpenBlob(name string) (vfs.File, error) {
+	obj, _, err := openObject(b.c, b.bucket, blobsPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3FileOpen{obj}, nil
+}
+
+func (b *blobStore) RenameBlob(oldname, newname string) error {
+	return moveObject(b.c, b.bucket, blobsPrefix+oldname, blobsPrefix+newname)
+}
+
+func (b *blobStore) RemoveBlob(name string) error {
+	return b.c.RemoveObject(b.bucket, blobsPrefix+name)
+}
+
+func (b *blobStore) RemoveBlobs(dir string) error {
+	return removeObjects(b.c, b.bucket, blobsPrefix+dir+"/")
+}
+
+var _ vfs.BlobStore = &blobStore{}
@@ -0,0 +1,698 @@
+package vfss3
+
+// #nosec
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+	"github.com/sirupsen/logrus"
+)
+
+// maxFileSize is the maximal size of a file: it is the limit for copying an
+// object in a single operation, as it is done when a file is renamed.
+const maxFileSize = 5 << (3 * 10) // 5 GiB
+
+// backupsDirName is the directory where the old content of a file is kept
+// while it is overwritten, to restore it if the upload fails.
+const backupsDirName = ".cozy_backups"
+
+// s3VFS is a struct implementing the vfs.VFS interface for a storage
+// compatible with the S3 API. All the instances share the same bucket, and
+// the objects of an instance are prefixed by its domain. The objects of the
+// files are named from the identifier of their parent directory and their
+// name, like for swift, so that a directory can be moved or renamed without
+// touching the objects of its content.
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	c      *minio.Client
+	bucket string
+	prefix string
+	mu     lock.ErrorRWLocker
+	cipher *vfs.Cipher
+	log    *logrus.Entry
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and the
+// S3 storage. The content of the files is encrypted with the cipher, if it is
+// not nil.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, cipher *vfs.Cipher, domain string) (vfs.VFS, error) {
+	if domain == "" {
+		return nil, fmt.Errorf("vfss3: specified domain is empty")
+	}
+	c, bucket := config.GetS3Client()
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+
+		c:      c,
+		bucket: bucket,
+		prefix: domain + "/",
+		mu:     mu,
+		cipher: cipher,
+		log:    logger.WithDomain(domain),
+	}, nil
+}
+
+func (sfs *s3VFS) InitFs() error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.Indexer.InitIndex()
+}
+
+func (sfs *s3VFS) Delete() error {
+	if err := removeObjects(sfs.c, sfs.bucket, sfs.prefix); err != nil {
+		sfs.log.Errorf("[vfss3] Could not delete the objects of %s: %s",
+			sfs.prefix, err.Error())
+		return err
+	}
+	sfs.log.Infof("[vfss3] Deleted the objects of %s", sfs.prefix)
+	return nil
+}
+
+func (sfs *s3VFS) objName(dirID, name string) string {
+	return sfs.prefix + dirID + "/" + name
+}
+
+func (sfs *s3VFS) versionObjName(v *vfs.Version) string {
+	return sfs.prefix + strings.TrimPrefix(vfs.VersionsDirName, "/") + "/" + v.FileID + "/" + v.ID()
+}
+
+func (sfs *s3VFS) backupObjName(fileID string) string {
+	return sfs.prefix + backupsDirName + "/" + fileID
+}
+
+func (sfs *s3VFS) uploadChunkObjName(sessionID, chunkID string) string {
+	return sfs.prefix + strings.TrimPrefix(vfs.UploadsDirName, "/") + "/" + sessionID + "/" + chunkID
+}
+
+// CreateDir only adds the directory to the index: there is no object for the
+// directories.
+func (sfs *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	exists, err := sfs.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return sfs.Indexer.CreateDirDoc(doc)
+	}
+	return sfs.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (sfs *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	diskQuota := sfs.DiskQuota()
+
+	var maxsize, newsize, oldsize int64
+	newsize = newdoc.ByteSize
+	if diskQuota > 0 {
+		diskUsage, err := sfs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		// the space reserved by the ongoing upload sessions is not available
+		reserved, err := vfs.ReservedUploadSpace(sfs, newdoc)
+		if err != nil {
+			return nil, err
+		}
+		// the old content is not freed if it is kept as a version
+		if olddoc != nil && !vfs.Versioning().Enabled() {
+			oldsize = olddoc.Size()
+		}
+		maxsize = diskQuota - diskUsage - reserved
+		if maxsize > maxFileSize {
+			maxsize = maxFileSize
+		}
+	} else {
+		maxsize = maxFileSize
+	}
+	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
+		return nil, vfs.ErrFileTooBig
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := sfs.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+
+		// When added to the index, the document is first considered hidden. This
+		// flag will only be removed at the end of the upload when all its metadata
+		// are known. See the Close() method.
+		newdoc.Trashed = true
+
+		if newdoc.ID() == "" {
+			err = sfs.Indexer.CreateFileDoc(newdoc)
+		} else {
+			err = sfs.Indexer.CreateNamedFileDoc(newdoc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Before overwriting the object, a copy of the old content is made: it is
+	// kept as a version of the file if the versioning is enabled, or as a
+	// backup that is restored if the upload fails.
+	var version *vfs.Version
+	var oldName, backup string
+	if olddoc != nil {
+		oldName = sfs.objName(olddoc.DirID, olddoc.DocName)
+		if vfs.Versioning().Enabled() {
+			version = vfs.NewVersion(olddoc)
+			if err = sfs.Indexer.CreateVersion(version); err != nil {
+				return nil, err
+			}
+			backup = sfs.versionObjName(version)
+		} else {
+			backup = sfs.backupObjName(olddoc.ID())
+		}
+		if err = copyObject(sfs.c, sfs.bucket, oldName, backup); err != nil {
+			if version != nil {
+				sfs.Indexer.DeleteVersion(version) // #nosec
+			}
+			return nil, err
+		}
+	}
+
+	objName := sfs.objName(newdoc.DirID, newdoc.DocName)
+	hash := md5.New() // #nosec
+	w := newObjectWriter(sfs.c, sfs.bucket, objName, sfs.cipher.EncryptedSize(newsize), newdoc.Mime)
+	return &s3FileCreation{
+		w:       w,
+		cw:      sfs.cipher.EncryptWriter(w),
+		fs:      sfs,
+		name:    objName,
+		oldName: oldName,
+		hash:    hash,
+		meta:    vfs.NewMetaExtractor(newdoc),
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		version: version,
+		backup:  backup,
+		maxsize: maxsize,
+	}, nil
+}
+
+func (sfs *s3VFS) DestroyDirContent(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyDirContent(doc)
+}
+
+func (sfs *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyDirAndContent(doc)
+}
+
+func (sfs *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyFile(doc)
+}
+
+func (sfs *s3VFS) destroyDirContent(doc *vfs.DirDoc) error {
+	iter := sfs.DirIterator(doc, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			err = sfs.destroyDirAndContent(d)
+		} else {
+			err = sfs.destroyFile(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sfs *s3VFS) destroyDirAndContent(doc *vfs.DirDoc) error {
+	if err := sfs.destroyDirContent(doc); err != nil {
+		return err
+	}
+	return sfs.Indexer.DeleteDirDoc(doc)
+}
+
+func (sfs *s3VFS) destroyFile(doc *vfs.FileDoc) error {
+	err := sfs.c.RemoveObject(sfs.bucket, sfs.objName(doc.DirID, doc.DocName))
+	if err != nil {
+		return err
+	}
+	versions, err := sfs.Indexer.AllVersions(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = sfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return sfs.Indexer.DeleteFileDoc(doc)
+}
+
+func (sfs *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	obj, _, err := openObject(sfs.c, sfs.bucket, sfs.objName(doc.DirID, doc.DocName))
+	if err != nil {
+		return nil, err
+	}
+	return sfs.cipher.DecryptFile(&s3FileOpen{obj}, doc.ByteSize)
+}
+
+func (sfs *s3VFS) OpenFileVersion(doc *vfs.FileDoc, v *vfs.Version) (vfs.File, error) {
+	if v.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	obj, _, err := openObject(sfs.c, sfs.bucket, sfs.versionObjName(v))
+	if os.IsNotExist(err) {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sfs.cipher.DecryptFile(&s3FileOpen{obj}, v.ByteSize)
+}
+
+func (sfs *s3VFS) DestroyVersion(v *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyVersion(v)
+}
+
+func (sfs *s3VFS) destroyVersion(v *vfs.Version) error {
+	if err := sfs.c.RemoveObject(sfs.bucket, sfs.versionObjName(v)); err != nil {
+		return err
+	}
+	return sfs.Indexer.DeleteVersion(v)
+}
+
+// cleanVersions removes the versions of a file that are no longer wanted by
+// the versioning policy.
+func (sfs *s3VFS) cleanVersions(fileID string) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	versions, err := sfs.Indexer.AllVersions(fileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range vfs.VersionsToClean(versions, vfs.Versioning(), time.Now()) {
+		if err = sfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sfs *s3VFS) CreateUploadChunk(sessionID, chunkID string) (io.WriteCloser, error) {
+	objName := sfs.uploadChunkObjName(sessionID, chunkID)
+	w := newObjectWriter(sfs.c, sfs.bucket, objName, -1, "")
+	return sfs.cipher.EncryptWriter(w), nil
+}
+
+func (sfs *s3VFS) OpenUploadChunk(sessionID, chunkID string) (io.ReadCloser, error) {
+	obj, _, err := openObject(sfs.c, sfs.bucket, sfs.uploadChunkObjName(sessionID, chunkID))
+	if err != nil {
+		return nil, err
+	}
+	return sfs.cipher.DecryptReader(obj), nil
+}
+
+func (sfs *s3VFS) DestroyUploadChunk(sessionID, chunkID string) error {
+	return sfs.c.RemoveObject(sfs.bucket, sfs.uploadChunkObjName(sessionID, chunkID))
+}
+
+func (sfs *s3VFS) DestroyUploadChunks(s *vfs.UploadSession) error {
+	if len(s.Chunks) == 0 {
+		return nil
+	}
+	return removeObjects(sfs.c, sfs.bucket, sfs.uploadChunkObjName(s.ID(), ""))
+}
+
+// UpdateFileDoc overrides the indexer's one since the s3 fs indexes files
+// using their DirID + Name value to preserve atomicity of the hierarchy.
+//
+// @override Indexer.UpdateFileDoc
+func (sfs *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+		err = moveObject(sfs.c, sfs.bucket,
+			sfs.objName(olddoc.DirID, olddoc.DocName),
+			sfs.objName(newdoc.DirID, newdoc.DocName),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UpdateDirDoc overrides the indexer's one to check that the new name of the
+// directory is not already used. There is no object to move, as the objects
+// of the content are named from the identifier of the directory.
+//
+// @override Indexer.UpdateDirDoc
+func (sfs *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return sfs.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (sfs *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByID(fileID)
+}
+
+func (sfs *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirByPath(name)
+}
+
+func (sfs *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByID(fileID)
+}
+
+func (sfs *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FileByPath(name)
+}
+
+func (sfs *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.FilePath(doc)
+}
+
+func (sfs *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByID(fileID)
+}
+
+func (sfs *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	return sfs.Indexer.DirOrFileByPath(name)
+}
+
+type s3FileCreation struct {
+	w       *objectWriter
+	cw      io.WriteCloser // writes in w, with the encryption if enabled
+	written int64
+	fs      *s3VFS
+	name    string
+	oldName string
+	err     error
+	hash    hash.Hash
+	meta    *vfs.MetaExtractor
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	version *vfs.Version
+	backup  string
+	maxsize int64
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	n, err := f.cw.Write(p)
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+
+	vfs.BytesWritten.WithLabelValues("s3").Add(float64(n))
+	f.written += int64(n)
+	if f.maxsize >= 0 && f.written > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return n, f.err
+	}
+
+	size := f.newdoc.ByteSize
+	if size >= 0 && f.written > size {
+		f.err = vfs.ErrContentLengthMismatch
+		return n, f.err
+	}
+
+	_, err = f.hash.Write(p[:n])
+	return n, err
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err != nil {
+			if f.olddoc == nil || f.oldName != f.name {
+				f.fs.c.RemoveObject(f.fs.bucket, f.name) // #nosec
+			}
+			if f.backup != "" {
+				// Put back the old content of the file
+				copyObject(f.fs.c, f.fs.bucket, f.backup, f.oldName) // #nosec
+			}
+
+			// If an error has occured that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				f.fs.Indexer.DeleteFileDoc(f.newdoc) // #nosec
+			}
+
+			if f.version != nil {
+				f.fs.destroyVersion(f.version) // #nosec
+			}
+		} else if f.version != nil {
+			if errc := f.fs.cleanVersions(f.version.FileID); errc != nil {
+				f.fs.log.Warnf("[vfss3] Could not clean the versions of %s: %s",
+					f.version.FileID, errc)
+			}
+		}
+		if f.version == nil && f.backup != "" {
+			f.fs.c.RemoveObject(f.fs.bucket, f.backup) // #nosec
+		}
+	}()
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.written
+	if f.err == nil && newdoc.ByteSize >= 0 && newdoc.ByteSize != written {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+
+	// The upload is cancelled if an error has occurred while writing
+	if f.err != nil {
+		f.w.Abort(f.err) // #nosec
+		if f.meta != nil {
+			(*f.meta).Abort(f.err)
+		}
+		return f.err
+	}
+
+	if err = f.cw.Close(); err != nil {
+		if f.meta != nil {
+			(*f.meta).Abort(err)
+		}
+		return err
+	}
+
+	if f.meta != nil {
+		if errc := (*f.meta).Close(); errc == nil {
+			newdoc.Metadata = (*f.meta).Result()
+		}
+	}
+
+	md5sum := f.hash.Sum(nil)
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	}
+
+	if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		return vfs.ErrInvalidHash
+	}
+
+	if newdoc.ByteSize < 0 {
+		newdoc.ByteSize = written
+	}
+
+	// The document is already added to the index when closing the file creation
+	// handler. When updating the content of the document with the final
+	// informations (size, md5, ...) we can reuse the same document as olddoc.
+	if olddoc == nil || !olddoc.Trashed {
+		newdoc.Trashed = false
+	}
+	if olddoc == nil {
+		olddoc = newdoc
+	}
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	// If we reach a conflict error, the document has been modified while
+	// uploading the content of the file.
+	if couchdb.IsConflictError(err) {
+		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		if err != nil {
+			return err
+		}
+		resdoc.Metadata = newdoc.Metadata
+		resdoc.ByteSize = newdoc.ByteSize
+		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	return err
+}
+
+type s3FileOpen struct {
+	obj *minio.Object
+}
+
+func (f *s3FileOpen) Read(p []byte) (int, error) {
+	return f.obj.Read(p)
+}
+
+func (f *s3FileOpen) ReadAt(p []byte, off int64) (int, error) {
+	return f.obj.ReadAt(p, off)
+}
+
+func (f *s3FileOpen) Seek(offset int64, whence int) (int64, error) {
+	return f.obj.Seek(offset, whence)
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileOpen) Close() error {
+	return f.obj.Close()
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+)
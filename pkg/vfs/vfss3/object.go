@@ -0,0 +1,130 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+
+	minio "github.com/minio/minio-go"
+)
+
+// partSize is the size of the parts for the multipart uploads. The parts are
+// kept in memory while they are sent, so it should not be too large. With the
+// 10000 parts allowed by S3, it is enough for the maximal size of a file.
+const partSize = 16 << (2 * 10) // 16 MiB
+
+// objectWriter uploads an object with the content written in it. The upload
+// is made by a goroutine while the content is written, and Close waits for
+// the end of the upload.
+type objectWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newObjectWriter starts the upload of an object. The size can be -1 if it is
+// not known in advance.
+func newObjectWriter(c *minio.Client, bucket, name string, size int64, contentType string) *objectWriter {
+	pr, pw := io.Pipe()
+	w := &objectWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := c.PutObject(bucket, name, pr, size, minio.PutObjectOptions{
+			ContentType: contentType,
+			PartSize:    partSize,
+		})
+		// Unblock the writer if the upload has failed
+		pr.CloseWithError(err) // #nosec
+		w.done <- err
+	}()
+	return w
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close finishes the upload, and returns its error
+func (w *objectWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// Abort cancels the upload: the object is not created
+func (w *objectWriter) Abort(err error) error {
+	w.pw.CloseWithError(err) // #nosec
+	return <-w.done
+}
+
+// openObject returns a reader for the object with its informations, or
+// os.ErrNotExist if it does not exist.
+func openObject(c *minio.Client, bucket, name string) (*minio.Object, minio.ObjectInfo, error) {
+	obj, err := c.GetObject(bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	// The request is sent on the first call to the object
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close() // #nosec
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	return obj, info, nil
+}
+
+func copyObject(c *minio.Client, bucket, src, dst string) error {
+	dstInfo, err := minio.NewDestinationInfo(bucket, dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	srcInfo := minio.NewSourceInfo(bucket, src, nil)
+	return wrapS3Err(c.CopyObject(dstInfo, srcInfo))
+}
+
+// moveObject renames an object: as S3 has no rename operation, the object is
+// copied and the original is removed.
+func moveObject(c *minio.Client, bucket, src, dst string) error {
+	if err := copyObject(c, bucket, src, dst); err != nil {
+		return err
+	}
+	return c.RemoveObject(bucket, src)
+}
+
+// removeObjects removes all the objects whose name starts with prefix
+func removeObjects(c *minio.Client, bucket, prefix string) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	namesCh := make(chan string)
+	var listErr error
+	go func() {
+		defer close(namesCh)
+		for obj := range c.ListObjects(bucket, prefix, true, doneCh) {
+			if obj.Err != nil {
+				listErr = obj.Err
+				return
+			}
+			namesCh <- obj.Key
+		}
+	}()
+	var err error
+	for rerr := range c.RemoveObjects(bucket, namesCh) {
+		if err == nil {
+			err = rerr.Err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return listErr
+}
+
+// wrapS3Err returns os.ErrNotExist for the errors of a missing object
+func wrapS3Err(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return os.ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package vfss3
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go"
+)
+
+// NewThumbsFs creates a new thumb filesystem base on S3. The thumbnails are
+// stored with the objects of the instance, under a .thumbs prefix, and they
+// are encrypted with the cipher, if not nil.
+func NewThumbsFs(c *minio.Client, bucket, domain string, cipher *vfs.Cipher) vfs.Thumbser {
+	return &thumbs{c: c, bucket: bucket, prefix: domain + "/.thumbs/", cipher: cipher}
+}
+
+type thumbs struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+	cipher *vfs.Cipher
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, error) {
+	w := newObjectWriter(t.c, t.bucket, t.makeName(img, format), -1, "")
+	return t.cipher.EncryptWriter(w), nil
+}
+
+func (t *thumbs) RemoveThumb(img *vfs.FileDoc, format string) error {
+	return t.c.RemoveObject(t.bucket, t.makeName(img, format))
+}
+
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc) error {
+	return removeObjects(t.c, t.bucket, t.makeName(img, ""))
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	name := t.makeName(img, format)
+	obj, info, err := openObject(t.c, t.bucket, name)
+	if err != nil {
+		return err
+	}
+	content, err := t.cipher.DecryptFile(&s3FileOpen{obj}, t.cipher.PlainSize(info.Size))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, info.ETag))
+	http.ServeContent(w, req, name, info.LastModified, content)
+	return nil
+}
+
+func (t *thumbs) makeName(img *vfs.FileDoc, format string) string {
+	return fmt.Sprintf("%s%s-%s", t.prefix, img.ID(), format)
+}
@@ -0,0 +1,68 @@
+package vfsswift
+
+import (
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// blobsContainer is the container where the blobs of the deduplicated mode
+// are stored.
+const blobsContainer = "cozy-blobs"
+
+// NewBlobStore returns a vfs.BlobStore for the deduplicated mode, based on
+// swift.
+func NewBlobStore(c *swift.Connection) vfs.BlobStore {
+	return &blobStore{c: c, container: blobsContainer}
+}
+
+type blobStore struct {
+	c         *swift.Connection
+	container string
+}
+
+func (b *blobStore) CreateBlob(name string) (io.WriteCloser, error) {
+	// TODO(optim): proper initialization of the container to avoir having to
+	// recreate it every time.
+	if err := b.c.ContainerCreate(b.container, nil); err != nil {
+		return nil, err
+	}
+	return b.c.ObjectCreate(b.container, name, false, "", "", nil)
+}
+
+func (b *blobStore) OpenBlob(name string) (vfs.File, error) {
+	f, _, err := b.c.ObjectOpen(b.container, name, false, nil)
+	if err != nil {
+		return nil, wrapSwiftErr(err)
+	}
+	return &swiftFileOpen{f, nil}, nil
+}
+
+func (b *blobStore) RenameBlob(oldname, newname string) error {
+	return wrapSwiftErr(b.c.ObjectMove(b.container, oldname, b.container, newname))
+}
+
+func (b *blobStore) RemoveBlob(name string) error {
+	err := b.c.ObjectDelete(b.container, name)
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return nil
+}
+
+func (b *blobStore) RemoveBlobs(dir string) error {
+	names, err := b.c.ObjectNamesAll(b.container, &swift.ObjectsOpts{
+		Prefix: dir + "/",
+	})
+	if err == swift.ContainerNotFound {
+		return nil
+	}
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	_, err = b.c.BulkDelete(b.container, names)
+	return err
+}
+
+var _ vfs.BlobStore = &blobStore{}
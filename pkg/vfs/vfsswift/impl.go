@@ -2,13 +2,16 @@ package vfsswift
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -29,12 +32,14 @@ type swiftVFS struct {
 	container string
 	version   string
 	mu        lock.ErrorRWLocker
+	cipher    *vfs.Cipher
 	log       *logrus.Entry
 }
 
 // New returns a vfs.VFS instance associated with the specified indexer and the
-// swift storage url.
-func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, domain string) (vfs.VFS, error) {
+// swift storage url. The content of the files is encrypted with the cipher, if
+// it is not nil.
+func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, cipher *vfs.Cipher, domain string) (vfs.VFS, error) {
 	if domain == "" {
 		return nil, fmt.Errorf("vfsswift: specified domain is empty")
 	}
@@ -46,6 +51,7 @@ func New(index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, dom
 		container: "cozy-" + domain,
 		version:   "cozy-" + domain + versionSuffix,
 		mu:        mu,
+		cipher:    cipher,
 		log:       logger.WithDomain(domain),
 	}, nil
 }
@@ -159,10 +165,16 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		if err != nil {
 			return nil, err
 		}
-		if olddoc != nil {
+		// the space reserved by the ongoing upload sessions is not available
+		reserved, err := vfs.ReservedUploadSpace(sfs, newdoc)
+		if err != nil {
+			return nil, err
+		}
+		// the old content is not freed if it is kept as a version
+		if olddoc != nil && !vfs.Versioning().Enabled() {
 			oldsize = olddoc.Size()
 		}
-		maxsize = diskQuota - diskUsage
+		maxsize = diskQuota - diskUsage - reserved
 		if maxsize > maxFileSize {
 			maxsize = maxFileSize
 		}
@@ -212,30 +224,62 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		}
 	}
 
+	// Before overwriting the object, a copy of the old content is made to keep
+	// it as a version of the file.
+	var version *vfs.Version
+	if olddoc != nil && vfs.Versioning().Enabled() {
+		version = vfs.NewVersion(olddoc)
+		if err = sfs.Indexer.CreateVersion(version); err != nil {
+			return nil, err
+		}
+		_, err = sfs.c.ObjectCopy(
+			sfs.container, olddoc.DirID+"/"+olddoc.DocName,
+			sfs.container, versionObjName(version),
+			nil,
+		)
+		if err != nil {
+			sfs.Indexer.DeleteVersion(version) // #nosec
+			return nil, err
+		}
+	}
+
 	var h swift.Headers
 	if newsize >= 0 {
-		h = swift.Headers{"Content-Length": strconv.FormatInt(newsize, 10)}
+		h = swift.Headers{"Content-Length": strconv.FormatInt(sfs.cipher.EncryptedSize(newsize), 10)}
 	}
 	objName := newdoc.DirID + "/" + newdoc.DocName
-	hash := hex.EncodeToString(newdoc.MD5Sum)
+	// When the content is encrypted, the ETag computed by swift is the one of
+	// the encrypted content: the md5 of the plain content is computed here.
+	var md5h hash.Hash
+	etag := hex.EncodeToString(newdoc.MD5Sum)
+	if sfs.cipher != nil {
+		md5h = md5.New() // #nosec
+		etag = ""
+	}
 	f, err := sfs.c.ObjectCreate(
 		sfs.container,
 		objName,
-		hash != "",
-		hash,
+		etag != "",
+		etag,
 		newdoc.Mime,
 		h,
 	)
 	if err != nil {
+		if version != nil {
+			sfs.destroyVersion(version) // #nosec
+		}
 		return nil, err
 	}
 	return &swiftFileCreation{
 		f:       f,
+		cw:      sfs.cipher.EncryptWriter(f),
+		hash:    md5h,
 		fs:      sfs,
 		name:    objName,
 		meta:    vfs.NewMetaExtractor(newdoc),
 		newdoc:  newdoc,
 		olddoc:  olddoc,
+		version: version,
 		maxsize: maxsize,
 	}, nil
 }
@@ -300,6 +344,15 @@ func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) error {
 	if err != nil {
 		return err
 	}
+	versions, err := sfs.Indexer.AllVersions(doc.ID())
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = sfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
 	versionObjNames, err := sfs.c.VersionObjectList(sfs.version, objName)
 	// could happened if the versionning could not be enabled, in which case we
 	// do not propagate the error.
@@ -331,7 +384,109 @@ func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileOpen{f, nil}, nil
+	return sfs.cipher.DecryptFile(&swiftFileOpen{f, nil}, doc.ByteSize)
+}
+
+func (sfs *swiftVFS) OpenFileVersion(doc *vfs.FileDoc, v *vfs.Version) (vfs.File, error) {
+	if v.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	f, _, err := sfs.c.ObjectOpen(sfs.container, versionObjName(v), false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, vfs.ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sfs.cipher.DecryptFile(&swiftFileOpen{f, nil}, v.ByteSize)
+}
+
+func (sfs *swiftVFS) DestroyVersion(v *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.destroyVersion(v)
+}
+
+func (sfs *swiftVFS) destroyVersion(v *vfs.Version) error {
+	err := sfs.c.ObjectDelete(sfs.container, versionObjName(v))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return sfs.Indexer.DeleteVersion(v)
+}
+
+// cleanVersions removes the versions of a file that are no longer wanted by
+// the versioning policy.
+func (sfs *swiftVFS) cleanVersions(fileID string) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	versions, err := sfs.Indexer.AllVersions(fileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range vfs.VersionsToClean(versions, vfs.Versioning(), time.Now()) {
+		if err = sfs.destroyVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func versionObjName(v *vfs.Version) string {
+	return strings.TrimPrefix(vfs.VersionsDirName, "/") + "/" + v.FileID + "/" + v.ID()
+}
+
+func (sfs *swiftVFS) CreateUploadChunk(sessionID, chunkID string) (io.WriteCloser, error) {
+	objName := uploadChunkObjName(sessionID, chunkID)
+	f, err := sfs.c.ObjectCreate(sfs.container, objName, false, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return sfs.cipher.EncryptWriter(f), nil
+}
+
+func (sfs *swiftVFS) OpenUploadChunk(sessionID, chunkID string) (io.ReadCloser, error) {
+	objName := uploadChunkObjName(sessionID, chunkID)
+	f, _, err := sfs.c.ObjectOpen(sfs.container, objName, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sfs.cipher.DecryptReader(f), nil
+}
+
+func (sfs *swiftVFS) DestroyUploadChunk(sessionID, chunkID string) error {
+	err := sfs.c.ObjectDelete(sfs.container, uploadChunkObjName(sessionID, chunkID))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return nil
+}
+
+func (sfs *swiftVFS) DestroyUploadChunks(s *vfs.UploadSession) error {
+	if len(s.Chunks) == 0 {
+		return nil
+	}
+	objNames := make([]string, len(s.Chunks))
+	for i, chunk := range s.Chunks {
+		objNames[i] = uploadChunkObjName(s.ID(), chunk.ID)
+	}
+	_, err := sfs.c.BulkDelete(sfs.container, objNames)
+	return err
+}
+
+func uploadChunkObjName(sessionID, chunkID string) string {
+	return strings.TrimPrefix(vfs.UploadsDirName, "/") + "/" + sessionID + "/" + chunkID
 }
 
 // UpdateFileDoc overrides the indexer's one since the swift fs indexes files
@@ -448,6 +603,8 @@ func (sfs *swiftVFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, er
 
 type swiftFileCreation struct {
 	f       *swift.ObjectCreateFile
+	cw      io.WriteCloser // writes in f, with the encryption if enabled
+	hash    hash.Hash      // md5 of the plain content, when encrypted
 	w       int64
 	fs      *swiftVFS
 	name    string
@@ -455,6 +612,7 @@ type swiftFileCreation struct {
 	meta    *vfs.MetaExtractor
 	newdoc  *vfs.FileDoc
 	olddoc  *vfs.FileDoc
+	version *vfs.Version
 	maxsize int64
 }
 
@@ -478,12 +636,16 @@ func (f *swiftFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	n, err := f.cw.Write(p)
 	if err != nil {
 		f.err = err
 		return n, err
 	}
+	if f.hash != nil {
+		f.hash.Write(p[:n]) // #nosec
+	}
 
+	vfs.BytesWritten.WithLabelValues("swift").Add(float64(n))
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
 		f.err = vfs.ErrFileTooBig
@@ -512,10 +674,19 @@ func (f *swiftFileCreation) Close() (err error) {
 			if !isCouchErr && f.olddoc == nil {
 				f.fs.Indexer.DeleteFileDoc(f.newdoc) // #nosec
 			}
+
+			if f.version != nil {
+				f.fs.destroyVersion(f.version) // #nosec
+			}
+		} else if f.version != nil {
+			if errc := f.fs.cleanVersions(f.version.FileID); errc != nil {
+				f.fs.log.Warnf("[vfsswift] Could not clean the versions of %s: %s",
+					f.version.FileID, errc)
+			}
 		}
 	}()
 
-	if err = f.f.Close(); err != nil {
+	if err = f.cw.Close(); err != nil {
 		if f.meta != nil {
 			(*f.meta).Abort(err)
 		}
@@ -536,8 +707,16 @@ func (f *swiftFileCreation) Close() (err error) {
 	}
 
 	// The actual check of the optionally given md5 hash is handled by the swift
-	// library.
-	if newdoc.MD5Sum == nil {
+	// library, except for an encrypted content.
+	if f.hash != nil {
+		md5sum := f.hash.Sum(nil)
+		if newdoc.MD5Sum == nil {
+			newdoc.MD5Sum = md5sum
+		}
+		if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+			return vfs.ErrInvalidHash
+		}
+	} else if newdoc.MD5Sum == nil {
 		var headers swift.Headers
 		var md5sum []byte
 		headers, err = f.f.Headers()
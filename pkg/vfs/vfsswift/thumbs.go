@@ -5,20 +5,23 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/swift"
 )
 
-// NewThumbsFs creates a new thumb filesystem base on swift.
-func NewThumbsFs(c *swift.Connection, domain string) vfs.Thumbser {
-	return &thumbs{c: c, container: "data-" + domain}
+// NewThumbsFs creates a new thumb filesystem base on swift. The thumbnails
+// are encrypted with the cipher, if not nil.
+func NewThumbsFs(c *swift.Connection, domain string, cipher *vfs.Cipher) vfs.Thumbser {
+	return &thumbs{c: c, container: "data-" + domain, cipher: cipher}
 }
 
 type thumbs struct {
 	c         *swift.Connection
 	container string
+	cipher    *vfs.Cipher
 }
 
 func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, error) {
@@ -27,23 +30,46 @@ func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (io.WriteCloser, e
 	if err := t.c.ContainerCreate(t.container, nil); err != nil {
 		return nil, err
 	}
-	return t.c.ObjectCreate(t.container, t.makeName(img, format), false, "", "", nil)
+	f, err := t.c.ObjectCreate(t.container, t.makeName(img, format), false, "", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return t.cipher.EncryptWriter(f), nil
 }
 
 func (t *thumbs) RemoveThumb(img *vfs.FileDoc, format string) error {
 	return t.c.ObjectDelete(t.container, t.makeName(img, format))
 }
 
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc) error {
+	names, err := t.c.ObjectNamesAll(t.container, &swift.ObjectsOpts{
+		Prefix: t.makeName(img, ""),
+	})
+	if err == swift.ContainerNotFound {
+		return nil
+	}
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	_, err = t.c.BulkDelete(t.container, names)
+	return err
+}
+
 func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
 	name := t.makeName(img, format)
 	f, o, err := t.c.ObjectOpen(t.container, name, false, nil)
 	if err != nil {
 		return wrapSwiftErr(err)
 	}
-	defer f.Close()
+	size, _ := strconv.ParseInt(o["Content-Length"], 10, 64) // #nosec
+	content, err := t.cipher.DecryptFile(&swiftFileOpen{f, nil}, t.cipher.PlainSize(size))
+	if err != nil {
+		return err
+	}
+	defer content.Close()
 	lastModified, _ := time.Parse(http.TimeFormat, o["Last-Modified"]) // #nosec
 	w.Header().Set("Etag", o["Etag"])
-	http.ServeContent(w, req, name, lastModified, f)
+	http.ServeContent(w, req, name, lastModified, content)
 	return nil
 }
 
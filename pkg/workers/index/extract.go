@@ -0,0 +1,186 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// maxFileSize is the maximal size of the files whose text is extracted
+const maxFileSize = 50 << (2 * 10) // 50 MiB
+
+// maxTextSize is the maximal size of the text indexed for a file
+const maxTextSize = 1 << (2 * 10) // 1 MiB
+
+var errTooBig = errors.New("the file is too big to be indexed")
+
+// The office documents are zip archives, where the text is in some XML files
+var officeParts = map[string]func(name string) bool{
+	// docx
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": func(name string) bool {
+		return name == "word/document.xml"
+	},
+	// xlsx
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": func(name string) bool {
+		return name == "xl/sharedStrings.xml"
+	},
+	// pptx
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": func(name string) bool {
+		return path.Dir(name) == "ppt/slides" && path.Ext(name) == ".xml"
+	},
+	// odt, ods, odp
+	"application/vnd.oasis.opendocument.text":         isODFContent,
+	"application/vnd.oasis.opendocument.spreadsheet":  isODFContent,
+	"application/vnd.oasis.opendocument.presentation": isODFContent,
+}
+
+func isODFContent(name string) bool {
+	return name == "content.xml"
+}
+
+// extractText returns the text of a file, for the plain-text, PDF and office
+// files. It returns an empty string for the other files.
+func extractText(ctx context.Context, fs vfs.VFS, doc *vfs.FileDoc) (string, error) {
+	isText := doc.Class == "text" || doc.Mime == "application/json"
+	isPDF := doc.Mime == "application/pdf"
+	isPart, isOffice := officeParts[doc.Mime]
+	if !isText && !isPDF && !isOffice {
+		return "", nil
+	}
+	if doc.ByteSize > maxFileSize {
+		return "", errTooBig
+	}
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var text string
+	switch {
+	case isText:
+		text, err = readText(f)
+	case isPDF:
+		text, err = pdfText(ctx, f)
+	default:
+		text, err = officeText(f, doc.ByteSize, isPart)
+	}
+	if err != nil {
+		return "", err
+	}
+	return truncate(text), nil
+}
+
+func readText(r io.Reader) (string, error) {
+	// One more byte is read to know if the text must be truncated
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxTextSize+1))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// The text of the PDF is extracted with pdftotext, from poppler-utils
+func pdfText(ctx context.Context, r io.Reader) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "pdftotext", "-q", "-enc", "UTF-8", "-", "-") // #nosec
+	cmd.Stdin = r
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+func officeText(r io.ReaderAt, size int64, isPart func(string) bool) (string, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	// The parts are sorted by name, for a stable order of the text
+	var parts []*zip.File
+	for _, f := range z.File {
+		if isPart(f.Name) {
+			parts = append(parts, f)
+		}
+	}
+	sort.Sort(byName(parts))
+	var texts []string
+	for _, part := range parts {
+		rc, err := part.Open()
+		if err != nil {
+			return "", err
+		}
+		text, err := xmlText(io.LimitReader(rc, 10*maxTextSize))
+		rc.Close() // #nosec
+		if err != nil {
+			return "", err
+		}
+		texts = append(texts, text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+type byName []*zip.File
+
+func (f byName) Len() int           { return len(f) }
+func (f byName) Less(i, j int) bool { return f[i].Name < f[j].Name }
+func (f byName) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// separators are the XML elements, in the office formats, after which a space
+// is added so that the words of two paragraphs or cells are not glued. The
+// other elements, like the runs of text, can split a word.
+var separators = map[string]bool{
+	"p":          true,
+	"h":          true,
+	"br":         true,
+	"tab":        true,
+	"si":         true,
+	"table-cell": true,
+}
+
+// xmlText returns the character data of an XML document
+func xmlText(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	decoder := xml.NewDecoder(r)
+	for buf.Len() < maxTextSize {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return buf.String(), err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			buf.Write(t)
+		case xml.EndElement:
+			if separators[t.Name.Local] {
+				buf.WriteByte(' ')
+			}
+		}
+	}
+	return buf.String(), nil
+}
+
+// truncate cuts the text to maxTextSize, without breaking a UTF-8 character
+func truncate(text string) string {
+	if len(text) <= maxTextSize {
+		return text
+	}
+	n := maxTextSize
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
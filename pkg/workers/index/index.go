@@ -0,0 +1,154 @@
+package index
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/trace"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+type indexMessage struct {
+	Message struct {
+		DocType string `json:"doctype"`
+	} `json:"message"`
+	Event struct {
+		Type string          `json:"Type"`
+		Doc  couchdb.JSONDoc `json:"Doc"`
+	} `json:"event"`
+}
+
+func init() {
+	jobs.AddWorker("index", &jobs.WorkerConfig{
+		Concurrency:  (runtime.NumCPU() + 1) / 2,
+		MaxExecCount: 2,
+		Timeout:      30 * time.Second,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that updates the full-text search index of an instance
+// when a document is created, updated or deleted.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	msg := &indexMessage{}
+	if err := m.Unmarshal(msg); err != nil {
+		return err
+	}
+	doctype := msg.Message.DocType
+	id := msg.Event.Doc.ID()
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	logger.WithDomain(domain).Debugf("[jobs] index: %s %s %s", msg.Event.Type, doctype, id)
+	if msg.Event.Type == "DELETED" {
+		return search.Remove(domain, doctype, id)
+	}
+	if doctype != consts.Files {
+		return search.Index(domain, id, &search.Document{
+			DocType: doctype,
+			Name:    docName(msg.Event.Doc.M),
+			Content: docText(msg.Event.Doc.M),
+		})
+	}
+
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	i.SetSpan(trace.FromContext(ctx))
+	fs := i.VFS()
+	// The document is reloaded, as the event may be older than its last change
+	dir, file, err := fs.DirOrFileByID(id)
+	if couchdb.IsNotFoundError(err) || os.IsNotExist(err) {
+		return search.Remove(domain, doctype, id)
+	}
+	if err != nil {
+		return err
+	}
+	doc := fileDocument(ctx, domain, fs, dir, file)
+	if doc == nil {
+		return search.Remove(domain, doctype, id)
+	}
+	return search.Index(domain, id, doc)
+}
+
+// fileDocument returns what is indexed for a directory or a file, or nil if
+// it must not be in the index, like the trashed files.
+func fileDocument(ctx context.Context, domain string, fs vfs.VFS, dir *vfs.DirDoc, file *vfs.FileDoc) *search.Document {
+	if dir != nil {
+		if dir.DocID == consts.RootDirID || dir.DocID == consts.TrashDirID ||
+			strings.HasPrefix(dir.Fullpath, vfs.TrashDirName) {
+			return nil
+		}
+		return &search.Document{
+			DocType: consts.Files,
+			Name:    dir.DocName,
+		}
+	}
+	if file.Trashed {
+		return nil
+	}
+	content, err := extractText(ctx, fs, file)
+	if err != nil {
+		// The file is still found by its name
+		logger.WithDomain(domain).Infof("[jobs] index: cannot extract the text of %s: %s", file.ID(), err)
+	}
+	return &search.Document{
+		DocType: consts.Files,
+		Name:    file.DocName,
+		Content: content,
+	}
+}
+
+// docName returns the name of a document, for the doctypes that have one
+func docName(doc map[string]interface{}) string {
+	for _, key := range []string{"name", "fullname", "title"} {
+		if name, ok := doc[key].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// docText returns all the strings of a document, except for the fields
+// reserved for CouchDB and the stack.
+func docText(doc map[string]interface{}) string {
+	var texts []string
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		if !strings.HasPrefix(key, "_") && key != "cozyMetadata" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		texts = appendTexts(texts, doc[key])
+	}
+	return strings.Join(texts, "\n")
+}
+
+func appendTexts(texts []string, value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			texts = append(texts, v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			texts = appendTexts(texts, item)
+		}
+	case map[string]interface{}:
+		if text := docText(v); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
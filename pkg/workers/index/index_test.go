@@ -0,0 +1,58 @@
+package index
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocText(t *testing.T) {
+	doc := map[string]interface{}{
+		"_id":      "42",
+		"_rev":     "1-abc",
+		"fullname": "Alice Martin",
+		"email": []interface{}{
+			map[string]interface{}{"address": "alice@example.com", "primary": true},
+		},
+		"age": 42,
+	}
+	assert.Equal(t, "Alice Martin", docName(doc))
+	text := docText(doc)
+	assert.Contains(t, text, "Alice Martin")
+	assert.Contains(t, text, "alice@example.com")
+	assert.NotContains(t, text, "1-abc")
+}
+
+func TestOfficeText(t *testing.T) {
+	buf := new(bytes.Buffer)
+	z := zip.NewWriter(buf)
+	parts := map[string]string{
+		"[Content_Types].xml": `<Types><Default Extension="xml"/></Types>`,
+		"word/document.xml": `<w:document xmlns:w="w"><w:body>` +
+			`<w:p><w:r><w:t>Hel</w:t></w:r><w:r><w:t>lo</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>world</w:t></w:r></w:p>` +
+			`</w:body></w:document>`,
+	}
+	for name, content := range parts {
+		w, err := z.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, z.Close())
+
+	isPart := officeParts["application/vnd.openxmlformats-officedocument.wordprocessingml.document"]
+	text, err := officeText(bytes.NewReader(buf.Bytes()), int64(buf.Len()), isPart)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Hello", "world"}, strings.Fields(text))
+}
+
+func TestTruncate(t *testing.T) {
+	text := strings.Repeat("a", maxTextSize-1) + "é"
+	truncated := truncate(text)
+	assert.Equal(t, maxTextSize-1, len(truncated))
+	assert.Equal(t, "abc", truncate("abc"))
+}
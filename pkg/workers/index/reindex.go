@@ -0,0 +1,120 @@
+package index
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/trace"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// reindexPageSize is the number of documents fetched at once from CouchDB
+const reindexPageSize = 100
+
+func init() {
+	jobs.AddWorker("reindex", &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   ReindexWorker,
+	})
+}
+
+// ReindexWorker is a worker that rebuilds the full-text search index of an
+// instance from all its files and the documents of the indexed doctypes, for
+// example for the instances created before the search was added.
+func ReindexWorker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	i.SetSpan(trace.FromContext(ctx))
+	fs := i.VFS()
+	logger.WithDomain(domain).Infof("[jobs] reindex: rebuilding the index")
+	return search.Rebuild(domain, func(b *search.Batch) error {
+		err := vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+			if err != nil {
+				return err
+			}
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			if dir != nil && dir.DocID == consts.TrashDirID {
+				return vfs.ErrSkipDir
+			}
+			doc := fileDocument(ctx, domain, fs, dir, file)
+			if doc == nil {
+				return nil
+			}
+			if dir != nil {
+				return b.Index(dir.ID(), doc)
+			}
+			return b.Index(file.ID(), doc)
+		})
+		if err != nil {
+			return err
+		}
+		for _, doctype := range search.Doctypes() {
+			if doctype == consts.Files {
+				continue
+			}
+			if err = reindexDocs(ctx, i, doctype, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reindexDocs adds all the documents of a doctype to the rebuilt index, page
+// by page.
+func reindexDocs(ctx context.Context, db couchdb.Database, doctype string, b *search.Batch) error {
+	var startKey string
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		req := &couchdb.AllDocsRequest{Limit: reindexPageSize}
+		if startKey != "" {
+			req.StartKey = startKey
+			req.Skip = 1
+		}
+		var docs []map[string]interface{}
+		err := couchdb.GetAllDocs(db, doctype, req, &docs)
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		for _, doc := range docs {
+			id, _ := doc["_id"].(string)
+			err = b.Index(id, &search.Document{
+				DocType: doctype,
+				Name:    docName(doc),
+				Content: docText(doc),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// The start key is sent as JSON in the query-string
+		last, _ := docs[len(docs)-1]["_id"].(string)
+		key, err := json.Marshal(last)
+		if err != nil {
+			return err
+		}
+		startKey = string(key)
+	}
+}
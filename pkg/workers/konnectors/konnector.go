@@ -21,7 +21,6 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
-	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/workers/mails"
 	"github.com/sirupsen/logrus"
@@ -182,7 +181,7 @@ func Worker(ctx context.Context, m *jobs.Message) error {
 	var msgChan = make(chan konnectorMsg)
 	var messages []konnectorMsg
 
-	log := logger.WithDomain(domain)
+	log := jobs.Logger(ctx)
 
 	go doScanOut(jobID, scanOut, domain, msgChan, log)
 	go doScanErr(jobID, scanErr, log)
@@ -262,7 +261,7 @@ func commit(ctx context.Context, m *jobs.Message, errjob error) error {
 	slug := opts.Konnector
 	domain := ctx.Value(jobs.ContextDomainKey).(string)
 
-	log := logger.WithDomain(domain)
+	log := jobs.Logger(ctx)
 
 	inst, err := instance.Get(domain)
 	if err != nil {
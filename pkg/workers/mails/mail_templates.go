@@ -69,6 +69,70 @@ Pour réinitialiser votre mot de passe, veuillez aller sur l'URL suivante :
 Vous n'avez jamais demandé de nouveau mot de passe ? Alors vous pouvez ignorer cet email.
 Pour information, vous disposez de 15 minutes pour choisir votre nouveau mot de passe, passé ce délai cet email s'auto-détruira.`
 
+	// --- lockout ---
+	mailLockoutHTMLEn = `` +
+		`<h1><img src="{{.BaseURL}}assets/images/icon-cozy-mail.png" alt="Cozy Cloud" width="52" height="52" /></h1>
+
+<p>Hello {{.RecipientName}}.<br/> There were too many failed attempts to connect to your Cozy{{if .IP}}, the last ones from the IP address {{.IP}}{{end}}. For your security, the connections are now blocked for {{.Duration}} minutes.</p>
+
+<p>If it was you, you can just try again later. Else, someone may be trying to guess your password: you should choose a strong one, and enable the two-factor authentication in the settings of your Cozy.</p>`
+
+	mailLockoutTextEn = `` +
+		`Cozy Cloud
+
+Hello {{.RecipientName}}.
+There were too many failed attempts to connect to your Cozy{{if .IP}}, the last ones from the IP address {{.IP}}{{end}}. For your security, the connections are now blocked for {{.Duration}} minutes.
+
+If it was you, you can just try again later. Else, someone may be trying to guess your password: you should choose a strong one, and enable the two-factor authentication in the settings of your Cozy.`
+
+	mailLockoutHTMLFr = `` +
+		`<h1><img src="{{.BaseURL}}assets/images/icon-cozy-mail.png" alt="Cozy Cloud" width="52" height="52" /></h1>
+
+<p>Bonjour {{.RecipientName}}.<br/> Il y a eu trop de tentatives de connexion échouées sur votre Cozy{{if .IP}}, les dernières depuis l'adresse IP {{.IP}}{{end}}. Pour votre sécurité, les connexions sont maintenant bloquées pendant {{.Duration}} minutes.</p>
+
+<p>Si c'était vous, vous pouvez simplement réessayer plus tard. Sinon, quelqu'un essaye peut-être de deviner votre mot de passe : nous vous conseillons d'en choisir un robuste, et d'activer l'authentification à deux facteurs dans les paramètres de votre Cozy.</p>`
+
+	mailLockoutTextFr = `` +
+		`Cozy Cloud
+
+Bonjour {{.RecipientName}}.
+Il y a eu trop de tentatives de connexion échouées sur votre Cozy{{if .IP}}, les dernières depuis l'adresse IP {{.IP}}{{end}}. Pour votre sécurité, les connexions sont maintenant bloquées pendant {{.Duration}} minutes.
+
+Si c'était vous, vous pouvez simplement réessayer plus tard. Sinon, quelqu'un essaye peut-être de deviner votre mot de passe : nous vous conseillons d'en choisir un robuste, et d'activer l'authentification à deux facteurs dans les paramètres de votre Cozy.`
+
+	// --- quota_alert ---
+	mailQuotaAlertHTMLEn = `` +
+		`<h1><img src="{{.BaseURL}}assets/images/icon-cozy-mail.png" alt="Cozy Cloud" width="52" height="52" /></h1>
+
+<p>Hello {{.RecipientName}}.<br/> Your Cozy is {{.Threshold}}% full: you are using {{.Used}} of your {{.Quota}} of storage.</p>
+
+<p>When it is full, you won't be able to add new files. You can free some space by removing the files you don't need anymore, and by emptying the <a href="{{.DriveLink}}">trash</a>, as the files in the trash still count in your storage.</p>`
+
+	mailQuotaAlertTextEn = `` +
+		`Cozy Cloud
+
+Hello {{.RecipientName}}.
+Your Cozy is {{.Threshold}}% full: you are using {{.Used}} of your {{.Quota}} of storage.
+
+When it is full, you won't be able to add new files. You can free some space by removing the files you don't need anymore, and by emptying the trash, as the files in the trash still count in your storage:
+{{.DriveLink}}`
+
+	mailQuotaAlertHTMLFr = `` +
+		`<h1><img src="{{.BaseURL}}assets/images/icon-cozy-mail.png" alt="Cozy Cloud" width="52" height="52" /></h1>
+
+<p>Bonjour {{.RecipientName}}.<br/> Votre Cozy est plein à {{.Threshold}} % : vous utilisez {{.Used}} de vos {{.Quota}} d'espace de stockage.</p>
+
+<p>Quand il sera plein, vous ne pourrez plus ajouter de nouveaux fichiers. Vous pouvez libérer de l'espace en supprimant les fichiers dont vous n'avez plus besoin, et en vidant la <a href="{{.DriveLink}}">corbeille</a>, car les fichiers de la corbeille comptent toujours dans votre espace de stockage.</p>`
+
+	mailQuotaAlertTextFr = `` +
+		`Cozy Cloud
+
+Bonjour {{.RecipientName}}.
+Votre Cozy est plein à {{.Threshold}} % : vous utilisez {{.Used}} de vos {{.Quota}} d'espace de stockage.
+
+Quand il sera plein, vous ne pourrez plus ajouter de nouveaux fichiers. Vous pouvez libérer de l'espace en supprimant les fichiers dont vous n'avez plus besoin, et en vidant la corbeille, car les fichiers de la corbeille comptent toujours dans votre espace de stockage :
+{{.DriveLink}}`
+
 	//  --- sharing_request ---
 	mailSharingRequestHTML = `` +
 		`<h2>Hey {{.RecipientName}}!</h2>
@@ -184,6 +248,26 @@ func init() {
 			BodyHTML: mailResetPassHTMLFr,
 			BodyText: mailResetPassTextFr,
 		},
+		{
+			Name:     "lockout_en",
+			BodyHTML: mailLockoutHTMLEn,
+			BodyText: mailLockoutTextEn,
+		},
+		{
+			Name:     "lockout_fr",
+			BodyHTML: mailLockoutHTMLFr,
+			BodyText: mailLockoutTextFr,
+		},
+		{
+			Name:     "quota_alert_en",
+			BodyHTML: mailQuotaAlertHTMLEn,
+			BodyText: mailQuotaAlertTextEn,
+		},
+		{
+			Name:     "quota_alert_fr",
+			BodyHTML: mailQuotaAlertHTMLFr,
+			BodyText: mailQuotaAlertTextFr,
+		},
 		{
 			Name:     "sharing_request",
 			BodyHTML: mailSharingRequestHTML,
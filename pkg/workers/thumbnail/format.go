@@ -0,0 +1,72 @@
+package thumbnail
+
+import (
+	"errors"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ErrInvalidFormat is used when the format of a thumbnail is not known
+var ErrInvalidFormat = errors.New("Invalid format for a thumbnail")
+
+// Format is a format of thumbnails. The named formats (small, medium and
+// large) are generated when a file is created, and the other formats are
+// generated on demand: WxH for a thumbnail that fits inside a box, and
+// WxH-crop for a thumbnail cropped to fill the box, like a square tile. Only
+// the sizes listed in fs.thumbnails_sizes of the configuration can be
+// generated on demand.
+type Format struct {
+	Name   string
+	Width  int
+	Height int
+	Crop   bool
+}
+
+var formats = map[string]*Format{
+	"small":  {Name: "small", Width: 640, Height: 480},
+	"medium": {Name: "medium", Width: 1280, Height: 720},
+	"large":  {Name: "large", Width: 1920, Height: 1080},
+}
+
+// namedFormats is the order for the generation of the named formats, from
+// the largest to the smallest, as each thumbnail is made from the previous
+// one.
+var namedFormats = []string{"large", "medium", "small"}
+
+// ParseFormat returns the format for the given name, or ErrInvalidFormat if
+// it is not a named format or a configured size.
+func ParseFormat(name string) (*Format, error) {
+	if f, ok := formats[name]; ok {
+		return f, nil
+	}
+	size, err := config.ParseThumbnailSize(name)
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	// The name is normalized, to have only one thumbnail for a size
+	for _, configured := range config.GetConfig().Fs.ThumbnailsSizes {
+		if configured == size.Name {
+			return &Format{
+				Name:   size.Name,
+				Width:  size.Width,
+				Height: size.Height,
+				Crop:   size.Crop,
+			}, nil
+		}
+	}
+	return nil, ErrInvalidFormat
+}
+
+// OnDemand returns true for the formats that are not generated when a file
+// is created.
+func (f *Format) OnDemand() bool {
+	_, ok := formats[f.Name]
+	return !ok
+}
+
+// Supported returns true if thumbnails can be generated for the file: the
+// images, the PDFs and the videos.
+func Supported(doc *vfs.FileDoc) bool {
+	return doc.Class == "image" || doc.Class == "video" || doc.Mime == "application/pdf"
+}
@@ -0,0 +1,55 @@
+package thumbnail
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("medium")
+	assert.NoError(t, err)
+	assert.Equal(t, "medium", f.Name)
+	assert.Equal(t, 1280, f.Width)
+	assert.Equal(t, 720, f.Height)
+	assert.False(t, f.Crop)
+	assert.False(t, f.OnDemand())
+
+	sizes := config.GetConfig().Fs.ThumbnailsSizes
+	defer func() { config.GetConfig().Fs.ThumbnailsSizes = sizes }()
+	config.GetConfig().Fs.ThumbnailsSizes = []string{"300x200", "256x256-crop"}
+	f, err = ParseFormat("300x200")
+	assert.NoError(t, err)
+	assert.Equal(t, "300x200", f.Name)
+	assert.Equal(t, 300, f.Width)
+	assert.Equal(t, 200, f.Height)
+	assert.False(t, f.Crop)
+	assert.True(t, f.OnDemand())
+
+	f, err = ParseFormat("0256x256-crop")
+	assert.NoError(t, err)
+	assert.Equal(t, "256x256-crop", f.Name)
+	assert.True(t, f.Crop)
+	assert.True(t, f.OnDemand())
+
+	for _, name := range []string{"", "huge", "200x300", "256x256", "300x200-crop", "256x256-fill", "256*256", "../256x256"} {
+		_, err = ParseFormat(name)
+		assert.Equal(t, ErrInvalidFormat, err, name)
+	}
+}
+
+func TestSupported(t *testing.T) {
+	assert.True(t, Supported(&vfs.FileDoc{Class: "image", Mime: "image/png"}))
+	assert.True(t, Supported(&vfs.FileDoc{Class: "video", Mime: "video/mp4"}))
+	assert.True(t, Supported(&vfs.FileDoc{Class: "application", Mime: "application/pdf"}))
+	assert.False(t, Supported(&vfs.FileDoc{Class: "text", Mime: "text/plain"}))
+	assert.False(t, Supported(&vfs.FileDoc{Class: "audio", Mime: "audio/mpeg"}))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	os.Exit(m.Run())
+}
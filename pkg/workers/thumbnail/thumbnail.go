@@ -5,26 +5,43 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/cache"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/stack"
+	"github.com/cozy/cozy-stack/pkg/trace"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
-var formats = map[string]string{
-	"small":  "640x480",
-	"medium": "1280x720",
-	"large":  "1920x1080",
-}
+// pendingTTL is the time during which a thumbnail asked on demand is
+// considered as pending, and no other job is pushed to generate it.
+const pendingTTL = 1 * time.Minute
+
+// The thumbnails pending are kept in memory when there is no redis for the
+// cache, with the time when they were asked.
+var (
+	pendingMu  sync.Mutex
+	pendingMem = make(map[string]time.Time)
+)
 
-type imageMessage struct {
-	Event struct {
-		Type string      `json:"Type"`
-		Doc  vfs.FileDoc `json:"Doc"`
+type thumbnailMessage struct {
+	// File and Format are used for a thumbnail generated on demand
+	File   string `json:"file,omitempty"`
+	Format string `json:"format,omitempty"`
+	Event  struct {
+		Type   string       `json:"Type"`
+		Doc    vfs.FileDoc  `json:"Doc"`
+		OldDoc *vfs.FileDoc `json:"OldDoc,omitempty"`
 	} `json:"event"`
 }
 
@@ -32,62 +49,244 @@ func init() {
 	jobs.AddWorker("thumbnail", &jobs.WorkerConfig{
 		Concurrency:  (runtime.NumCPU() + 1) / 2,
 		MaxExecCount: 2,
-		Timeout:      15 * time.Second,
-		WorkerFunc:   Worker,
+		// A video is copied to a temporary file before extracting a frame
+		Timeout:    1 * time.Minute,
+		WorkerFunc: Worker,
 	})
 }
 
-// Worker is a worker that creates thumbnails for photos and images.
+// Worker is a worker that creates thumbnails for photos and images, PDFs and
+// videos.
 func Worker(ctx context.Context, m *jobs.Message) error {
-	msg := &imageMessage{}
+	msg := &thumbnailMessage{}
 	if err := m.Unmarshal(msg); err != nil {
 		return err
 	}
-	if msg.Event.Type != "DELETED" && msg.Event.Doc.Trashed {
-		return nil
-	}
 	domain := ctx.Value(jobs.ContextDomainKey).(string)
 	log := logger.WithDomain(domain)
-	log.Infof("[jobs] thumbnail: %s %s", msg.Event.Type, msg.Event.Doc.ID())
 	i, err := instance.Get(domain)
 	if err != nil {
 		return err
 	}
+	i.SetSpan(trace.FromContext(ctx))
+	if msg.File != "" {
+		log.Infof("[jobs] thumbnail: %s %s", msg.Format, msg.File)
+		return generateOnDemand(ctx, i, msg.File, msg.Format)
+	}
+
+	if msg.Event.Type != "DELETED" && msg.Event.Doc.Trashed {
+		return nil
+	}
+	log.Infof("[jobs] thumbnail: %s %s", msg.Event.Type, msg.Event.Doc.ID())
 	switch msg.Event.Type {
 	case "CREATED":
 		return generateThumbnails(ctx, i, &msg.Event.Doc)
 	case "UPDATED":
-		if err = removeThumbnails(i, &msg.Event.Doc); err != nil {
+		// The thumbnails are kept when only the name or the tags have changed
+		old := msg.Event.OldDoc
+		if old != nil && !old.Trashed && old.MD5Sum != nil &&
+			bytes.Equal(old.MD5Sum, msg.Event.Doc.MD5Sum) {
+			return nil
+		}
+		if err = i.ThumbsFS().RemoveThumbs(&msg.Event.Doc); err != nil {
 			log.Infof("[jobs] failed to remove thumbnails for %s", msg.Event.Doc.ID())
 		}
 		return generateThumbnails(ctx, i, &msg.Event.Doc)
 	case "DELETED":
-		return removeThumbnails(i, &msg.Event.Doc)
+		return i.ThumbsFS().RemoveThumbs(&msg.Event.Doc)
 	}
 	return fmt.Errorf("Unknown type %s for image event", msg.Event.Type)
 }
 
-func generateThumbnails(ctx context.Context, i *instance.Instance, img *vfs.FileDoc) error {
-	fs := i.ThumbsFS()
-	var in io.Reader
-	in, err := i.VFS().OpenFile(img)
+// Request pushes a job to generate a thumbnail on demand, unless a job has
+// already been pushed recently for the same thumbnail.
+func Request(i *instance.Instance, doc *vfs.FileDoc, format *Format) error {
+	key := i.Domain + "/" + doc.ID() + "/" + format.Name
+	if !markPending(key) {
+		return nil
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, map[string]string{
+		"file":   doc.ID(),
+		"format": format.Name,
+	})
+	if err == nil {
+		_, err = stack.GetBroker().PushJob(&jobs.JobRequest{
+			Domain:     i.Domain,
+			WorkerType: "thumbnail",
+			Message:    msg,
+		})
+	}
+	if err != nil {
+		unmarkPending(key)
+	}
+	return err
+}
+
+// markPending marks a thumbnail as pending, and returns false if it was
+// already pending.
+func markPending(key string) bool {
+	if config.GetConfig().Cache.Client() != nil {
+		pending := cache.Create("thumbnails:", pendingTTL)
+		var requested bool
+		if pending.Get(key, &requested) && requested {
+			return false
+		}
+		pending.Set(key, true)
+		return true
+	}
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	now := time.Now()
+	for k, at := range pendingMem {
+		if now.Sub(at) > pendingTTL {
+			delete(pendingMem, k)
+		}
+	}
+	if _, ok := pendingMem[key]; ok {
+		return false
+	}
+	pendingMem[key] = now
+	return true
+}
+
+func unmarkPending(key string) {
+	if config.GetConfig().Cache.Client() != nil {
+		cache.Create("thumbnails:", pendingTTL).Del(key)
+		return
+	}
+	pendingMu.Lock()
+	delete(pendingMem, key)
+	pendingMu.Unlock()
+}
+
+func generateOnDemand(ctx context.Context, i *instance.Instance, fileID, name string) error {
+	format, err := ParseFormat(name)
 	if err != nil {
 		return err
 	}
-	in, err = recGenerateThub(ctx, in, fs, img, "large")
+	doc, err := i.VFS().FileByID(fileID)
 	if err != nil {
 		return err
 	}
-	in, err = recGenerateThub(ctx, in, fs, img, "medium")
+	if doc.Trashed || !Supported(doc) {
+		return nil
+	}
+	in, err := openSource(ctx, i, doc)
 	if err != nil {
 		return err
 	}
-	// TODO(optim): no need for the last output
-	_, err = recGenerateThub(ctx, in, fs, img, "small")
+	_, err = recGenerateThub(ctx, in, i.ThumbsFS(), doc, format)
 	return err
 }
 
-func recGenerateThub(ctx context.Context, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format string) (r io.Reader, err error) {
+func generateThumbnails(ctx context.Context, i *instance.Instance, doc *vfs.FileDoc) error {
+	if !Supported(doc) {
+		return nil
+	}
+	fs := i.ThumbsFS()
+	in, err := openSource(ctx, i, doc)
+	if err != nil {
+		return err
+	}
+	for _, name := range namedFormats {
+		// TODO(optim): no need for the last output
+		in, err = recGenerateThub(ctx, in, fs, doc, formats[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openSource returns the image from which the thumbnails of a file are made:
+// the image itself, the first page of a PDF, or a frame of a video.
+func openSource(ctx context.Context, i *instance.Instance, doc *vfs.FileDoc) (io.Reader, error) {
+	f, err := i.VFS().OpenFile(doc)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case doc.Class == "image":
+		return f, nil
+	case doc.Mime == "application/pdf":
+		defer f.Close()
+		return pdfPage(ctx, f)
+	case doc.Class == "video":
+		defer f.Close()
+		return videoFrame(ctx, f, doc)
+	}
+	f.Close()
+	return nil, fmt.Errorf("No thumbnail for the mime type %s", doc.Mime)
+}
+
+// The first page of a PDF is rendered with pdftoppm, from poppler-utils, in
+// the size of the large thumbnail.
+func pdfPage(ctx context.Context, in io.Reader) (io.Reader, error) {
+	var out bytes.Buffer
+	size := strconv.Itoa(formats["large"].Width)
+	cmd := exec.CommandContext(ctx, "pdftoppm", // #nosec
+		"-f", "1", "-l", "1", // Only the first page
+		"-singlefile",
+		"-scale-to", size,
+		"-png",
+		"-", // Takes the input from stdin, and send the output on stdout
+	)
+	cmd.Stdin = in
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// A frame of the video is extracted with ffmpeg. The video is copied to a
+// temporary file, as ffmpeg needs to seek in some formats, like the MP4 files
+// with their index at the end.
+func videoFrame(ctx context.Context, in io.Reader, doc *vfs.FileDoc) (io.Reader, error) {
+	tmp, err := ioutil.TempFile("", "cozy-thumbnail")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if errc := tmp.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", // #nosec
+		"-loglevel", "error",
+		"-ss", posterTime(doc), // Seeks before opening the input, which is faster
+		"-i", tmp.Name(),
+		"-vf", "thumbnail", // Picks a representative frame, not a black one
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "png",
+		"pipe:1", // Send the output on stdout
+	)
+	cmd.Stdout = &out
+	if err = cmd.Run(); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// posterTime returns the position of the poster frame of a video, in
+// seconds: 10% of its duration, up to 10 seconds, to skip the intros.
+func posterTime(doc *vfs.FileDoc) string {
+	var position float64
+	if duration, ok := doc.Metadata["duration"].(float64); ok && duration > 0 {
+		position = duration / 10
+		if position > 10 {
+			position = 10
+		}
+	}
+	return strconv.FormatFloat(position, 'f', 3, 64)
+}
+
+func recGenerateThub(ctx context.Context, in io.Reader, fs vfs.Thumbser, img *vfs.FileDoc, format *Format) (r io.Reader, err error) {
 	defer func() {
 		if inCloser, ok := in.(io.Closer); ok {
 			if errc := inCloser.Close(); errc != nil && err == nil {
@@ -95,7 +294,7 @@ func recGenerateThub(ctx context.Context, in io.Reader, fs vfs.Thumbser, img *vf
 			}
 		}
 	}()
-	file, err := fs.CreateThumb(img, format)
+	file, err := fs.CreateThumb(img, format.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -116,7 +315,8 @@ func recGenerateThub(ctx context.Context, in io.Reader, fs vfs.Thumbser, img *vf
 // We are using some complicated ImageMagick options to optimize the speed and
 // quality of the generated thumbnails.
 // See https://www.smashingmagazine.com/2015/06/efficient-image-resizing-with-imagemagick/
-func generateThumb(ctx context.Context, in io.Reader, out io.Writer, format string) error {
+func generateThumb(ctx context.Context, in io.Reader, out io.Writer, format *Format) error {
+	size := fmt.Sprintf("%dx%d", format.Width, format.Height)
 	args := []string{
 		"-limit", "Memory", "2GB",
 		"-limit", "Map", "3GB",
@@ -125,22 +325,24 @@ func generateThumb(ctx context.Context, in io.Reader, out io.Writer, format stri
 		"-strip",         // Strip the EXIF metadata
 		"-quality", "82", // A good compromise between file size and quality
 		"-interlace", "none", // Don't use progressive JPEGs, they are heavier
-		"-thumbnail", formats[format], // Makes a thumbnail that fits inside the given format
+	}
+	if format.Crop {
+		args = append(args,
+			"-thumbnail", size+"^", // Makes a thumbnail that fills the given format
+			"-gravity", "center",
+			"-extent", size, // And crops it at the center
+		)
+	} else {
+		args = append(args,
+			"-thumbnail", size, // Makes a thumbnail that fits inside the given format
+		)
+	}
+	args = append(args,
 		"-colorspace", "sRGB", // Use the colorspace recommended for web, sRGB
 		"jpg:-", // Send the output on stdout, in JPEG format
-	}
+	)
 	cmd := exec.CommandContext(ctx, "convert", args...) // #nosec
 	cmd.Stdin = in
 	cmd.Stdout = out
 	return cmd.Run()
 }
-
-func removeThumbnails(i *instance.Instance, img *vfs.FileDoc) error {
-	var e error
-	for format := range formats {
-		if err := i.ThumbsFS().RemoveThumb(img, format); err != nil {
-			e = err
-		}
-	}
-	return e
-}
@@ -0,0 +1,48 @@
+package trash
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func init() {
+	jobs.AddWorker("trash", &jobs.WorkerConfig{
+		Concurrency:  2,
+		MaxExecCount: 2,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that destroys the files and directories that have been
+// in the trash for longer than the retention period of the instance. If the
+// instance has opted in, the oldest items of the trash are also destroyed
+// while the disk quota is exceeded.
+func Worker(ctx context.Context, m *jobs.Message) error {
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	logger.WithDomain(domain).Debugf("[jobs] trash: retention of %d days, purge on quota: %t",
+		i.TrashRetentionDays, i.TrashPurgeOnQuota)
+	return purge(i.VFS(), i.TrashRetentionDays, i.TrashPurgeOnQuota, time.Now())
+}
+
+func purge(fs vfs.VFS, retentionDays int, purgeOnQuota bool, now time.Time) error {
+	if retentionDays > 0 {
+		before := now.AddDate(0, 0, -retentionDays)
+		if err := vfs.DestroyExpiredTrash(fs, before); err != nil {
+			return err
+		}
+	}
+	if purgeOnQuota {
+		return vfs.FreeTrashSpace(fs, 0)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package trash
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var inst *instance.Instance
+
+func createTrashedFile(t *testing.T, fs vfs.VFS, name string, size int, trashedAt time.Time) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(size), nil, "text/plain", "text", time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	file, err := fs.CreateFile(doc, nil)
+	assert.NoError(t, err)
+	_, err = io.Copy(file, bytes.NewReader(crypto.GenerateRandomBytes(size)))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	doc, err = vfs.TrashFile(fs, doc)
+	assert.NoError(t, err)
+	assert.NotNil(t, doc.TrashedAt)
+	doc, err = vfs.ModifyFileMetadata(fs, doc, &vfs.DocPatch{TrashedAt: &trashedAt})
+	assert.NoError(t, err)
+	return doc
+}
+
+func TestTrashRetention(t *testing.T) {
+	fs := inst.VFS()
+	now := time.Now()
+	old := createTrashedFile(t, fs, "old.txt", 10, now.AddDate(0, 0, -40))
+	recent := createTrashedFile(t, fs, "recent.txt", 10, now.AddDate(0, 0, -10))
+
+	dir, err := vfs.Mkdir(fs, "/old-dir", nil)
+	assert.NoError(t, err)
+	_, err = vfs.Mkdir(fs, "/old-dir/child", nil)
+	assert.NoError(t, err)
+	dir, err = vfs.TrashDir(fs, dir)
+	assert.NoError(t, err)
+	assert.NotNil(t, dir.TrashedAt)
+	trashedAt := now.AddDate(0, 0, -31)
+	dir, err = vfs.ModifyDirMetadata(fs, dir, &vfs.DocPatch{TrashedAt: &trashedAt})
+	assert.NoError(t, err)
+
+	// Nothing is destroyed without a retention period
+	assert.NoError(t, purge(fs, 0, false, now))
+	_, err = fs.FileByID(old.ID())
+	assert.NoError(t, err)
+
+	assert.NoError(t, purge(fs, 30, false, now))
+	_, err = fs.FileByID(old.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.DirByID(dir.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.DirByPath("/.cozy_trash/old-dir/child")
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByID(recent.ID())
+	assert.NoError(t, err)
+
+	// A restored file is not expired anymore
+	restored, err := vfs.RestoreFile(fs, recent)
+	assert.NoError(t, err)
+	assert.Nil(t, restored.TrashedAt)
+	assert.NoError(t, purge(fs, 1, false, now))
+	_, err = fs.FileByID(recent.ID())
+	assert.NoError(t, err)
+	assert.NoError(t, fs.DestroyFile(restored))
+}
+
+func TestTrashRetentionLegacy(t *testing.T) {
+	fs := inst.VFS()
+	now := time.Now()
+	doc := createTrashedFile(t, fs, "legacy.txt", 10, now)
+
+	// A file trashed before the trashed_at field was introduced is dated by
+	// its last update
+	legacy := doc.Clone().(*vfs.FileDoc)
+	legacy.TrashedAt = nil
+	legacy.UpdatedAt = now.AddDate(0, 0, -40)
+	assert.NoError(t, fs.UpdateFileDoc(doc, legacy))
+	recent := createTrashedFile(t, fs, "recent-legacy.txt", 10, now)
+	recentLegacy := recent.Clone().(*vfs.FileDoc)
+	recentLegacy.TrashedAt = nil
+	recentLegacy.UpdatedAt = now.AddDate(0, 0, -10)
+	assert.NoError(t, fs.UpdateFileDoc(recent, recentLegacy))
+
+	assert.NoError(t, purge(fs, 30, false, now))
+	_, err := fs.FileByID(legacy.ID())
+	assert.True(t, os.IsNotExist(err))
+	kept, err := fs.FileByID(recentLegacy.ID())
+	assert.NoError(t, err)
+	assert.Nil(t, kept.TrashedAt)
+	assert.Equal(t, recentLegacy.Rev(), kept.Rev())
+	assert.NoError(t, fs.DestroyFile(kept))
+}
+
+func TestTrashPurgeOnQuota(t *testing.T) {
+	fs := inst.VFS()
+	now := time.Now()
+	first := createTrashedFile(t, fs, "first.txt", 100, now.Add(-3*time.Hour))
+	second := createTrashedFile(t, fs, "second.txt", 100, now.Add(-2*time.Hour))
+	third := createTrashedFile(t, fs, "third.txt", 100, now.Add(-1*time.Hour))
+
+	usage, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	inst.BytesDiskQuota = usage - 150
+	defer func() { inst.BytesDiskQuota = 0 }()
+
+	// The trash is not purged if the instance has not opted in
+	assert.NoError(t, purge(fs, 0, false, now))
+	_, err = fs.FileByID(first.ID())
+	assert.NoError(t, err)
+
+	assert.NoError(t, purge(fs, 0, true, now))
+	_, err = fs.FileByID(first.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByID(second.ID())
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.FileByID(third.ID())
+	assert.NoError(t, err)
+
+	// Some space is freed for a new file
+	assert.NoError(t, vfs.FreeTrashSpace(fs, 60))
+	_, err = fs.FileByID(third.ID())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	setup := testutils.NewSetup(m, "trash_test")
+	inst = setup.GetTestInstance()
+	os.Exit(setup.Run())
+}
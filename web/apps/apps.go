@@ -12,6 +12,8 @@ import (
 	"path"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -107,7 +109,26 @@ func installHandler(installerType apps.AppType) echo.HandlerFunc {
 			return wrapAppsError(err)
 		}
 
-		go inst.Run()
+		doctype := consts.Apps
+		if installerType == apps.Konnector {
+			doctype = consts.Konnectors
+		}
+		// The installation is logged in the audit log only when it has
+		// succeeded, and the context of the request can't be used after the
+		// response has been sent.
+		actor := permissions.GetActor(c)
+		ip := config.ClientIP(c.Request())
+		details := map[string]string{
+			"slug":   slug,
+			"type":   doctype,
+			"source": c.QueryParam("Source"),
+		}
+		go func() {
+			inst.Run()
+			if inst.Err() == nil {
+				audit.Log(instance, actor, audit.AppInstallation, ip, details)
+			}
+		}()
 		return pollInstaller(c, isEventStream, w, slug, inst)
 	}
 }
@@ -238,7 +238,7 @@ func TestServeAppsWithACode(t *testing.T) {
 	assert.Equal(t, "/auth/login", location.Path)
 	assert.NotEmpty(t, location.Query().Get("redirect"))
 
-	session, _ := sessions.New(testInstance)
+	session, _ := sessions.New(testInstance, nil, false)
 	code := sessions.BuildCode(session.ID(), appHost)
 
 	req, _ = http.NewRequest("GET", ts.URL+"/foo?code="+code.Value, nil)
@@ -361,7 +361,7 @@ func TestMain(m *testing.M) {
 
 	ts = setup.GetTestServer("/apps", webApps.WebappsRoutes, func(r *echo.Echo) *echo.Echo {
 		r.POST("/login", func(c echo.Context) error {
-			session, _ := sessions.New(testInstance)
+			session, _ := sessions.New(testInstance, nil, false)
 			cookie, _ := session.ToCookie()
 			c.SetCookie(cookie)
 			return c.HTML(http.StatusOK, "OK")
@@ -17,8 +17,11 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/intents"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/web/auth"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/echo"
 )
 
@@ -162,6 +165,15 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs apps.FileServer, app
 		token = i.BuildAppToken(app)
 	} else {
 		token = c.QueryParam("sharecode")
+		if token != "" {
+			err = webpermissions.CheckShareCode(i, token)
+			if err == permissions.ErrSharePasswordRequired {
+				u := c.Request().URL
+				u.Scheme = i.Scheme()
+				u.Host = c.Request().Host
+				return auth.RenderSharePasswordForm(c, i, token, u.String(), http.StatusOK)
+			}
+		}
 	}
 	tracking := "false"
 	settings, err := i.SettingsDocument()
@@ -5,15 +5,19 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
@@ -27,6 +31,14 @@ import (
 // user when he/she enters incorrect credentials
 const CredentialsErrorKey = "Login Credentials error"
 
+// TwoFactorErrorKey is the key for translating the message showed to the
+// user when they enter an incorrect passcode for the second factor
+const TwoFactorErrorKey = "Login Two factor error"
+
+// TooManyAttemptsKey is the key for translating the message showed to the
+// user when their attempts are refused after too many failures
+const TooManyAttemptsKey = "Login Too many attempts"
+
 // Home is the handler for /
 // It redirects to the login page is the user is not yet authentified
 // Else, it redirects to its home application (or onboarding)
@@ -68,11 +80,12 @@ func addCodeToRedirect(redirect, domain, sessionID string) string {
 	return redirect
 }
 
-// SetCookieForNewSession creates a new session and sets the cookie on echo context
-func SetCookieForNewSession(c echo.Context) (string, error) {
+// SetCookieForNewSession creates a new session and sets the cookie on echo
+// context. twoFactor tells if the second factor has been checked.
+func SetCookieForNewSession(c echo.Context, twoFactor bool) (string, error) {
 	instance := middlewares.GetInstance(c)
 
-	session, err := sessions.New(instance)
+	session, err := sessions.New(instance, c.Request(), twoFactor)
 	if err != nil {
 		return "", err
 	}
@@ -84,24 +97,50 @@ func SetCookieForNewSession(c echo.Context) (string, error) {
 	return session.ID(), nil
 }
 
-func renderLoginForm(c echo.Context, i *instance.Instance, code int, redirect string) error {
+func publicName(i *instance.Instance) string {
 	publicName := "J. Doe"
 	if doc, err := i.SettingsDocument(); err == nil {
 		if name, ok := doc.M["public_name"].(string); ok {
 			publicName = name
 		}
 	}
+	return publicName
+}
 
+func renderLoginForm(c echo.Context, i *instance.Instance, code int, redirect string) error {
 	var credsErrors string
-	if code == http.StatusUnauthorized {
+	switch code {
+	case http.StatusUnauthorized:
 		credsErrors = i.Translate(CredentialsErrorKey)
+	case http.StatusTooManyRequests:
+		credsErrors = i.Translate(TooManyAttemptsKey)
+	}
+
+	return c.Render(code, "login.html", echo.Map{
+		"Locale":           i.Locale,
+		"PublicName":       publicName(i),
+		"CredentialsError": credsErrors,
+		"Redirect":         redirect,
+	})
+}
+
+// renderTwoFactorForm renders the second step of the login, where the user
+// types the passcode of their authenticator app, or a recovery code.
+func renderTwoFactorForm(c echo.Context, i *instance.Instance, code int, redirect, token string) error {
+	var credsErrors string
+	switch code {
+	case http.StatusUnauthorized:
+		credsErrors = i.Translate(TwoFactorErrorKey)
+	case http.StatusTooManyRequests:
+		credsErrors = i.Translate(TooManyAttemptsKey)
 	}
 
 	return c.Render(code, "login.html", echo.Map{
 		"Locale":           i.Locale,
-		"PublicName":       publicName,
+		"PublicName":       publicName(i),
 		"CredentialsError": credsErrors,
 		"Redirect":         redirect,
+		"TwoFactorToken":   token,
 	})
 }
 
@@ -132,15 +171,70 @@ func login(c echo.Context) error {
 	}
 
 	var sessionID string
+	ip := config.ClientIP(c.Request())
+	token := c.FormValue("two_factor_token")
 	session, err := sessions.GetSession(c, instance)
 	if err == nil {
 		sessionID = session.ID()
+	} else if err := limits.Check(instance, ip, limits.Login); err != nil {
+		setRetryAfter(c, err)
+		if wantsJSON {
+			return c.JSON(http.StatusTooManyRequests, echo.Map{
+				"error": instance.Translate(TooManyAttemptsKey),
+			})
+		}
+		if token != "" && instance.ValidateTwoFactorToken(token) {
+			return renderTwoFactorForm(c, instance, http.StatusTooManyRequests, redirect, token)
+		}
+		return renderLoginForm(c, instance, http.StatusTooManyRequests, redirect)
+	} else if token != "" {
+		// Second step of the login: the passphrase has already been checked
+		if !instance.ValidateTwoFactorToken(token) {
+			limits.Failure(instance, ip, limits.Login)
+			auditLoginFailure(instance, ip, "two_factor_token")
+			return renderLoginForm(c, instance, http.StatusUnauthorized, redirect)
+		}
+		passcode := c.FormValue("two_factor_passcode")
+		if err := instance.CheckTwoFactor(passcode); err != nil {
+			limits.Failure(instance, ip, limits.Login)
+			auditLoginFailure(instance, ip, "two_factor_passcode")
+			if wantsJSON {
+				return c.JSON(http.StatusUnauthorized, echo.Map{
+					"error": instance.Translate(TwoFactorErrorKey),
+				})
+			}
+			return renderTwoFactorForm(c, instance, http.StatusUnauthorized, redirect, token)
+		}
+		limits.Success(instance, ip, limits.Login)
+		if sessionID, err = SetCookieForNewSession(c, true); err != nil {
+			return err
+		}
+		audit.Log(instance, audit.Actor{Type: audit.ActorSession, ID: sessionID},
+			audit.Login, ip, map[string]string{"two_factor": "true"})
 	} else {
 		passphrase := []byte(c.FormValue("passphrase"))
 		if err := instance.CheckPassphrase(passphrase); err == nil {
-			if sessionID, err = SetCookieForNewSession(c); err != nil {
+			// With the two-factor authentication, the counters are reset
+			// only after the second step, to limit the guesses of passcodes
+			if instance.HasTwoFactor() {
+				token, err := instance.BuildTwoFactorToken()
+				if err != nil {
+					return err
+				}
+				if wantsJSON {
+					return c.JSON(http.StatusOK, echo.Map{"two_factor_token": token})
+				}
+				return renderTwoFactorForm(c, instance, http.StatusOK, redirect, token)
+			}
+			limits.Success(instance, ip, limits.Login)
+			if sessionID, err = SetCookieForNewSession(c, false); err != nil {
 				return err
 			}
+			audit.Log(instance, audit.Actor{Type: audit.ActorSession, ID: sessionID},
+				audit.Login, ip, nil)
+		} else {
+			limits.Failure(instance, ip, limits.Login)
+			auditLoginFailure(instance, ip, "passphrase")
 		}
 	}
 
@@ -161,6 +255,22 @@ func login(c echo.Context) error {
 	return renderLoginForm(c, instance, http.StatusUnauthorized, redirect)
 }
 
+// auditLoginFailure records a failed login in the audit log, with the step of
+// the login that has failed
+func auditLoginFailure(i *instance.Instance, ip, step string) {
+	audit.Log(i, audit.Actor{Type: audit.ActorAnonymous}, audit.LoginFailure, ip,
+		map[string]string{"step": step})
+}
+
+// setRetryAfter adds the Retry-After header to the response, if the attempt
+// has been refused by the rate limiter
+func setRetryAfter(c echo.Context, err error) {
+	if limited, ok := err.(*limits.ErrRateLimited); ok {
+		seconds := int(math.Ceil(limited.RetryAfter.Seconds()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
 func logout(c echo.Context) error {
 	res := c.Response()
 	origin := c.Request().Header.Get(echo.HeaderOrigin)
@@ -250,6 +360,12 @@ func registerClient(c echo.Context) error {
 	if err := client.Create(instance); err != nil {
 		return c.JSON(err.Code, err)
 	}
+	audit.Log(instance, webpermissions.GetActor(c), audit.OAuthClientRegistration,
+		config.ClientIP(c.Request()), map[string]string{
+			"client_id":   client.ClientID,
+			"client_name": client.ClientName,
+			"software_id": client.SoftwareID,
+		})
 	return c.JSON(http.StatusCreated, client)
 }
 
@@ -514,13 +630,23 @@ func accessToken(c echo.Context) error {
 		})
 	}
 
+	ip := config.ClientIP(c.Request())
+	if err := limits.Check(instance, ip, limits.OAuthToken); err != nil {
+		setRetryAfter(c, err)
+		return c.JSON(http.StatusTooManyRequests, echo.Map{
+			"error": err.Error(),
+		})
+	}
+
 	client, err := oauth.FindClient(instance, clientID)
 	if err != nil {
+		limits.Failure(instance, ip, limits.OAuthToken)
 		return c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "the client must be registered",
 		})
 	}
 	if subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.ClientSecret)) == 0 {
+		limits.Failure(instance, ip, limits.OAuthToken)
 		return c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "invalid client_secret",
 		})
@@ -539,6 +665,7 @@ func accessToken(c echo.Context) error {
 		}
 		accessCode := &oauth.AccessCode{}
 		if err = couchdb.GetDoc(instance, consts.OAuthAccessCodes, code, accessCode); err != nil {
+			limits.Failure(instance, ip, limits.OAuthToken)
 			return c.JSON(http.StatusBadRequest, echo.Map{
 				"error": "invalid code",
 			})
@@ -560,6 +687,7 @@ func accessToken(c echo.Context) error {
 	case "refresh_token":
 		claims, ok := client.ValidToken(instance, permissions.RefreshTokenAudience, c.FormValue("refresh_token"))
 		if !ok {
+			limits.Failure(instance, ip, limits.OAuthToken)
 			return c.JSON(http.StatusBadRequest, echo.Map{
 				"error": "invalid refresh token",
 			})
@@ -579,6 +707,7 @@ func accessToken(c echo.Context) error {
 		})
 	}
 
+	limits.Success(instance, ip, limits.OAuthToken)
 	return c.JSON(http.StatusOK, out)
 }
 
@@ -619,6 +748,14 @@ func passphraseResetForm(c echo.Context) error {
 
 func passphraseReset(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
+	// A reset request is not a failed attempt: the mail is sent only once
+	// while its token is valid. But the requests are refused while the
+	// renewals with an invalid token are locked out.
+	ip := config.ClientIP(c.Request())
+	if err := limits.Check(instance, ip, limits.PassphraseReset); err != nil {
+		setRetryAfter(c, err)
+		return echo.NewHTTPError(http.StatusTooManyRequests, instance.Translate(TooManyAttemptsKey))
+	}
 	// TODO: check user informations to allow the reset of the passphrase since
 	// this route is of course not protected by authentication/permission check.
 	if err := instance.RequestPassphraseReset(); err != nil {
@@ -664,18 +801,28 @@ func passphraseRenew(c echo.Context) error {
 		redirect := instance.DefaultRedirection().String()
 		return c.Redirect(http.StatusSeeOther, redirect)
 	}
+	ip := config.ClientIP(c.Request())
+	if err := limits.Check(instance, ip, limits.PassphraseReset); err != nil {
+		setRetryAfter(c, err)
+		return echo.NewHTTPError(http.StatusTooManyRequests, instance.Translate(TooManyAttemptsKey))
+	}
 	pass := []byte(c.FormValue("passphrase"))
 	token, err := hex.DecodeString(c.FormValue("passphrase_reset_token"))
 	if err != nil {
+		limits.Failure(instance, ip, limits.PassphraseReset)
 		return c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "invalid_token",
 		})
 	}
 	if err := instance.PassphraseRenew(pass, token); err != nil {
+		limits.Failure(instance, ip, limits.PassphraseReset)
 		return c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "invalid_token",
 		})
 	}
+	limits.Success(instance, ip, limits.PassphraseReset)
+	audit.Log(instance, audit.Actor{Type: audit.ActorAnonymous}, audit.PassphraseChange,
+		config.ClientIP(c.Request()), map[string]string{"method": "renew"})
 	return c.Redirect(http.StatusSeeOther, instance.PageURL("/auth/login", nil))
 }
 
@@ -698,6 +845,8 @@ func Routes(router *echo.Group) {
 	router.GET("/passphrase_renew", passphraseRenewForm, noCSRF)
 	router.POST("/passphrase_renew", passphraseRenew, noCSRF)
 
+	router.POST("/share_password", unlockShare)
+
 	router.POST("/register", registerClient, middlewares.AcceptJSON, middlewares.ContentTypeJSON)
 	router.GET("/register/:client-id", readClient, middlewares.AcceptJSON, checkRegistrationToken)
 	router.PUT("/register/:client-id", updateClient, middlewares.AcceptJSON, middlewares.ContentTypeJSON, checkRegistrationToken)
@@ -15,6 +15,7 @@ import (
 	"os"
 	"regexp"
 	"testing"
+	"time"
 
 	app "github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -1056,6 +1057,18 @@ func TestPassphraseReset(t *testing.T) {
 		assert.Equal(t, "https://cozy.example.net/auth/login",
 			res2.Header.Get("Location"))
 	}
+
+	// The reset requests are not counted as failed attempts
+	for i := 0; i < 12; i++ {
+		res, err := postForm("/auth/passphrase_reset", &url.Values{
+			"csrf_token": {csrfCookie.Value},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, "303 See Other", res.Status)
+	}
 }
 
 func TestPassphraseRenewFormNoToken(t *testing.T) {
@@ -1154,6 +1167,77 @@ func TestPassphraseRenew(t *testing.T) {
 	}
 }
 
+func TestLoginWithTwoFactor(t *testing.T) {
+	d := "test.cozycloud.cc.web_two_factor"
+	instance.Destroy(d)
+	in, err := instance.Create(&instance.Options{Domain: d, Locale: "en"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		instance.Destroy(d)
+	}()
+	err = in.RegisterPassphrase([]byte("MyPass"), in.RegisterToken)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = in.StartTwoFactor()
+	assert.NoError(t, err)
+	secret := in.TwoFactorPendingSecret
+	counter := crypto.TOTPCounter(time.Now())
+	_, err = in.ConfirmTwoFactor(crypto.TOTPPasscode(secret, counter))
+	assert.NoError(t, err)
+
+	// The sessions are checked on the response, not kept in a cookie jar
+	c := &http.Client{CheckRedirect: noRedirect}
+	post := func(v *url.Values) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", ts.URL+"/auth/login", bytes.NewBufferString(v.Encode()))
+		req.Host = d
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		res, err := c.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	res1, body := post(&url.Values{"passphrase": {"MyPass"}})
+	assert.Equal(t, "200 OK", res1.Status)
+	assert.Len(t, res1.Cookies(), 0)
+	matches := regexp.MustCompile(`name="two_factor_token" value="([^"]+)"`).FindStringSubmatch(body)
+	if !assert.Len(t, matches, 2) {
+		return
+	}
+	token := matches[1]
+
+	res2, body := post(&url.Values{
+		"two_factor_token":    {token},
+		"two_factor_passcode": {"000000"},
+	})
+	assert.Equal(t, "401 Unauthorized", res2.Status)
+	assert.Len(t, res2.Cookies(), 0)
+	assert.Contains(t, body, `name="two_factor_passcode"`)
+
+	res3, _ := post(&url.Values{
+		"two_factor_token":    {"invalid"},
+		"two_factor_passcode": {crypto.TOTPPasscode(secret, counter+1)},
+	})
+	assert.Equal(t, "401 Unauthorized", res3.Status)
+	assert.Len(t, res3.Cookies(), 0)
+
+	res4, _ := post(&url.Values{
+		"two_factor_token":    {token},
+		"two_factor_passcode": {crypto.TOTPPasscode(secret, counter+1)},
+	})
+	if assert.Equal(t, "303 See Other", res4.Status) {
+		cookies := res4.Cookies()
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, cookies[0].Name, sessions.SessionCookieName)
+	}
+}
+
 func TestIsLoggedOutAfterLogout(t *testing.T) {
 	content, err := getTestURL()
 	assert.NoError(t, err)
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// SharePasswordErrorKey is the key for translating the message showed to the
+// user when they enter an incorrect password for a share by link
+const SharePasswordErrorKey = "Share Password error"
+
+// The password page is served on the domain of the shared app, so the assets
+// are loaded from the stack domain.
+var sharePasswordTemplate = template.Must(template.New("share-password").Parse(`<!DOCTYPE html>
+<html lang="{{.Locale}}">
+  <head>
+    <meta charset="utf-8">
+    <title>Cozy</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <link rel="stylesheet" href="//{{.Domain}}/assets/fonts/fonts.css">
+    <link rel="stylesheet" href="//{{.Domain}}/assets/styles/login.css">
+    <link rel="icon" type="image/png" href="//{{.Domain}}/assets/images/happycloud.png" />
+  </head>
+  <body>
+    <div role="application">
+      <main>
+        <div class="login auth">
+          <div class="main-wrapper">
+            <div role="region">
+              <form id="share-password-form" method="POST" action="{{.Action}}" class="login auth">
+                <input type="hidden" name="sharecode" value="{{.ShareCode}}" />
+                <input type="hidden" name="redirect" value="{{.Redirect}}" />
+                <p class="help" id="share-password-tip">{{.Help}}</p>
+                <div class="input-wrapper">
+                  <label for="password" aria-describedby="share-password-tip">{{.Field}}</label>
+                  <input id="password" name="password" placeholder="{{.Field}}" type="password" autofocus="true" autocomplete="off" />
+                </div>
+                {{if .Error}}
+                <div class="errors">
+                  <p>{{.Error}}</p>
+                </div>
+                {{end}}
+              </form>
+            </div>
+            <footer>
+              <div class="controls">
+                <button id="share-password-submit" form="share-password-form" type="submit">{{.Submit}}</button>
+              </div>
+            </footer>
+          </div>
+        </div>
+      </main>
+    </div>
+  </body>
+</html>
+`))
+
+// RenderSharePasswordForm renders the page where the password of a share by
+// link is asked, before the shared app or file is shown. The redirect is the
+// URL where the user goes back after the password has been checked, with the
+// share code replaced by an unlocked token.
+func RenderSharePasswordForm(c echo.Context, i *instance.Instance, code, redirect string, status int) error {
+	var errMsg string
+	switch status {
+	case http.StatusUnauthorized:
+		errMsg = i.Translate(SharePasswordErrorKey)
+	case http.StatusTooManyRequests:
+		errMsg = i.Translate(TooManyAttemptsKey)
+	}
+
+	res := c.Response()
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	res.WriteHeader(status)
+	return sharePasswordTemplate.Execute(res, echo.Map{
+		"Locale":    i.Locale,
+		"Domain":    i.Domain,
+		"Action":    i.PageURL("/auth/share_password", nil),
+		"ShareCode": code,
+		"Redirect":  redirect,
+		"Help":      i.Translate("Share Password help"),
+		"Field":     i.Translate("Share Password field"),
+		"Submit":    i.Translate("Share Password submit"),
+		"Error":     errMsg,
+	})
+}
+
+func unlockShare(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	code := c.FormValue("sharecode")
+	password := c.FormValue("password")
+
+	redirect, err := checkRedirectParam(c, instance.DefaultRedirection())
+	if err != nil {
+		return err
+	}
+
+	ip := config.ClientIP(c.Request())
+	if err = limits.Check(instance, ip, limits.Share); err != nil {
+		setRetryAfter(c, err)
+		return RenderSharePasswordForm(c, instance, code, redirect, http.StatusTooManyRequests)
+	}
+
+	pdoc, err := permissions.GetForShareCode(instance, code)
+	if err != nil {
+		return err
+	}
+	if !pdoc.HasPassword() {
+		return c.Redirect(http.StatusSeeOther, redirect)
+	}
+	if err = pdoc.CheckPassword(password); err != nil {
+		limits.Failure(instance, ip, limits.Share)
+		return RenderSharePasswordForm(c, instance, code, redirect, http.StatusUnauthorized)
+	}
+	limits.Success(instance, ip, limits.Share)
+
+	// The unlocked token is bound to the current password and codes, so that
+	// changing them revokes it
+	token, err := instance.MakeJWT(permissions.UnlockedShareAudience,
+		pdoc.ID(), pdoc.LockFingerprint(), time.Now())
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("sharecode", token)
+	u.RawQuery = q.Encode()
+	return c.Redirect(http.StatusSeeOther, u.String())
+}
@@ -29,6 +29,7 @@ var blackList = map[string]bool{
 	consts.Queues:           readable,
 	consts.Triggers:         readable,
 	consts.RemoteRequests:   readable,
+	consts.Audit:            readable,
 }
 
 // CheckReadable will abort the context and returns false if the doctype
@@ -11,6 +11,7 @@ import (
 	"math"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +23,7 @@ import (
 	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/thumbnail"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
@@ -363,6 +365,10 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 		return err
 	}
 
+	if err = permissions.CountDownload(c); err != nil {
+		return err
+	}
+
 	disposition := "inline"
 	if c.QueryParam("Dl") == "1" {
 		disposition = "attachment"
@@ -375,7 +381,9 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	return nil
 }
 
-// ThumbnailHandler serves thumbnails of the images/photos
+// ThumbnailHandler serves thumbnails of the images/photos, the PDFs and the
+// videos. When a thumbnail is missing, a job is pushed to generate it, and a
+// placeholder is sent with a 202 Accepted status.
 func ThumbnailHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -401,8 +409,35 @@ func ThumbnailHandler(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, "Wrong download token")
 	}
 
+	format, err := thumbnail.ParseFormat(c.Param("format"))
+	if err != nil {
+		return jsonapi.InvalidParameter("format", err)
+	}
+	if !thumbnail.Supported(doc) {
+		return jsonapi.NotFound(errors.New("No thumbnail for this file"))
+	}
+
 	fs := instance.ThumbsFS()
-	return fs.ServeThumbContent(c.Response(), c.Request(), doc, c.Param("format"))
+	err = fs.ServeThumbContent(c.Response(), c.Request(), doc, format.Name)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err = thumbnail.Request(instance, doc, format); err != nil {
+		return err
+	}
+	return servePlaceholder(c, format)
+}
+
+// servePlaceholder sends an empty image of the size of the thumbnail, while
+// it is generated. The client can retry later to get the thumbnail.
+func servePlaceholder(c echo.Context, format *thumbnail.Format) error {
+	h := c.Response().Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Retry-After", "2")
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+		`<rect width="100%%" height="100%%" fill="#f5f6f7"/></svg>`,
+		format.Width, format.Height)
+	return c.Blob(http.StatusAccepted, "image/svg+xml", []byte(svg))
 }
 
 func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
@@ -418,6 +453,9 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 		if err != nil {
 			return err
 		}
+		if err = permissions.CountDownload(c); err != nil {
+			return err
+		}
 	}
 
 	disposition := "inline"
@@ -483,6 +521,10 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 		}
 	}
 
+	if err = permissions.CountDownload(c); err != nil {
+		return err
+	}
+
 	// if accept header is application/zip, send the archive immediately
 	if c.Request().Header.Get("Accept") == "application/zip" {
 		return archive.Serve(instance.VFS(), c.Response())
@@ -529,6 +571,10 @@ func FileDownloadCreateHandler(c echo.Context) error {
 		return err
 	}
 
+	if err = permissions.CountDownload(c); err != nil {
+		return err
+	}
+
 	secret, err := vfs.GetStore().AddFile(instance.Domain, path)
 	if err != nil {
 		return wrapVfsError(err)
@@ -792,12 +838,24 @@ func Routes(router *echo.Group) {
 	router.PATCH("/metadata", ModifyMetadataByPathHandler)
 	router.PATCH("/:file-id", ModifyMetadataByIDHandler)
 
+	router.POST("/uploads", CreateUploadSessionHandler)
+	router.GET("/uploads/:session-id", UploadSessionStatusHandler)
+	router.HEAD("/uploads/:session-id", UploadSessionStatusHandler)
+	router.PUT("/uploads/:session-id", UploadChunkHandler)
+	router.POST("/uploads/:session-id/finalize", FinalizeUploadHandler)
+	router.DELETE("/uploads/:session-id", AbortUploadHandler)
+
 	router.POST("/", CreationHandler)
 	router.POST("/:dir-id", CreationHandler)
 	router.PUT("/:file-id", OverwriteFileContentHandler)
 
 	router.GET("/:file-id/thumbnails/:secret/:format", ThumbnailHandler)
 
+	router.GET("/:file-id/versions", ListVersionsHandler)
+	router.GET("/:file-id/versions/:version-id", ReadVersionContentHandler)
+	router.HEAD("/:file-id/versions/:version-id", ReadVersionContentHandler)
+	router.POST("/:file-id/versions/:version-id/restore", RestoreVersionHandler)
+
 	router.POST("/archive", ArchiveDownloadCreateHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
@@ -842,6 +900,12 @@ func wrapVfsError(err error) error {
 		return jsonapi.BadRequest(err)
 	case vfs.ErrFileTooBig:
 		return jsonapi.NewError(http.StatusRequestEntityTooLarge, err)
+	case vfs.ErrVersionNotFound, vfs.ErrUploadSessionNotFound:
+		return jsonapi.NotFound(err)
+	case vfs.ErrUploadOffsetMismatch:
+		return jsonapi.Conflict(err)
+	case vfs.ErrUploadIncomplete:
+		return jsonapi.PreconditionFailed(UploadOffsetHeader, err)
 	}
 	return err
 }
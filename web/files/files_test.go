@@ -2,6 +2,8 @@ package files
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +15,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -1712,6 +1715,42 @@ func TestDestroyFile(t *testing.T) {
 	assert.True(t, len(v.Data) == 0)
 }
 
+func TestUploadPurgesTrashOnQuota(t *testing.T) {
+	body := "foo,bar"
+	res1, data1 := upload(t, "/files/?Type=file&Name=topurgefile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+	res2, data2 := trash(t, "/files/"+fileID)
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+	_, v2 := extractDirData(t, data2)
+	attrs2 := v2["attributes"].(map[string]interface{})
+	assert.NotEmpty(t, attrs2["trashed_at"])
+
+	usage, err := testInstance.VFS().DiskUsage()
+	assert.NoError(t, err)
+	testInstance.BytesDiskQuota = usage + 3
+	assert.NoError(t, instance.Update(testInstance))
+	defer func() {
+		testInstance.BytesDiskQuota = 0
+		testInstance.TrashPurgeOnQuota = false
+		assert.NoError(t, instance.Update(testInstance))
+	}()
+
+	res3, _ := upload(t, "/files/?Type=file&Name=afterpurgefile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 413, res3.StatusCode)
+
+	testInstance.TrashPurgeOnQuota = true
+	assert.NoError(t, instance.Update(testInstance))
+	res4, _ := upload(t, "/files/?Type=file&Name=afterpurgefile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res4.StatusCode)
+	_, err = testInstance.VFS().FileByID(fileID)
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestThumbnail(t *testing.T) {
 	res1, _ := httpGet(ts.URL + "/files/" + imgID)
 	assert.Equal(t, 200, res1.StatusCode)
@@ -1735,6 +1774,34 @@ func TestThumbnail(t *testing.T) {
 	assert.True(t, strings.HasPrefix(res4.Header.Get("Content-Type"), "image/jpeg"))
 }
 
+func TestThumbnailOnDemand(t *testing.T) {
+	res1, _ := httpGet(ts.URL + "/files/" + imgID)
+	assert.Equal(t, 200, res1.StatusCode)
+	var obj map[string]interface{}
+	err := extractJSONRes(res1, &obj)
+	assert.NoError(t, err)
+	data := obj["data"].(map[string]interface{})
+	links := data["links"].(map[string]interface{})
+	small := links["small"].(string)
+	base := strings.TrimSuffix(small, "small")
+
+	res2, _ := download(t, base+"huge", "")
+	assert.Equal(t, 400, res2.StatusCode)
+
+	// A placeholder is sent while the thumbnail is generated
+	res3, body := download(t, base+"128x128-crop", "")
+	if res3.StatusCode == 202 {
+		assert.Equal(t, "image/svg+xml", res3.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), `width="128" height="128"`)
+		for i := 0; i < 50 && res3.StatusCode == 202; i++ {
+			time.Sleep(100 * time.Millisecond)
+			res3, _ = download(t, base+"128x128-crop", "")
+		}
+	}
+	assert.Equal(t, 200, res3.StatusCode)
+	assert.True(t, strings.HasPrefix(res3.Header.Get("Content-Type"), "image/jpeg"))
+}
+
 func TestFindFiles(t *testing.T) {
 	err := couchdb.DefineIndex(testInstance, mango.IndexOnFields(consts.Files, "by-class", []string{"class"}))
 	if !assert.NoError(t, err) {
@@ -1764,6 +1831,166 @@ func TestFindFiles(t *testing.T) {
 	assert.NotEmpty(t, small)
 }
 
+func TestFileVersions(t *testing.T) {
+	config.GetConfig().Fs.Versioning = config.FsVersioning{MaxNumberToKeep: 5}
+	defer func() { config.GetConfig().Fs.Versioning = config.FsVersioning{} }()
+
+	res1, data1 := upload(t, "/files/?Type=file&Name=versioned", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+	res2, _ := uploadMod(t, "/files/"+fileID, "text/plain", "bar", "")
+	if !assert.Equal(t, 200, res2.StatusCode) {
+		return
+	}
+
+	res3, err := httpGet(ts.URL + "/files/" + fileID + "/versions")
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res3.StatusCode) {
+		return
+	}
+	var list map[string]interface{}
+	err = extractJSONRes(res3, &list)
+	assert.NoError(t, err)
+	versions := list["data"].([]interface{})
+	if !assert.Len(t, versions, 1) {
+		return
+	}
+	version := versions[0].(map[string]interface{})
+	versionID := version["id"].(string)
+	assert.Equal(t, consts.FilesVersions, version["type"])
+	attrs := version["attributes"].(map[string]interface{})
+	assert.Equal(t, fileID, attrs["file_id"])
+
+	res4, body := download(t, "/files/"+fileID+"/versions/"+versionID, "")
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, "foo", string(body))
+
+	res5, _ := download(t, "/files/"+fileID+"/versions/unknown", "")
+	assert.Equal(t, 404, res5.StatusCode)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/"+fileID+"/versions/"+versionID+"/restore", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res6, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, res6.StatusCode) {
+		return
+	}
+	res6.Body.Close()
+
+	buf, err := readFile(testInstance.VFS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(buf))
+
+	versionDocs, err := testInstance.VFS().AllVersions(fileID)
+	assert.NoError(t, err)
+	assert.Len(t, versionDocs, 2)
+}
+
+func TestResumableUpload(t *testing.T) {
+	content := "Hello, resumable world!"
+	sum := md5.Sum([]byte(content))
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/uploads?Name=resumable.txt", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	req.Header.Add("Content-Type", "text/plain")
+	req.Header.Add("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Add("Upload-Length", strconv.Itoa(len(content)))
+	res1, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) || !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	var session map[string]interface{}
+	err = extractJSONRes(res1, &session)
+	assert.NoError(t, err)
+	data := session["data"].(map[string]interface{})
+	sessionID := data["id"].(string)
+	assert.Equal(t, consts.FilesUploads, data["type"])
+	assert.Equal(t, "0", res1.Header.Get("Upload-Offset"))
+
+	sendChunk := func(offset int, chunk string) *http.Response {
+		req, err := http.NewRequest("PUT", ts.URL+"/files/uploads/"+sessionID, strings.NewReader(chunk))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		req.Header.Add("Upload-Offset", strconv.Itoa(offset))
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res2 := sendChunk(0, content[:10])
+	assert.Equal(t, 204, res2.StatusCode)
+	assert.Equal(t, "10", res2.Header.Get("Upload-Offset"))
+
+	// The same chunk sent twice is rejected
+	res3 := sendChunk(0, content[:10])
+	assert.Equal(t, 409, res3.StatusCode)
+	assert.Equal(t, "10", res3.Header.Get("Upload-Offset"))
+
+	req, err = http.NewRequest("HEAD", ts.URL+"/files/uploads/"+sessionID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res4, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res4.Body.Close()
+		assert.Equal(t, 200, res4.StatusCode)
+		assert.Equal(t, "10", res4.Header.Get("Upload-Offset"))
+	}
+
+	finalize := func() *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/files/uploads/"+sessionID+"/finalize", nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+
+	res5 := finalize()
+	res5.Body.Close()
+	assert.Equal(t, 412, res5.StatusCode)
+
+	res6 := sendChunk(10, content[10:])
+	assert.Equal(t, 204, res6.StatusCode)
+
+	res7 := finalize()
+	if !assert.Equal(t, 201, res7.StatusCode) {
+		return
+	}
+	var file map[string]interface{}
+	err = extractJSONRes(res7, &file)
+	assert.NoError(t, err)
+	attrs := file["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Equal(t, "resumable.txt", attrs["name"])
+	assert.Equal(t, "text/plain", attrs["mime"])
+
+	buf, err := readFile(testInstance.VFS(), "/resumable.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(buf))
+
+	res8, err := httpGet(ts.URL + "/files/uploads/" + sessionID)
+	if assert.NoError(t, err) {
+		res8.Body.Close()
+		assert.Equal(t, 404, res8.StatusCode)
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -8,6 +8,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/workers/thumbnail"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
@@ -242,7 +243,7 @@ func (f *file) MarshalJSON() ([]byte, error) {
 }
 func (f *file) Links() *jsonapi.LinksList {
 	links := jsonapi.LinksList{Self: "/files/" + f.doc.DocID}
-	if f.doc.Class == "image" {
+	if thumbnail.Supported(f.doc) {
 		if path, err := f.doc.Path(f.instance.VFS()); err == nil {
 			if secret, err := vfs.GetStore().AddFile(f.instance.Domain, path); err == nil {
 				links.Small = "/files/" + f.doc.DocID + "/thumbnails/" + secret + "/small"
@@ -0,0 +1,241 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	// UploadLengthHeader is the header used to give the total size of the
+	// content of a resumable upload
+	UploadLengthHeader = "Upload-Length"
+	// UploadOffsetHeader is the header used to give the offset of a chunk, or
+	// the number of bytes already received for a resumable upload
+	UploadOffsetHeader = "Upload-Offset"
+)
+
+type uploadSession struct {
+	doc *vfs.UploadSession
+}
+
+func (u *uploadSession) ID() string         { return u.doc.ID() }
+func (u *uploadSession) Rev() string        { return u.doc.Rev() }
+func (u *uploadSession) SetID(id string)    { u.doc.SetID(id) }
+func (u *uploadSession) SetRev(rev string)  { u.doc.SetRev(rev) }
+func (u *uploadSession) DocType() string    { return u.doc.DocType() }
+func (u *uploadSession) Clone() couchdb.Doc { cloned := *u; return &cloned }
+func (u *uploadSession) Relationships() jsonapi.RelationshipMap {
+	if u.doc.FileID == "" {
+		return nil
+	}
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + u.doc.FileID,
+			},
+			Data: couchdb.DocReference{
+				ID:   u.doc.FileID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+func (u *uploadSession) Included() []jsonapi.Object { return []jsonapi.Object{} }
+func (u *uploadSession) MarshalJSON() ([]byte, error) {
+	// The chunks are an implementation detail
+	doc := *u.doc
+	doc.Chunks = nil
+	return json.Marshal(doc)
+}
+func (u *uploadSession) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/uploads/" + u.doc.ID()}
+}
+
+var _ jsonapi.Object = (*uploadSession)(nil)
+
+// checkUploadPerm checks that the permissions of the request allow to create
+// the file of the upload session, or to overwrite its content.
+func checkUploadPerm(c echo.Context, fs vfs.VFS, s *vfs.UploadSession) error {
+	if s.FileID != "" {
+		olddoc, err := fs.FileByID(s.FileID)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+		return checkPerm(c, permissions.PUT, nil, olddoc)
+	}
+	doc, err := vfs.NewFileDoc(s.Name, s.DirID, s.Size, s.MD5Sum, s.Mime,
+		s.Class, time.Now(), s.Executable, false, s.Tags)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return checkPerm(c, permissions.POST, nil, doc)
+}
+
+// uploadSessionFromReq returns the upload session with the session-id
+// parameter of the request, after checking the permissions.
+func uploadSessionFromReq(c echo.Context) (*vfs.UploadSession, error) {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := vfs.GetUploadSession(fs, c.Param("session-id"))
+	if err != nil {
+		return nil, wrapVfsError(err)
+	}
+	if err = checkUploadPerm(c, fs, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func setUploadHeaders(c echo.Context, s *vfs.UploadSession) {
+	h := c.Response().Header()
+	h.Set(UploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+	h.Set(UploadLengthHeader, strconv.FormatInt(s.Size, 10))
+	h.Set("Cache-Control", "no-store")
+}
+
+// CreateUploadSessionHandler handles POST requests on /files/uploads. It
+// starts a resumable upload, for a new file with the Name and DirID
+// parameters, or for a new content of the file with the FileID parameter.
+func CreateUploadSessionHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	header := c.Request().Header
+
+	size, err := strconv.ParseInt(header.Get(UploadLengthHeader), 10, 64)
+	if err != nil || size <= 0 {
+		return jsonapi.InvalidParameter(UploadLengthHeader, vfs.ErrContentLengthMismatch)
+	}
+	md5Sum, err := parseMD5Hash(header.Get("Content-MD5"))
+	if err != nil {
+		return jsonapi.InvalidParameter("Content-MD5", err)
+	}
+
+	s := &vfs.UploadSession{
+		Size:       size,
+		MD5Sum:     md5Sum,
+		Executable: c.QueryParam("Executable") == "true",
+		Tags:       utils.SplitTrimString(c.QueryParam("Tags"), TagSeparator),
+	}
+
+	if fileID := c.QueryParam("FileID"); fileID != "" {
+		olddoc, err := fs.FileByID(fileID)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+		if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+			return wrapVfsError(err)
+		}
+		s.FileID = olddoc.ID()
+		s.Name = olddoc.DocName
+		s.DirID = olddoc.DirID
+		s.Tags = olddoc.Tags
+		s.Executable = olddoc.Executable
+	} else {
+		s.Name = c.QueryParam("Name")
+		s.DirID = c.QueryParam("DirID")
+		if s.DirID == "" {
+			s.DirID = consts.RootDirID
+		}
+	}
+
+	contentType := header.Get(echo.HeaderContentType)
+	if contentType == "" || strings.HasPrefix(contentType, vfs.DefaultContentType) {
+		s.Mime, s.Class = vfs.ExtractMimeAndClassFromFilename(s.Name)
+	} else {
+		s.Mime, s.Class = vfs.ExtractMimeAndClass(contentType)
+	}
+
+	if err = checkUploadPerm(c, fs, s); err != nil {
+		return err
+	}
+
+	if err = vfs.CreateUploadSession(fs, s); err != nil {
+		return wrapVfsError(err)
+	}
+
+	c.Response().Header().Set("Location", "/files/uploads/"+s.ID())
+	setUploadHeaders(c, s)
+	return jsonapi.Data(c, http.StatusCreated, &uploadSession{s}, nil)
+}
+
+// UploadSessionStatusHandler handles GET and HEAD requests on
+// /files/uploads/:session-id and returns the current offset of the upload,
+// ie the offset where the next chunk should start.
+func UploadSessionStatusHandler(c echo.Context) error {
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	setUploadHeaders(c, s)
+	return jsonapi.Data(c, http.StatusOK, &uploadSession{s}, nil)
+}
+
+// UploadChunkHandler handles PUT requests on /files/uploads/:session-id to
+// send a chunk of the content, starting at the offset given in the
+// Upload-Offset header.
+func UploadChunkHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(c.Request().Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return jsonapi.InvalidParameter(UploadOffsetHeader, vfs.ErrUploadOffsetMismatch)
+	}
+
+	if err = vfs.WriteUploadChunk(fs, s, offset, c.Request().Body); err != nil {
+		setUploadHeaders(c, s)
+		return wrapVfsError(err)
+	}
+
+	setUploadHeaders(c, s)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// FinalizeUploadHandler handles POST requests on
+// /files/uploads/:session-id/finalize. When all the content has been
+// received, it creates the file (or its new content) and returns it.
+func FinalizeUploadHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+
+	doc, err := vfs.FinalizeUploadSession(fs, s)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if s.FileID != "" {
+		return fileData(c, http.StatusOK, doc, nil)
+	}
+	return fileData(c, http.StatusCreated, doc, nil)
+}
+
+// AbortUploadHandler handles DELETE requests on /files/uploads/:session-id
+// to cancel a resumable upload and free the reserved space.
+func AbortUploadHandler(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	s, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+
+	if err = vfs.DestroyUploadSession(fs, s); err != nil {
+		return wrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type version struct {
+	doc *vfs.Version
+}
+
+func (v *version) ID() string         { return v.doc.ID() }
+func (v *version) Rev() string        { return v.doc.Rev() }
+func (v *version) SetID(id string)    { v.doc.SetID(id) }
+func (v *version) SetRev(rev string)  { v.doc.SetRev(rev) }
+func (v *version) DocType() string    { return v.doc.DocType() }
+func (v *version) Clone() couchdb.Doc { cloned := *v; return &cloned }
+func (v *version) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Links: &jsonapi.LinksList{
+				Related: "/files/" + v.doc.FileID,
+			},
+			Data: couchdb.DocReference{
+				ID:   v.doc.FileID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+func (v *version) Included() []jsonapi.Object { return []jsonapi.Object{} }
+func (v *version) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.doc)
+}
+func (v *version) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{
+		Self: "/files/" + v.doc.FileID + "/versions/" + v.doc.ID(),
+	}
+}
+
+var _ jsonapi.Object = (*version)(nil)
+
+// versionFromReq returns the file and its version from the file-id and
+// version-id parameters of the request.
+func versionFromReq(c echo.Context) (*vfs.FileDoc, *vfs.Version, error) {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := instance.VFS().VersionByID(c.Param("version-id"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if v.FileID != doc.ID() {
+		return nil, nil, vfs.ErrVersionNotFound
+	}
+	return doc, v, nil
+}
+
+// ListVersionsHandler handles GET requests on /files/:file-id/versions and
+// returns the old versions of the file, from the oldest to the most recent.
+func ListVersionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	err = checkPerm(c, permissions.GET, nil, doc)
+	if err != nil {
+		return err
+	}
+
+	versions, err := instance.VFS().AllVersions(doc.ID())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(versions))
+	for i, v := range versions {
+		objs[i] = &version{v}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// ReadVersionContentHandler handles GET requests on
+// /files/:file-id/versions/:version-id and serves the content of an old
+// version of the file.
+func ReadVersionContentHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, v, err := versionFromReq(c)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	err = checkPerm(c, permissions.GET, nil, doc)
+	if err != nil {
+		return err
+	}
+
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	}
+	err = vfs.ServeVersionContent(instance.VFS(), doc, v, disposition, c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return nil
+}
+
+// RestoreVersionHandler handles POST requests on
+// /files/:file-id/versions/:version-id/restore and replaces the content of
+// the file by the content of the old version.
+func RestoreVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	olddoc, v, err := versionFromReq(c)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	err = checkPerm(c, permissions.PUT, nil, olddoc)
+	if err != nil {
+		return err
+	}
+
+	if err = CheckIfMatch(c, olddoc.Rev()); err != nil {
+		return wrapVfsError(err)
+	}
+
+	newdoc, err := vfs.RestoreVersion(instance.VFS(), olddoc, v)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
@@ -1,102 +1,73 @@
 package imexport
 
 import (
-	"encoding/base32"
-	"fmt"
-	"io"
 	"net/http"
-	"os"
+	"strings"
 
-	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/imexport"
-	"github.com/cozy/cozy-stack/pkg/jobs"
-	workers "github.com/cozy/cozy-stack/pkg/workers/mails"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/echo"
 )
 
-func export(c echo.Context) error {
+// exportArchive handles GET requests on /export: the response is an archive
+// with all the data of the instance, that can be imported on another host.
+// Only the CLI can use it.
+func exportArchive(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
-	fs := instance.VFS()
 
-	domain := instance.Domain
-
-	tab := crypto.GenerateRandomBytes(20)
-	id := base32.StdEncoding.EncodeToString(tab)
-
-	w, err := os.Create(fmt.Sprintf("%s-%s.tar.gz", domain, id))
+	pdoc, err := permissions.GetPermission(c)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
-
-	err = imexport.Tardir(w, fs)
-	if err != nil {
-		return err
-	}
-
-	lien := fmt.Sprintf("http://%s%s%s-%s", domain, c.Path(), domain, id)
-
-	mailBody := fmt.Sprintf("Bonjour %s,\n\nVotre archive contenant l'ensemble de vos fichiers Cozy est prête à être téléchargée. Vous pouvez vous rendre sur %s pour y accéder.\n\nBonne journée\nL'équipe Cozy.",
-		instance.Domain, lien)
-	msg, err := jobs.NewMessage("json", workers.Options{
-		Mode:    workers.ModeNoReply,
-		Subject: "Téléchargement de vos fichiers Cozy",
-		Parts: []*workers.Part{
-			{
-				Type: "text/plain",
-				Body: mailBody,
-			},
-		},
-	})
-	if err != nil {
-		return err
-	}
-
-	context := jobs.NewWorkerContext(instance.Domain, "abcd")
-	err = workers.SendMail(context, msg)
-	if err != nil {
-		return err
+	if pdoc.Type != pkgperm.TypeCLI {
+		return echo.NewHTTPError(http.StatusForbidden)
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"message": "bienvenue sur la super page",
-	})
+	filename := strings.Replace(instance.Domain, ":", "-", -1) + ".tar.gz"
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	res.WriteHeader(http.StatusOK)
+	// The archive is streamed: an error can't change the status anymore, and
+	// the client will get a truncated archive.
+	return imexport.Export(res, instance)
 }
 
-func exportDir(c echo.Context) error {
-	domID := c.Param("domain-id")
-	fmt.Println(domID)
+// importArchive handles POST requests on /import: the body is an archive
+// made by the export, that is used to rebuild a fresh instance. Only the CLI
+// can use it.
+func importArchive(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
 
-	src, err := os.Open(fmt.Sprintf("%s.tar.gz", domID))
+	pdoc, err := permissions.GetPermission(c)
 	if err != nil {
 		return err
 	}
-	dst, err := os.Create("cozy.tar.gz")
-	if err != nil {
-		return err
+	if pdoc.Type != pkgperm.TypeCLI {
+		return echo.NewHTTPError(http.StatusForbidden)
 	}
 
-	_, err = io.Copy(dst, src)
-	if err != nil {
-		return err
+	err = imexport.Import(instance, c.Request().Body)
+	switch err {
+	case nil:
+		return c.NoContent(http.StatusNoContent)
+	case imexport.ErrNotFresh:
+		return jsonapi.Conflict(err)
+	case imexport.ErrInvalidArchive:
+		return jsonapi.BadRequest(err)
 	}
-
-	err = os.Remove(fmt.Sprintf("%s.tar.gz", domID))
-	if err != nil {
-		return err
-	}
-
-	return c.JSON(http.StatusOK, echo.Map{
-		"message": "bienvenue sur la super page bis",
-	})
+	return err
 }
 
-// Routes sets the routing for export
-func Routes(router *echo.Group) {
-	router.GET("/", export)
-	router.HEAD("/", export)
-
-	router.GET("/:domain-id", exportDir)
+// ExportRoutes sets the routing for export
+func ExportRoutes(router *echo.Group) {
+	router.GET("", exportArchive)
+}
 
+// ImportRoutes sets the routing for import
+func ImportRoutes(router *echo.Group) {
+	router.POST("", importArchive)
 }
@@ -7,11 +7,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/echo"
@@ -21,8 +25,11 @@ type apiInstance struct {
 	*instance.Instance
 }
 
+// MarshalJSON never sends the data key, even wrapped, outside of the stack
 func (i *apiInstance) MarshalJSON() ([]byte, error) {
-	return json.Marshal(i.Instance)
+	scrubbed := *i.Instance
+	scrubbed.WrappedDataKey = nil
+	return json.Marshal(&scrubbed)
 }
 
 // Links is used to generate a JSON-API link for the instance
@@ -49,6 +56,14 @@ func createHandler(c echo.Context) error {
 			return wrapError(err)
 		}
 	}
+	var trashRetention int
+	if days := c.QueryParam("TrashRetentionDays"); days != "" {
+		var err error
+		trashRetention, err = strconv.Atoi(days)
+		if err != nil {
+			return wrapError(err)
+		}
+	}
 	var settings couchdb.JSONDoc
 	settings.M = make(map[string]interface{})
 	for _, setting := range strings.Split(c.QueryParam("Settings"), ",") {
@@ -66,12 +81,14 @@ func createHandler(c echo.Context) error {
 		settings.M["public_name"] = name
 	}
 	in, err := instance.Create(&instance.Options{
-		Domain:    c.QueryParam("Domain"),
-		Locale:    c.QueryParam("Locale"),
-		DiskQuota: diskQuota,
-		Settings:  settings,
-		Apps:      utils.SplitTrimString(c.QueryParam("Apps"), ","),
-		Dev:       (c.QueryParam("Dev") == "true"),
+		Domain:             c.QueryParam("Domain"),
+		Locale:             c.QueryParam("Locale"),
+		DiskQuota:          diskQuota,
+		TrashRetentionDays: trashRetention,
+		TrashPurgeOnQuota:  (c.QueryParam("TrashPurgeOnQuota") == "true"),
+		Settings:           settings,
+		Apps:               utils.SplitTrimString(c.QueryParam("Apps"), ","),
+		Dev:                (c.QueryParam("Dev") == "true"),
 	})
 	if err != nil {
 		return wrapError(err)
@@ -103,7 +120,7 @@ func modifyHandler(c echo.Context) error {
 	if err != nil {
 		return wrapError(err)
 	}
-	var shouldUpdate bool
+	var shouldUpdate, trashChanged bool
 	if quota := c.QueryParam("DiskQuota"); quota != "" {
 		var diskQuota int64
 		diskQuota, err = strconv.ParseInt(quota, 10, 64)
@@ -113,6 +130,21 @@ func modifyHandler(c echo.Context) error {
 		i.BytesDiskQuota = diskQuota
 		shouldUpdate = true
 	}
+	if days := c.QueryParam("TrashRetentionDays"); days != "" {
+		var trashRetention int
+		trashRetention, err = strconv.Atoi(days)
+		if err != nil {
+			return wrapError(err)
+		}
+		i.TrashRetentionDays = trashRetention
+		shouldUpdate = true
+		trashChanged = true
+	}
+	if purge, err := strconv.ParseBool(c.QueryParam("TrashPurgeOnQuota")); err == nil {
+		i.TrashPurgeOnQuota = purge
+		shouldUpdate = true
+		trashChanged = true
+	}
 	if locale := c.QueryParam("Locale"); locale != "" {
 		i.Locale = locale
 		shouldUpdate = true
@@ -122,6 +154,13 @@ func modifyHandler(c echo.Context) error {
 			return wrapError(err)
 		}
 	}
+	// The instances created before the retention of the trash don't have the
+	// trigger of the trash worker
+	if trashChanged {
+		if _, err = i.AddMissingTriggers(); err != nil {
+			return wrapError(err)
+		}
+	}
 	if debug, err := strconv.ParseBool(c.QueryParam("Debug")); err == nil {
 		if debug {
 			err = logger.AddDebugDomain(domain)
@@ -214,9 +253,83 @@ func registerClient(c echo.Context) error {
 	if regErr := client.Create(in); regErr != nil {
 		return c.String(http.StatusBadRequest, regErr.Description)
 	}
+	audit.Log(in, audit.Actor{Type: audit.ActorCLI}, audit.OAuthClientRegistration,
+		config.ClientIP(c.Request()), map[string]string{
+			"client_id":   client.ClientID,
+			"client_name": client.ClientName,
+			"software_id": client.SoftwareID,
+		})
 	return c.String(http.StatusOK, client.ClientID)
 }
 
+// rotateMasterKey wraps the data keys of all the instances with the current
+// master key of the configuration.
+func rotateMasterKey(c echo.Context) error {
+	is, err := instance.List()
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return c.JSON(http.StatusOK, echo.Map{"rotated": 0, "failed": 0})
+		}
+		return wrapError(err)
+	}
+	rotated, failed := 0, 0
+	for _, in := range is {
+		ok, err := in.RewrapDataKey()
+		if err != nil {
+			in.Logger().Errorf("Could not rewrap the data key: %s", err)
+			failed++
+		} else if ok {
+			rotated++
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"rotated": rotated, "failed": failed})
+}
+
+// addTriggersHandler adds the missing triggers to an instance, like the ones
+// of the thumbnails of the videos and PDF for an instance created before they
+// were added.
+func addTriggersHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	added, err := in.AddMissingTriggers()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{"triggers_added": added})
+}
+
+// reindexHandler adds the missing triggers to an instance, like the ones of
+// the full-text search for an instance created before it, and pushes a job to
+// rebuild its search index.
+func reindexHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	added, err := in.AddMissingTriggers()
+	if err != nil {
+		return err
+	}
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, map[string]string{})
+	if err != nil {
+		return err
+	}
+	job, err := stack.GetBroker().PushJob(&jobs.JobRequest{
+		Domain:     in.Domain,
+		WorkerType: "reindex",
+		Message:    msg,
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, echo.Map{
+		"triggers_added": added,
+		"job_id":         job.JobID,
+	})
+}
+
 func wrapError(err error) error {
 	switch err {
 	case instance.ErrNotFound:
@@ -244,6 +357,9 @@ func Routes(router *echo.Group) {
 	router.GET("/:domain", showHandler)
 	router.PATCH("/:domain", modifyHandler)
 	router.DELETE("/:domain", deleteHandler)
+	router.POST("/:domain/triggers", addTriggersHandler)
+	router.POST("/:domain/reindex", reindexHandler)
 	router.POST("/token", createToken)
 	router.POST("/oauth_client", registerClient)
+	router.POST("/rotate_master_key", rotateMasterKey)
 }
@@ -1,12 +1,19 @@
 package jobs
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/scheduler"
 	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/web/jsonapi"
@@ -15,11 +22,13 @@ import (
 	"github.com/cozy/echo"
 
 	// import workers
+	_ "github.com/cozy/cozy-stack/pkg/workers/index"
 	_ "github.com/cozy/cozy-stack/pkg/workers/konnectors"
 	_ "github.com/cozy/cozy-stack/pkg/workers/log"
 	_ "github.com/cozy/cozy-stack/pkg/workers/mails"
 	_ "github.com/cozy/cozy-stack/pkg/workers/sharings"
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
+	_ "github.com/cozy/cozy-stack/pkg/workers/trash"
 	_ "github.com/cozy/cozy-stack/pkg/workers/unzip"
 )
 
@@ -31,6 +40,9 @@ type (
 		Arguments json.RawMessage  `json:"arguments"`
 		Options   *jobs.JobOptions `json:"options"`
 	}
+	apiJobLogs struct {
+		l *jobs.JobLogs
+	}
 	apiQueue struct {
 		Count      int `json:"count"`
 		workerType string
@@ -62,6 +74,21 @@ func (j *apiJob) MarshalJSON() ([]byte, error) {
 	return json.Marshal(j.j)
 }
 
+func (l *apiJobLogs) ID() string                             { return l.l.ID() }
+func (l *apiJobLogs) Rev() string                            { return l.l.Rev() }
+func (l *apiJobLogs) DocType() string                        { return consts.JobLogs }
+func (l *apiJobLogs) Clone() couchdb.Doc                     { return l }
+func (l *apiJobLogs) SetID(_ string)                         {}
+func (l *apiJobLogs) SetRev(_ string)                        {}
+func (l *apiJobLogs) Relationships() jsonapi.RelationshipMap { return nil }
+func (l *apiJobLogs) Included() []jsonapi.Object             { return nil }
+func (l *apiJobLogs) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/" + l.l.ID() + "/logs"}
+}
+func (l *apiJobLogs) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.l)
+}
+
 func (q *apiQueue) ID() string                             { return q.workerType }
 func (q *apiQueue) Rev() string                            { return "" }
 func (q *apiQueue) DocType() string                        { return consts.Queues }
@@ -130,6 +157,7 @@ func pushJob(c echo.Context) error {
 			Type: jobs.JSONEncoding,
 			Data: req.Arguments,
 		},
+		TraceParent: middlewares.GetSpan(c).TraceParent(),
 	}
 	if err := permissions.Allow(c, permissions.POST, jr); err != nil {
 		return err
@@ -229,7 +257,7 @@ func getJob(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	job, err := stack.GetBroker().GetJobInfos(instance.Domain, c.Param("job-id"))
 	if err != nil {
-		return err
+		return wrapJobsError(err)
 	}
 	if err := permissions.Allow(c, permissions.GET, job); err != nil {
 		return err
@@ -237,6 +265,217 @@ func getJob(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, &apiJob{job}, nil)
 }
 
+// defaultJobsLimit is the default number of jobs per page
+const defaultJobsLimit = 100
+
+func listJobs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	workerType := c.QueryParam("Worker")
+	state := jobs.State(c.QueryParam("State"))
+
+	if workerType == "" {
+		if err := permissions.AllowWholeType(c, permissions.GET, consts.Jobs); err != nil {
+			return err
+		}
+	} else {
+		o := &jobs.JobRequest{WorkerType: workerType}
+		if err := permissions.Allow(c, permissions.GET, o); err != nil {
+			return err
+		}
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultJobsLimit)
+	if err != nil {
+		return err
+	}
+	js, err := stack.GetBroker().ListJobs(instance.Domain, workerType, state, cursor)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		if workerType != "" {
+			params.Set("Worker", workerType)
+		}
+		if state != "" {
+			params.Set("State", string(state))
+		}
+		links.Next = fmt.Sprintf("/jobs?%s", params.Encode())
+	}
+
+	objs := make([]jsonapi.Object, len(js))
+	for i, j := range js {
+		objs[i] = &apiJob{j}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func cancelJob(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	broker := stack.GetBroker()
+	job, err := broker.GetJobInfos(instance.Domain, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = permissions.Allow(c, permissions.PATCH, job); err != nil {
+		return err
+	}
+	job, err = broker.CancelJob(instance.Domain, job.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiJob{job}, nil)
+}
+
+func purgeJobs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	if err := permissions.AllowWholeType(c, permissions.DELETE, consts.Jobs); err != nil {
+		return err
+	}
+
+	before := time.Now()
+	if param := c.QueryParam("Before"); param != "" {
+		var err error
+		before, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			return jsonapi.InvalidParameter("Before", err)
+		}
+	}
+
+	count, err := stack.GetBroker().PurgeJobs(instance.Domain, before)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"count": count})
+}
+
+const typeTextEventStream = "text/event-stream"
+
+// logsPollInterval is the interval between two checks of the state of a job
+// when its logs are tailed, in case the end of the logs has been missed
+const logsPollInterval = 5 * time.Second
+
+func getJobLogs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := stack.GetBroker().GetJobInfos(instance.Domain, c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = permissions.Allow(c, permissions.GET, job); err != nil {
+		return err
+	}
+	if c.Request().Header.Get("Accept") == typeTextEventStream {
+		return tailJobLogs(c, job)
+	}
+	logs, err := jobs.GetLogs(instance.Domain, job.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiJobLogs{logs}, nil)
+}
+
+// tailJobLogs sends the lines of logs of a job as server-sent events, first
+// the lines already persisted, and then the new lines as they are written,
+// until the job is finished.
+func tailJobLogs(c echo.Context, job *jobs.JobInfos) error {
+	instance := middlewares.GetInstance(c)
+	broker := stack.GetBroker()
+
+	// Subscribe before reading the persisted logs, to not miss the lines
+	// written in the meantime
+	sub := realtime.GetHub().Subscribe(instance.Domain, consts.JobLogs)
+	defer sub.Close()
+	logs, err := jobs.GetLogs(instance.Domain, job.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	w := c.Response().Writer
+	w.Header().Set("Content-Type", typeTextEventStream)
+	w.WriteHeader(200)
+
+	last := 0
+	for i := range logs.Lines {
+		writeLogLine(w, &logs.Lines[i])
+		last = logs.Lines[i].N
+	}
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	ticker := time.NewTicker(logsPollInterval)
+	defer ticker.Stop()
+
+	finished := logs.Finished || job.Finished()
+	for !finished {
+		select {
+		case e, ok := <-sub.Read():
+			if !ok {
+				return nil
+			}
+			// The events are either lines of logs, or the updates of the
+			// document of the logs
+			b, err := json.Marshal(e.Doc)
+			if err != nil {
+				continue
+			}
+			var doc struct {
+				jobs.LogLine
+				DocID    string `json:"_id"`
+				Finished bool   `json:"finished"`
+			}
+			if err = json.Unmarshal(b, &doc); err != nil {
+				continue
+			}
+			if doc.JobID == job.ID() && doc.N > last {
+				writeLogLine(w, &doc.LogLine)
+				last = doc.N
+			} else if doc.DocID == job.ID() && doc.Finished {
+				finished = true
+			}
+		case <-ticker.C:
+			infos, err := broker.GetJobInfos(instance.Domain, job.ID())
+			if err != nil || infos.Finished() {
+				finished = true
+			}
+		case <-closed:
+			return nil
+		}
+	}
+
+	if infos, err := broker.GetJobInfos(instance.Domain, job.ID()); err == nil {
+		job = infos
+	}
+	buf := new(bytes.Buffer)
+	if err = jsonapi.WriteData(buf, &apiJob{job}, nil); err == nil {
+		writeStream(w, "done", buf.String())
+	}
+	return nil
+}
+
+func writeLogLine(w http.ResponseWriter, line *jobs.LogLine) {
+	if b, err := json.Marshal(line); err == nil {
+		writeStream(w, "log", string(b))
+	}
+}
+
+func writeStream(w http.ResponseWriter, event string, b string) {
+	s := fmt.Sprintf("event: %s\r\ndata: %s\r\n\r\n", event, b)
+	_, err := w.Write([]byte(s))
+	if err != nil {
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // Routes sets the routing for the jobs service
 func Routes(router *echo.Group) {
 	router.GET("/queue/:worker-type", getQueue)
@@ -247,7 +486,100 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers/:trigger-id", getTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
+	router.GET("", listJobs)
+	router.DELETE("/purge", purgeJobs)
 	router.GET("/:job-id", getJob)
+	router.POST("/:job-id/cancel", cancelJob)
+	router.GET("/:job-id/logs", getJobLogs)
+}
+
+func listDeadLetters(c echo.Context) error {
+	domain := c.QueryParam("Domain")
+	workerType := c.QueryParam("Worker")
+	limit := defaultJobsLimit
+	if l := c.QueryParam("page[limit]"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return jsonapi.InvalidParameter("page[limit]", errors.New("invalid limit"))
+		}
+	}
+	deads, next, err := jobs.ListDeadLetters(domain, workerType, limit, c.QueryParam("page[cursor]"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	broker := stack.GetBroker()
+	objs := make([]jsonapi.Object, 0, len(deads))
+	for _, dead := range deads {
+		job, err := broker.GetJobInfos(dead.Domain, dead.ID())
+		if err == jobs.ErrNotFoundJob {
+			// The job may have been removed with its domain
+			continue
+		}
+		if err != nil {
+			return wrapJobsError(err)
+		}
+		objs = append(objs, &apiJob{job})
+	}
+
+	links := &jsonapi.LinksList{}
+	if next != "" {
+		params := url.Values{
+			"page[limit]":  {strconv.Itoa(limit)},
+			"page[cursor]": {next},
+		}
+		if domain != "" {
+			params.Set("Domain", domain)
+		}
+		if workerType != "" {
+			params.Set("Worker", workerType)
+		}
+		links.Next = fmt.Sprintf("/jobs/dead_letters?%s", params.Encode())
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func getDeadLetter(c echo.Context) error {
+	dead, err := jobs.GetDeadLetter(c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	job, err := stack.GetBroker().GetJobInfos(dead.Domain, dead.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiJob{job}, nil)
+}
+
+func replayDeadLetter(c echo.Context) error {
+	dead, err := jobs.GetDeadLetter(c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	job, err := stack.GetBroker().ReplayJob(dead.Domain, dead.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiJob{job}, nil)
+}
+
+func discardDeadLetter(c echo.Context) error {
+	dead, err := jobs.GetDeadLetter(c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = stack.GetBroker().DiscardJob(dead.Domain, dead.ID()); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// AdminRoutes sets the routing for the administration of the jobs of all the
+// domains: the dead letters can be inspected, replayed or discarded.
+func AdminRoutes(router *echo.Group) {
+	router.GET("/dead_letters", listDeadLetters)
+	router.GET("/dead_letters/:job-id", getDeadLetter)
+	router.POST("/dead_letters/:job-id/replay", replayDeadLetter)
+	router.DELETE("/dead_letters/:job-id", discardDeadLetter)
 }
 
 func wrapJobsError(err error) error {
@@ -258,6 +590,9 @@ func wrapJobsError(err error) error {
 		return jsonapi.NotFound(err)
 	case scheduler.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
+	case jobs.ErrJobFinished,
+		jobs.ErrNotDeadLetter:
+		return jsonapi.Conflict(err)
 	}
 	return err
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -24,6 +25,7 @@ import (
 var ts *httptest.Server
 var testInstance *instance.Instance
 var token string
+var waitCancelled = make(chan struct{}, 1)
 
 type jobRequest struct {
 	Arguments interface{} `json:"arguments"`
@@ -289,8 +291,9 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	// The instance already has a trigger for thumbnails
-	assert.Len(t, v.Data, 1)
+	// The instance already has triggers for the thumbnails and the search
+	nb := len(instance.Triggers(testInstance.Domain))
+	assert.Len(t, v.Data, nb)
 
 	body, _ := json.Marshal(&jsonapiReq{
 		Data: &jsonapiData{
@@ -325,12 +328,12 @@ func TestGetAllJobs(t *testing.T) {
 		return
 	}
 
-	if assert.Len(t, v.Data, 2) {
+	if assert.Len(t, v.Data, nb+1) {
 		var index int
-		if v.Data[1].Attributes.Type == "@in" {
-			index = 1
-		} else {
-			index = 0
+		for i, data := range v.Data {
+			if data.Attributes.Type == "@in" {
+				index = i
+			}
 		}
 		assert.Equal(t, consts.Triggers, v.Data[index].Type)
 		assert.Equal(t, "@in", v.Data[index].Attributes.Type)
@@ -375,6 +378,197 @@ func TestGetAllJobs(t *testing.T) {
 	assert.Len(t, v.Data, 0)
 }
 
+func TestListCancelAndPurgeJobs(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: &jobRequest{Arguments: "foobar"},
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/wait", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	var v struct {
+		Data struct {
+			ID         string         `json:"id"`
+			Attributes *jobs.JobInfos `json:"attributes"`
+		}
+	}
+	err = json.NewDecoder(res.Body).Decode(&v)
+	res.Body.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	jobID := v.Data.ID
+
+	// Wait for the job to be running
+	for i := 0; i < 50; i++ {
+		infos, err := stack.GetBroker().GetJobInfos(testInstance.Domain, jobID)
+		if err == nil && infos.State == jobs.Running {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/jobs/"+jobID+"/cancel", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	err = json.NewDecoder(res.Body).Decode(&v)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, jobs.State(jobs.Cancelled), v.Data.Attributes.State)
+
+	select {
+	case <-waitCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The context of the job has not been cancelled")
+	}
+
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/jobs/"+jobID+"/cancel", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	var list struct {
+		Data []struct {
+			ID         string         `json:"id"`
+			Attributes *jobs.JobInfos `json:"attributes"`
+		}
+	}
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/jobs?Worker=wait&State=cancelled", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	err = json.NewDecoder(res.Body).Decode(&list)
+	res.Body.Close()
+	assert.NoError(t, err)
+	if assert.Len(t, list.Data, 1) {
+		assert.Equal(t, jobID, list.Data[0].ID)
+		assert.Equal(t, "wait", list.Data[0].Attributes.WorkerType)
+	}
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/jobs/purge", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var purge struct {
+		Count int `json:"count"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&purge)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.True(t, purge.Count >= 1)
+
+	_, err = stack.GetBroker().GetJobInfos(testInstance.Domain, jobID)
+	assert.Equal(t, jobs.ErrNotFoundJob, err)
+}
+
+func TestGetJobLogs(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: &jobRequest{Arguments: "foobar"},
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/jobs/queue/logs", bytes.NewReader(body))
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	var v struct {
+		Data struct {
+			ID string `json:"id"`
+		}
+	}
+	err = json.NewDecoder(res.Body).Decode(&v)
+	res.Body.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	jobID := v.Data.ID
+
+	// Wait for the job to be done
+	for i := 0; i < 50; i++ {
+		infos, err := stack.GetBroker().GetJobInfos(testInstance.Domain, jobID)
+		if err == nil && infos.State == jobs.Done {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+jobID+"/logs", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var logs struct {
+		Data struct {
+			ID         string        `json:"id"`
+			Type       string        `json:"type"`
+			Attributes *jobs.JobLogs `json:"attributes"`
+		}
+	}
+	err = json.NewDecoder(res.Body).Decode(&logs)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, jobID, logs.Data.ID)
+	assert.Equal(t, consts.JobLogs, logs.Data.Type)
+	if assert.NotNil(t, logs.Data.Attributes) {
+		assert.True(t, logs.Data.Attributes.Finished)
+		if assert.Len(t, logs.Data.Attributes.Lines, 2) {
+			line := logs.Data.Attributes.Lines[0]
+			assert.Equal(t, 1, line.N)
+			assert.Equal(t, "info", line.Level)
+			assert.Equal(t, "hello foobar", line.Message)
+			assert.Equal(t, "warning", logs.Data.Attributes.Lines[1].Level)
+		}
+	}
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/jobs/"+jobID+"/logs", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "text/event-stream")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	stream, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Contains(t, string(stream), "event: log\r\ndata: ")
+	assert.Contains(t, string(stream), "hello foobar")
+	assert.Contains(t, string(stream), "event: done\r\n")
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -391,6 +585,31 @@ func TestMain(m *testing.M) {
 			return err
 		},
 	})
+	jobs.AddWorker("wait", &jobs.WorkerConfig{
+		Concurrency: 1,
+		WorkerFunc: func(ctx context.Context, m *jobs.Message) error {
+			<-ctx.Done()
+			if ctx.Err() == context.Canceled {
+				waitCancelled <- struct{}{}
+			}
+			return ctx.Err()
+		},
+	})
+
+	jobs.AddWorker("logs", &jobs.WorkerConfig{
+		Concurrency: 1,
+		WorkerFunc: func(ctx context.Context, m *jobs.Message) error {
+			var msg string
+			if err := m.Unmarshal(&msg); err != nil {
+				return err
+			}
+			log := jobs.Logger(ctx)
+			log.Infof("hello %s", msg)
+			log.Debugf("not kept")
+			log.Warnf("bye %s", msg)
+			return nil
+		},
+	})
 
 	testInstance = setup.GetTestInstance()
 	if err := stack.Start(); err != nil {
@@ -0,0 +1,36 @@
+// Package metrics exposes the metrics of the stack, in the text format of
+// Prometheus, on the admin server.
+package metrics
+
+import (
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/stack"
+	"github.com/cozy/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var registerOnce sync.Once
+
+// Routes sets the routing for the metrics service
+func Routes(router *echo.Group) {
+	// The broker is known only when the stack has been started
+	registerOnce.Do(func() {
+		prometheus.MustRegister(jobs.NewQueueLenCollector(lazyBroker{}))
+	})
+	handler := echo.WrapHandler(promhttp.Handler())
+	router.GET("", handler)
+	router.GET("/", handler)
+}
+
+// lazyBroker is a broker that fetches the global broker of the stack on each
+// call, as it is not yet initialized when the routes are defined.
+type lazyBroker struct {
+	jobs.Broker
+}
+
+func (b lazyBroker) QueueLen(workerType string) (int, error) {
+	return stack.GetBroker().QueueLen(workerType)
+}
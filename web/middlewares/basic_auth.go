@@ -9,6 +9,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/echo"
 )
 
@@ -26,6 +27,11 @@ func BasicAuth(secretFileName string) echo.MiddlewareFunc {
 				return echo.NewHTTPError(http.StatusUnauthorized, "missing basic auth")
 			}
 
+			ip := config.ClientIP(c.Request())
+			if err := limits.Check(nil, ip, limits.Admin); err != nil {
+				return echo.NewHTTPError(http.StatusTooManyRequests, err)
+			}
+
 			shadowFile, err := config.FindConfigFile(secretFileName)
 			if err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, err)
@@ -45,8 +51,10 @@ func BasicAuth(secretFileName string) echo.MiddlewareFunc {
 
 			needUpdate, err := crypto.CompareHashAndPassphrase(b, []byte(passphrase))
 			if err != nil {
+				limits.Failure(nil, ip, limits.Admin)
 				return echo.NewHTTPError(http.StatusForbidden, "bad passphrase")
 			}
+			limits.Success(nil, ip, limits.Admin)
 
 			if needUpdate {
 				return errors.New("Passphrase hash needs update and should be regenerated")
@@ -12,6 +12,7 @@ import (
 // corsBlackList list all routes prefix that are not eligible to CORS
 var corsBlackList = []string{
 	"/auth/",
+	"/dav/",
 }
 
 // MaxAgeCORS is used to cache the CORS header for 12 hours
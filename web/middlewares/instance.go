@@ -25,6 +25,7 @@ func NeedInstance(next echo.HandlerFunc) echo.HandlerFunc {
 				return echo.NewHTTPError(http.StatusInternalServerError, err)
 			}
 		}
+		i.SetSpan(GetSpan(c))
 		c.Set("instance", i)
 		return next(c)
 	}
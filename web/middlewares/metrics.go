@@ -0,0 +1,59 @@
+package middlewares
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/echo"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// requestDuration measures the latency of the HTTP requests, by route group,
+// method and status
+var requestDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "cozy",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	},
+	[]string{"group", "method", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+}
+
+// Metrics is a middleware that measures the latency of the requests, and
+// counts their statuses, by route group. The group is the first segment of
+// the route, like files for /files/:file-id.
+func Metrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		// The error is handled here to know the status of the response
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		status := strconv.Itoa(c.Response().Status)
+		requestDuration.WithLabelValues(routeGroup(c.Path()), c.Request().Method, status).
+			Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// routeGroup returns the first segment of a route
+func routeGroup(route string) string {
+	route = strings.TrimPrefix(route, "/")
+	if route == "" {
+		return "root"
+	}
+	if i := strings.IndexAny(route, "/*"); i >= 0 {
+		route = route[:i]
+	}
+	if route == "" {
+		return "other"
+	}
+	return route
+}
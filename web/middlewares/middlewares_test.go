@@ -35,3 +35,12 @@ func TestSplitHost(t *testing.T) {
 	assert.Equal(t, "", app)
 	assert.Equal(t, "", siblings)
 }
+
+func TestRouteGroup(t *testing.T) {
+	assert.Equal(t, "root", routeGroup("/"))
+	assert.Equal(t, "root", routeGroup(""))
+	assert.Equal(t, "files", routeGroup("/files/:file-id"))
+	assert.Equal(t, "files", routeGroup("/files/"))
+	assert.Equal(t, "version", routeGroup("/version"))
+	assert.Equal(t, "other", routeGroup("/*"))
+}
@@ -0,0 +1,55 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/trace"
+	"github.com/cozy/echo"
+)
+
+// contextSpan is the key used in the echo context to store the span of the
+// request
+const contextSpan = "span"
+
+// Tracing is a middleware that starts a span for the request. Its parent is
+// given by the traceparent header, if the request comes from a traced
+// service.
+func Tracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		span := trace.StartRemote("HTTP "+req.Method,
+			req.Header.Get(trace.TraceParentHeader), trace.KindServer)
+		if span == nil {
+			return next(c)
+		}
+		defer span.End()
+		c.Set(contextSpan, span)
+		// The error is handled here to know the status of the response
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		status := c.Response().Status
+		span.SetName(req.Method + " " + c.Path())
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.route", c.Path())
+		span.SetAttribute("http.host", req.Host)
+		span.SetAttribute("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(errorStatus(status))
+		}
+		return nil
+	}
+}
+
+// GetSpan returns the span of the request, or nil if the request is not
+// traced
+func GetSpan(c echo.Context) *trace.Span {
+	span, _ := c.Get(contextSpan).(*trace.Span)
+	return span
+}
+
+type errorStatus int
+
+func (e errorStatus) Error() string {
+	return http.StatusText(int(e))
+}
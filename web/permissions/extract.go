@@ -4,12 +4,16 @@ import (
 	"crypto/subtle"
 	"encoding/hex"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
@@ -51,11 +55,10 @@ func getRequestToken(c echo.Context) string {
 	return ""
 }
 
-func parseJWT(instance *instance.Instance, token string) (*permissions.Permission, error) {
-	var claims permissions.Claims
+func parseJWT(instance *instance.Instance, token string, claims *permissions.Claims) (*permissions.Permission, error) {
 	err := crypto.ParseJWT(token, func(token *jwt.Token) (interface{}, error) {
 		return instance.PickKey(token.Claims.(*permissions.Claims).Audience)
-	}, &claims)
+	}, claims)
 
 	if err != nil {
 		return nil, permissions.ErrInvalidToken
@@ -77,11 +80,11 @@ func parseJWT(instance *instance.Instance, token string) (*permissions.Permissio
 			return nil, permissions.ErrInvalidToken
 		}
 
-		return permissions.GetForOauth(&claims)
+		return permissions.GetForOauth(claims)
 
 	case permissions.CLIAudience:
 		// do not check client existence
-		return permissions.GetForCLI(&claims)
+		return permissions.GetForCLI(claims)
 
 	case permissions.AppAudience:
 		pdoc, err := permissions.GetForWebapp(instance, claims.Subject)
@@ -102,6 +105,30 @@ func parseJWT(instance *instance.Instance, token string) (*permissions.Permissio
 		if err != nil {
 			return nil, err
 		}
+		// The share codes protected by a password must be exchanged for an
+		// unlocked token first
+		if pdoc.HasPassword() {
+			return nil, permissions.ErrSharePasswordRequired
+		}
+		return pdoc, nil
+
+	case permissions.UnlockedShareAudience:
+		pdoc, err := permissions.GetByID(instance, claims.Subject)
+		if err != nil || pdoc.Type != permissions.TypeSharing {
+			return nil, permissions.ErrInvalidToken
+		}
+		if pdoc.Expired() {
+			return nil, permissions.ErrExpiredToken
+		}
+		validUntil := claims.IssuedAtUTC().Add(permissions.UnlockedShareTokenValidity)
+		if validUntil.Before(time.Now().UTC()) {
+			return nil, permissions.ErrExpiredToken
+		}
+		// The token is revoked when the password or the codes are changed
+		fingerprint := pdoc.LockFingerprint()
+		if subtle.ConstantTimeCompare([]byte(claims.Scope), []byte(fingerprint)) != 1 {
+			return nil, permissions.ErrInvalidToken
+		}
 		return pdoc, nil
 
 	default:
@@ -109,6 +136,54 @@ func parseJWT(instance *instance.Instance, token string) (*permissions.Permissio
 	}
 }
 
+// CheckShareCode returns an error if the given code cannot be used to access
+// a share by link, for example ErrSharePasswordRequired if the password of
+// the share has not been checked.
+func CheckShareCode(instance *instance.Instance, code string) error {
+	_, err := parseJWT(instance, code, &permissions.Claims{})
+	return err
+}
+
+// CountDownload checks that the maximal number of downloads of a share by link
+// has not been reached, and counts a new download. It does nothing for the
+// other permissions.
+func CountDownload(c echo.Context) error {
+	pdoc, err := GetPermission(c)
+	if err != nil || pdoc.Type != permissions.TypeSharing || pdoc.MaxDownloads == 0 {
+		return nil
+	}
+	// Only the requests for the beginning of the file are counted
+	req := c.Request()
+	if req.Method == http.MethodHead || !isFromBeginning(req.Header.Get("Range")) {
+		return nil
+	}
+	return pdoc.CountDownload(middlewares.GetInstance(c))
+}
+
+// isFromBeginning returns false if the Range header asks only for parts of a
+// file after its first byte. The suffix ranges (bytes=-500) and the malformed
+// headers are considered as asking for the beginning, so that they can't be
+// used to download a share without counting it.
+func isFromBeginning(rng string) bool {
+	if rng == "" {
+		return true
+	}
+	if !strings.HasPrefix(rng, "bytes=") {
+		return true
+	}
+	for _, spec := range strings.Split(rng[len("bytes="):], ",") {
+		parts := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+		if len(parts) != 2 {
+			return true
+		}
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || start <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // extract permissions doc or set from the context
 func extract(c echo.Context) (*permissions.Permission, error) {
 	instance := middlewares.GetInstance(c)
@@ -122,7 +197,44 @@ func extract(c echo.Context) (*permissions.Permission, error) {
 		return nil, ErrNoToken
 	}
 
-	return parseJWT(instance, tok)
+	var claims permissions.Claims
+	pdoc, err := parseJWT(instance, tok, &claims)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(ContextClaims, &claims)
+	return pdoc, nil
+}
+
+// GetActor returns who is doing the request, for the audit log. It uses the
+// claims of the token of the request if there is one, or else the session of
+// the user.
+func GetActor(c echo.Context) audit.Actor {
+	// The claims are put in the context when the permissions are extracted
+	_, err := GetPermission(c)
+	if claims, ok := c.Get(ContextClaims).(*permissions.Claims); ok && err == nil {
+		switch claims.Audience {
+		case permissions.AppAudience:
+			return audit.Actor{Type: audit.ActorApp, ID: claims.Subject}
+		case permissions.KonnectorAudience:
+			return audit.Actor{Type: audit.ActorKonnector, ID: claims.Subject}
+		case permissions.AccessTokenAudience:
+			return audit.Actor{Type: audit.ActorOAuth, ID: claims.Subject}
+		case permissions.CLIAudience:
+			return audit.Actor{Type: audit.ActorCLI}
+		case permissions.ShareAudience, permissions.UnlockedShareAudience:
+			actor := audit.Actor{Type: audit.ActorShare}
+			if pdoc, ok := c.Get(contextPermissionDoc).(*permissions.Permission); ok {
+				actor.ID = pdoc.ID()
+			}
+			return actor
+		}
+	}
+	instance := middlewares.GetInstance(c)
+	if session, err := sessions.GetSession(c, instance); err == nil {
+		return audit.Actor{Type: audit.ActorSession, ID: session.ID()}
+	}
+	return audit.Actor{Type: audit.ActorAnonymous}
 }
 
 // GetPermission extracts the permission from the echo context and checks their validity
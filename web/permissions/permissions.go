@@ -2,10 +2,15 @@ package permissions
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -43,7 +48,12 @@ type apiPermission struct {
 }
 
 func (p *apiPermission) MarshalJSON() ([]byte, error) {
-	return json.Marshal(p.Permission)
+	// The hash of the password is never sent, only the fact that there is
+	// a password
+	return json.Marshal(struct {
+		*permissions.Permission
+		Password bool `json:"password,omitempty"`
+	}{p.Permission, p.HasPassword()})
 }
 
 // Relationships implements jsonapi.Doc
@@ -80,10 +90,25 @@ func createPermission(c echo.Context) error {
 		return err
 	}
 
-	var subdoc permissions.Permission
+	var subdoc struct {
+		Permissions  permissions.Set `json:"permissions"`
+		ExpiresAt    int             `json:"expires_at"`
+		Password     string          `json:"password"`
+		MaxDownloads int             `json:"max_downloads"`
+	}
 	if _, err = jsonapi.Bind(c.Request(), &subdoc); err != nil {
 		return err
 	}
+	if subdoc.ExpiresAt < 0 || subdoc.MaxDownloads < 0 {
+		return jsonapi.NewError(http.StatusBadRequest, "Invalid expires_at or max_downloads")
+	}
+	if ttl := c.QueryParam("ttl"); ttl != "" {
+		d, errt := parseTTL(ttl)
+		if errt != nil {
+			return jsonapi.NewError(http.StatusBadRequest, "Invalid ttl")
+		}
+		subdoc.ExpiresAt = int(time.Now().Add(d).Unix())
+	}
 
 	var codes map[string]string
 	if names != nil {
@@ -108,14 +133,36 @@ func createPermission(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "no parent")
 	}
 
-	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions)
+	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions, &permissions.ShareOptions{
+		ExpiresAt:    subdoc.ExpiresAt,
+		Password:     subdoc.Password,
+		MaxDownloads: subdoc.MaxDownloads,
+	})
 	if err != nil {
 		return err
 	}
+	audit.Log(instance, GetActor(c), audit.PermissionCreation, config.ClientIP(c.Request()),
+		map[string]string{"permission_id": pdoc.ID(), "codes": c.QueryParam("codes")})
 
 	return jsonapi.Data(c, http.StatusOK, &apiPermission{pdoc}, nil)
 }
 
+// parseTTL parses a duration like 1h or 30m, with a d suffix for days
+func parseTTL(ttl string) (time.Duration, error) {
+	if strings.HasSuffix(ttl, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(ttl, "d"))
+		if err != nil || days <= 0 {
+			return 0, errors.New("Invalid ttl")
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err == nil && d <= 0 {
+		err = errors.New("Invalid ttl")
+	}
+	return d, err
+}
+
 type refAndVerb struct {
 	ID      string               `json:"id"`
 	DocType string               `json:"type"`
@@ -276,6 +323,8 @@ func patchPermission(getPerms getPermsFunc, paramName string) echo.HandlerFunc {
 		if err = couchdb.UpdateDoc(instance, toPatch); err != nil {
 			return err
 		}
+		audit.Log(instance, GetActor(c), audit.PermissionUpdate, config.ClientIP(c.Request()),
+			map[string]string{"permission_id": toPatch.ID()})
 
 		return jsonapi.Data(c, http.StatusOK, &apiPermission{toPatch}, nil)
 	}
@@ -324,6 +324,149 @@ func TestRevoke(t *testing.T) {
 
 }
 
+func TestCreateSharePermissionWithPassword(t *testing.T) {
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=oscar", token, `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"password": "secret",
+		"max_downloads": 3,
+		"permissions": {
+			"whatever": {
+				"type":   "io.cozy.files",
+				"verbs":  ["GET"],
+				"values": ["io.cozy.music"]
+			}
+		}
+	}
+}
+	}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := out["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["password"])
+	assert.Equal(t, float64(3), attrs["max_downloads"])
+	oscarCode := attrs["codes"].(map[string]interface{})["oscar"].(string)
+
+	// The code cannot be used before the password has been checked
+	req, _ := http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+	req.Header.Add("Authorization", "Bearer "+oscarCode)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	pdoc, err := permissions.GetForShareCode(testInstance, oscarCode)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Error(t, pdoc.CheckPassword("wrong"))
+	assert.NoError(t, pdoc.CheckPassword("secret"))
+
+	fingerprint := pdoc.LockFingerprint()
+	unlocked, err := testInstance.MakeJWT(permissions.UnlockedShareAudience, id, fingerprint, time.Now())
+	assert.NoError(t, err)
+	req, _ = http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+	req.Header.Add("Authorization", "Bearer "+unlocked)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// An unlocked token for another password is refused
+	other, err := testInstance.MakeJWT(permissions.UnlockedShareAudience, id, "", time.Now())
+	assert.NoError(t, err)
+	req, _ = http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+	req.Header.Add("Authorization", "Bearer "+other)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// And the unlocked tokens expire
+	old := time.Now().Add(-2 * permissions.UnlockedShareTokenValidity)
+	expired, err := testInstance.MakeJWT(permissions.UnlockedShareAudience, id, fingerprint, old)
+	assert.NoError(t, err)
+	req, _ = http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+	req.Header.Add("Authorization", "Bearer "+expired)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestIsFromBeginning(t *testing.T) {
+	assert.True(t, isFromBeginning(""))
+	assert.True(t, isFromBeginning("bytes=0-"))
+	assert.True(t, isFromBeginning("bytes=0-499"))
+	assert.True(t, isFromBeginning("bytes=-500"))
+	assert.True(t, isFromBeginning("bytes=500-999,0-10"))
+	assert.True(t, isFromBeginning("bytes=foo"))
+	assert.True(t, isFromBeginning("items=500-"))
+	assert.False(t, isFromBeginning("bytes=500-"))
+	assert.False(t, isFromBeginning("bytes=500-999, 2000-2999"))
+}
+
+func TestCreateExpiredSharePermission(t *testing.T) {
+	expiresAt := time.Now().Add(-1 * time.Hour).Unix()
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=paul", token, `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"expires_at": `+fmt.Sprintf("%d", expiresAt)+`,
+		"permissions": {
+			"whatever": {
+				"type":   "io.cozy.files",
+				"verbs":  ["GET"],
+				"values": ["io.cozy.music"]
+			}
+		}
+	}
+}
+	}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs := out["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+	paulCode := attrs["codes"].(map[string]interface{})["paul"].(string)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+	req.Header.Add("Authorization", "Bearer "+paulCode)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `Expired token`, string(body))
+}
+
+func TestParseTTL(t *testing.T) {
+	d, err := parseTTL("2h")
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, d)
+	d, err = parseTTL("7d")
+	assert.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, d)
+	_, err = parseTTL("-1d")
+	assert.Error(t, err)
+	_, err = parseTTL("foo")
+	assert.Error(t, err)
+}
+
 func createTestSubPermissions(tok string, codes string) (string, map[string]interface{}, error) {
 	out, err := doRequest("POST", ts.URL+"/permissions?codes="+codes, tok, `{
 "data": {
@@ -415,8 +558,8 @@ func TestListPermission(t *testing.T) {
 		}}
 
 	codes := map[string]string{"bob": "secret"}
-	permissions.CreateShareSet(testInstance, parent, codes, p1)
-	permissions.CreateShareSet(testInstance, parent, codes, p2)
+	permissions.CreateShareSet(testInstance, parent, codes, p1, nil)
+	permissions.CreateShareSet(testInstance, parent, codes, p2, nil)
 
 	reqbody := strings.NewReader(`{
 "data": [
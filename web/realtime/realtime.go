@@ -0,0 +1,340 @@
+// Package realtime exposes the realtime events of an instance to the clients
+// via a websocket. See docs/realtime.md for the protocol.
+package realtime
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong message from the peer
+	pongWait = 60 * time.Second
+	// Send pings to peer with this period (must be less than pongWait)
+	pingPeriod = (pongWait * 9) / 10
+	// Maximum message size allowed from peer
+	maxMessageSize = 1024
+	// Number of events that can be buffered for a slow client
+	eventsBufferSize = 64
+)
+
+// Protocol is the name of the websocket subprotocol spoken on /realtime
+const Protocol = "io.cozy.websocket"
+
+var upgrader = websocket.Upgrader{
+	// The origin is not checked: the permissions are given by the token
+	CheckOrigin:     func(r *http.Request) bool { return true },
+	Subprotocols:    []string{Protocol},
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+type command struct {
+	Method  string         `json:"method"`
+	Payload commandPayload `json:"payload"`
+}
+
+type commandPayload struct {
+	Type        string `json:"type"`
+	ID          string `json:"id,omitempty"`
+	IncludeDocs bool   `json:"include_docs,omitempty"`
+}
+
+type wsResponse struct {
+	Event   string      `json:"event"`
+	Payload interface{} `json:"payload"`
+}
+
+type wsEventPayload struct {
+	Type string        `json:"type"`
+	ID   string        `json:"id"`
+	Rev  string        `json:"rev,omitempty"`
+	Doc  realtime.Doc  `json:"doc,omitempty"`
+	Old  *wsOldPayload `json:"old,omitempty"`
+}
+
+type wsOldPayload struct {
+	Rev string `json:"rev,omitempty"`
+}
+
+type wsErrorPayload struct {
+	Status string      `json:"status"`
+	Code   string      `json:"code"`
+	Title  string      `json:"title"`
+	Source interface{} `json:"source,omitempty"`
+}
+
+// subscription is the set of selectors asked by the client for a doctype,
+// with the channel of events coming from the hub.
+type subscription struct {
+	channel     realtime.EventChannel
+	wholeType   bool
+	ids         map[string]struct{}
+	includeDocs bool
+}
+
+func (s *subscription) match(e *realtime.Event) bool {
+	if s.wholeType {
+		return true
+	}
+	_, ok := s.ids[e.Doc.ID()]
+	return ok
+}
+
+type client struct {
+	ws       *websocket.Conn
+	domain   string
+	perms    pkgperm.Set
+	appName  string
+	mu       sync.Mutex
+	subs     map[string]*subscription
+	events   chan *realtime.Event
+	errors   chan *wsErrorPayload
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (cl *client) close() {
+	cl.doneOnce.Do(func() { close(cl.done) })
+}
+
+func (cl *client) subscribe(cmd *command) *wsErrorPayload {
+	doctype := cmd.Payload.Type
+	id := cmd.Payload.ID
+	if doctype == "" {
+		return &wsErrorPayload{
+			Status: "400 Bad Request",
+			Code:   "bad_request",
+			Title:  "The payload must have a type",
+			Source: cmd,
+		}
+	}
+
+	var allowed bool
+	if id == "" {
+		allowed = cl.perms.AllowWholeType(pkgperm.GET, doctype)
+	} else {
+		allowed = cl.perms.AllowID(pkgperm.GET, doctype, id)
+	}
+	if !allowed {
+		return &wsErrorPayload{
+			Status: "403 Forbidden",
+			Code:   "forbidden",
+			Title:  cl.appName + " can't subscribe to " + doctype,
+			Source: cmd,
+		}
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	sub, ok := cl.subs[doctype]
+	if !ok {
+		sub = &subscription{
+			channel: realtime.GetHub().Subscribe(cl.domain, doctype),
+			ids:     make(map[string]struct{}),
+		}
+		cl.subs[doctype] = sub
+		go cl.forward(sub.channel)
+	}
+	if id == "" {
+		sub.wholeType = true
+	} else {
+		sub.ids[id] = struct{}{}
+	}
+	if cmd.Payload.IncludeDocs {
+		sub.includeDocs = true
+	}
+	return nil
+}
+
+// forward reads the events from the hub and sends them to the events channel
+// of the client, until the subscription is closed.
+func (cl *client) forward(ch realtime.EventChannel) {
+	for e := range ch.Read() {
+		select {
+		case cl.events <- e:
+		case <-cl.done:
+		}
+	}
+}
+
+func (cl *client) unsubscribeAll() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for doctype, sub := range cl.subs {
+		sub.channel.Close()
+		delete(cl.subs, doctype)
+	}
+}
+
+// payloadFor returns the payload to send to the client for an event, or nil
+// if the client has not subscribed to it.
+func (cl *client) payloadFor(e *realtime.Event) *wsEventPayload {
+	if e.Doc == nil {
+		return nil
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	sub, ok := cl.subs[e.Doc.DocType()]
+	if !ok || !sub.match(e) {
+		return nil
+	}
+	payload := &wsEventPayload{
+		Type: e.Doc.DocType(),
+		ID:   e.Doc.ID(),
+		Rev:  e.Doc.Rev(),
+	}
+	if sub.includeDocs {
+		payload.Doc = e.Doc
+	}
+	if e.OldDoc != nil {
+		payload.Old = &wsOldPayload{Rev: e.OldDoc.Rev()}
+	}
+	return payload
+}
+
+func (cl *client) readPump() {
+	defer cl.close()
+	cl.ws.SetReadLimit(maxMessageSize)
+	cl.ws.SetReadDeadline(time.Now().Add(pongWait))
+	cl.ws.SetPongHandler(func(string) error {
+		return cl.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		var cmd command
+		if err := cl.ws.ReadJSON(&cmd); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				cl.sendError(&wsErrorPayload{
+					Status: "400 Bad Request",
+					Code:   "bad_request",
+					Title:  "The message is not valid JSON",
+				})
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.WithDomain(cl.domain).Infof("[realtime] read error: %s", err)
+			}
+			return
+		}
+		if strings.ToUpper(cmd.Method) != "SUBSCRIBE" {
+			cl.sendError(&wsErrorPayload{
+				Status: "405 Method Not Allowed",
+				Code:   "method_not_allowed",
+				Title:  "The method " + cmd.Method + " is not supported",
+				Source: cmd,
+			})
+			continue
+		}
+		if err := cl.subscribe(&cmd); err != nil {
+			cl.sendError(err)
+		}
+	}
+}
+
+func (cl *client) sendError(e *wsErrorPayload) {
+	select {
+	case cl.errors <- e:
+	case <-cl.done:
+	}
+}
+
+func (cl *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		cl.ws.Close()
+	}()
+	for {
+		var res *wsResponse
+		select {
+		case <-cl.done:
+			cl.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			cl.ws.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case e := <-cl.errors:
+			res = &wsResponse{Event: "error", Payload: e}
+		case e := <-cl.events:
+			payload := cl.payloadFor(e)
+			if payload == nil {
+				continue
+			}
+			res = &wsResponse{Event: e.Type, Payload: payload}
+		case <-ticker.C:
+			cl.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := cl.ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				cl.close()
+				return
+			}
+			continue
+		}
+		cl.ws.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := cl.ws.WriteJSON(res); err != nil {
+			cl.close()
+			return
+		}
+	}
+}
+
+func appName(pdoc *pkgperm.Permission) string {
+	switch pdoc.Type {
+	case pkgperm.TypeWebapp, pkgperm.TypeKonnector:
+		return "Application " + strings.TrimPrefix(pdoc.SourceID, "io.cozy.apps/")
+	case pkgperm.TypeOauth:
+		return "OAuth client " + pdoc.SourceID
+	}
+	return "This token"
+}
+
+// Ws is the API handler for realtime via a websocket connection. The token
+// must be given in the Authorization header or in the bearer_token query
+// parameter, as the permissions are checked before the upgrade.
+func Ws(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return nil // the upgrader has already replied with an HTTP error
+	}
+
+	cl := newClient(ws, i, pdoc)
+	go cl.writePump()
+	cl.readPump()
+	cl.unsubscribeAll()
+	return nil
+}
+
+func newClient(ws *websocket.Conn, i *instance.Instance, pdoc *pkgperm.Permission) *client {
+	return &client{
+		ws:      ws,
+		domain:  i.Domain,
+		perms:   pdoc.Permissions,
+		appName: appName(pdoc),
+		subs:    make(map[string]*subscription),
+		events:  make(chan *realtime.Event, eventsBufferSize),
+		errors:  make(chan *wsErrorPayload),
+		done:    make(chan struct{}),
+	}
+}
+
+// Routes set the routing for the realtime service
+func Routes(router *echo.Group) {
+	router.GET("/", Ws)
+}
@@ -0,0 +1,84 @@
+package realtime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+
+func TestWSNoToken(t *testing.T) {
+	u := strings.Replace(ts.URL+"/realtime/", "http", "ws", 1)
+	_, res, err := websocket.DefaultDialer.Dial(u, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func TestWSSubscribe(t *testing.T) {
+	u := strings.Replace(ts.URL+"/realtime/", "http", "ws", 1)
+	u += "?bearer_token=" + token
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Close()
+
+	err = c.WriteMessage(websocket.TextMessage, []byte(`{"method": "SUBSCRIBE", "payload": {"type": "io.cozy.foos", "include_docs": true}}`))
+	assert.NoError(t, err)
+	err = c.WriteMessage(websocket.TextMessage, []byte(`{"method": "SUBSCRIBE", "payload": {"type": "io.cozy.bars"}}`))
+	assert.NoError(t, err)
+
+	var res map[string]interface{}
+	err = c.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "error", res["event"])
+	payload := res["payload"].(map[string]interface{})
+	assert.Equal(t, "403 Forbidden", payload["status"])
+	assert.Equal(t, "forbidden", payload["code"])
+
+	doc := couchdb.JSONDoc{
+		Type: "io.cozy.foos",
+		M:    map[string]interface{}{"bar": "baz"},
+	}
+	err = couchdb.CreateDoc(testInstance, doc)
+	assert.NoError(t, err)
+
+	err = c.ReadJSON(&res)
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATED", res["event"])
+	payload = res["payload"].(map[string]interface{})
+	assert.Equal(t, "io.cozy.foos", payload["type"])
+	assert.Equal(t, doc.ID(), payload["id"])
+	embedded := payload["doc"].(map[string]interface{})
+	assert.Equal(t, "baz", embedded["bar"])
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "realtime_test")
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient("io.cozy.foos")
+	if err := couchdb.ResetDB(testInstance, "io.cozy.foos"); err != nil {
+		setup.CleanupAndDie("Could not create the io.cozy.foos database", err)
+	}
+	setup.AddCleanup(func() error {
+		return couchdb.DeleteDB(testInstance, "io.cozy.foos")
+	})
+	ts = setup.GetTestServer("/realtime", Routes)
+	os.Exit(setup.Run())
+}
@@ -23,14 +23,18 @@ import (
 	"github.com/cozy/cozy-stack/web/intents"
 	"github.com/cozy/cozy-stack/web/jobs"
 	"github.com/cozy/cozy-stack/web/konnectorsauth"
+	"github.com/cozy/cozy-stack/web/metrics"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/cozy-stack/web/realtime"
 	"github.com/cozy/cozy-stack/web/remote"
+	"github.com/cozy/cozy-stack/web/search"
 	"github.com/cozy/cozy-stack/web/settings"
 	"github.com/cozy/cozy-stack/web/sharings"
 	_ "github.com/cozy/cozy-stack/web/statik" // Generated file with the packed assets
 	"github.com/cozy/cozy-stack/web/status"
 	"github.com/cozy/cozy-stack/web/version"
+	"github.com/cozy/cozy-stack/web/webdav"
 	"github.com/cozy/echo"
 	"github.com/rakyll/statik/fs"
 )
@@ -152,7 +156,8 @@ func SetupRoutes(router *echo.Echo) error {
 		XFrameOptions: middlewares.XFrameDeny,
 	})
 
-	router.Use(secure, middlewares.CORS)
+	router.Pre(webdav.Methods)
+	router.Use(middlewares.Metrics, middlewares.Tracing, secure, middlewares.CORS)
 
 	mws := []echo.MiddlewareFunc{
 		middlewares.NeedInstance,
@@ -165,16 +170,18 @@ func SetupRoutes(router *echo.Echo) error {
 	apps.WebappsRoutes(router.Group("/apps", mws...))
 	apps.KonnectorRoutes(router.Group("/konnectors", mws...))
 	data.Routes(router.Group("/data", mws...))
-	if config.IsDevRelease() {
-		imexport.Routes(router.Group("/export", mws...))
-	}
+	imexport.ExportRoutes(router.Group("/export", mws...))
 	files.Routes(router.Group("/files", mws...))
+	imexport.ImportRoutes(router.Group("/import", mws...))
 	intents.Routes(router.Group("/intents", mws...))
 	jobs.Routes(router.Group("/jobs", mws...))
 	permissions.Routes(router.Group("/permissions", mws...))
+	realtime.Routes(router.Group("/realtime", mws...))
 	remote.Routes(router.Group("/remote", mws...))
+	search.Routes(router.Group("/search", mws...))
 	settings.Routes(router.Group("/settings", mws...))
 	sharings.Routes(router.Group("/sharings", mws...))
+	webdav.Routes(router.Group(webdav.Prefix, mws...))
 	status.Routes(router.Group("/status"))
 	version.Routes(router.Group("/version"))
 
@@ -191,6 +198,8 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	}
 
 	instances.Routes(router.Group("/instances"))
+	jobs.AdminRoutes(router.Group("/jobs"))
+	metrics.Routes(router.Group("/metrics"))
 	version.Routes(router.Group("/version"))
 
 	setupRecover(router)
@@ -214,6 +223,7 @@ func CreateSubdomainProxy(router *echo.Echo, serveApps echo.HandlerFunc) (*echo.
 	serveApps = SetupAppsHandler(serveApps)
 
 	main := echo.New()
+	main.Pre(webdav.Methods)
 	main.Any("/*", func(c echo.Context) error {
 		// TODO(optim): minimize the number of instance requests
 		if parent, slug, _ := middlewares.SplitHost(c.Request().Host); slug != "" {
@@ -0,0 +1,175 @@
+// Package search is the HTTP routes for the full-text search
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/data"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const (
+	defaultLimit = 30
+	maxLimit     = 100
+)
+
+// apiResult is a document found by the search: a file, a directory, or a
+// document of another doctype.
+type apiResult struct {
+	couchdb.Doc
+}
+
+func (r *apiResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Doc)
+}
+
+// Links is used to generate a JSON-API link for the document
+func (r *apiResult) Links() *jsonapi.LinksList {
+	if r.DocType() == consts.Files {
+		return &jsonapi.LinksList{Self: "/files/" + r.ID()}
+	}
+	return &jsonapi.LinksList{Self: "/data/" + r.DocType() + "/" + r.ID()}
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (r *apiResult) Relationships() jsonapi.RelationshipMap {
+	return nil
+}
+
+// Included is part of the jsonapi.Object interface
+func (r *apiResult) Included() []jsonapi.Object {
+	return nil
+}
+
+func searchHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return jsonapi.InvalidParameter("q", errors.New("The query is empty"))
+	}
+	limit := defaultLimit
+	if param := c.QueryParam("page[limit]"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			return jsonapi.InvalidParameter("page[limit]", errors.New("Invalid limit"))
+		}
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+	}
+
+	// The documents are loaded to check the permissions, and kept for the
+	// response.
+	fs := instance.VFS()
+	docs := make(map[string]couchdb.Doc)
+	filter := func(hits []search.Hit) []search.Hit {
+		loadDocs(instance, hits, docs)
+		var allowed []search.Hit
+		for _, hit := range hits {
+			doc, ok := docs[hit.DocType+"/"+hit.ID]
+			if ok && allows(fs, pdoc.Permissions, hit.DocType, doc) {
+				allowed = append(allowed, hit)
+			}
+		}
+		return allowed
+	}
+
+	hits, err := search.Search(instance.Domain, &search.Query{
+		Q:       q,
+		DocType: c.QueryParam("doctype"),
+		Limit:   limit,
+		Filter:  filter,
+	})
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(hits))
+	for i, hit := range hits {
+		objs[i] = &apiResult{docs[hit.DocType+"/"+hit.ID]}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// loadDocs loads the documents of a batch of hits, with one request by
+// doctype, in docs. The documents that can't be loaded are skipped.
+func loadDocs(db couchdb.Database, hits []search.Hit, docs map[string]couchdb.Doc) {
+	ids := make(map[string][]string)
+	for _, hit := range hits {
+		if _, ok := docs[hit.DocType+"/"+hit.ID]; !ok {
+			ids[hit.DocType] = append(ids[hit.DocType], hit.ID)
+		}
+	}
+	for doctype, keys := range ids {
+		req := &couchdb.AllDocsRequest{Keys: keys}
+		if doctype == consts.Files {
+			var results []*vfs.DirOrFileDoc
+			if err := couchdb.GetAllDocs(db, doctype, req, &results); err != nil {
+				continue
+			}
+			for _, result := range results {
+				if result == nil || result.DirDoc == nil {
+					continue
+				}
+				if dir, file := result.Refine(); dir != nil {
+					docs[doctype+"/"+dir.ID()] = dir
+				} else if file != nil {
+					docs[doctype+"/"+file.ID()] = file
+				}
+			}
+			continue
+		}
+		if data.CheckReadable(doctype) != nil {
+			continue
+		}
+		var results []*couchdb.JSONDoc
+		if err := couchdb.GetAllDocs(db, doctype, req, &results); err != nil {
+			continue
+		}
+		for _, doc := range results {
+			if doc != nil {
+				doc.Type = doctype
+				docs[doctype+"/"+doc.ID()] = doc
+			}
+		}
+	}
+}
+
+// allows returns true if the permissions allow to read the document. The
+// document is not checked if the whole doctype can be read.
+func allows(fs vfs.VFS, perms pkgperm.Set, doctype string, doc couchdb.Doc) bool {
+	if perms.AllowWholeType(pkgperm.GET, doctype) {
+		return true
+	}
+	switch doc := doc.(type) {
+	case *vfs.DirDoc:
+		return vfs.Allows(fs, perms, pkgperm.GET, doc) == nil
+	case *vfs.FileDoc:
+		return vfs.Allows(fs, perms, pkgperm.GET, doc) == nil
+	case *couchdb.JSONDoc:
+		return perms.Allow(pkgperm.GET, doc)
+	}
+	return false
+}
+
+// Routes sets the routing for the search service
+func Routes(router *echo.Group) {
+	router.GET("", searchHandler)
+	router.GET("/", searchHandler)
+}
@@ -0,0 +1,67 @@
+package settings
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const defaultAuditPageLimit = 50
+
+type apiAuditEntry struct {
+	*audit.Entry
+}
+
+// Links is part of the jsonapi.Object interface. The entries have no route of
+// their own.
+func (e *apiAuditEntry) Links() *jsonapi.LinksList {
+	return nil
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (e *apiAuditEntry) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{}
+}
+
+// Included is part of the jsonapi.Object interface
+func (e *apiAuditEntry) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+func listAuditEntries(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.Audit); err != nil {
+		return err
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, defaultAuditPageLimit)
+	if err != nil {
+		return err
+	}
+
+	entries, err := audit.List(instance, cursor)
+	if err != nil {
+		return err
+	}
+
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		links.Next = "/settings/audit?" + params.Encode()
+	}
+
+	objs := make([]jsonapi.Object, len(entries))
+	for i, e := range entries {
+		objs[i] = jsonapi.Object(&apiAuditEntry{e})
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
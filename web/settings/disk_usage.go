@@ -5,6 +5,7 @@ package settings
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -15,8 +16,11 @@ import (
 )
 
 type apiDiskUsage struct {
-	Used  int64 `json:"used,string"`
-	Quota int64 `json:"quota,string,omitempty"`
+	Used     int64             `json:"used,string"`
+	Quota    int64             `json:"quota,string,omitempty"`
+	ByClass  map[string]string `json:"by_class"`
+	Trash    int64             `json:"trash,string"`
+	Versions int64             `json:"versions,string"`
 }
 
 func (j *apiDiskUsage) ID() string                             { return consts.DiskUsageID }
@@ -54,7 +58,20 @@ func diskUsage(c echo.Context) error {
 
 	quota := fs.DiskQuota()
 
+	details, err := fs.DiskUsageDetails()
+	if err != nil {
+		return err
+	}
+	// The sizes are serialized as strings, like the used and quota fields
+	byClass := make(map[string]string, len(details.ByClass))
+	for class, size := range details.ByClass {
+		byClass[class] = strconv.FormatInt(size, 10)
+	}
+
 	result.Used = used
 	result.Quota = quota
+	result.ByClass = byClass
+	result.Trash = details.Trash
+	result.Versions = details.Versions
 	return jsonapi.Data(c, http.StatusOK, &result, nil)
 }
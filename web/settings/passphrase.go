@@ -7,9 +7,12 @@ import (
 	"encoding/hex"
 	"net/http"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/web/auth"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/echo"
 )
 
@@ -33,8 +36,10 @@ func registerPassphrase(c echo.Context) error {
 	if err := instance.RegisterPassphrase(passphrase, registerToken); err != nil {
 		return jsonapi.BadRequest(err)
 	}
+	audit.Log(instance, audit.Actor{Type: audit.ActorAnonymous}, audit.PassphraseChange,
+		config.ClientIP(c.Request()), map[string]string{"method": "register"})
 
-	if _, err := auth.SetCookieForNewSession(c); err != nil {
+	if _, err := auth.SetCookieForNewSession(c, false); err != nil {
 		return err
 	}
 	return c.NoContent(http.StatusNoContent)
@@ -53,11 +58,16 @@ func updatePassphrase(c echo.Context) error {
 
 	newPassphrase := []byte(args.Passphrase)
 	currentPassphrase := []byte(args.Current)
+	actor := permissions.GetActor(c)
 	if err := instance.UpdatePassphrase(newPassphrase, currentPassphrase); err != nil {
 		return jsonapi.BadRequest(err)
 	}
+	audit.Log(instance, actor, audit.PassphraseChange, config.ClientIP(c.Request()),
+		map[string]string{"method": "update"})
 
-	if _, err := auth.SetCookieForNewSession(c); err != nil {
+	// The new session has been opened with the second factor only if the
+	// request comes from a valid session
+	if _, err := auth.SetCookieForNewSession(c, middlewares.IsLoggedIn(c)); err != nil {
 		return err
 	}
 	return c.NoContent(http.StatusNoContent)
@@ -0,0 +1,114 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiSession struct {
+	*sessions.Session
+	current bool
+}
+
+func (s *apiSession) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*sessions.Session
+		Current bool `json:"current"`
+	}{s.Session, s.current})
+}
+
+// Links is used to generate a JSON-API link for the session - see
+// jsonapi.Object interface
+func (s *apiSession) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/sessions/" + s.ID()}
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (s *apiSession) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{}
+}
+
+// Included is part of the jsonapi.Object interface
+func (s *apiSession) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+// currentSessionID returns the identifier of the session of the request, or
+// an empty string if the request has no session
+func currentSessionID(c echo.Context) string {
+	instance := middlewares.GetInstance(c)
+	if session, err := sessions.GetSession(c, instance); err == nil {
+		return session.ID()
+	}
+	return ""
+}
+
+func listSessions(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	if err := permissions.AllowWholeType(c, permissions.GET, consts.Sessions); err != nil {
+		return err
+	}
+
+	list, err := sessions.GetAll(instance)
+	if err != nil {
+		return err
+	}
+
+	current := currentSessionID(c)
+	objs := make([]jsonapi.Object, len(list))
+	for i, s := range list {
+		objs[i] = jsonapi.Object(&apiSession{s, s.ID() == current})
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func revokeSession(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	if err := permissions.AllowWholeType(c, permissions.DELETE, consts.Sessions); err != nil {
+		return err
+	}
+
+	session, err := sessions.Get(instance, c.Param("id"))
+	if err == sessions.ErrInvalidID {
+		return jsonapi.NotFound(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	current := currentSessionID(c)
+	cookie := session.Delete(instance)
+	if session.ID() == current {
+		c.SetCookie(cookie)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func revokeOtherSessions(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	if err := permissions.AllowWholeType(c, permissions.DELETE, consts.Sessions); err != nil {
+		return err
+	}
+
+	// Without a current session, like for a request with only a token, all
+	// the sessions would be revoked, including the one of the user.
+	current := currentSessionID(c)
+	if current == "" {
+		return jsonapi.BadRequest(errors.New("No current session"))
+	}
+	if err := sessions.DeleteOthers(instance, current); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -13,9 +13,20 @@ func Routes(router *echo.Group) {
 	router.POST("/passphrase", registerPassphrase)
 	router.PUT("/passphrase", updatePassphrase)
 
+	router.GET("/two-factor", getTwoFactor)
+	router.POST("/two-factor/enrol", enrolTwoFactor)
+	router.POST("/two-factor/confirm", confirmTwoFactor)
+	router.POST("/two-factor/disable", disableTwoFactor)
+
 	router.GET("/instance", getInstance)
 	router.PUT("/instance", updateInstance)
 
+	router.GET("/sessions", listSessions)
+	router.DELETE("/sessions", revokeOtherSessions)
+	router.DELETE("/sessions/:id", revokeSession)
+
+	router.GET("/audit", listAuditEntries)
+
 	router.GET("/clients", listClients)
 	router.DELETE("/clients/:id", revokeClient)
 
@@ -10,6 +10,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
@@ -17,6 +18,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/tests/testutils"
 	"github.com/cozy/echo"
 	"github.com/stretchr/testify/assert"
@@ -27,6 +29,7 @@ var testInstance *instance.Instance
 var instanceRev string
 var token string
 var oauthClientID string
+var sessionID string
 
 func TestThemeCSS(t *testing.T) {
 	res, err := http.Get(ts.URL + "/settings/theme.css")
@@ -60,6 +63,54 @@ func TestDiskUsage(t *testing.T) {
 	assert.Equal(t, "0", used)
 }
 
+func createFile(t *testing.T, name, mime, class, content string) *vfs.FileDoc {
+	fs := testInstance.VFS()
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)), nil, mime, class, time.Now(), false, false, nil)
+	assert.NoError(t, err)
+	file, err := fs.CreateFile(doc, nil)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	return doc
+}
+
+func TestDiskUsageDetails(t *testing.T) {
+	fs := testInstance.VFS()
+	photo := createFile(t, "photo.jpg", "image/jpeg", "image", "JPEG")
+	note := createFile(t, "note.txt", "text/plain", "text", "foo")
+	note, err := vfs.TrashFile(fs, note)
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, fs.DestroyFile(photo))
+		assert.NoError(t, fs.DestroyFile(note))
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/settings/disk-usage", nil)
+	req.Header.Add("Authorization", "Bearer "+token)
+	assert.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result struct {
+		Data struct {
+			Attributes struct {
+				Used     string            `json:"used"`
+				ByClass  map[string]string `json:"by_class"`
+				Trash    string            `json:"trash"`
+				Versions string            `json:"versions"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	attrs := result.Data.Attributes
+	assert.Equal(t, "7", attrs.Used)
+	assert.Equal(t, map[string]string{"image": "4"}, attrs.ByClass)
+	assert.Equal(t, "3", attrs.Trash)
+	assert.Equal(t, "0", attrs.Versions)
+}
+
 func TestRegisterPassphraseWrongToken(t *testing.T) {
 	args, _ := json.Marshal(&echo.Map{
 		"passphrase":     "MyFirstPassphrase",
@@ -301,6 +352,139 @@ func TestRevokeClient(t *testing.T) {
 	assert.Len(t, data, 1)
 }
 
+func TestListSessions(t *testing.T) {
+	res, err := http.Get(ts.URL + "/settings/sessions")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	r, _ := http.NewRequest(http.MethodPost, "https://"+testInstance.Domain+"/auth/login", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/55.0")
+	r.RemoteAddr = "192.0.2.1:4242"
+	session, err := sessions.New(testInstance, r, false)
+	assert.NoError(t, err)
+	sessionID = session.ID()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/settings/sessions", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	var found map[string]interface{}
+	for _, d := range data {
+		obj := d.(map[string]interface{})
+		assert.Equal(t, "io.cozy.sessions", obj["type"].(string))
+		if obj["id"].(string) == sessionID {
+			found = obj
+		}
+	}
+	if !assert.NotNil(t, found) {
+		return
+	}
+	links := found["links"].(map[string]interface{})
+	assert.Equal(t, "/settings/sessions/"+sessionID, links["self"].(string))
+	attrs := found["attributes"].(map[string]interface{})
+	assert.Equal(t, "Mozilla/5.0 (X11; Linux x86_64) Firefox/55.0", attrs["user_agent"].(string))
+	assert.Equal(t, "192.0.2.1", attrs["ip"].(string))
+	assert.NotEmpty(t, attrs["created_at"])
+	assert.Equal(t, false, attrs["current"])
+}
+
+func TestRevokeSession(t *testing.T) {
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/settings/sessions/"+sessionID, nil)
+	assert.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/settings/sessions/"+sessionID, nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, res.StatusCode)
+
+	_, err = sessions.Get(testInstance, sessionID)
+	assert.Equal(t, sessions.ErrInvalidID, err)
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/settings/sessions/"+sessionID, nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	_, err := sessions.New(testInstance, nil, false)
+	assert.NoError(t, err)
+	current, err := sessions.New(testInstance, nil, false)
+	assert.NoError(t, err)
+	cookie, err := current.ToCookie()
+	assert.NoError(t, err)
+	before, err := sessions.GetAll(testInstance)
+	assert.NoError(t, err)
+
+	// The sessions are kept if the request has no current session
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/settings/sessions", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+
+	list, err := sessions.GetAll(testInstance)
+	assert.NoError(t, err)
+	assert.Len(t, list, len(before))
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/settings/sessions", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, res.StatusCode)
+
+	list, err = sessions.GetAll(testInstance)
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, current.ID(), list[0].ID())
+	}
+}
+
+func TestListAuditEntries(t *testing.T) {
+	res, err := http.Get(ts.URL + "/settings/audit")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/settings/audit?page[limit]=1", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	if !assert.Len(t, data, 1) {
+		return
+	}
+	// The passphrase has been registered, then updated, by the previous tests
+	obj := data[0].(map[string]interface{})
+	assert.Equal(t, consts.Audit, obj["type"].(string))
+	attrs := obj["attributes"].(map[string]interface{})
+	assert.Equal(t, "passphrase.change", attrs["action"])
+	details := attrs["details"].(map[string]interface{})
+	assert.Equal(t, "update", details["method"])
+	links := result["links"].(map[string]interface{})
+	assert.Contains(t, links["next"], "/settings/audit?")
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -313,7 +497,7 @@ func TestMain(m *testing.M) {
 		Locale:   "en",
 		Settings: settings,
 	})
-	scope := consts.Settings + " " + consts.OAuthClients
+	scope := consts.Settings + " " + consts.OAuthClients + " " + consts.Sessions + " " + consts.Audit
 	_, token = setup.GetTestClient(scope)
 
 	ts = setup.GetTestServer("/settings", Routes)
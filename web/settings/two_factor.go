@@ -0,0 +1,134 @@
+package settings
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiTwoFactor struct {
+	Enabled           bool     `json:"enabled"`
+	RecoveryCodesLeft int      `json:"recovery_codes_left"`
+	Secret            string   `json:"secret,omitempty"`
+	URI               string   `json:"uri,omitempty"`
+	RecoveryCodes     []string `json:"recovery_codes,omitempty"`
+}
+
+func (t *apiTwoFactor) ID() string                             { return consts.TwoFactorID }
+func (t *apiTwoFactor) Rev() string                            { return "" }
+func (t *apiTwoFactor) DocType() string                        { return consts.Settings }
+func (t *apiTwoFactor) Clone() couchdb.Doc                     { return t }
+func (t *apiTwoFactor) SetID(_ string)                         {}
+func (t *apiTwoFactor) SetRev(_ string)                        {}
+func (t *apiTwoFactor) Relationships() jsonapi.RelationshipMap { return nil }
+func (t *apiTwoFactor) Included() []jsonapi.Object             { return nil }
+func (t *apiTwoFactor) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/two-factor"}
+}
+
+// Settings objects permissions are only on ID
+func (t *apiTwoFactor) Valid(k, f string) bool { return false }
+
+func newAPITwoFactor(i *instance.Instance) *apiTwoFactor {
+	return &apiTwoFactor{
+		Enabled:           i.HasTwoFactor(),
+		RecoveryCodesLeft: len(i.RecoveryCodes),
+	}
+}
+
+func getTwoFactor(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	result := newAPITwoFactor(inst)
+	if err := permissions.Allow(c, permissions.GET, result); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, result, nil)
+}
+
+func enrolTwoFactor(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := permissions.Allow(c, permissions.PUT, &apiTwoFactor{}); err != nil {
+		return err
+	}
+	uri, err := inst.StartTwoFactor()
+	if err != nil {
+		return wrapTwoFactorError(err)
+	}
+	result := newAPITwoFactor(inst)
+	result.Secret = crypto.EncodeTOTPSecret(inst.TwoFactorPendingSecret)
+	result.URI = uri
+	return jsonapi.Data(c, http.StatusOK, result, nil)
+}
+
+func confirmTwoFactor(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := permissions.Allow(c, permissions.PUT, &apiTwoFactor{}); err != nil {
+		return err
+	}
+
+	args := &struct {
+		Passcode string `json:"passcode"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return err
+	}
+
+	codes, err := inst.ConfirmTwoFactor(args.Passcode)
+	if err != nil {
+		return wrapTwoFactorError(err)
+	}
+
+	// The user has just proved that they have the second factor, so the
+	// current session is kept valid
+	if session, err := sessions.GetSession(c, inst); err == nil {
+		session.TwoFactor = true
+		if err = couchdb.UpdateDoc(inst, session); err != nil {
+			return err
+		}
+	}
+
+	result := newAPITwoFactor(inst)
+	result.RecoveryCodes = codes
+	return jsonapi.Data(c, http.StatusOK, result, nil)
+}
+
+func disableTwoFactor(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	if err := permissions.Allow(c, permissions.PUT, &apiTwoFactor{}); err != nil {
+		return err
+	}
+
+	args := &struct {
+		Passphrase string `json:"passphrase"`
+		Passcode   string `json:"passcode"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return err
+	}
+
+	if err := inst.DisableTwoFactor([]byte(args.Passphrase), args.Passcode); err != nil {
+		return wrapTwoFactorError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, newAPITwoFactor(inst), nil)
+}
+
+func wrapTwoFactorError(err error) error {
+	switch err {
+	case instance.ErrInvalidPassphrase,
+		instance.ErrInvalidPasscode:
+		return jsonapi.BadRequest(err)
+	case instance.ErrTwoFactorEnabled,
+		instance.ErrTwoFactorDisabled,
+		instance.ErrTwoFactorNotStarted:
+		return jsonapi.Conflict(err)
+	}
+	return err
+}
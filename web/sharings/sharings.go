@@ -5,12 +5,15 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/sharings"
 	"github.com/cozy/cozy-stack/web/data"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/cozy/echo"
 )
 
@@ -154,6 +157,11 @@ func CreateSharing(c echo.Context) error {
 	if err != nil {
 		return wrapErrors(err)
 	}
+	audit.Log(instance, permissions.GetActor(c), audit.SharingCreation, config.ClientIP(c.Request()),
+		map[string]string{
+			"sharing_id":   sharing.SharingID,
+			"sharing_type": sharing.SharingType,
+		})
 
 	err = sharings.SendSharingMails(instance, sharing)
 	if err != nil {
@@ -429,6 +437,8 @@ func revokeSharing(c echo.Context) error {
 	if err != nil {
 		return wrapErrors(err)
 	}
+	audit.Log(instance, permissions.GetActor(c), audit.SharingRevocation, config.ClientIP(c.Request()),
+		map[string]string{"sharing_id": sharing.SharingID})
 
 	return c.JSON(http.StatusOK, nil)
 }
@@ -447,6 +457,11 @@ func revokeRecipient(c echo.Context) error {
 	if err != nil {
 		return wrapErrors(err)
 	}
+	audit.Log(ins, permissions.GetActor(c), audit.SharingRevocation, config.ClientIP(c.Request()),
+		map[string]string{
+			"sharing_id": sharing.SharingID,
+			"client_id":  c.Param("recipient-client-id"),
+		})
 
 	return c.NoContent(http.StatusOK)
 }
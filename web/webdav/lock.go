@@ -0,0 +1,367 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// defaultLockTimeout is the duration of a lock when the client has not asked
+// for a specific timeout
+const defaultLockTimeout = 1 * time.Hour
+
+// maxLockTimeout is the maximal duration of a lock
+const maxLockTimeout = 24 * time.Hour
+
+// davLock is a write lock on a resource. Only the exclusive write locks are
+// supported.
+type davLock struct {
+	token    string
+	root     string
+	infinite bool
+	owner    string
+	expires  time.Time
+}
+
+// covers returns true if the lock applies to the resource with the given
+// path.
+func (l *davLock) covers(name string) bool {
+	if l.root == name {
+		return true
+	}
+	return l.infinite && isDescendant(name, l.root)
+}
+
+func (l *davLock) xml() string {
+	depth := "0"
+	if l.infinite {
+		depth = "infinity"
+	}
+	timeout := int(l.expires.Sub(time.Now()).Seconds())
+	if timeout < 0 {
+		timeout = 0
+	}
+	return "<D:activelock>" +
+		"<D:locktype><D:write/></D:locktype>" +
+		"<D:lockscope><D:exclusive/></D:lockscope>" +
+		"<D:depth>" + depth + "</D:depth>" +
+		"<D:owner>" + l.owner + "</D:owner>" +
+		"<D:timeout>Second-" + strconv.Itoa(timeout) + "</D:timeout>" +
+		"<D:locktoken><D:href>" + escapeXML(l.token) + "</D:href></D:locktoken>" +
+		"<D:lockroot><D:href>" + escapeXML(href(l.root, false)) + "</D:href></D:lockroot>" +
+		"</D:activelock>"
+}
+
+func isDescendant(name, ancestor string) bool {
+	if ancestor == "/" {
+		return name != "/"
+	}
+	return strings.HasPrefix(name, ancestor+"/")
+}
+
+// lockSystem keeps the WebDAV locks in memory, indexed by instance domain and
+// then by token. The locks are not shared between the cozy-stack processes:
+// with several processes, the WebDAV clients should be sent to the same one.
+type lockSystem struct {
+	mu    sync.Mutex
+	locks map[string]map[string]*davLock
+}
+
+var locks = &lockSystem{locks: make(map[string]map[string]*davLock)}
+
+var errLocked = echo.NewHTTPError(http.StatusLocked, "The resource is locked")
+
+// forDomain returns the unexpired locks of an instance. It must be called
+// with the mutex held.
+func (ls *lockSystem) forDomain(domain string) map[string]*davLock {
+	m, ok := ls.locks[domain]
+	if !ok {
+		m = make(map[string]*davLock)
+		ls.locks[domain] = m
+	}
+	now := time.Now()
+	for token, l := range m {
+		if l.expires.Before(now) {
+			delete(m, token)
+		}
+	}
+	return m
+}
+
+// conflicts returns the locks that forbid to modify the resource with the
+// given path: the locks on it, on one of its ancestors with an infinite
+// depth, or on one of its descendants.
+func (ls *lockSystem) conflicts(domain, name string) []*davLock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var conflicts []*davLock
+	for _, l := range ls.forDomain(domain) {
+		if l.covers(name) || isDescendant(l.root, name) {
+			conflicts = append(conflicts, l)
+		}
+	}
+	return conflicts
+}
+
+// discovery returns the lockdiscovery property of a resource
+func (ls *lockSystem) discovery(domain, name string) string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var discovery string
+	for _, l := range ls.forDomain(domain) {
+		if l.covers(name) {
+			discovery += l.xml()
+		}
+	}
+	return discovery
+}
+
+func (ls *lockSystem) create(domain string, l *davLock) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	m := ls.forDomain(domain)
+	for _, other := range m {
+		if other.covers(l.root) || (l.infinite && isDescendant(other.root, l.root)) {
+			return errLocked
+		}
+	}
+	l.token = "opaquelocktoken:" + utils.RandomString(32)
+	m[l.token] = l
+	return nil
+}
+
+// refresh extends the duration of a lock on the given resource, identified
+// by one of the tokens.
+func (ls *lockSystem) refresh(domain, name string, tokens []string, timeout time.Duration) *davLock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	m := ls.forDomain(domain)
+	for _, token := range tokens {
+		if l, ok := m[token]; ok && l.covers(name) {
+			l.expires = time.Now().Add(timeout)
+			return l
+		}
+	}
+	return nil
+}
+
+func (ls *lockSystem) remove(domain, name, token string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	m := ls.forDomain(domain)
+	if l, ok := m[token]; ok && l.covers(name) {
+		delete(m, token)
+		return true
+	}
+	return false
+}
+
+// removeAll removes the locks on a resource and its descendants, when it has
+// been deleted or moved.
+func (ls *lockSystem) removeAll(domain, name string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	m := ls.forDomain(domain)
+	for token, l := range m {
+		if l.root == name || isDescendant(l.root, name) {
+			delete(m, token)
+		}
+	}
+}
+
+var tokenRegexp = regexp.MustCompile(`<(opaquelocktoken:[^>]+)>`)
+
+// submittedTokens returns the lock tokens sent by the client in the If
+// header. The conditions of this header are not evaluated, the tokens are
+// only used to check that the client owns the locks.
+func submittedTokens(req *http.Request) []string {
+	var tokens []string
+	for _, match := range tokenRegexp.FindAllStringSubmatch(req.Header.Get("If"), -1) {
+		tokens = append(tokens, match[1])
+	}
+	return tokens
+}
+
+// checkLocks returns a 423 Locked error if one of the resources is locked and
+// its lock token has not been submitted in the If header.
+func checkLocks(c echo.Context, names ...string) error {
+	domain := middlewares.GetInstance(c).Domain
+	tokens := submittedTokens(c.Request())
+	for _, name := range names {
+		for _, l := range locks.conflicts(domain, name) {
+			if !containsToken(tokens, l.token) {
+				return errLocked
+			}
+		}
+	}
+	return nil
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeout parses the Timeout header, like "Second-3600" or "Infinite".
+func parseTimeout(header string) time.Duration {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "Infinite" {
+			return maxLockTimeout
+		}
+		if strings.HasPrefix(value, "Second-") {
+			seconds, err := strconv.Atoi(strings.TrimPrefix(value, "Second-"))
+			if err != nil || seconds <= 0 {
+				continue
+			}
+			timeout := time.Duration(seconds) * time.Second
+			if timeout > maxLockTimeout {
+				timeout = maxLockTimeout
+			}
+			return timeout
+		}
+	}
+	return defaultLockTimeout
+}
+
+// lockInfo is the body of a LOCK request
+type lockInfo struct {
+	XMLName   xml.Name  `xml:"DAV: lockinfo"`
+	Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+	Shared    *struct{} `xml:"DAV: lockscope>shared"`
+	Write     *struct{} `xml:"DAV: locktype>write"`
+	Owner     struct {
+		InnerXML string `xml:",innerxml"`
+	} `xml:"DAV: owner"`
+}
+
+func lock(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	fs := i.VFS()
+	name := davPath(c)
+	if name == "/" || inTrash(name) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	timeout := parseTimeout(c.Request().Header.Get("Timeout"))
+
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, 64*1024))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// A LOCK request without a body is used to refresh a lock
+	if len(body) == 0 {
+		l := locks.refresh(i.Domain, name, submittedTokens(c.Request()), timeout)
+		if l == nil {
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "No lock to refresh")
+		}
+		return writeLockDiscovery(c, http.StatusOK, l)
+	}
+
+	var info lockInfo
+	if err = xml.Unmarshal(body, &info); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if info.Shared != nil || info.Write == nil {
+		return echo.NewHTTPError(http.StatusNotImplemented, "Only the exclusive write locks are supported")
+	}
+
+	dir, file, err := fs.DirOrFileByPath(name)
+	if err != nil && !os.IsNotExist(err) {
+		return wrapVfsError(err)
+	}
+	created := dir == nil && file == nil
+	if created {
+		// Locking an unmapped URL creates an empty resource
+		parent, err := fs.DirByPath(path.Dir(name))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusConflict, "The parent collection does not exist")
+		}
+		if err = checkLocks(c, name); err != nil {
+			return err
+		}
+		mime, class := vfs.ExtractMimeAndClassFromFilename(path.Base(name))
+		file, err = vfs.NewFileDoc(path.Base(name), parent.ID(), 0, nil, mime, class,
+			time.Now(), false, false, nil)
+		if err != nil {
+			return wrapVfsError(err)
+		}
+		if err = allow(c, permissions.POST, file); err != nil {
+			return err
+		}
+	} else if err = allow(c, permissions.PUT, validable(dir, file)); err != nil {
+		return err
+	}
+
+	l := &davLock{
+		root:     name,
+		infinite: c.Request().Header.Get("Depth") != "0",
+		owner:    info.Owner.InnerXML,
+		expires:  time.Now().Add(timeout),
+	}
+	if err = locks.create(i.Domain, l); err != nil {
+		return err
+	}
+
+	status := http.StatusOK
+	if created {
+		f, err := fs.CreateFile(file, nil)
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			locks.remove(i.Domain, name, l.token)
+			return wrapVfsError(err)
+		}
+		status = http.StatusCreated
+	}
+	return writeLockDiscovery(c, status, l)
+}
+
+func writeLockDiscovery(c echo.Context, status int, l *davLock) error {
+	c.Response().Header().Set("Lock-Token", "<"+l.token+">")
+	body := xml.Header + `<D:prop xmlns:D="DAV:"><D:lockdiscovery>` +
+		l.xml() + `</D:lockdiscovery></D:prop>`
+	return c.Blob(status, "application/xml; charset=utf-8", []byte(body))
+}
+
+func unlock(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	name := davPath(c)
+	token := strings.TrimSpace(c.Request().Header.Get("Lock-Token"))
+	token = strings.TrimSuffix(strings.TrimPrefix(token, "<"), ">")
+	if token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing Lock-Token header")
+	}
+
+	dir, file, err := i.VFS().DirOrFileByPath(name)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = allow(c, permissions.PUT, validable(dir, file)); err != nil {
+		return err
+	}
+
+	if !locks.remove(i.Domain, name, token) {
+		return echo.NewHTTPError(http.StatusConflict, "The lock token does not match the resource")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,302 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// property is a WebDAV property, with its name and its value as raw XML
+type property struct {
+	XMLName  xml.Name
+	InnerXML string `xml:",innerxml"`
+}
+
+type propstat struct {
+	Props  []property `xml:"D:prop>_ignored_"`
+	Status string     `xml:"D:status"`
+}
+
+type response struct {
+	XMLName   xml.Name   `xml:"D:response"`
+	Href      string     `xml:"D:href"`
+	Propstats []propstat `xml:"D:propstat"`
+}
+
+type multistatus struct {
+	XMLName   xml.Name    `xml:"D:multistatus"`
+	XMLNS     string      `xml:"xmlns:D,attr"`
+	Responses []*response `xml:"D:response"`
+}
+
+// propfindRequest is the body of a PROPFIND request
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	AllProp  *struct{} `xml:"DAV: allprop"`
+	PropName *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Props []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// proppatchRequest is the body of a PROPPATCH request
+type proppatchRequest struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Items   []struct {
+		Props []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:",any"`
+}
+
+// davProps are the live properties that are computed from the VFS
+var davProps = []string{
+	"displayname",
+	"resourcetype",
+	"creationdate",
+	"getlastmodified",
+	"getcontentlength",
+	"getcontenttype",
+	"getetag",
+	"supportedlock",
+	"lockdiscovery",
+}
+
+func statusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// davProperty returns a property in the DAV: namespace. As encoding/xml does
+// not handle well the namespace prefixes, the name is prefixed manually.
+func davProperty(name, value string) property {
+	return property{XMLName: xml.Name{Local: "D:" + name}, InnerXML: value}
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	if err := xml.EscapeText(&buf, []byte(s)); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+func writeMultistatus(c echo.Context, responses []*response) error {
+	ms := &multistatus{XMLNS: "DAV:", Responses: responses}
+	body, err := xml.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/xml; charset=utf-8")
+	c.Response().WriteHeader(http.StatusMultiStatus)
+	if _, err = io.WriteString(c.Response(), xml.Header); err != nil {
+		return err
+	}
+	_, err = c.Response().Write(body)
+	return err
+}
+
+// parsePropfind returns the names of the requested properties, or nil for
+// all the properties. An empty body is equivalent to allprop.
+func parsePropfind(r io.Reader) (names []xml.Name, propname bool, err error) {
+	var req propfindRequest
+	err = xml.NewDecoder(r).Decode(&req)
+	if err == io.EOF {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if req.PropName != nil {
+		return nil, true, nil
+	}
+	if req.Prop != nil {
+		for _, p := range req.Prop.Props {
+			names = append(names, p.XMLName)
+		}
+	}
+	return names, false, nil
+}
+
+func parseProppatch(r io.Reader) ([]property, error) {
+	var req proppatchRequest
+	if err := xml.NewDecoder(r).Decode(&req); err != nil {
+		return nil, err
+	}
+	var props []property
+	for _, item := range req.Items {
+		for _, p := range item.Props {
+			props = append(props, property{XMLName: propName(p.XMLName)})
+		}
+	}
+	return props, nil
+}
+
+// propName returns the name to use for a property in the response
+func propName(name xml.Name) xml.Name {
+	if name.Space == "DAV:" {
+		return xml.Name{Local: "D:" + name.Local}
+	}
+	return name
+}
+
+func propfind(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	fs := i.VFS()
+	name := davPath(c)
+
+	depth := c.Request().Header.Get("Depth")
+	if depth == "" || depth == "infinity" {
+		return c.Blob(http.StatusForbidden, "application/xml; charset=utf-8", []byte(xml.Header+
+			`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+	}
+	if depth != "0" && depth != "1" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid Depth header")
+	}
+
+	names, propname, err := parsePropfind(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	dir, file, err := fs.DirOrFileByPath(name)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = allow(c, permissions.GET, validable(dir, file)); err != nil {
+		return err
+	}
+
+	lockdiscovery := locks.discovery(i.Domain, name)
+	responses := []*response{newResponse(name, dir, file, names, propname, lockdiscovery)}
+
+	if dir != nil && depth == "1" {
+		iter := fs.DirIterator(dir, nil)
+		for {
+			d, f, err := iter.Next()
+			if err == vfs.ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				return wrapVfsError(err)
+			}
+			// The children that are not readable with the permissions of the
+			// request are hidden
+			if allow(c, permissions.GET, validable(d, f)) != nil {
+				continue
+			}
+			var childPath string
+			if d != nil {
+				childPath = d.Fullpath
+			} else {
+				childPath = path.Join(name, f.DocName)
+			}
+			ld := locks.discovery(i.Domain, childPath)
+			responses = append(responses, newResponse(childPath, d, f, names, propname, ld))
+		}
+	}
+
+	return writeMultistatus(c, responses)
+}
+
+func newResponse(fullpath string, dir *vfs.DirDoc, file *vfs.FileDoc, names []xml.Name, propname bool, lockdiscovery string) *response {
+	res := response{Href: href(fullpath, dir != nil)}
+	var found, notFound []property
+
+	if names == nil {
+		for _, name := range davProps {
+			value, ok := davPropertyValue(name, dir, file, lockdiscovery)
+			if !ok {
+				continue
+			}
+			if propname {
+				value = ""
+			}
+			found = append(found, davProperty(name, value))
+		}
+	} else {
+		for _, name := range names {
+			if name.Space == "DAV:" {
+				value, ok := davPropertyValue(name.Local, dir, file, lockdiscovery)
+				if ok {
+					found = append(found, davProperty(name.Local, value))
+					continue
+				}
+			}
+			notFound = append(notFound, property{XMLName: propName(name)})
+		}
+	}
+
+	if len(found) > 0 {
+		res.Propstats = append(res.Propstats, propstat{
+			Props:  found,
+			Status: statusLine(http.StatusOK),
+		})
+	}
+	if len(notFound) > 0 {
+		res.Propstats = append(res.Propstats, propstat{
+			Props:  notFound,
+			Status: statusLine(http.StatusNotFound),
+		})
+	}
+	return &res
+}
+
+// davPropertyValue returns the XML value of a live property for a file or a
+// directory, and false if the property is not defined for it.
+func davPropertyValue(name string, dir *vfs.DirDoc, file *vfs.FileDoc, lockdiscovery string) (string, bool) {
+	var docName string
+	var createdAt, updatedAt time.Time
+	if dir != nil {
+		docName, createdAt, updatedAt = dir.DocName, dir.CreatedAt, dir.UpdatedAt
+	} else {
+		docName, createdAt, updatedAt = file.DocName, file.CreatedAt, file.UpdatedAt
+	}
+
+	switch name {
+	case "displayname":
+		return escapeXML(docName), true
+	case "resourcetype":
+		if dir != nil {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "creationdate":
+		return createdAt.UTC().Format(time.RFC3339), true
+	case "getlastmodified":
+		return updatedAt.UTC().Format(http.TimeFormat), true
+	case "getcontentlength":
+		if file == nil {
+			return "", false
+		}
+		return strconv.FormatInt(file.ByteSize, 10), true
+	case "getcontenttype":
+		if file == nil {
+			return "", false
+		}
+		return escapeXML(file.Mime), true
+	case "getetag":
+		if dir != nil {
+			return escapeXML(`"` + dir.Rev() + `"`), true
+		}
+		return escapeXML(`"` + base64.StdEncoding.EncodeToString(file.MD5Sum) + `"`), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+			"<D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "lockdiscovery":
+		return lockdiscovery, true
+	}
+	return "", false
+}
@@ -0,0 +1,576 @@
+// Package webdav exposes the VFS of an instance with the WebDAV protocol, so
+// that it can be mounted as a network drive by the file managers. See
+// docs/webdav.md for more informations.
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// Prefix is the path where the VFS is served with WebDAV
+const Prefix = "/dav/files"
+
+// methodHeader is the header used to keep the WebDAV method of a request
+// while it is routed by echo, which only knows the standard HTTP methods.
+const methodHeader = "X-Cozy-Webdav-Method"
+
+// extensionMethods are the methods added by WebDAV to HTTP
+var extensionMethods = []string{
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+const allowedMethods = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+
+// Methods is a middleware that must be used with echo.Pre to route the
+// WebDAV requests. The echo router does not know the WebDAV methods, like
+// MKCOL or MOVE, so these requests are routed as POST and the original method
+// is kept in a header.
+func Methods(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if isExtensionMethod(req.Method) &&
+			(req.URL.Path == Prefix || strings.HasPrefix(req.URL.Path, Prefix+"/")) {
+			req.Header.Set(methodHeader, req.Method)
+			req.Method = http.MethodPost
+		}
+		return next(c)
+	}
+}
+
+func isExtensionMethod(method string) bool {
+	for _, m := range extensionMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler is the entry point for the WebDAV requests. It dispatches them on
+// their method.
+func Handler(c echo.Context) error {
+	method := c.Request().Method
+	if m := c.Request().Header.Get(methodHeader); m != "" && method == http.MethodPost {
+		method = m
+	}
+
+	if method == http.MethodOptions {
+		return options(c)
+	}
+
+	// The permissions are checked here to ask the credentials to the WebDAV
+	// client with the WWW-Authenticate header before anything else.
+	if _, err := permissions.GetPermission(c); err != nil {
+		c.Response().Header().Set("WWW-Authenticate", `Basic realm="Cozy"`)
+		return err
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return get(c)
+	case http.MethodPut:
+		return put(c)
+	case http.MethodDelete:
+		return remove(c)
+	case "PROPFIND":
+		return propfind(c)
+	case "PROPPATCH":
+		return proppatch(c)
+	case "MKCOL":
+		return mkcol(c)
+	case "COPY":
+		return copyOrMove(c, false)
+	case "MOVE":
+		return copyOrMove(c, true)
+	case "LOCK":
+		return lock(c)
+	case "UNLOCK":
+		return unlock(c)
+	}
+	c.Response().Header().Set("Allow", allowedMethods)
+	return echo.NewHTTPError(http.StatusMethodNotAllowed)
+}
+
+func options(c echo.Context) error {
+	h := c.Response().Header()
+	h.Set("DAV", "1, 2")
+	h.Set("Allow", allowedMethods)
+	h.Set("MS-Author-Via", "DAV")
+	return c.NoContent(http.StatusOK)
+}
+
+// davPath returns the path in the VFS of the resource targeted by the
+// request.
+func davPath(c echo.Context) string {
+	return pathFromURL(c.Request().URL.Path)
+}
+
+func pathFromURL(urlPath string) string {
+	return path.Clean("/" + strings.TrimPrefix(urlPath, Prefix))
+}
+
+// href returns the escaped URL path of a resource from its path in the VFS.
+func href(name string, isDir bool) string {
+	p := path.Join(Prefix, name)
+	if isDir {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+func inTrash(name string) bool {
+	return name == vfs.TrashDirName || strings.HasPrefix(name, vfs.TrashDirName+"/")
+}
+
+// allow checks that the permissions of the request allow the verb on the
+// file or directory, with vfs.Allows.
+func allow(c echo.Context, v pkgperm.Verb, fd vfs.Validable) error {
+	pdoc, err := permissions.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	i := middlewares.GetInstance(c)
+	if err = vfs.Allows(i.VFS(), pdoc.Permissions, v, fd); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return nil
+}
+
+// wrapVfsError translates the errors of the VFS to the HTTP status codes
+// expected by the WebDAV clients.
+func wrapVfsError(err error) error {
+	if os.IsNotExist(err) {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	if os.IsExist(err) {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Resource already exists")
+	}
+	switch err {
+	case vfs.ErrFileTooBig:
+		return echo.NewHTTPError(http.StatusInsufficientStorage, err.Error())
+	case vfs.ErrParentDoesNotExist:
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case vfs.ErrIllegalFilename, vfs.ErrContentLengthMismatch, vfs.ErrInvalidHash:
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	case vfs.ErrConflict:
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case vfs.ErrForbiddenDocMove, vfs.ErrParentInTrash, vfs.ErrFileInTrash, os.ErrInvalid:
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	return err
+}
+
+func get(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	dir, file, err := i.VFS().DirOrFileByPath(davPath(c))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if dir != nil {
+		c.Response().Header().Set("Allow", allowedMethods)
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Use PROPFIND to list a collection")
+	}
+	if err = allow(c, permissions.GET, file); err != nil {
+		return err
+	}
+	err = vfs.ServeFileContent(i.VFS(), file, "", c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	return nil
+}
+
+func put(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	fs := i.VFS()
+	name := davPath(c)
+	if name == "/" || inTrash(name) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	dir, olddoc, err := fs.DirOrFileByPath(name)
+	if err != nil && !os.IsNotExist(err) {
+		return wrapVfsError(err)
+	}
+	if dir != nil {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "A collection already exists")
+	}
+	parent, err := fs.DirByPath(path.Dir(name))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, "The parent collection does not exist")
+	}
+
+	if err = checkLocks(c, name); err != nil {
+		return err
+	}
+
+	newdoc, err := newFileDoc(c.Request(), path.Base(name), parent)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if olddoc != nil {
+		newdoc.Tags = olddoc.Tags
+		newdoc.Executable = olddoc.Executable
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+		err = allow(c, permissions.PUT, olddoc)
+	} else {
+		err = allow(c, permissions.POST, newdoc)
+	}
+	if err != nil {
+		return err
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	_, err = io.Copy(file, c.Request().Body)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if olddoc != nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+// newFileDoc returns the document for a file uploaded with the request. The
+// WebDAV clients often send a generic content-type, so the mime type is
+// deduced from the filename in this case.
+func newFileDoc(req *http.Request, name string, parent *vfs.DirDoc) (*vfs.FileDoc, error) {
+	var mime, class string
+	contentType := req.Header.Get(echo.HeaderContentType)
+	if contentType == "" || strings.HasPrefix(contentType, vfs.DefaultContentType) {
+		mime, class = vfs.ExtractMimeAndClassFromFilename(name)
+	} else {
+		mime, class = vfs.ExtractMimeAndClass(contentType)
+	}
+	size := req.ContentLength
+	if size < 0 {
+		size = -1
+	}
+	return vfs.NewFileDoc(name, parent.ID(), size, nil, mime, class,
+		time.Now(), false, false, nil)
+}
+
+func mkcol(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	fs := i.VFS()
+	name := davPath(c)
+	if name == "/" || inTrash(name) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if c.Request().ContentLength > 0 {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType)
+	}
+
+	exists, err := resourceExists(fs, name)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if exists {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Resource already exists")
+	}
+	parent, err := fs.DirByPath(path.Dir(name))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, "The parent collection does not exist")
+	}
+
+	if err = checkLocks(c, name); err != nil {
+		return err
+	}
+
+	dir, err := vfs.NewDirDocWithParent(path.Base(name), parent, nil)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = allow(c, permissions.POST, dir); err != nil {
+		return err
+	}
+	if err = fs.CreateDir(dir); err != nil {
+		return wrapVfsError(err)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+// remove puts the file or directory in the trash, like the DELETE on
+// /files/:file-id. If it is already in the trash, it is destroyed.
+func remove(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	fs := i.VFS()
+	name := davPath(c)
+	if name == "/" || name == vfs.TrashDirName {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	dir, file, err := fs.DirOrFileByPath(name)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkLocks(c, name); err != nil {
+		return err
+	}
+
+	if inTrash(name) {
+		if err = allow(c, permissions.DELETE, validable(dir, file)); err != nil {
+			return err
+		}
+		if dir != nil {
+			err = fs.DestroyDirAndContent(dir)
+		} else {
+			err = fs.DestroyFile(file)
+		}
+	} else {
+		err = trash(c, fs, dir, file)
+	}
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	locks.removeAll(i.Domain, name)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// trash moves a file or directory to the trash, after checking the
+// permissions.
+func trash(c echo.Context, fs vfs.VFS, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	if err := allow(c, permissions.PUT, validable(dir, file)); err != nil {
+		return err
+	}
+	var err error
+	if dir != nil {
+		_, err = vfs.TrashDir(fs, dir)
+	} else {
+		_, err = vfs.TrashFile(fs, file)
+	}
+	return err
+}
+
+func validable(dir *vfs.DirDoc, file *vfs.FileDoc) vfs.Validable {
+	if dir != nil {
+		return dir
+	}
+	return file
+}
+
+func resourceExists(fs vfs.VFS, name string) (bool, error) {
+	_, _, err := fs.DirOrFileByPath(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// destination returns the path in the VFS of the Destination header of a
+// COPY or MOVE request.
+func destination(c echo.Context) (string, error) {
+	req := c.Request()
+	header := req.Header.Get("Destination")
+	if header == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Missing Destination header")
+	}
+	u, err := url.Parse(header)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid Destination header")
+	}
+	if u.Host != "" && u.Host != req.Host {
+		return "", echo.NewHTTPError(http.StatusBadGateway, "Destination is on another server")
+	}
+	if u.Path != Prefix && !strings.HasPrefix(u.Path, Prefix+"/") {
+		return "", echo.NewHTTPError(http.StatusBadGateway, "Destination is not in "+Prefix)
+	}
+	return pathFromURL(u.Path), nil
+}
+
+func copyOrMove(c echo.Context, move bool) error {
+	i := middlewares.GetInstance(c)
+	fs := i.VFS()
+	src := davPath(c)
+	if src == "/" || (move && src == vfs.TrashDirName) {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	dst, err := destination(c)
+	if err != nil {
+		return err
+	}
+	if dst == "/" || inTrash(dst) || dst == src || strings.HasPrefix(dst, src+"/") {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	overwrite := c.Request().Header.Get("Overwrite") != "F"
+
+	dir, file, err := fs.DirOrFileByPath(src)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	parent, err := fs.DirByPath(path.Dir(dst))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, "The parent collection does not exist")
+	}
+
+	if move {
+		err = checkLocks(c, src, dst)
+	} else {
+		err = checkLocks(c, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	if move {
+		err = allow(c, permissions.PATCH, validable(dir, file))
+	} else {
+		err = allow(c, permissions.GET, validable(dir, file))
+	}
+	if err != nil {
+		return err
+	}
+	if err = allow(c, permissions.POST, parent); err != nil {
+		return err
+	}
+
+	// The existing resource at the destination is moved to the trash
+	status := http.StatusCreated
+	dstDir, dstFile, err := fs.DirOrFileByPath(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return wrapVfsError(err)
+	}
+	if dstDir != nil || dstFile != nil {
+		if !overwrite {
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "Destination already exists")
+		}
+		if err = trash(c, fs, dstDir, dstFile); err != nil {
+			return wrapVfsError(err)
+		}
+		status = http.StatusNoContent
+	}
+
+	name := path.Base(dst)
+	switch {
+	case move && dir != nil:
+		_, err = vfs.ModifyDirMetadata(fs, dir, &vfs.DocPatch{Name: &name, DirID: &parent.DocID})
+	case move:
+		_, err = vfs.ModifyFileMetadata(fs, file, &vfs.DocPatch{Name: &name, DirID: &parent.DocID})
+	case dir != nil:
+		err = copyDir(fs, dir, parent, name, c.Request().Header.Get("Depth") != "0")
+	default:
+		err = copyFile(fs, file, parent, name)
+	}
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if move {
+		locks.removeAll(i.Domain, src)
+	}
+	return c.NoContent(status)
+}
+
+func copyFile(fs vfs.VFS, src *vfs.FileDoc, parent *vfs.DirDoc, name string) error {
+	newdoc, err := vfs.NewFileDoc(name, parent.ID(), src.ByteSize, src.MD5Sum,
+		src.Mime, src.Class, time.Now(), src.Executable, false, src.Tags)
+	if err != nil {
+		return err
+	}
+	content, err := fs.OpenFile(src)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	file, err := fs.CreateFile(newdoc, nil)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func copyDir(fs vfs.VFS, src *vfs.DirDoc, parent *vfs.DirDoc, name string, recursive bool) error {
+	newdir, err := vfs.NewDirDocWithParent(name, parent, src.Tags)
+	if err != nil {
+		return err
+	}
+	if err = fs.CreateDir(newdir); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	iter := fs.DirIterator(src, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			err = copyDir(fs, d, newdir, d.DocName, true)
+		} else {
+			err = copyFile(fs, f, newdir, f.DocName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// proppatch is not supported as the documents of the VFS have no dead
+// properties: all the properties are forbidden to modify.
+func proppatch(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	name := davPath(c)
+	dir, file, err := i.VFS().DirOrFileByPath(name)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	if err = allow(c, permissions.PATCH, validable(dir, file)); err != nil {
+		return err
+	}
+	props, err := parseProppatch(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	res := &response{
+		Href: href(name, dir != nil),
+		Propstats: []propstat{{
+			Props:  props,
+			Status: statusLine(http.StatusForbidden),
+		}},
+	}
+	return writeMultistatus(c, []*response{res})
+}
+
+// Routes sets the routing for the WebDAV service. The Methods middleware
+// must be used with echo.Pre for the WebDAV methods.
+func Routes(router *echo.Group) {
+	for _, p := range []string{"", "/*"} {
+		router.OPTIONS(p, Handler)
+		router.GET(p, Handler)
+		router.HEAD(p, Handler)
+		router.PUT(p, Handler)
+		router.DELETE(p, Handler)
+		router.POST(p, Handler)
+	}
+}
@@ -0,0 +1,286 @@
+package webdav
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+
+func davRequest(method, name string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, ts.URL+Prefix+name, body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("", token)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func readBody(res *http.Response) string {
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestNoToken(t *testing.T) {
+	req, err := http.NewRequest("PROPFIND", ts.URL+Prefix+"/", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Depth", "0")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	assert.Equal(t, `Basic realm="Cozy"`, res.Header.Get("WWW-Authenticate"))
+}
+
+func TestOptions(t *testing.T) {
+	req, err := http.NewRequest("OPTIONS", ts.URL+Prefix+"/", nil)
+	assert.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "1, 2", res.Header.Get("DAV"))
+	assert.Contains(t, res.Header.Get("Allow"), "PROPFIND")
+}
+
+func TestMkcolPutGet(t *testing.T) {
+	res, err := davRequest("MKCOL", "/mkcol", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	res, err = davRequest("MKCOL", "/mkcol", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	res, err = davRequest("MKCOL", "/no/parent", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+
+	res, err = davRequest("PUT", "/mkcol/hello.txt", strings.NewReader("hello"), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	file, err := testInstance.VFS().FileByPath("/mkcol/hello.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "text/plain", file.Mime)
+		assert.Equal(t, int64(5), file.ByteSize)
+	}
+
+	res, err = davRequest("PUT", "/mkcol/hello.txt", strings.NewReader("hello world"), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = davRequest("GET", "/mkcol/hello.txt", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "hello world", readBody(res))
+
+	res, err = davRequest("GET", "/mkcol/unknown.txt", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestPropfind(t *testing.T) {
+	_, err := vfs.Mkdir(testInstance.VFS(), "/propfind", nil)
+	assert.NoError(t, err)
+	res, err := davRequest("PUT", "/propfind/foo bar.txt", strings.NewReader("foo"), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	res, err = davRequest("PROPFIND", "/propfind", nil, map[string]string{"Depth": "infinity"})
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, err = davRequest("PROPFIND", "/propfind", nil, map[string]string{"Depth": "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+	body := readBody(res)
+	assert.Contains(t, body, "<D:href>/dav/files/propfind/</D:href>")
+	assert.Contains(t, body, "<D:href>/dav/files/propfind/foo%20bar.txt</D:href>")
+	assert.Contains(t, body, "<D:collection/>")
+	assert.Contains(t, body, "<D:getcontentlength>3</D:getcontentlength>")
+
+	propfind := `<?xml version="1.0" encoding="utf-8" ?>
+<D:propfind xmlns:D="DAV:"><D:prop xmlns:R="http://ns.example.com/">
+<D:getcontenttype/><R:bigbox/>
+</D:prop></D:propfind>`
+	res, err = davRequest("PROPFIND", "/propfind/foo bar.txt", strings.NewReader(propfind),
+		map[string]string{"Depth": "0"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, res.StatusCode)
+	body = readBody(res)
+	assert.Contains(t, body, "<D:getcontenttype>text/plain</D:getcontenttype>")
+	assert.Contains(t, body, `<bigbox xmlns="http://ns.example.com/"></bigbox>`)
+	assert.Contains(t, body, "HTTP/1.1 404 Not Found")
+}
+
+func TestMoveCopy(t *testing.T) {
+	_, err := vfs.Mkdir(testInstance.VFS(), "/move", nil)
+	assert.NoError(t, err)
+	res, err := davRequest("PUT", "/move/a.txt", strings.NewReader("aaa"), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	dest := map[string]string{"Destination": ts.URL + Prefix + "/move/b.txt"}
+	res, err = davRequest("MOVE", "/move/a.txt", nil, dest)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	_, err = testInstance.VFS().FileByPath("/move/a.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	dest = map[string]string{"Destination": Prefix + "/move/c.txt"}
+	res, err = davRequest("COPY", "/move/b.txt", nil, dest)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	dest["Overwrite"] = "F"
+	res, err = davRequest("COPY", "/move/b.txt", nil, dest)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusPreconditionFailed, res.StatusCode)
+
+	res, err = davRequest("GET", "/move/c.txt", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "aaa", readBody(res))
+
+	dest = map[string]string{"Destination": Prefix + "/move-copy"}
+	res, err = davRequest("COPY", "/move", nil, dest)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	_, err = testInstance.VFS().FileByPath("/move-copy/b.txt")
+	assert.NoError(t, err)
+	_, err = testInstance.VFS().FileByPath("/move-copy/c.txt")
+	assert.NoError(t, err)
+}
+
+func TestDelete(t *testing.T) {
+	res, err := davRequest("PUT", "/to-delete.txt", strings.NewReader("bye"), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	res, err = davRequest("DELETE", "/to-delete.txt", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	_, err = testInstance.VFS().FileByPath("/to-delete.txt")
+	assert.True(t, os.IsNotExist(err))
+	file, err := testInstance.VFS().FileByPath(vfs.TrashDirName + "/to-delete.txt")
+	if assert.NoError(t, err) {
+		assert.Equal(t, consts.TrashDirID, file.DirID)
+	}
+
+	res, err = davRequest("DELETE", vfs.TrashDirName+"/to-delete.txt", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	_, err = testInstance.VFS().FileByPath(vfs.TrashDirName + "/to-delete.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	res, err = davRequest("DELETE", vfs.TrashDirName, nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestLockUnlock(t *testing.T) {
+	lockinfo := `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+<D:lockscope><D:exclusive/></D:lockscope>
+<D:locktype><D:write/></D:locktype>
+<D:owner><D:href>http://example.org/~bob/</D:href></D:owner>
+</D:lockinfo>`
+	res, err := davRequest("LOCK", "/locked.txt", strings.NewReader(lockinfo),
+		map[string]string{"Timeout": "Second-600"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	lockToken := res.Header.Get("Lock-Token")
+	assert.True(t, strings.HasPrefix(lockToken, "<opaquelocktoken:"))
+	assert.Contains(t, readBody(res), "http://example.org/~bob/")
+
+	res, err = davRequest("LOCK", "/locked.txt", strings.NewReader(lockinfo), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusLocked, res.StatusCode)
+
+	res, err = davRequest("PUT", "/locked.txt", strings.NewReader("foo"), nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusLocked, res.StatusCode)
+
+	res, err = davRequest("PUT", "/locked.txt", strings.NewReader("foo"),
+		map[string]string{"If": fmt.Sprintf("(%s)", lockToken)})
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = davRequest("UNLOCK", "/locked.txt", nil,
+		map[string]string{"Lock-Token": lockToken})
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = davRequest("DELETE", "/locked.txt", nil, nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+	setup := testutils.NewSetup(m, "webdav_test")
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if err != nil {
+		fmt.Println("Could not create temporary directory.")
+		os.Exit(1)
+	}
+	setup.AddCleanup(func() error { return os.RemoveAll(tempdir) })
+
+	config.GetConfig().Fs.URL = &url.URL{
+		Scheme: "file",
+		Host:   "localhost",
+		Path:   tempdir,
+	}
+
+	testInstance = setup.GetTestInstance()
+	_, token = setup.GetTestClient(consts.Files)
+	ts = setup.GetTestServer(Prefix, Routes, func(r *echo.Echo) *echo.Echo {
+		r.Pre(Methods)
+		return r
+	})
+
+	os.Exit(setup.Run())
+}